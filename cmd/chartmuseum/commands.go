@@ -0,0 +1,388 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	"helm.sh/chartmuseum/pkg/config"
+	"helm.sh/chartmuseum/pkg/maintenance"
+
+	"github.com/chartmuseum/storage"
+	"github.com/urfave/cli"
+)
+
+var (
+	// echo prints the output of admin commands
+	echo = fmt.Println
+
+	repoFlag = cli.StringSliceFlag{
+		Name:  "repo",
+		Usage: "repo (storage prefix) to process, e.g. org1/repoa (repeatable, default: the storage root)",
+	}
+)
+
+// commands are the admin subcommands, they accept the same configuration flags as the server
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "backfill-sidecars",
+			Usage: "write the metadata sidecar of every chart package already in storage",
+			Flags: withConfigFlags(
+				repoFlag,
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "rewrite sidecars which already exist",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 10,
+					Usage: "number of packages processed in parallel",
+				},
+			),
+			Action: backfillSidecarsHandler,
+		},
+		{
+			Name:  "migrate",
+			Usage: "copy the chart packages, provenance files and statefiles of all repos to another storage backend",
+			Flags: withConfigFlags(
+				repoFlag,
+				cli.StringFlag{
+					Name:  "to-config",
+					Usage: "config file of the destination storage backend, with the same keys as the server config file",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 10,
+					Usage: "number of objects copied in parallel",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report the objects which would be copied",
+				},
+			),
+			Action: migrateHandler,
+		},
+		{
+			Name:  "backup",
+			Usage: "export the chart packages and provenance files of all repos to a tar archive",
+			Flags: withConfigFlags(
+				repoFlag,
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "path of the backup archive to write",
+				},
+			),
+			Action: backupHandler,
+		},
+		{
+			Name:  "restore",
+			Usage: "import the chart packages and provenance files of a backup archive",
+			Flags: withConfigFlags(
+				cli.StringSliceFlag{
+					Name:  "repo",
+					Usage: "repo of the archive to restore (repeatable, default: every repo)",
+				},
+				cli.StringFlag{
+					Name:  "input",
+					Usage: "path of the backup archive to read",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "replace existing files with another content, unless --disable-force-overwrite is set",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only validate the archive and report the files which would be restored",
+				},
+			),
+			Action: restoreHandler,
+		},
+		{
+			Name:  "fsck",
+			Usage: "check the chart packages, provenance files and statefile of repos for inconsistencies",
+			Flags: withConfigFlags(
+				repoFlag,
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "fix the problems which can be fixed without losing data",
+				},
+			),
+			Action: fsckHandler,
+		},
+		{
+			Name:  "reencrypt",
+			Usage: "encrypt the objects of repos again with the primary storage encryption key",
+			Flags: withConfigFlags(
+				repoFlag,
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 10,
+					Usage: "number of objects processed in parallel",
+				},
+			),
+			Action: reencryptHandler,
+		},
+	}
+}
+
+func backfillSidecarsHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	backend, mirrored := commandStorageFromConfig(conf)
+	if mirrored != nil {
+		defer mirrored.Flush()
+	}
+
+	for _, repo := range reposFromCLIContext(c) {
+		report, err := maintenance.BackfillSidecars(backend, maintenance.BackfillSidecarsOptions{
+			Repo:        repo,
+			Overwrite:   c.Bool("overwrite"),
+			Concurrency: c.Int("concurrency"),
+		})
+		if err != nil {
+			crash(err)
+		}
+		for path, err := range report.Failed {
+			echo(fmt.Sprintf("failed: %s: %s", path, err))
+		}
+		echo(fmt.Sprintf("repo %q: %d packages, %d sidecars written, %d skipped, %d failed",
+			report.Repo, report.Scanned, report.Written, report.Skipped, len(report.Failed)))
+	}
+}
+
+func migrateHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	toConfigPath := c.String("to-config")
+	if toConfigPath == "" {
+		crash("Missing required flags(s): --to-config")
+	}
+	toConf, err := config.NewConfigFromFile(toConfigPath)
+	if err != nil {
+		crash("Unable to read destination config: ", err)
+	}
+	source, sourceMirrored := commandStorageFromConfig(conf)
+	if sourceMirrored != nil {
+		defer sourceMirrored.Flush()
+	}
+	destination, destinationMirrored := commandStorageFromConfig(toConf)
+	if destinationMirrored != nil {
+		defer destinationMirrored.Flush()
+	}
+
+	// every repo, unless some are given
+	repos := c.StringSlice("repo")
+	dryRun := c.Bool("dry-run")
+	report, err := maintenance.Migrate(source, destination, maintenance.MigrateOptions{
+		Repos:       repos,
+		Recursive:   len(repos) == 0,
+		Concurrency: c.Int("concurrency"),
+		DryRun:      dryRun,
+	})
+	if err != nil {
+		crash(err)
+	}
+	for path, err := range report.Failed {
+		echo(fmt.Sprintf("failed: %s: %s", path, err))
+	}
+	if dryRun {
+		for _, path := range report.Copied {
+			echo(fmt.Sprintf("would copy: %s", path))
+		}
+		echo(fmt.Sprintf("dry run: %d repos, %d objects, %d to copy, %d already migrated, %d failed",
+			len(report.Repos), report.Scanned, len(report.Copied), report.Skipped, len(report.Failed)))
+		return
+	}
+	echo(fmt.Sprintf("%d repos, %d objects, %d copied, %d already migrated, %d failed",
+		len(report.Repos), report.Scanned, len(report.Copied), report.Skipped, len(report.Failed)))
+}
+
+func backupHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	output := c.String("output")
+	if output == "" {
+		crash("Missing required flags(s): --output")
+	}
+	backend, mirrored := commandStorageFromConfig(conf)
+	if mirrored != nil {
+		defer mirrored.Flush()
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		crash(err)
+	}
+	defer file.Close()
+	// every repo, unless some are given
+	repos := c.StringSlice("repo")
+	manifest, err := maintenance.Backup(backend, file, maintenance.BackupOptions{
+		Repos:     repos,
+		Recursive: len(repos) == 0,
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		os.Remove(output)
+		crash(err)
+	}
+	echo(fmt.Sprintf("%d repos, %d files backed up to %s", len(manifest.Repos), len(manifest.Objects), output))
+}
+
+func restoreHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	input := c.String("input")
+	if input == "" {
+		crash("Missing required flags(s): --input")
+	}
+	backend, mirrored := commandStorageFromConfig(conf)
+	if mirrored != nil {
+		defer mirrored.Flush()
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		crash(err)
+	}
+	defer file.Close()
+	// the same conflict policy as uploads
+	overwrite := conf.GetBool("allowoverwrite") || (!conf.GetBool("disableforceoverwrite") && c.Bool("force"))
+	dryRun := c.Bool("dry-run")
+	report, err := maintenance.Restore(backend, file, maintenance.RestoreOptions{
+		Repos:     c.StringSlice("repo"),
+		Overwrite: overwrite,
+		DryRun:    dryRun,
+	})
+	if err != nil {
+		crash(err)
+	}
+	for _, path := range report.Conflicts {
+		echo(fmt.Sprintf("conflict: %s already exists", path))
+	}
+	for path, err := range report.Failed {
+		echo(fmt.Sprintf("failed: %s: %s", path, err))
+	}
+	if dryRun {
+		for _, path := range report.Restored {
+			echo(fmt.Sprintf("would restore: %s", path))
+		}
+		echo(fmt.Sprintf("dry run: backup of %s valid, %d to restore, %d identical, %d conflicts, %d failed",
+			report.Manifest.Created.Format(time.RFC3339), len(report.Restored), report.Skipped, len(report.Conflicts), len(report.Failed)))
+		return
+	}
+	echo(fmt.Sprintf("backup of %s: %d restored, %d identical, %d conflicts, %d failed",
+		report.Manifest.Created.Format(time.RFC3339), len(report.Restored), report.Skipped, len(report.Conflicts), len(report.Failed)))
+}
+
+func fsckHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	backend, mirrored := commandStorageFromConfig(conf)
+	if mirrored != nil {
+		defer mirrored.Flush()
+	}
+
+	for _, repo := range reposFromCLIContext(c) {
+		report, err := maintenance.Fsck(backend, maintenance.FsckOptions{
+			Repo:   repo,
+			Repair: c.Bool("repair"),
+			MinAge: conf.GetDuration("gc.minage"),
+		})
+		if err != nil {
+			crash(err)
+		}
+		repaired := 0
+		for _, problem := range report.Problems {
+			line := fmt.Sprintf("%s: %s", problem.Kind, problem.Path)
+			if problem.Detail != "" {
+				line += ": " + problem.Detail
+			}
+			switch {
+			case problem.Repaired:
+				repaired++
+				line += " (repaired)"
+			case problem.Error != "":
+				line += fmt.Sprintf(" (repair failed: %s)", problem.Error)
+			}
+			echo(line)
+		}
+		echo(fmt.Sprintf("repo %q: %d files, %d problems, %d repaired",
+			report.Repo, report.Scanned, len(report.Problems), repaired))
+	}
+}
+
+func reencryptHandler(c *cli.Context) {
+	conf := configFromCLIContext(c)
+	backend, mirrored := commandStorageFromConfig(conf)
+	if mirrored != nil {
+		defer mirrored.Flush()
+	}
+	encrypted, ok := backend.(*cm_backend.EncryptedBackend)
+	if !ok {
+		crash("Missing required flags(s): --storage-encryption-keyfile")
+	}
+
+	// every repo, unless some are given
+	repos := c.StringSlice("repo")
+	report, err := maintenance.Reencrypt(encrypted, maintenance.ReencryptOptions{
+		Repos:       repos,
+		Recursive:   len(repos) == 0,
+		Concurrency: c.Int("concurrency"),
+	})
+	if err != nil {
+		crash(err)
+	}
+	for path, err := range report.Failed {
+		echo(fmt.Sprintf("failed: %s: %s", path, err))
+	}
+	echo(fmt.Sprintf("%d repos, %d objects, %d reencrypted, %d skipped, %d failed",
+		len(report.Repos), report.Scanned, report.Reencrypted, report.Skipped, len(report.Failed)))
+}
+
+// commandStorageFromConfig returns the storage backend of an admin command, printing the
+// writes which could not be mirrored
+func commandStorageFromConfig(conf *config.Config) (storage.Backend, *cm_backend.MirroredBackend) {
+	backend, mirrored := storageFromConfig(conf)
+	if mirrored != nil {
+		mirrored.OnError = func(operation string, path string, err error) {
+			echo(fmt.Sprintf("failed to mirror: %s %s: %s", operation, path, err))
+		}
+	}
+	return backend, mirrored
+}
+
+func withConfigFlags(flags ...cli.Flag) []cli.Flag {
+	return append(append([]cli.Flag{}, config.CLIFlags...), flags...)
+}
+
+func configFromCLIContext(c *cli.Context) *config.Config {
+	conf := config.NewConfig()
+	err := conf.UpdateFromCLIContext(c)
+	if err != nil {
+		crash(err)
+	}
+	return conf
+}
+
+func reposFromCLIContext(c *cli.Context) []string {
+	repos := c.StringSlice("repo")
+	if len(repos) == 0 {
+		return []string{""}
+	}
+	return repos
+}
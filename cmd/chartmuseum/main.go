@@ -24,10 +24,14 @@ import (
 
 	"github.com/chartmuseum/storage"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	"helm.sh/chartmuseum/pkg/cache"
 	"helm.sh/chartmuseum/pkg/chartmuseum"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	"helm.sh/chartmuseum/pkg/config"
+	"helm.sh/chartmuseum/pkg/metadb"
+	"helm.sh/chartmuseum/pkg/protection"
+	"helm.sh/chartmuseum/pkg/retention"
 
 	"github.com/urfave/cli"
 )
@@ -51,6 +55,7 @@ func main() {
 	app.Usage = "Helm Chart Repository with support for Amazon S3, Google Cloud Storage, Oracle Cloud Infrastructure Object Storage and Openstack"
 	app.Action = cliHandler
 	app.Flags = config.CLIFlags
+	app.Commands = commands()
 	app.Run(os.Args)
 }
 
@@ -71,8 +76,12 @@ func cliHandler(c *cli.Context) {
 
 	conf.ShowDeprecationWarnings(c, logger)
 
-	backend := backendFromConfig(conf)
-	store := storeFromConfig(conf)
+	backend, mirrored := storageFromConfig(conf)
+	redisStore := redisStoreFromConfig(conf)
+	store := storeFromConfig(conf, redisStore)
+	metadataStore := metadataStoreFromConfig(conf)
+	bus := busFromConfig(conf, redisStore)
+	locker := lockerFromConfig(conf, redisStore)
 
 	options := chartmuseum.ServerOptions{
 		Version:                Version,
@@ -114,12 +123,47 @@ func cliHandler(c *cli.Context) {
 		ReadTimeout:            conf.GetInt("readtimeout"),
 		EnforceSemver2:         conf.GetBool("enforce-semver2"),
 		CacheInterval:          conf.GetDuration("cacheinterval"),
+		CacheMaxTenants:        conf.GetInt("cache-max-tenants"),
+		CacheTenantIdleTimeout: conf.GetDuration("cache-tenant-idle-timeout"),
 		Host:                   conf.GetString("listen.host"),
 		PerChartLimit:          conf.GetInt("per-chart-limit"),
 		WebTemplatePath:        conf.GetString("web-template-path"),
 		ArtifactHubRepoID:      conf.GetStringMapString("artifact-hub-repo-id"),
 		AlwaysRegenerateIndex:  conf.GetBool("always-regenerate-chart-index"),
 		JSONIndex:              conf.GetBool("json-index"),
+		ShardedIndex:           conf.GetBool("sharded-index"),
+		UseSidecars:            conf.GetBool("sidecars"),
+		MetadataStore:          metadataStore,
+		Bus:                    bus,
+		Locker:                 locker,
+		StaleWhileRevalidate:   conf.GetBool("stale-while-revalidate"),
+		URLSigner:              urlSignerFromConfig(conf, backend),
+		SignedURLExpiry:        conf.GetDuration("redirect-downloads-expiry"),
+		ScrubInterval:          conf.GetDuration("scrub.interval"),
+		ScrubRateLimit:         conf.GetInt("scrub.ratelimit"),
+		ScrubQuarantine:        conf.GetBool("scrub.quarantine"),
+		RetentionPolicy:        retentionPolicyFromConfig(conf),
+		RetentionInterval:      conf.GetDuration("retention.interval"),
+		RetentionDryRun:        conf.GetBool("retention.dryrun"),
+		GCInterval:             conf.GetDuration("gc.interval"),
+		GCMinAge:               conf.GetDuration("gc.minage"),
+		GCUnknown:              conf.GetBool("gc.unknown"),
+		GCDryRun:               conf.GetBool("gc.dryrun"),
+		Trash:                  conf.GetBool("trash.enabled"),
+		TrashPurgeAfter:        conf.GetDuration("trash.purgeafter"),
+		ProtectionPolicy:       protectionPolicyFromConfig(conf),
+		AllowUnlock:            conf.GetBool("protection.allowunlock"),
+	}
+	if mirrored != nil {
+		mirrored.OnError = func(operation string, path string, err error) {
+			logger.Warnw("Unable to mirror storage object",
+				"operation", operation,
+				"path", path,
+				"error", err.Error(),
+			)
+		}
+		options.MirrorReconciler = mirrored
+		options.ReconcileInterval = conf.GetDuration("storage.mirror.reconcileinterval")
 	}
 
 	server, err := newServer(options)
@@ -161,9 +205,93 @@ func backendFromConfig(conf *config.Config) storage.Backend {
 		crash("Unsupported storage backend: ", storageFlag)
 	}
 
+	backend = cm_backend.NewResilientBackend(backend, cm_backend.ResilientBackendOptions{
+		Timeout:         conf.GetDuration("storage.timeout"),
+		Retries:         conf.GetInt("storage.retries"),
+		RetryBackoff:    conf.GetDuration("storage.retry.backoff"),
+		MaxRetryBackoff: conf.GetDuration("storage.retry.maxbackoff"),
+		Breaker:         storageBreakerFromConfig(conf),
+	})
+
+	if dir := conf.GetString("storage.cache.dir"); dir != "" {
+		cached, err := cm_backend.NewDiskCacheBackend(backend, dir, int64(conf.GetInt("storage.cache.maxsize")))
+		if err != nil {
+			crash("Unable to create storage cache: ", err)
+		}
+		backend = cached
+	}
+
 	return backend
 }
 
+// storageFromConfig returns the storage backend used by the server and admin commands, along
+// with the mirrored backend if writes are mirrored to a secondary backend
+func storageFromConfig(conf *config.Config) (storage.Backend, *cm_backend.MirroredBackend) {
+	backend := backendFromConfig(conf)
+	mirrored := mirroredBackendFromConfig(conf, backend)
+	if mirrored != nil {
+		backend = mirrored
+	}
+	return encryptedBackendFromConfig(conf, backend), mirrored
+}
+
+// mirroredBackendFromConfig mirrors the writes to backend to the storage backend of the mirror
+// config file, if configured
+func mirroredBackendFromConfig(conf *config.Config, backend storage.Backend) *cm_backend.MirroredBackend {
+	mirrorConfigPath := conf.GetString("storage.mirror.config")
+	if mirrorConfigPath == "" {
+		return nil
+	}
+	mirrorConf, err := config.NewConfigFromFile(mirrorConfigPath)
+	if err != nil {
+		crash("Unable to read storage mirror config: ", err)
+	}
+	return cm_backend.NewMirroredBackend(backend, backendFromConfig(mirrorConf), cm_backend.MirroredBackendOptions{
+		Async:     conf.GetBool("storage.mirror.async"),
+		QueueSize: conf.GetInt("storage.mirror.queuesize"),
+		Failover:  conf.GetBool("storage.mirror.failover"),
+	})
+}
+
+// encryptedBackendFromConfig wraps backend to encrypt storage objects, if a keyfile is configured
+func encryptedBackendFromConfig(conf *config.Config, backend storage.Backend) storage.Backend {
+	keyfile := conf.GetString("storage.encryption.keyfile")
+	if keyfile == "" {
+		return backend
+	}
+	keyring, err := cm_backend.LoadKeyring(keyfile)
+	if err != nil {
+		crash("Unable to load storage encryption keys: ", err)
+	}
+	return cm_backend.NewEncryptedBackend(backend, keyring, conf.GetBool("storage.encryption.allowplaintext"))
+}
+
+// retentionPolicyFromConfig loads the retention rules, if a policy file is configured
+func retentionPolicyFromConfig(conf *config.Config) *retention.Policy {
+	policyfile := conf.GetString("retention.policyfile")
+	if policyfile == "" {
+		return nil
+	}
+	policy, err := retention.LoadPolicy(policyfile)
+	if err != nil {
+		crash("Unable to load retention policy: ", err)
+	}
+	return policy
+}
+
+// protectionPolicyFromConfig loads the protection rules, if a policy file is configured
+func protectionPolicyFromConfig(conf *config.Config) *protection.Policy {
+	policyfile := conf.GetString("protection.policyfile")
+	if policyfile == "" {
+		return nil
+	}
+	policy, err := protection.LoadPolicy(policyfile)
+	if err != nil {
+		crash("Unable to load protection policy: ", err)
+	}
+	return policy
+}
+
 func localBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.local.rootdir"})
 	return storage.NewLocalFilesystemBackend(
@@ -178,7 +306,8 @@ func amazonBackendFromConfig(conf *config.Config) storage.Backend {
 	}
 	crashIfConfigMissingVars(conf, []string{"storage.amazon.bucket", "storage.amazon.region"})
 	forcePathStyle := conf.GetBool("storage.amazon.forcepathstyle")
-	return storage.NewAmazonS3BackendWithOptions(
+	// list ETags along with objects, so changes are detected by content rather than timestamp
+	return cm_backend.NewAmazonS3Backend(storage.NewAmazonS3BackendWithOptions(
 		conf.GetString("storage.amazon.bucket"),
 		conf.GetString("storage.amazon.prefix"),
 		conf.GetString("storage.amazon.region"),
@@ -187,7 +316,7 @@ func amazonBackendFromConfig(conf *config.Config) storage.Backend {
 		&storage.AmazonS3Options{
 			S3ForcePathStyle: &forcePathStyle,
 		},
-	)
+	))
 }
 
 func googleBackendFromConfig(conf *config.Config) storage.Backend {
@@ -282,7 +411,7 @@ func tencentBackendFromConfig(conf *config.Config) storage.Backend {
 	)
 }
 
-func storeFromConfig(conf *config.Config) cache.Store {
+func storeFromConfig(conf *config.Config, redisStore *cache.RedisStore) cache.Store {
 	if conf.GetString("cache.store") == "" {
 		return nil
 	}
@@ -292,7 +421,9 @@ func storeFromConfig(conf *config.Config) cache.Store {
 	cacheFlag := strings.ToLower(conf.GetString("cache.store"))
 	switch cacheFlag {
 	case "redis":
-		store = redisCacheFromConfig(conf)
+		store = cache.Store(redisStore)
+	case "disk":
+		store = diskCacheFromConfig(conf)
 	default:
 		crash("Unsupported cache store: ", cacheFlag)
 	}
@@ -300,13 +431,133 @@ func storeFromConfig(conf *config.Config) cache.Store {
 	return store
 }
 
-func redisCacheFromConfig(conf *config.Config) cache.Store {
+// redisStoreFromConfig returns the Redis connection shared by the cache store, the
+// notification bus and the locker, or nil when none of them uses Redis
+func redisStoreFromConfig(conf *config.Config) *cache.RedisStore {
+	for _, key := range []string{"cache.store", "cache.bus.backend", "cache.lock.backend"} {
+		if strings.ToLower(conf.GetString(key)) == "redis" {
+			return cache.NewRedisStoreWithOptions(redisOptionsFromConfig(conf))
+		}
+	}
+	return nil
+}
+
+func diskCacheFromConfig(conf *config.Config) cache.Store {
+	crashIfConfigMissingVars(conf, []string{"cache.disk.path"})
+	store, err := cache.NewDiskStore(conf.GetString("cache.disk.path"))
+	if err != nil {
+		crash("Unable to open disk cache store: ", err)
+	}
+	return cache.Store(store)
+}
+
+func redisOptionsFromConfig(conf *config.Config) cache.RedisStoreOptions {
 	crashIfConfigMissingVars(conf, []string{"cache.redis.addr"})
-	return cache.Store(cache.NewRedisStore(
-		conf.GetString("cache.redis.addr"),
-		conf.GetString("cache.redis.password"),
-		conf.GetInt("cache.redis.db"),
-	))
+	options := cache.RedisStoreOptions{
+		Addrs:     strings.Split(conf.GetString("cache.redis.addr"), ","),
+		Password:  conf.GetString("cache.redis.password"),
+		DB:        conf.GetInt("cache.redis.db"),
+		KeyPrefix: conf.GetString("cache.redis.keyprefix"),
+		TTL:       conf.GetDuration("cache.redis.ttl"),
+	}
+	for i, addr := range options.Addrs {
+		options.Addrs[i] = strings.TrimSpace(addr)
+	}
+
+	mode := strings.ToLower(conf.GetString("cache.redis.mode"))
+	switch mode {
+	case "", "standalone":
+	case "sentinel":
+		crashIfConfigMissingVars(conf, []string{"cache.redis.mastername"})
+		options.MasterName = conf.GetString("cache.redis.mastername")
+	case "cluster":
+		options.Cluster = true
+	default:
+		crash("Unsupported Redis mode: ", mode)
+	}
+
+	if conf.GetBool("cache.redis.tls.enabled") {
+		tlsConfig, err := cache.NewRedisTLSConfig(
+			conf.GetString("cache.redis.tls.cacert"),
+			conf.GetString("cache.redis.tls.cert"),
+			conf.GetString("cache.redis.tls.key"),
+			conf.GetBool("cache.redis.tls.insecureskipverify"),
+		)
+		if err != nil {
+			crash("Unable to configure Redis TLS: ", err)
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	return options
+}
+
+func busFromConfig(conf *config.Config, redisStore *cache.RedisStore) cache.Bus {
+	backend := strings.ToLower(conf.GetString("cache.bus.backend"))
+	switch backend {
+	case "":
+		return nil
+	case "redis":
+		return cache.NewRedisBus(redisStore.UniversalClient, redisStore.KeyPrefix+conf.GetString("cache.bus.channel"))
+	default:
+		crash("Unsupported cache bus: ", backend)
+	}
+	return nil
+}
+
+func storageBreakerFromConfig(conf *config.Config) *cm_backend.CircuitBreaker {
+	threshold := conf.GetInt("storage.breaker.threshold")
+	if threshold <= 0 {
+		return nil
+	}
+	return cm_backend.NewCircuitBreaker(threshold, conf.GetDuration("storage.breaker.cooldown"))
+}
+
+func urlSignerFromConfig(conf *config.Config, backend storage.Backend) cm_backend.URLSigner {
+	if !conf.GetBool("redirect-downloads") {
+		return nil
+	}
+	if signer := cm_backend.NewURLSigner(backend); signer != nil {
+		return signer
+	}
+	if strings.ToLower(conf.GetString("storage.backend")) != "local" {
+		// downloads are proxied
+		return nil
+	}
+	// URLs signed by a replica must be valid on the others
+	crashIfConfigMissingVars(conf, []string{"redirect-downloads-secret"})
+	secret := []byte(conf.GetString("redirect-downloads-secret"))
+	baseURL := strings.TrimSuffix(conf.GetString("charturl"), "/")
+	if baseURL == "" {
+		baseURL = conf.GetString("contextpath")
+	}
+	return cm_backend.NewLocalURLSigner(secret, baseURL)
+}
+
+func lockerFromConfig(conf *config.Config, redisStore *cache.RedisStore) cache.Locker {
+	backend := strings.ToLower(conf.GetString("cache.lock.backend"))
+	timeout := conf.GetDuration("cache.lock.timeout")
+	switch backend {
+	case "", "memory":
+		return cache.NewMemoryLocker(timeout)
+	case "redis":
+		return cache.NewRedisLocker(redisStore.UniversalClient, redisStore.KeyPrefix, conf.GetDuration("cache.lock.ttl"), timeout)
+	default:
+		crash("Unsupported cache lock: ", backend)
+	}
+	return nil
+}
+
+func metadataStoreFromConfig(conf *config.Config) metadb.Store {
+	path := conf.GetString("metadata-db-path")
+	if path == "" {
+		return nil
+	}
+	store, err := metadb.NewBoltStore(path)
+	if err != nil {
+		crash("Unable to open metadata database: ", err)
+	}
+	return store
 }
 
 func crashIfConfigMissingVars(conf *config.Config, vars []string) {
@@ -20,7 +20,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	pathutil "path"
 	"testing"
+	"time"
 
 	"helm.sh/chartmuseum/pkg/chartmuseum"
 
@@ -32,6 +34,7 @@ type MainTestSuite struct {
 	suite.Suite
 	RedisMock        *miniredis.Miniredis
 	LastCrashMessage string
+	LastPrinted      string
 }
 
 func (suite *MainTestSuite) SetupSuite() {
@@ -39,6 +42,10 @@ func (suite *MainTestSuite) SetupSuite() {
 		suite.LastCrashMessage = fmt.Sprint(v...)
 		panic(v)
 	}
+	echo = func(a ...interface{}) (int, error) {
+		suite.LastPrinted = fmt.Sprint(a...)
+		return 0, nil
+	}
 	newServer = func(options chartmuseum.ServerOptions) (chartmuseum.Server, error) {
 		return nil, errors.New("graceful crash")
 	}
@@ -106,11 +113,317 @@ func (suite *MainTestSuite) TestMain() {
 	suite.Panics(main, "redis cache")
 	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with redis cache")
 
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "redis", "--cache-redis-addr", suite.RedisMock.Addr(),
+		"--cache-redis-key-prefix", "chartmuseum:", "--cache-redis-ttl", "1h", "--cache-redis-tls", "--cache-redis-tls-insecure-skip-verify"}
+	suite.Panics(main, "redis cache with options")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with redis cache options")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "redis", "--cache-redis-addr", "localhost:26379,localhost:26380", "--cache-redis-mode", "sentinel"}
+	suite.Panics(main, "redis sentinel without master name")
+	suite.Equal("Missing required flags(s): --cache-redis-master-name", suite.LastCrashMessage, "crashes with no master name")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "redis", "--cache-redis-addr", suite.RedisMock.Addr(), "--cache-redis-mode", "ring"}
+	suite.Panics(main, "bad redis mode")
+	suite.Equal("Unsupported Redis mode: ring", suite.LastCrashMessage, "crashes with bad redis mode")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "redis", "--cache-redis-addr", suite.RedisMock.Addr(), "--cache-redis-tls", "--cache-redis-tls-cert", "client.crt"}
+	suite.Panics(main, "redis tls without key")
+	suite.Contains(suite.LastCrashMessage, "Unable to configure Redis TLS", "crashes with bad redis tls")
+
+	// Disk cache
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "disk", "--cache-disk-path", "../../.test/chartmuseum-main/cache.db"}
+	suite.Panics(main, "disk cache")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with disk cache")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "disk"}
+	suite.Panics(main, "disk cache without path")
+	suite.Equal("Missing required flags(s): --cache-disk-path", suite.LastCrashMessage, "crashes with no disk cache path")
+
+	// Cache bus
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache-bus", "redis", "--cache-redis-addr", suite.RedisMock.Addr()}
+	suite.Panics(main, "redis bus")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with redis bus")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache-bus", "carrier-pigeon"}
+	suite.Panics(main, "bad bus")
+	suite.Equal("Unsupported cache bus: carrier-pigeon", suite.LastCrashMessage, "crashes with bad bus")
+
+	// Cache lock
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache-lock", "redis", "--cache-redis-addr", suite.RedisMock.Addr(), "--cache-lock-timeout", "10s"}
+	suite.Panics(main, "redis lock")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with redis lock")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache-lock", "flock"}
+	suite.Panics(main, "bad lock")
+	suite.Equal("Unsupported cache lock: flock", suite.LastCrashMessage, "crashes with bad lock")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "redis", "--cache-bus", "redis", "--cache-lock", "redis", "--cache-redis-addr", suite.RedisMock.Addr()}
+	suite.Panics(main, "redis cache, bus and lock")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error sharing the redis connection")
+
+	// Stale index
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--stale-while-revalidate", "--storage-breaker-threshold", "3", "--storage-breaker-cooldown", "1m"}
+	suite.Panics(main, "stale index")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with stale index options")
+
+	// Storage resilience
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-timeout", "10s", "--storage-retries", "3", "--storage-retry-backoff", "50ms", "--storage-retry-max-backoff", "1s"}
+	suite.Panics(main, "storage resilience")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with storage resilience options")
+
+	// Storage cache
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-cache-dir", "../../.test/chartmuseum-main/storage-cache", "--storage-cache-max-size", "1048576"}
+	suite.Panics(main, "storage cache")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with storage cache")
+
+	// Download redirects
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--redirect-downloads", "--redirect-downloads-expiry", "1m", "--redirect-downloads-secret", "secret"}
+	suite.Panics(main, "download redirects")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with download redirects")
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--redirect-downloads"}
+	suite.Panics(main, "download redirects without secret")
+	suite.Equal("Missing required flags(s): --redirect-downloads-secret", suite.LastCrashMessage, "crashes without download URL secret")
+
+	// Storage encryption
+	keyfile := pathutil.Join(suite.T().TempDir(), "keys.yaml")
+	suite.Nil(os.WriteFile(keyfile, []byte("keys:\n  k1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n"), 0600))
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-encryption-keyfile", keyfile, "--storage-encryption-allow-plaintext"}
+	suite.Panics(main, "storage encryption")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with storage encryption")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-encryption-keyfile", pathutil.Join(suite.T().TempDir(), "missing.yaml")}
+	suite.Panics(main, "missing keyfile")
+	suite.Contains(suite.LastCrashMessage, "Unable to load storage encryption keys: ", "crashes with missing keyfile")
+
+	// Storage mirror
+	mirrorConfig := pathutil.Join(suite.T().TempDir(), "mirror.yaml")
+	suite.Nil(os.WriteFile(mirrorConfig, []byte("storage:\n  backend: local\n  local:\n    rootdir: ../../.test/chartmuseum-main/mirror\n"), 0644))
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-mirror-config", mirrorConfig,
+		"--storage-mirror-async", "--storage-mirror-failover", "--storage-mirror-reconcile-interval", "1h"}
+	suite.Panics(main, "storage mirror")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with storage mirror")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--storage-mirror-config", "missing.yaml"}
+	suite.Panics(main, "missing mirror config")
+	suite.Contains(suite.LastCrashMessage, "Unable to read storage mirror config: ", "crashes with missing mirror config")
+
+	// Retention rules
+	policyfile := pathutil.Join(suite.T().TempDir(), "retention.yaml")
+	suite.Nil(os.WriteFile(policyfile, []byte("rules:\n  - keepLastPatches: 3\n"), 0600))
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--retention-policy-file", policyfile, "--retention-interval", "1h"}
+	suite.Panics(main, "retention rules")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with retention rules")
+
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--retention-policy-file", pathutil.Join(suite.T().TempDir(), "missing.yaml")}
+	suite.Panics(main, "missing retention policy")
+	suite.Contains(suite.LastCrashMessage, "Unable to load retention policy: ", "crashes with missing retention policy")
+
+	// Protected chart versions
+	policyfile = pathutil.Join(suite.T().TempDir(), "protection.yaml")
+	suite.Nil(os.WriteFile(policyfile, []byte("rules:\n  - chart: mychart\n    versions: '>=1.0.0'\n"), 0600))
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--protection-policy-file", policyfile}
+	suite.Panics(main, "protection rules")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with protection rules")
+
+	suite.Nil(os.WriteFile(policyfile, []byte("rules:\n  - versions: 'not a range'\n"), 0600))
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--protection-policy-file", policyfile}
+	suite.Panics(main, "invalid protection policy")
+	suite.Contains(suite.LastCrashMessage, "Unable to load protection policy: ", "crashes with invalid protection policy")
+
+	// Garbage collection
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--gc-interval", "1h", "--gc-min-age", "10m", "--gc-unknown", "--gc-dry-run"}
+	suite.Panics(main, "garbage collection")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with garbage collection")
+
+	// Trash
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--trash", "--trash-purge-after", "720h"}
+	suite.Panics(main, "trash")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with trash")
+
+	// Metadata database
+	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--metadata-db-path", "../../.test/chartmuseum-main/metadata.db"}
+	suite.Panics(main, "metadata db")
+	suite.Equal("graceful crash", suite.LastCrashMessage, "no error with metadata db")
+
 	// Unsupported cache store
 	os.Args = []string{"chartmuseum", "--storage", "local", "--storage-local-rootdir", "../../.chartstorage", "--cache", "wallet"}
 	suite.Panics(main, "bad cache")
 	suite.Equal("Unsupported cache store: wallet", suite.LastCrashMessage, "crashes with bad cache")
+}
+
+func (suite *MainTestSuite) TestBackfillSidecars() {
+	dir := "../../.test/chartmuseum-main/backfill-sidecars"
+	err := os.MkdirAll(dir, os.ModePerm)
+	suite.Nil(err, "no error creating storage directory")
+	defer os.RemoveAll(dir)
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading test tarball")
+	err = os.WriteFile(pathutil.Join(dir, "mychart-0.1.0.tgz"), content, 0644)
+	suite.Nil(err, "no error copying test tarball")
+
+	os.Args = []string{"chartmuseum", "backfill-sidecars"}
+	suite.Panics(main, "no storage")
+	suite.Equal("Missing required flags(s): --storage", suite.LastCrashMessage, "crashes with no storage")
+
+	os.Args = []string{"chartmuseum", "backfill-sidecars", "--storage", "local", "--storage-local-rootdir", dir}
+	suite.NotPanics(main, "backfill sidecars")
+	suite.Equal(`repo "": 1 packages, 1 sidecars written, 0 skipped, 0 failed`, suite.LastPrinted, "sidecar written")
+	_, err = os.Stat(pathutil.Join(dir, ".meta", "mychart-0.1.0.tgz.json"))
+	suite.Nil(err, "sidecar in storage")
+
+	os.Args = []string{"chartmuseum", "backfill-sidecars", "--storage", "local", "--storage-local-rootdir", dir, "--repo", "org1"}
+	suite.NotPanics(main, "backfill sidecars of empty repo")
+	suite.Equal(`repo "org1": 0 packages, 0 sidecars written, 0 skipped, 0 failed`, suite.LastPrinted, "nothing to backfill")
+
+	keyfile := pathutil.Join(suite.T().TempDir(), "keys.yaml")
+	suite.Nil(os.WriteFile(keyfile, []byte("keys:\n  k1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n"), 0600))
+	os.Args = []string{"chartmuseum", "backfill-sidecars", "--storage", "local", "--storage-local-rootdir", dir, "--overwrite",
+		"--storage-encryption-keyfile", keyfile, "--storage-encryption-allow-plaintext"}
+	suite.NotPanics(main, "backfill sidecars with encryption")
+	suite.Equal(`repo "": 1 packages, 1 sidecars written, 0 skipped, 0 failed`, suite.LastPrinted, "sidecar written")
+	sidecar, err := os.ReadFile(pathutil.Join(dir, ".meta", "mychart-0.1.0.tgz.json"))
+	suite.Nil(err, "sidecar in storage")
+	suite.NotContains(string(sidecar), "mychart", "sidecar encrypted")
+}
+
+func (suite *MainTestSuite) TestMigrate() {
+	dir := suite.T().TempDir()
+	source, destination := pathutil.Join(dir, "source"), pathutil.Join(dir, "destination")
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading test tarball")
+	suite.Nil(os.MkdirAll(pathutil.Join(source, "org1"), os.ModePerm))
+	suite.Nil(os.WriteFile(pathutil.Join(source, "org1", "mychart-0.1.0.tgz"), content, 0644))
+	toConfig := pathutil.Join(dir, "destination.yaml")
+	suite.Nil(os.WriteFile(toConfig, []byte("storage.backend: local\nstorage.local.rootdir: "+destination+"\n"), 0644))
+
+	os.Args = []string{"chartmuseum", "migrate", "--storage", "local", "--storage-local-rootdir", source}
+	suite.Panics(main, "no destination")
+	suite.Equal("Missing required flags(s): --to-config", suite.LastCrashMessage, "crashes with no destination")
+
+	os.Args = []string{"chartmuseum", "migrate", "--storage", "local", "--storage-local-rootdir", source, "--to-config", toConfig, "--dry-run"}
+	suite.NotPanics(main, "migrate dry run")
+	suite.Equal("dry run: 2 repos, 1 objects, 1 to copy, 0 already migrated, 0 failed", suite.LastPrinted)
+	_, err = os.Stat(pathutil.Join(destination, "org1", "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "nothing copied on dry run")
+
+	os.Args = []string{"chartmuseum", "migrate", "--storage", "local", "--storage-local-rootdir", source, "--to-config", toConfig}
+	suite.NotPanics(main, "migrate")
+	suite.Equal("2 repos, 1 objects, 1 copied, 0 already migrated, 0 failed", suite.LastPrinted)
+	copied, err := os.ReadFile(pathutil.Join(destination, "org1", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "package copied")
+	suite.Equal(content, copied)
+
+	os.Args = []string{"chartmuseum", "migrate", "--storage", "local", "--storage-local-rootdir", source, "--to-config", toConfig, "--repo", "org1"}
+	suite.NotPanics(main, "resume migration")
+	suite.Equal("1 repos, 1 objects, 0 copied, 1 already migrated, 0 failed", suite.LastPrinted)
+}
+
+func (suite *MainTestSuite) TestBackupRestore() {
+	dir := suite.T().TempDir()
+	source, destination := pathutil.Join(dir, "source"), pathutil.Join(dir, "destination")
+	archive := pathutil.Join(dir, "backup.tar")
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading test tarball")
+	suite.Nil(os.MkdirAll(pathutil.Join(source, "org1"), os.ModePerm))
+	suite.Nil(os.WriteFile(pathutil.Join(source, "org1", "mychart-0.1.0.tgz"), content, 0644))
+
+	os.Args = []string{"chartmuseum", "backup", "--storage", "local", "--storage-local-rootdir", source}
+	suite.Panics(main, "no output")
+	suite.Equal("Missing required flags(s): --output", suite.LastCrashMessage, "crashes with no output")
+
+	os.Args = []string{"chartmuseum", "backup", "--storage", "local", "--storage-local-rootdir", source, "--output", archive}
+	suite.NotPanics(main, "backup")
+	suite.Equal("2 repos, 1 files backed up to "+archive, suite.LastPrinted)
+
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination}
+	suite.Panics(main, "no input")
+	suite.Equal("Missing required flags(s): --input", suite.LastCrashMessage, "crashes with no input")
+
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination, "--input", archive}
+	suite.NotPanics(main, "restore")
+	suite.Contains(suite.LastPrinted, ": 1 restored, 0 identical, 0 conflicts, 0 failed")
+	restored, err := os.ReadFile(pathutil.Join(destination, "org1", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "package restored")
+	suite.Equal(content, restored)
+
+	suite.Nil(os.WriteFile(pathutil.Join(destination, "org1", "mychart-0.1.0.tgz"), []byte("other"), 0644))
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination, "--input", archive}
+	suite.NotPanics(main, "restore with conflict")
+	suite.Contains(suite.LastPrinted, ": 0 restored, 0 identical, 1 conflicts, 0 failed")
+
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination, "--input", archive,
+		"--force", "--disable-force-overwrite"}
+	suite.NotPanics(main, "restore with force disabled")
+	suite.Contains(suite.LastPrinted, ": 0 restored, 0 identical, 1 conflicts, 0 failed")
+
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination, "--input", archive, "--force"}
+	suite.NotPanics(main, "restore with force")
+	suite.Contains(suite.LastPrinted, ": 1 restored, 0 identical, 0 conflicts, 0 failed")
+
+	suite.Nil(os.WriteFile(archive, []byte("not an archive"), 0644))
+	os.Args = []string{"chartmuseum", "restore", "--storage", "local", "--storage-local-rootdir", destination, "--input", archive}
+	suite.Panics(main, "invalid archive")
+	suite.Contains(suite.LastCrashMessage, "invalid backup archive")
+}
+
+func (suite *MainTestSuite) TestFsck() {
+	dir := suite.T().TempDir()
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading test tarball")
+	suite.Nil(os.WriteFile(pathutil.Join(dir, "mychart-0.1.0.tgz"), content, 0644))
+	orphan := pathutil.Join(dir, "otherchart-0.1.0.tgz.prov")
+	suite.Nil(os.WriteFile(orphan, []byte("orphan"), 0644))
+
+	os.Args = []string{"chartmuseum", "fsck", "--storage", "local", "--storage-local-rootdir", dir, "--repair"}
+	suite.NotPanics(main, "fsck with recent provenance file")
+	suite.Equal(`repo "": 2 files, 0 problems, 0 repaired`, suite.LastPrinted, "provenance file modified less than --gc-min-age ago ignored")
+	modified := time.Now().Add(-2 * time.Hour)
+	suite.Nil(os.Chtimes(orphan, modified, modified))
+
+	os.Args = []string{"chartmuseum", "fsck", "--storage", "local", "--storage-local-rootdir", dir}
+	suite.NotPanics(main, "fsck")
+	suite.Equal(`repo "": 2 files, 1 problems, 0 repaired`, suite.LastPrinted)
+
+	os.Args = []string{"chartmuseum", "fsck", "--storage", "local", "--storage-local-rootdir", dir, "--repair"}
+	suite.NotPanics(main, "fsck with repair")
+	suite.Equal(`repo "": 2 files, 1 problems, 1 repaired`, suite.LastPrinted)
+	_, err = os.Stat(pathutil.Join(dir, "otherchart-0.1.0.tgz.prov"))
+	suite.True(os.IsNotExist(err), "orphaned provenance file deleted")
+
+	os.Args = []string{"chartmuseum", "fsck", "--storage", "local", "--storage-local-rootdir", dir}
+	suite.NotPanics(main, "fsck after repair")
+	suite.Equal(`repo "": 1 files, 0 problems, 0 repaired`, suite.LastPrinted)
+}
+
+func (suite *MainTestSuite) TestReencrypt() {
+	dir := suite.T().TempDir()
+	storageDir := pathutil.Join(dir, "storage")
+	suite.Nil(os.MkdirAll(pathutil.Join(storageDir, "org1", "repoa"), os.ModePerm))
+	suite.Nil(os.WriteFile(pathutil.Join(storageDir, "org1", "mychart-0.1.0.tgz"), []byte("plaintext"), 0644))
+	suite.Nil(os.WriteFile(pathutil.Join(storageDir, "org1", "repoa", "mychart-0.1.0.tgz"), []byte("plaintext"), 0644))
+	keyfile := pathutil.Join(dir, "keys.yaml")
+	suite.Nil(os.WriteFile(keyfile, []byte("keys:\n  k1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n"), 0600))
+
+	os.Args = []string{"chartmuseum", "reencrypt", "--storage", "local", "--storage-local-rootdir", storageDir}
+	suite.Panics(main, "no keyfile")
+	suite.Equal("Missing required flags(s): --storage-encryption-keyfile", suite.LastCrashMessage, "crashes with no keyfile")
+
+	os.Args = []string{"chartmuseum", "reencrypt", "--storage", "local", "--storage-local-rootdir", storageDir, "--repo", "org1",
+		"--storage-encryption-keyfile", keyfile, "--storage-encryption-allow-plaintext"}
+	suite.NotPanics(main, "reencrypt")
+	suite.Equal("1 repos, 1 objects, 1 reencrypted, 0 skipped, 0 failed", suite.LastPrinted, "given repo only")
+	content, err := os.ReadFile(pathutil.Join(storageDir, "org1", "mychart-0.1.0.tgz"))
+	suite.Nil(err)
+	suite.NotContains(string(content), "plaintext", "object encrypted")
 
+	// every repo, nested ones included
+	os.Args = []string{"chartmuseum", "reencrypt", "--storage", "local", "--storage-local-rootdir", storageDir,
+		"--storage-encryption-keyfile", keyfile, "--storage-encryption-allow-plaintext"}
+	suite.NotPanics(main, "reencrypt every repo")
+	suite.Equal("3 repos, 2 objects, 1 reencrypted, 1 skipped, 0 failed", suite.LastPrinted)
+	content, err = os.ReadFile(pathutil.Join(storageDir, "org1", "repoa", "mychart-0.1.0.tgz"))
+	suite.Nil(err)
+	suite.NotContains(string(content), "plaintext", "object of nested repo encrypted")
 }
 
 func TestMainTestSuite(t *testing.T) {
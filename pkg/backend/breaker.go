@@ -0,0 +1,103 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned instead of calling a backend which keeps failing
+	ErrCircuitOpen = errors.New("storage backend unavailable (circuit breaker open)")
+)
+
+type (
+	// CircuitBreaker stops calls to a failing backend. It opens after Threshold consecutive
+	// failures, then lets a single trial call through once Cooldown has elapsed: the circuit
+	// closes again if the trial succeeds, and stays open for another Cooldown otherwise.
+	CircuitBreaker struct {
+		Threshold int
+		Cooldown  time.Duration
+		mutex     sync.Mutex
+		failures  int
+		openedAt  time.Time
+		trial     bool
+		now       func() time.Time
+	}
+)
+
+// NewCircuitBreaker creates a new CircuitBreaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the backend should not be called
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if !breaker.open() {
+		return nil
+	}
+	if breaker.trial || breaker.now().Sub(breaker.openedAt) < breaker.Cooldown {
+		return ErrCircuitOpen
+	}
+	breaker.trial = true
+	return nil
+}
+
+// Record records the outcome of a call which was allowed
+func (breaker *CircuitBreaker) Record(err error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.trial = false
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.open() {
+		breaker.openedAt = breaker.now()
+	}
+}
+
+// Open reports whether calls are currently rejected
+func (breaker *CircuitBreaker) Open() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.open()
+}
+
+// open reports whether the circuit is open, it never opens without a threshold
+func (breaker *CircuitBreaker) open() bool {
+	return breaker.Threshold > 0 && breaker.failures >= breaker.Threshold
+}
+
+// Call calls fn unless the circuit is open, and records its outcome
+func (breaker *CircuitBreaker) Call(fn func() error) error {
+	if err := breaker.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	breaker.Record(err)
+	return err
+}
@@ -0,0 +1,70 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CircuitBreakerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker() {
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	failure := errors.New("failure")
+	fail := func() error { return failure }
+	succeed := func() error { return nil }
+
+	suite.Equal(failure, breaker.Call(fail), "call allowed while closed")
+	suite.Nil(breaker.Call(succeed), "call allowed while closed")
+	suite.Equal(failure, breaker.Call(fail), "failures counted again after success")
+	suite.False(breaker.Open(), "closed below threshold")
+	suite.Equal(failure, breaker.Call(fail), "call allowed below threshold")
+	suite.True(breaker.Open(), "open at threshold")
+	suite.Equal(ErrCircuitOpen, breaker.Call(succeed), "call rejected while open")
+
+	// a single trial call is let through after the cooldown
+	now = now.Add(2 * time.Minute)
+	suite.Nil(breaker.Allow(), "trial call allowed after cooldown")
+	suite.Equal(ErrCircuitOpen, breaker.Allow(), "concurrent call rejected during trial")
+	breaker.Record(failure)
+	suite.Equal(ErrCircuitOpen, breaker.Call(succeed), "open again after failed trial")
+
+	now = now.Add(2 * time.Minute)
+	suite.Nil(breaker.Call(succeed), "trial call succeeds")
+	suite.False(breaker.Open(), "closed after successful trial")
+}
+
+func (suite *CircuitBreakerTestSuite) TestDisabled() {
+	breaker := NewCircuitBreaker(0, time.Minute)
+	failure := errors.New("failure")
+	for i := 0; i < 5; i++ {
+		suite.Equal(failure, breaker.Call(func() error { return failure }), "call allowed without threshold")
+	}
+	suite.False(breaker.Open(), "never open without threshold")
+}
+
+func TestCircuitBreakerTestSuite(t *testing.T) {
+	suite.Run(t, new(CircuitBreakerTestSuite))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	pathutil "path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+)
+
+type (
+	// ChecksumLister is implemented by storage backends able to list a checksum of the
+	// content of every object (for example its ETag) without downloading it
+	ChecksumLister interface {
+		ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error)
+	}
+
+	// AmazonS3Backend is an Amazon S3 storage backend which lists object ETags
+	AmazonS3Backend struct {
+		*storage.AmazonS3Backend
+	}
+)
+
+// NewAmazonS3Backend wraps an Amazon S3 storage backend to list object ETags
+func NewAmazonS3Backend(b *storage.AmazonS3Backend) *AmazonS3Backend {
+	return &AmazonS3Backend{AmazonS3Backend: b}
+}
+
+// ListObjectsWithChecksums lists all objects in Amazon S3 bucket, at prefix, along with their ETag
+func (b AmazonS3Backend) ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error) {
+	var objects []storage.Object
+	checksums := map[string]string{}
+	prefix = pathutil.Join(b.Prefix, prefix)
+	s3Input := &s3.ListObjectsInput{
+		Bucket: aws.String(b.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		s3Result, err := b.Client.ListObjects(s3Input)
+		if err != nil {
+			return objects, nil, err
+		}
+		for _, obj := range s3Result.Contents {
+			path := *obj.Key
+			if prefix != "" {
+				path = strings.Replace(path, prefix+"/", "", 1)
+			}
+			if strings.Contains(path, "/") || path == "" {
+				continue
+			}
+			objects = append(objects, storage.Object{
+				Path:         path,
+				Content:      []byte{},
+				LastModified: *obj.LastModified,
+			})
+			if obj.ETag != nil {
+				checksums[path] = strings.Trim(*obj.ETag, `"`)
+			}
+		}
+		if !*s3Result.IsTruncated {
+			break
+		}
+		s3Input.Marker = s3Result.Contents[len(s3Result.Contents)-1].Key
+	}
+	return objects, checksums, nil
+}
@@ -0,0 +1,347 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chartmuseum/storage"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+var (
+	diskCacheFilePattern = regexp.MustCompile(`^([0-9a-f]{64}|\.tmp-[0-9]+)$`)
+)
+
+type (
+	// ObjectInvalidator is implemented by backends which cache objects, so that changes
+	// made elsewhere (e.g. by another replica) can be dropped from the cache
+	ObjectInvalidator interface {
+		InvalidateObject(path string)
+		InvalidatePrefix(prefix string)
+	}
+
+	// DiskCacheBackend decorates a storage backend with a read-through cache of chart packages
+	// and provenance files on local disk. Objects are evicted in least recently used order once
+	// the cache grows over MaxSize bytes. The cache starts empty, since objects may have
+	// changed while it was not running.
+	DiskCacheBackend struct {
+		Backend    storage.Backend
+		Dir        string
+		MaxSize    int64
+		mutex      sync.Mutex
+		lru        *list.List
+		objects    map[string]*list.Element
+		size       int64
+		generation uint64
+	}
+
+	// removeOnClose is a temporary file removed once read
+	removeOnClose struct {
+		*os.File
+	}
+
+	diskCacheItem struct {
+		path         string
+		size         int64
+		lastModified time.Time
+	}
+)
+
+// NewDiskCacheBackend wraps a storage backend, caching objects under dir
+func NewDiskCacheBackend(backend storage.Backend, dir string, maxSize int64) (*DiskCacheBackend, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	// only the files written by the cache are removed, in case dir is shared
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if diskCacheFilePattern.MatchString(file.Name()) {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+	return &DiskCacheBackend{
+		Backend: backend,
+		Dir:     dir,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		objects: map[string]*list.Element{},
+	}, nil
+}
+
+// ListObjects lists all objects under prefix, never from the cache
+func (b *DiskCacheBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsWithChecksums lists all objects under prefix, with their checksums when the
+// decorated backend is a ChecksumLister
+func (b *DiskCacheBackend) ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error) {
+	if lister, ok := b.Backend.(ChecksumLister); ok {
+		return lister.ListObjectsWithChecksums(prefix)
+	}
+	objects, err := b.Backend.ListObjects(prefix)
+	return objects, nil, err
+}
+
+// GetObject retrieves an object from the cache, or from storage on a miss
+func (b *DiskCacheBackend) GetObject(path string) (storage.Object, error) {
+	if !cacheable(path) {
+		return b.Backend.GetObject(path)
+	}
+	if object, ok := b.get(path); ok {
+		diskCacheHitsCounter.Inc()
+		return object, nil
+	}
+	diskCacheMissesCounter.Inc()
+
+	b.mutex.Lock()
+	generation := b.generation
+	b.mutex.Unlock()
+
+	object, err := b.Backend.GetObject(path)
+	if err != nil {
+		return object, err
+	}
+	b.put(path, object, generation)
+	return object, nil
+}
+
+// GetObjectStream retrieves an object as a stream from the cache. On a miss, the object is
+// copied from storage to the cache directory first, and kept in the cache if it fits.
+func (b *DiskCacheBackend) GetObjectStream(path string) (storage.Object, io.ReadSeekCloser, error) {
+	if !cacheable(path) {
+		return GetObjectStream(b.Backend, path)
+	}
+	if object, file, ok := b.open(path); ok {
+		diskCacheHitsCounter.Inc()
+		return object, file, nil
+	}
+	diskCacheMissesCounter.Inc()
+
+	b.mutex.Lock()
+	generation := b.generation
+	b.mutex.Unlock()
+
+	object, reader, err := GetObjectStream(b.Backend, path)
+	if err != nil {
+		return object, nil, err
+	}
+	defer reader.Close()
+	tmp, err := os.CreateTemp(b.Dir, ".tmp-")
+	if err != nil {
+		return object, nil, err
+	}
+	size, err := io.Copy(tmp, reader)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return object, nil, err
+	}
+	// the open file stays readable if it is evicted meanwhile
+	if b.add(path, tmp.Name(), size, object.LastModified, generation) {
+		return object, tmp, nil
+	}
+	return object, removeOnClose{tmp}, nil
+}
+
+// PutObjectStream uploads an object from a stream, dropping it from the cache
+func (b *DiskCacheBackend) PutObjectStream(path string, content io.ReaderAt, size int64) error {
+	defer b.InvalidateObject(path)
+	return PutObjectStream(b.Backend, path, content, size)
+}
+
+// PutObject uploads an object, dropping it from the cache
+func (b *DiskCacheBackend) PutObject(path string, content []byte) error {
+	defer b.InvalidateObject(path)
+	return b.Backend.PutObject(path, content)
+}
+
+// DeleteObject removes an object, dropping it from the cache
+func (b *DiskCacheBackend) DeleteObject(path string) error {
+	defer b.InvalidateObject(path)
+	return b.Backend.DeleteObject(path)
+}
+
+// InvalidateObject drops an object from the cache
+func (b *DiskCacheBackend) InvalidateObject(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.generation++
+	if element, ok := b.objects[path]; ok {
+		b.remove(element)
+	}
+}
+
+// InvalidatePrefix drops all objects under prefix from the cache
+func (b *DiskCacheBackend) InvalidatePrefix(prefix string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.generation++
+	for path, element := range b.objects {
+		if strings.HasPrefix(path, prefix) {
+			b.remove(element)
+		}
+	}
+}
+
+// Size returns the total size of the cached objects
+func (b *DiskCacheBackend) Size() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.size
+}
+
+// get reads a cached object, files are read under the lock so that they are not evicted meanwhile
+func (b *DiskCacheBackend) get(path string) (storage.Object, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	element, ok := b.objects[path]
+	if !ok {
+		return storage.Object{}, false
+	}
+	item := element.Value.(*diskCacheItem)
+	content, err := os.ReadFile(b.filename(path))
+	if err != nil {
+		b.remove(element)
+		return storage.Object{}, false
+	}
+	b.lru.MoveToFront(element)
+	return storage.Object{
+		Path:         path,
+		Content:      content,
+		LastModified: item.lastModified,
+	}, true
+}
+
+// open opens a cached object
+func (b *DiskCacheBackend) open(path string) (storage.Object, *os.File, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	element, ok := b.objects[path]
+	if !ok {
+		return storage.Object{}, nil, false
+	}
+	file, err := os.Open(b.filename(path))
+	if err != nil {
+		b.remove(element)
+		return storage.Object{}, nil, false
+	}
+	b.lru.MoveToFront(element)
+	return storage.Object{
+		Path:         path,
+		LastModified: element.Value.(*diskCacheItem).lastModified,
+	}, file, true
+}
+
+// put caches an object fetched from storage, unless it was invalidated since
+func (b *DiskCacheBackend) put(path string, object storage.Object, generation uint64) {
+	if int64(len(object.Content)) > b.MaxSize {
+		return
+	}
+	// written to a temporary file first, so that a partial file is never read
+	tmp, err := os.CreateTemp(b.Dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(object.Content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !b.add(path, tmp.Name(), int64(len(object.Content)), object.LastModified, generation) {
+		os.Remove(tmp.Name())
+	}
+}
+
+// add moves a complete temporary file into the cache, unless the object was invalidated since
+// it was fetched, and reports whether it did
+func (b *DiskCacheBackend) add(path string, tmpName string, size int64, lastModified time.Time, generation uint64) bool {
+	if size > b.MaxSize {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if generation != b.generation {
+		return false
+	}
+	if _, ok := b.objects[path]; ok {
+		return false
+	}
+	if err := os.Rename(tmpName, b.filename(path)); err != nil {
+		return false
+	}
+	b.objects[path] = b.lru.PushFront(&diskCacheItem{
+		path:         path,
+		size:         size,
+		lastModified: lastModified,
+	})
+	b.size += size
+	for b.size > b.MaxSize {
+		b.remove(b.lru.Back())
+	}
+	return true
+}
+
+// remove drops a cached object, the mutex must be held
+func (b *DiskCacheBackend) remove(element *list.Element) {
+	item := element.Value.(*diskCacheItem)
+	b.lru.Remove(element)
+	delete(b.objects, item.path)
+	b.size -= item.size
+	os.Remove(b.filename(item.path))
+}
+
+// filename returns the file holding a cached object, named after a hash of its path
+func (b *DiskCacheBackend) filename(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(b.Dir, hex.EncodeToString(sum[:]))
+}
+
+// cacheable reports whether an object is cached: chart packages and provenance files
+func cacheable(path string) bool {
+	return strings.HasSuffix(path, "."+cm_repo.ChartPackageFileExtension) ||
+		strings.HasSuffix(path, "."+cm_repo.ProvenanceFileExtension)
+}
+
+// Unwrap returns the decorated backend
+func (b *DiskCacheBackend) Unwrap() storage.Backend {
+	return b.Backend
+}
+
+// Close closes and removes the file
+func (f removeOnClose) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,147 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type DiskCacheBackendTestSuite struct {
+	suite.Suite
+	Storage *countingBackend
+	Cache   *DiskCacheBackend
+	Dir     string
+}
+
+// countingBackend counts the objects read from a local backend
+type countingBackend struct {
+	storage.Backend
+	gets int
+}
+
+func (b *countingBackend) GetObject(path string) (storage.Object, error) {
+	b.gets++
+	return b.Backend.GetObject(path)
+}
+
+func (suite *DiskCacheBackendTestSuite) SetupTest() {
+	root := suite.T().TempDir()
+	suite.Dir = filepath.Join(root, "cache")
+	suite.Storage = &countingBackend{Backend: storage.NewLocalFilesystemBackend(filepath.Join(root, "storage"))}
+	cache, err := NewDiskCacheBackend(suite.Storage, suite.Dir, 10)
+	suite.Nil(err, "no error creating disk cache")
+	suite.Cache = cache
+}
+
+func (suite *DiskCacheBackendTestSuite) TestReadThrough() {
+	suite.Nil(suite.Storage.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+
+	object, err := suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(err, "no error on miss")
+	suite.Equal([]byte("abcd"), object.Content, "content read from storage")
+	object, err = suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(err, "no error on hit")
+	suite.Equal([]byte("abcd"), object.Content, "content read from cache")
+	suite.Equal("mychart-0.1.0.tgz", object.Path, "path of cached object")
+	suite.False(object.LastModified.IsZero(), "last modified time of cached object")
+	suite.Equal(1, suite.Storage.gets, "storage read once")
+	suite.Equal(int64(4), suite.Cache.Size(), "cache size")
+
+	_, err = suite.Cache.GetObject("missing-0.1.0.tgz")
+	suite.NotNil(err, "error on missing object")
+
+	suite.Nil(suite.Storage.PutObject("index-cache.yaml", []byte("{}")))
+	suite.Cache.GetObject("index-cache.yaml")
+	suite.Cache.GetObject("index-cache.yaml")
+	suite.Equal(4, suite.Storage.gets, "other files are not cached")
+}
+
+func (suite *DiskCacheBackendTestSuite) TestInvalidation() {
+	suite.Nil(suite.Cache.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Cache.GetObject("mychart-0.1.0.tgz")
+
+	suite.Nil(suite.Cache.PutObject("mychart-0.1.0.tgz", []byte("efgh")), "overwrite through the cache")
+	object, _ := suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Equal([]byte("efgh"), object.Content, "overwritten object not served from cache")
+
+	// changed behind the cache, e.g. by another replica
+	suite.Nil(suite.Storage.PutObject("mychart-0.1.0.tgz", []byte("ijkl")))
+	object, _ = suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Equal([]byte("efgh"), object.Content, "stale content until invalidated")
+	suite.Cache.InvalidateObject("mychart-0.1.0.tgz")
+	object, _ = suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Equal([]byte("ijkl"), object.Content, "fresh content after invalidation")
+
+	suite.Nil(suite.Cache.PutObject("org/mychart-0.1.0.tgz", []byte("mnop")))
+	suite.Cache.GetObject("org/mychart-0.1.0.tgz")
+	suite.Cache.InvalidatePrefix("org/")
+	suite.Equal(int64(4), suite.Cache.Size(), "objects under prefix invalidated")
+
+	suite.Nil(suite.Cache.DeleteObject("mychart-0.1.0.tgz"), "delete through the cache")
+	_, err := suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.NotNil(err, "deleted object not served from cache")
+	suite.Equal(int64(0), suite.Cache.Size(), "cache empty")
+}
+
+func (suite *DiskCacheBackendTestSuite) TestEviction() {
+	suite.Nil(suite.Storage.PutObject("a-0.1.0.tgz", []byte("aaaa")))
+	suite.Nil(suite.Storage.PutObject("b-0.1.0.tgz", []byte("bbbb")))
+	suite.Nil(suite.Storage.PutObject("c-0.1.0.tgz", []byte("cccc")))
+	suite.Nil(suite.Storage.PutObject("big-0.1.0.tgz", []byte("0123456789a")))
+
+	suite.Cache.GetObject("a-0.1.0.tgz")
+	suite.Cache.GetObject("b-0.1.0.tgz")
+	suite.Cache.GetObject("a-0.1.0.tgz")
+	suite.Cache.GetObject("c-0.1.0.tgz")
+	suite.Equal(int64(8), suite.Cache.Size(), "cache bounded by max size")
+	suite.Equal(3, suite.Storage.gets)
+
+	suite.Cache.GetObject("a-0.1.0.tgz")
+	suite.Equal(3, suite.Storage.gets, "recently used object kept")
+	suite.Cache.GetObject("b-0.1.0.tgz")
+	suite.Equal(4, suite.Storage.gets, "least recently used object evicted")
+
+	suite.Cache.GetObject("big-0.1.0.tgz")
+	suite.Cache.GetObject("big-0.1.0.tgz")
+	suite.Equal(6, suite.Storage.gets, "objects over max size not cached")
+
+	files, err := os.ReadDir(suite.Dir)
+	suite.Nil(err)
+	suite.Len(files, 2, "evicted files removed from disk")
+}
+
+func (suite *DiskCacheBackendTestSuite) TestStartsEmpty() {
+	suite.Nil(suite.Storage.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Cache.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(os.WriteFile(filepath.Join(suite.Dir, "README"), []byte{}, 0644))
+
+	cache, err := NewDiskCacheBackend(suite.Storage, suite.Dir, 10)
+	suite.Nil(err, "no error reopening disk cache")
+	suite.Equal(int64(0), cache.Size(), "reopened cache is empty")
+	files, err := os.ReadDir(suite.Dir)
+	suite.Nil(err)
+	suite.Len(files, 1, "cached files removed, other files kept")
+}
+
+func TestDiskCacheBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(DiskCacheBackendTestSuite))
+}
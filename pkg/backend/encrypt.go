@@ -0,0 +1,279 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/chartmuseum/storage"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// ErrNotEncrypted is returned when reading an object which was not encrypted, unless
+	// plaintext objects are allowed
+	ErrNotEncrypted = errors.New("storage object is not encrypted")
+
+	// ErrUnknownKey is returned when reading an object encrypted with a key missing from the keyring
+	ErrUnknownKey = errors.New("storage object encrypted with an unknown key")
+
+	// encryptedObjectMagic starts the content of every encrypted object, followed by the length
+	// and ID of the key, the nonce and the sealed content
+	encryptedObjectMagic = []byte("CMENC\x01")
+)
+
+type (
+	// Keyring holds the keys used to encrypt storage objects. New objects are encrypted with
+	// the primary key, the other keys are only used to decrypt objects written before a rotation.
+	Keyring struct {
+		Primary string
+		keys    map[string]cipher.AEAD
+	}
+
+	// keyfile is the content of a keyring file, with base64 encoded AES keys
+	keyfile struct {
+		Primary string            `json:"primary"`
+		Keys    map[string]string `json:"keys"`
+	}
+
+	// EncryptedBackend decorates a storage backend to encrypt the content of objects with
+	// AES-GCM before they are stored, and decrypt them when they are read. Objects are bound
+	// to their path, so that encrypted content cannot be moved to another path of the storage.
+	// It does not implement Unwrapper: URLs of the decorated backend would serve encrypted content.
+	EncryptedBackend struct {
+		Backend storage.Backend
+		Keyring *Keyring
+		// AllowPlaintext lets objects written before encryption was enabled be read as is
+		AllowPlaintext bool
+	}
+)
+
+// LoadKeyring reads a keyring from a YAML file such as:
+//
+//	primary: 2024-06
+//	keys:
+//	  2024-06: <base64 encoded 32 bytes key>
+//	  2024-01: <base64 encoded 32 bytes key>
+//
+// The primary key may be omitted when there is a single key.
+func LoadKeyring(filename string) (*Keyring, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file keyfile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid keyfile %s: %w", filename, err)
+	}
+	keys := map[string][]byte{}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in keyfile %s: %w", id, filename, err)
+		}
+		keys[id] = key
+	}
+	primary := file.Primary
+	if primary == "" && len(keys) == 1 {
+		for id := range keys {
+			primary = id
+		}
+	}
+	return NewKeyring(primary, keys)
+}
+
+// NewKeyring creates a keyring of AES-128, AES-192 or AES-256 keys by ID
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	keyring := &Keyring{
+		Primary: primary,
+		keys:    map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+	}
+	if _, ok := keyring.keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q not found in keyring", primary)
+	}
+	return keyring, nil
+}
+
+// Encrypt seals the content of the object at path with the primary key
+func (keyring *Keyring) Encrypt(path string, content []byte) ([]byte, error) {
+	aead := keyring.keys[keyring.Primary]
+	header := make([]byte, 0, len(encryptedObjectMagic)+1+len(keyring.Primary)+aead.NonceSize())
+	header = append(header, encryptedObjectMagic...)
+	header = append(header, byte(len(keyring.Primary)))
+	header = append(header, keyring.Primary...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, content, []byte(path)), nil
+}
+
+// Decrypt opens the content of the object at path, returning ErrNotEncrypted if it was not encrypted
+func (keyring *Keyring) Decrypt(path string, content []byte) ([]byte, error) {
+	keyID, nonce, sealed, err := keyring.parse(content)
+	if err != nil {
+		return nil, err
+	}
+	return keyring.keys[keyID].Open(nil, nonce, sealed, []byte(path))
+}
+
+// KeyID returns the ID of the key an object was encrypted with, ErrNotEncrypted if it was not encrypted
+func (keyring *Keyring) KeyID(content []byte) (string, error) {
+	keyID, _, _, err := keyring.parse(content)
+	return keyID, err
+}
+
+func (keyring *Keyring) parse(content []byte) (string, []byte, []byte, error) {
+	if !bytes.HasPrefix(content, encryptedObjectMagic) || len(content) == len(encryptedObjectMagic) {
+		return "", nil, nil, ErrNotEncrypted
+	}
+	content = content[len(encryptedObjectMagic):]
+	idLength := int(content[0])
+	content = content[1:]
+	if len(content) < idLength {
+		return "", nil, nil, ErrNotEncrypted
+	}
+	keyID := string(content[:idLength])
+	aead, ok := keyring.keys[keyID]
+	if !ok {
+		return keyID, nil, nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+	content = content[idLength:]
+	if len(content) < aead.NonceSize()+aead.Overhead() {
+		return keyID, nil, nil, ErrNotEncrypted
+	}
+	return keyID, content[:aead.NonceSize()], content[aead.NonceSize():], nil
+}
+
+// NewEncryptedBackend wraps a storage backend
+func NewEncryptedBackend(backend storage.Backend, keyring *Keyring, allowPlaintext bool) *EncryptedBackend {
+	return &EncryptedBackend{
+		Backend:        backend,
+		Keyring:        keyring,
+		AllowPlaintext: allowPlaintext,
+	}
+}
+
+// ListObjects lists all objects under prefix
+func (b *EncryptedBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	return b.Backend.ListObjects(prefix)
+}
+
+// ListObjectsWithChecksums lists all objects under prefix, with the checksums of their
+// encrypted content when the decorated backend is a ChecksumLister
+func (b *EncryptedBackend) ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error) {
+	if lister, ok := b.Backend.(ChecksumLister); ok {
+		return lister.ListObjectsWithChecksums(prefix)
+	}
+	objects, err := b.Backend.ListObjects(prefix)
+	return objects, nil, err
+}
+
+// ListPrefixes lists the prefixes nested under prefix in the decorated backend
+func (b *EncryptedBackend) ListPrefixes(prefix string) ([]string, error) {
+	return ListPrefixes(b.Backend, prefix)
+}
+
+// StatObject returns an object of the decorated backend without its content
+func (b *EncryptedBackend) StatObject(path string) (storage.Object, error) {
+	return StatObject(b.Backend, path)
+}
+
+// GetObject retrieves and decrypts an object
+func (b *EncryptedBackend) GetObject(path string) (storage.Object, error) {
+	object, err := b.Backend.GetObject(path)
+	if err != nil {
+		return object, err
+	}
+	content, err := b.Keyring.Decrypt(path, object.Content)
+	if errors.Is(err, ErrNotEncrypted) && b.AllowPlaintext {
+		return object, nil
+	}
+	if err != nil {
+		return object, fmt.Errorf("unable to decrypt %s: %w", path, err)
+	}
+	object.Content = content
+	return object, nil
+}
+
+// PutObject encrypts and uploads an object
+func (b *EncryptedBackend) PutObject(path string, content []byte) error {
+	encrypted, err := b.Keyring.Encrypt(path, content)
+	if err != nil {
+		return err
+	}
+	return b.Backend.PutObject(path, encrypted)
+}
+
+// DeleteObject removes an object
+func (b *EncryptedBackend) DeleteObject(path string) error {
+	return b.Backend.DeleteObject(path)
+}
+
+// Reencrypt encrypts an object again with the primary key, if it was encrypted with another
+// key (or not encrypted), and reports whether it did
+func (b *EncryptedBackend) Reencrypt(path string) (bool, error) {
+	object, err := b.Backend.GetObject(path)
+	if err != nil {
+		return false, err
+	}
+	keyID, err := b.Keyring.KeyID(object.Content)
+	if err == nil && keyID == b.Keyring.Primary {
+		return false, nil
+	}
+	object, err = b.GetObject(path)
+	if err != nil {
+		return false, err
+	}
+	return true, b.PutObject(path, object.Content)
+}
+
+// InvalidateObject drops an object from the cache of the decorated backend, if any
+func (b *EncryptedBackend) InvalidateObject(path string) {
+	if invalidator, ok := b.Backend.(ObjectInvalidator); ok {
+		invalidator.InvalidateObject(path)
+	}
+}
+
+// InvalidatePrefix drops the objects under prefix from the cache of the decorated backend, if any
+func (b *EncryptedBackend) InvalidatePrefix(prefix string) {
+	if invalidator, ok := b.Backend.(ObjectInvalidator); ok {
+		invalidator.InvalidatePrefix(prefix)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+type EncryptedBackendTestSuite struct {
+	suite.Suite
+	Storage *storage.LocalFilesystemBackend
+}
+
+func (suite *EncryptedBackendTestSuite) SetupTest() {
+	suite.Storage = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+}
+
+func (suite *EncryptedBackendTestSuite) newKeyring(primary string) *Keyring {
+	keyring, err := NewKeyring(primary, map[string][]byte{"k1": testKey1, "k2": testKey2})
+	suite.Nil(err, "no error creating keyring")
+	return keyring
+}
+
+func (suite *EncryptedBackendTestSuite) TestEncryption() {
+	backend := NewEncryptedBackend(suite.Storage, suite.newKeyring("k1"), false)
+	suite.Nil(backend.PutObject("org/mychart-0.1.0.tgz", []byte("secret defaults")))
+
+	stored, err := suite.Storage.GetObject("org/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.NotContains(string(stored.Content), "secret defaults", "content encrypted in storage")
+	keyID, err := backend.Keyring.KeyID(stored.Content)
+	suite.Nil(err)
+	suite.Equal("k1", keyID, "encrypted with the primary key")
+
+	object, err := backend.GetObject("org/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading encrypted object")
+	suite.Equal("secret defaults", string(object.Content), "content decrypted")
+
+	objects, err := backend.ListObjects("org")
+	suite.Nil(err)
+	suite.Len(objects, 1, "objects listed")
+
+	// encrypted content moved to another path
+	suite.Nil(suite.Storage.PutObject("org/other-0.1.0.tgz", stored.Content))
+	_, err = backend.GetObject("org/other-0.1.0.tgz")
+	suite.NotNil(err, "content bound to its path")
+
+	suite.Nil(suite.Storage.PutObject("index-cache.yaml", []byte("plaintext")))
+	_, err = backend.GetObject("index-cache.yaml")
+	suite.ErrorIs(err, ErrNotEncrypted, "plaintext object rejected")
+	backend.AllowPlaintext = true
+	object, err = backend.GetObject("index-cache.yaml")
+	suite.Nil(err, "plaintext object allowed")
+	suite.Equal("plaintext", string(object.Content))
+
+	suite.Nil(backend.DeleteObject("org/mychart-0.1.0.tgz"))
+	_, err = suite.Storage.GetObject("org/mychart-0.1.0.tgz")
+	suite.NotNil(err, "object deleted")
+}
+
+func (suite *EncryptedBackendTestSuite) TestKeyRotation() {
+	backend := NewEncryptedBackend(suite.Storage, suite.newKeyring("k1"), false)
+	suite.Nil(backend.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+
+	// the new primary key encrypts new objects, the old key still decrypts
+	backend.Keyring = suite.newKeyring("k2")
+	object, err := backend.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(err, "object encrypted with previous key read")
+	suite.Equal("abcd", string(object.Content))
+
+	reencrypted, err := backend.Reencrypt("mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reencrypting")
+	suite.True(reencrypted, "object reencrypted with new key")
+	reencrypted, err = backend.Reencrypt("mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.False(reencrypted, "object already encrypted with primary key")
+
+	// the previous key can be retired
+	keyring, err := NewKeyring("k2", map[string][]byte{"k2": testKey2})
+	suite.Nil(err)
+	backend.Keyring = keyring
+	object, err = backend.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(err, "reencrypted object read without previous key")
+	suite.Equal("abcd", string(object.Content))
+
+	suite.Nil(NewEncryptedBackend(suite.Storage, suite.newKeyring("k1"), false).PutObject("other-0.1.0.tgz", []byte("efgh")))
+	_, err = backend.GetObject("other-0.1.0.tgz")
+	suite.ErrorIs(err, ErrUnknownKey, "object encrypted with retired key")
+}
+
+func (suite *EncryptedBackendTestSuite) TestLoadKeyring() {
+	dir := suite.T().TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "keys.yaml")
+		suite.Nil(os.WriteFile(filename, []byte(content), 0600))
+		return filename
+	}
+	key1 := base64.StdEncoding.EncodeToString(testKey1)
+	key2 := base64.StdEncoding.EncodeToString(testKey2)
+
+	keyring, err := LoadKeyring(write("primary: k2\nkeys:\n  k1: " + key1 + "\n  k2: " + key2 + "\n"))
+	suite.Nil(err, "no error loading keyring")
+	suite.Equal("k2", keyring.Primary)
+
+	keyring, err = LoadKeyring(write("keys:\n  k1: " + key1 + "\n"))
+	suite.Nil(err, "no error loading keyring with a single key")
+	suite.Equal("k1", keyring.Primary, "single key is primary")
+
+	_, err = LoadKeyring(write("keys:\n  k1: " + key1 + "\n  k2: " + key2 + "\n"))
+	suite.NotNil(err, "primary key required with several keys")
+	_, err = LoadKeyring(write("keys:\n  k1: " + base64.StdEncoding.EncodeToString([]byte("short")) + "\n"))
+	suite.NotNil(err, "invalid key size")
+	_, err = LoadKeyring(write("keys:\n  k1: not base64\n"))
+	suite.NotNil(err, "invalid key encoding")
+	_, err = LoadKeyring(write("primary: k1\nkeyz: {}\n"))
+	suite.NotNil(err, "unknown field")
+	_, err = LoadKeyring(filepath.Join(dir, "missing.yaml"))
+	suite.NotNil(err, "missing keyfile")
+}
+
+func TestEncryptedBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(EncryptedBackendTestSuite))
+}
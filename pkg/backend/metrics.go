@@ -0,0 +1,108 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Duration of storage operations, retries included
+	storageDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Duration of storage backend operations, retries included",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	// Storage operations which failed, after retries
+	storageErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_operation_errors_total",
+			Help:      "Number of storage backend operations which failed, after retries",
+		},
+		[]string{"operation"},
+	)
+	// Retries of storage operations
+	storageRetriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_operation_retries_total",
+			Help:      "Number of storage backend operations retried after a transient error",
+		},
+		[]string{"operation"},
+	)
+	// Reads served from the disk cache
+	diskCacheHitsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_cache_hits_total",
+			Help:      "Number of storage objects read from the local disk cache",
+		},
+	)
+	// Reads which missed the disk cache
+	diskCacheMissesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_cache_misses_total",
+			Help:      "Number of storage objects read from storage since they were not in the local disk cache",
+		},
+	)
+	// Writes which could not be mirrored to the secondary backend
+	storageMirrorErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_mirror_errors_total",
+			Help:      "Number of writes which could not be mirrored to the secondary storage backend",
+		},
+		[]string{"operation"},
+	)
+	// Writes waiting to be mirrored in the background
+	storageMirrorQueueGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_mirror_queue_length",
+			Help:      "Number of writes waiting to be mirrored to the secondary storage backend",
+		},
+	)
+	// Reads served by the secondary backend
+	storageMirrorFailoversCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_mirror_failovers_total",
+			Help:      "Number of reads served by the secondary storage backend while the primary one was unavailable",
+		},
+	)
+	// Objects repaired by reconciliations
+	storageMirrorReconciledCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_mirror_reconciled_objects_total",
+			Help:      "Number of objects copied to or deleted from the secondary storage backend by reconciliations",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageDurationHistogram, storageErrorsCounter, storageRetriesCounter,
+		diskCacheHitsCounter, diskCacheMissesCounter, storageMirrorErrorsCounter, storageMirrorQueueGauge,
+		storageMirrorFailoversCounter, storageMirrorReconciledCounter)
+}
@@ -0,0 +1,372 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"io"
+	pathutil "path"
+	"sync"
+
+	"github.com/chartmuseum/storage"
+)
+
+var (
+	// ErrMirrorQueueFull is reported when an asynchronous write cannot be queued, the
+	// object is mirrored by the next reconciliation
+	ErrMirrorQueueFull = errors.New("storage mirror queue full")
+)
+
+const defaultMirrorQueueSize = 1000
+
+type (
+	// MirroredBackendOptions are options for constructing a MirroredBackend
+	MirroredBackendOptions struct {
+		// Async mirrors writes in the background, instead of before returning
+		Async bool
+		// QueueSize is the number of writes waiting to be mirrored in the background
+		QueueSize int
+		// Failover reads from the secondary backend when the primary one is unavailable
+		Failover bool
+		// OnError is called when a write could not be mirrored (optional)
+		OnError func(operation string, path string, err error)
+	}
+
+	// MirroredBackend decorates a primary storage backend to replicate every write to a
+	// secondary backend, e.g. for disaster recovery. Writes succeed once done on the primary
+	// backend, with synchronous mirroring once attempted on the secondary one too: writes which
+	// could not be mirrored are reported, and retried by the next reconciliation of their prefix.
+	MirroredBackend struct {
+		Primary   storage.Backend
+		Secondary storage.Backend
+		MirroredBackendOptions
+		queue        chan mirrorWrite
+		wg           sync.WaitGroup
+		pendingMutex sync.Mutex
+		pending      map[string]struct{}
+	}
+
+	// Reconciler is implemented by backends able to repair drift between copies of the
+	// objects under a prefix
+	Reconciler interface {
+		Reconcile(prefix string) (*ReconcileReport, error)
+	}
+
+	// ReconcileReport summarizes a reconciliation of the objects under a prefix
+	ReconcileReport struct {
+		Prefix  string
+		Scanned int
+		Copied  int
+		Deleted int
+		Failed  map[string]error
+	}
+
+	// mirrorWrite is a write to replay on the secondary backend. A put without content
+	// copies the object from the primary backend.
+	mirrorWrite struct {
+		operation string
+		path      string
+		content   []byte
+	}
+)
+
+// NewMirroredBackend wraps a primary storage backend, mirroring writes to a secondary one
+func NewMirroredBackend(primary storage.Backend, secondary storage.Backend, options MirroredBackendOptions) *MirroredBackend {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultMirrorQueueSize
+	}
+	b := &MirroredBackend{
+		Primary:                primary,
+		Secondary:              secondary,
+		MirroredBackendOptions: options,
+	}
+	if b.Async {
+		b.queue = make(chan mirrorWrite, b.QueueSize)
+		go b.startMirroring()
+	}
+	return b
+}
+
+// IsUnavailableError reports whether an error shows that a backend could not be reached,
+// rather than e.g. a missing object
+func IsUnavailableError(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || IsTransientError(err)
+}
+
+// ListObjects lists all objects under prefix
+func (b *MirroredBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	objects, err := b.Primary.ListObjects(prefix)
+	if b.failover(err) {
+		return b.Secondary.ListObjects(prefix)
+	}
+	return objects, err
+}
+
+// ListObjectsWithChecksums lists all objects under prefix, with their checksums when the
+// primary backend is a ChecksumLister and available
+func (b *MirroredBackend) ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error) {
+	lister, ok := b.Primary.(ChecksumLister)
+	if !ok {
+		objects, err := b.ListObjects(prefix)
+		return objects, nil, err
+	}
+	objects, checksums, err := lister.ListObjectsWithChecksums(prefix)
+	if b.failover(err) {
+		objects, err = b.Secondary.ListObjects(prefix)
+		return objects, nil, err
+	}
+	return objects, checksums, err
+}
+
+// GetObject retrieves an object
+func (b *MirroredBackend) GetObject(path string) (storage.Object, error) {
+	object, err := b.Primary.GetObject(path)
+	if b.failover(err) {
+		return b.Secondary.GetObject(path)
+	}
+	return object, err
+}
+
+// GetObjectStream retrieves an object as a stream
+func (b *MirroredBackend) GetObjectStream(path string) (storage.Object, io.ReadSeekCloser, error) {
+	object, reader, err := GetObjectStream(b.Primary, path)
+	if b.failover(err) {
+		return GetObjectStream(b.Secondary, path)
+	}
+	return object, reader, err
+}
+
+// PutObject uploads an object to both backends
+func (b *MirroredBackend) PutObject(path string, content []byte) error {
+	if err := b.Primary.PutObject(path, content); err != nil {
+		return err
+	}
+	return b.mirror(mirrorWrite{operation: "put", path: path, content: content})
+}
+
+// PutObjectStream uploads an object to both backends from a stream. With asynchronous
+// mirroring, the object is copied from the primary backend once its turn comes.
+func (b *MirroredBackend) PutObjectStream(path string, content io.ReaderAt, size int64) error {
+	if err := PutObjectStream(b.Primary, path, content, size); err != nil {
+		return err
+	}
+	if b.Async {
+		return b.mirror(mirrorWrite{operation: "put", path: path})
+	}
+	if err := PutObjectStream(b.Secondary, path, content, size); err != nil {
+		b.reportError("put", path, err)
+	}
+	return nil
+}
+
+// DeleteObject removes an object from both backends
+func (b *MirroredBackend) DeleteObject(path string) error {
+	if err := b.Primary.DeleteObject(path); err != nil {
+		return err
+	}
+	return b.mirror(mirrorWrite{operation: "delete", path: path})
+}
+
+// Reconcile copies the objects under prefix which are missing or outdated on the secondary
+// backend, and deletes the ones missing from the primary backend unless there are none under
+// prefix. Writes under prefix which could not be mirrored are replayed either way. Nested
+// prefixes are not reconciled.
+func (b *MirroredBackend) Reconcile(prefix string) (*ReconcileReport, error) {
+	primaryObjects, err := b.Primary.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	secondaryObjects, err := b.Secondary.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	pending := b.takePending(prefix)
+
+	report := &ReconcileReport{
+		Prefix:  prefix,
+		Scanned: len(primaryObjects),
+		Failed:  map[string]error{},
+	}
+	mirrored := map[string]storage.Object{}
+	for _, object := range secondaryObjects {
+		mirrored[object.Path] = object
+	}
+	for _, object := range primaryObjects {
+		path := pathutil.Join(prefix, object.Path)
+		secondary, ok := mirrored[object.Path]
+		delete(mirrored, object.Path)
+		_, failed := pending[path]
+		delete(pending, path)
+		// the secondary copy is written after the primary one
+		if ok && !failed && !object.LastModified.After(secondary.LastModified) {
+			continue
+		}
+		if err := b.copy(path); err != nil {
+			report.Failed[path] = err
+			b.addPending(path)
+			continue
+		}
+		report.Copied++
+	}
+	for _, object := range mirrored {
+		path := pathutil.Join(prefix, object.Path)
+		_, failed := pending[path]
+		if len(primaryObjects) == 0 && !failed {
+			// e.g. the primary storage directory is not mounted, rather than every object deleted
+			continue
+		}
+		if err := b.Secondary.DeleteObject(path); err != nil {
+			report.Failed[path] = err
+			b.addPending(path)
+			continue
+		}
+		report.Deleted++
+	}
+	storageMirrorReconciledCounter.WithLabelValues("copy").Add(float64(report.Copied))
+	storageMirrorReconciledCounter.WithLabelValues("delete").Add(float64(report.Deleted))
+	return report, nil
+}
+
+// Flush waits until the writes queued so far have been mirrored
+func (b *MirroredBackend) Flush() {
+	b.wg.Wait()
+}
+
+// InvalidateObject drops an object from the cache of both backends, if any
+func (b *MirroredBackend) InvalidateObject(path string) {
+	for _, backend := range []storage.Backend{b.Primary, b.Secondary} {
+		if invalidator, ok := backend.(ObjectInvalidator); ok {
+			invalidator.InvalidateObject(path)
+		}
+	}
+}
+
+// InvalidatePrefix drops the objects under prefix from the cache of both backends, if any
+func (b *MirroredBackend) InvalidatePrefix(prefix string) {
+	for _, backend := range []storage.Backend{b.Primary, b.Secondary} {
+		if invalidator, ok := backend.(ObjectInvalidator); ok {
+			invalidator.InvalidatePrefix(prefix)
+		}
+	}
+}
+
+// Unwrap returns the primary backend
+func (b *MirroredBackend) Unwrap() storage.Backend {
+	return b.Primary
+}
+
+func (b *MirroredBackend) failover(err error) bool {
+	if err == nil || !b.Failover || !IsUnavailableError(err) {
+		return false
+	}
+	storageMirrorFailoversCounter.Inc()
+	return true
+}
+
+// mirror replays a write on the secondary backend, or queues it
+func (b *MirroredBackend) mirror(write mirrorWrite) error {
+	if !b.Async {
+		if err := b.apply(write); err != nil {
+			b.reportError(write.operation, write.path, err)
+		}
+		return nil
+	}
+	b.wg.Add(1)
+	select {
+	case b.queue <- write:
+		storageMirrorQueueGauge.Inc()
+	default:
+		b.wg.Done()
+		b.reportError(write.operation, write.path, ErrMirrorQueueFull)
+	}
+	return nil
+}
+
+func (b *MirroredBackend) startMirroring() {
+	for write := range b.queue {
+		storageMirrorQueueGauge.Dec()
+		if err := b.apply(write); err != nil {
+			b.reportError(write.operation, write.path, err)
+		}
+		b.wg.Done()
+	}
+}
+
+func (b *MirroredBackend) apply(write mirrorWrite) error {
+	switch {
+	case write.operation == "delete":
+		return b.Secondary.DeleteObject(write.path)
+	case write.content != nil:
+		return b.Secondary.PutObject(write.path, write.content)
+	}
+	return b.copy(write.path)
+}
+
+// copy copies an object from the primary backend to the secondary one
+func (b *MirroredBackend) copy(path string) error {
+	_, reader, err := GetObjectStream(b.Primary, path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	readerAt, ok := reader.(io.ReaderAt)
+	if !ok {
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		return b.Secondary.PutObject(path, content)
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	return PutObjectStream(b.Secondary, path, readerAt, size)
+}
+
+// reportError reports a write which could not be mirrored, left to the next reconciliation
+func (b *MirroredBackend) reportError(operation string, path string, err error) {
+	storageMirrorErrorsCounter.WithLabelValues(operation).Inc()
+	b.addPending(path)
+	if b.OnError != nil {
+		b.OnError(operation, path, err)
+	}
+}
+
+func (b *MirroredBackend) addPending(path string) {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+	if b.pending == nil {
+		b.pending = map[string]struct{}{}
+	}
+	b.pending[path] = struct{}{}
+}
+
+// takePending returns the paths of the objects directly under prefix which could not be mirrored,
+// forgetting them
+func (b *MirroredBackend) takePending(prefix string) map[string]struct{} {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+	paths := map[string]struct{}{}
+	for path := range b.pending {
+		if pathutil.Join(prefix, pathutil.Base(path)) == path {
+			paths[path] = struct{}{}
+			delete(b.pending, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,254 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type MirroredBackendTestSuite struct {
+	suite.Suite
+	Primary   *switchableBackend
+	Secondary *switchableBackend
+	Dir       string
+}
+
+// switchableBackend is a local backend which can be made unavailable
+type switchableBackend struct {
+	storage.Backend
+	mutex sync.Mutex
+	err   error
+}
+
+func (b *switchableBackend) fail(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.err = err
+}
+
+func (b *switchableBackend) error() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.err
+}
+
+func (b *switchableBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	if err := b.error(); err != nil {
+		return nil, err
+	}
+	return b.Backend.ListObjects(prefix)
+}
+
+func (b *switchableBackend) GetObject(path string) (storage.Object, error) {
+	if err := b.error(); err != nil {
+		return storage.Object{}, err
+	}
+	return b.Backend.GetObject(path)
+}
+
+func (b *switchableBackend) PutObject(path string, content []byte) error {
+	if err := b.error(); err != nil {
+		return err
+	}
+	return b.Backend.PutObject(path, content)
+}
+
+func (b *switchableBackend) DeleteObject(path string) error {
+	if err := b.error(); err != nil {
+		return err
+	}
+	return b.Backend.DeleteObject(path)
+}
+
+func (suite *MirroredBackendTestSuite) SetupTest() {
+	suite.Dir = suite.T().TempDir()
+	suite.Primary = &switchableBackend{Backend: storage.NewLocalFilesystemBackend(filepath.Join(suite.Dir, "primary"))}
+	suite.Secondary = &switchableBackend{Backend: storage.NewLocalFilesystemBackend(filepath.Join(suite.Dir, "secondary"))}
+}
+
+func (suite *MirroredBackendTestSuite) content(backend storage.Backend, path string) string {
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return ""
+	}
+	return string(object.Content)
+}
+
+func (suite *MirroredBackendTestSuite) TestSync() {
+	var failed []string
+	backend := NewMirroredBackend(suite.Primary, suite.Secondary, MirroredBackendOptions{
+		OnError: func(operation string, path string, err error) {
+			failed = append(failed, operation+" "+path)
+		},
+	})
+
+	suite.Nil(backend.PutObject("org/mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Equal("abcd", suite.content(suite.Secondary, "org/mychart-0.1.0.tgz"), "put mirrored")
+	suite.Nil(PutObjectStream(backend, "org/mychart-0.2.0.tgz", strings.NewReader("efgh"), 4))
+	suite.Equal("efgh", suite.content(suite.Secondary, "org/mychart-0.2.0.tgz"), "streamed put mirrored")
+	suite.Nil(backend.DeleteObject("org/mychart-0.1.0.tgz"))
+	suite.Equal("", suite.content(suite.Secondary, "org/mychart-0.1.0.tgz"), "delete mirrored")
+
+	suite.Nil(backend.PutObject("single/mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Secondary.fail(errors.New("secondary down"))
+	suite.Nil(backend.PutObject("org/mychart-0.3.0.tgz", []byte("ijkl")), "write succeeds if not mirrored")
+	suite.Equal("ijkl", suite.content(suite.Primary, "org/mychart-0.3.0.tgz"), "written to primary")
+	suite.Nil(PutObjectStream(backend, "org/mychart-0.4.0.tgz", strings.NewReader("mnop"), 4), "streamed write succeeds if not mirrored")
+	suite.Nil(backend.DeleteObject("single/mychart-0.1.0.tgz"), "delete succeeds if not mirrored")
+	suite.Equal([]string{"put org/mychart-0.3.0.tgz", "put org/mychart-0.4.0.tgz", "delete single/mychart-0.1.0.tgz"}, failed,
+		"mirroring errors reported")
+
+	// writes which could not be mirrored are replayed by the next reconciliation
+	suite.Secondary.fail(nil)
+	report, err := backend.Reconcile("org")
+	suite.Nil(err, "no error reconciling")
+	suite.Equal(2, report.Copied, "failed puts replayed")
+	suite.Equal("mnop", suite.content(suite.Secondary, "org/mychart-0.4.0.tgz"), "streamed put mirrored")
+	report, err = backend.Reconcile("single")
+	suite.Nil(err, "no error reconciling")
+	suite.Equal(1, report.Deleted, "failed delete replayed, even if the primary prefix is empty")
+	suite.Equal("", suite.content(suite.Secondary, "single/mychart-0.1.0.tgz"), "delete mirrored")
+
+	suite.Primary.fail(errors.New("primary down"))
+	suite.NotNil(backend.PutObject("org/mychart-0.5.0.tgz", []byte("qrst")), "write fails on primary error")
+	suite.Len(failed, 3, "not mirrored when primary write fails")
+}
+
+func (suite *MirroredBackendTestSuite) TestAsync() {
+	backend := NewMirroredBackend(suite.Primary, suite.Secondary, MirroredBackendOptions{Async: true})
+	suite.Nil(backend.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Nil(PutObjectStream(backend, "mychart-0.2.0.tgz", strings.NewReader("efgh"), 4))
+	suite.Nil(backend.DeleteObject("mychart-0.1.0.tgz"))
+	backend.Flush()
+	suite.Equal("", suite.content(suite.Secondary, "mychart-0.1.0.tgz"), "writes mirrored in order")
+	suite.Equal("efgh", suite.content(suite.Secondary, "mychart-0.2.0.tgz"), "streamed put copied from primary")
+
+	var failed []string
+	var mutex sync.Mutex
+	backend = NewMirroredBackend(suite.Primary, suite.Secondary, MirroredBackendOptions{
+		Async: true,
+		OnError: func(operation string, path string, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			failed = append(failed, operation+" "+path)
+		},
+	})
+	suite.Secondary.fail(errors.New("secondary down"))
+	suite.Nil(backend.PutObject("mychart-0.3.0.tgz", []byte("ijkl")), "write succeeds before being mirrored")
+	backend.Flush()
+	suite.Equal([]string{"put mychart-0.3.0.tgz"}, failed, "mirroring error reported")
+}
+
+func (suite *MirroredBackendTestSuite) TestQueueFull() {
+	backend := &MirroredBackend{
+		Primary:                suite.Primary,
+		Secondary:              suite.Secondary,
+		MirroredBackendOptions: MirroredBackendOptions{Async: true, QueueSize: 1},
+		queue:                  make(chan mirrorWrite, 1),
+	}
+	var failed []error
+	backend.OnError = func(operation string, path string, err error) {
+		failed = append(failed, err)
+	}
+	// not mirroring, so the queue fills up
+	suite.Nil(backend.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+	suite.Nil(backend.PutObject("mychart-0.2.0.tgz", []byte("efgh")), "write succeeds with full queue")
+	suite.Len(failed, 1)
+	suite.ErrorIs(failed[0], ErrMirrorQueueFull)
+	go backend.startMirroring()
+	backend.Flush()
+
+	report, err := backend.Reconcile("")
+	suite.Nil(err)
+	suite.Equal(1, report.Copied, "dropped write reconciled")
+	suite.Equal("efgh", suite.content(suite.Secondary, "mychart-0.2.0.tgz"))
+}
+
+func (suite *MirroredBackendTestSuite) TestFailover() {
+	backend := NewMirroredBackend(suite.Primary, suite.Secondary, MirroredBackendOptions{Failover: true})
+	suite.Nil(backend.PutObject("mychart-0.1.0.tgz", []byte("abcd")))
+
+	suite.Primary.fail(ErrCircuitOpen)
+	object, err := backend.GetObject("mychart-0.1.0.tgz")
+	suite.Nil(err, "read from secondary")
+	suite.Equal("abcd", string(object.Content))
+	objects, err := backend.ListObjects("")
+	suite.Nil(err, "listed from secondary")
+	suite.Len(objects, 1)
+	_, reader, err := GetObjectStream(backend, "mychart-0.1.0.tgz")
+	suite.Nil(err, "streamed from secondary")
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	suite.Equal("abcd", string(content))
+
+	suite.Primary.fail(errors.New("object not found"))
+	_, err = backend.GetObject("mychart-0.1.0.tgz")
+	suite.NotNil(err, "no failover unless the primary is unavailable")
+
+	backend.Failover = false
+	suite.Primary.fail(ErrCircuitOpen)
+	_, err = backend.GetObject("mychart-0.1.0.tgz")
+	suite.ErrorIs(err, ErrCircuitOpen, "no failover unless enabled")
+}
+
+func (suite *MirroredBackendTestSuite) TestReconcile() {
+	backend := NewMirroredBackend(suite.Primary, suite.Secondary, MirroredBackendOptions{})
+	suite.Nil(suite.Primary.PutObject("org/missing-0.1.0.tgz", []byte("abcd")))
+	suite.Nil(backend.PutObject("org/synced-0.1.0.tgz", []byte("efgh")))
+	suite.Nil(backend.PutObject("org/outdated-0.1.0.tgz", []byte("ijkl")))
+	suite.Nil(suite.Secondary.PutObject("org/deleted-0.1.0.tgz", []byte("mnop")))
+	suite.Nil(suite.Primary.PutObject("org/outdated-0.1.0.tgz", []byte("qrst")))
+	past := time.Now().Add(-time.Hour)
+	suite.Nil(os.Chtimes(filepath.Join(suite.Dir, "secondary", "org", "outdated-0.1.0.tgz"), past, past))
+
+	report, err := backend.Reconcile("org")
+	suite.Nil(err, "no error reconciling")
+	suite.Equal(3, report.Scanned)
+	suite.Equal(2, report.Copied, "missing and outdated objects copied")
+	suite.Equal(1, report.Deleted, "deleted object removed")
+	suite.Empty(report.Failed)
+	suite.Equal("abcd", suite.content(suite.Secondary, "org/missing-0.1.0.tgz"))
+	suite.Equal("qrst", suite.content(suite.Secondary, "org/outdated-0.1.0.tgz"))
+	suite.Equal("", suite.content(suite.Secondary, "org/deleted-0.1.0.tgz"))
+
+	report, err = backend.Reconcile("org")
+	suite.Nil(err)
+	suite.Equal(0, report.Copied+report.Deleted, "nothing left to reconcile")
+
+	suite.Nil(suite.Secondary.PutObject("empty/mychart-0.1.0.tgz", []byte("abcd")))
+	report, err = backend.Reconcile("empty")
+	suite.Nil(err)
+	suite.Equal(0, report.Deleted, "secondary objects kept while primary prefix is empty")
+
+	suite.Primary.fail(ErrCircuitOpen)
+	_, err = backend.Reconcile("org")
+	suite.NotNil(err, "error listing primary")
+}
+
+func TestMirroredBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(MirroredBackendTestSuite))
+}
@@ -0,0 +1,106 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"os"
+	pathutil "path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+)
+
+var (
+	// ErrPrefixListingUnsupported is returned by ListPrefixes for backends which cannot list prefixes
+	ErrPrefixListingUnsupported = errors.New("storage backend cannot list prefixes")
+)
+
+type (
+	// PrefixLister is implemented by backends able to list the prefixes nested directly under
+	// a prefix, i.e. subdirectories
+	PrefixLister interface {
+		ListPrefixes(prefix string) ([]string, error)
+	}
+)
+
+// ListPrefixes returns the names of the prefixes nested directly under prefix. The local
+// filesystem and Amazon S3 backends are supported, through decorators.
+func ListPrefixes(backend storage.Backend, prefix string) ([]string, error) {
+	for {
+		if lister, ok := backend.(PrefixLister); ok {
+			return lister.ListPrefixes(prefix)
+		}
+		unwrapper, ok := backend.(Unwrapper)
+		if !ok {
+			break
+		}
+		backend = unwrapper.Unwrap()
+	}
+	switch b := backend.(type) {
+	case *storage.LocalFilesystemBackend:
+		return listLocalPrefixes(b, prefix)
+	case *storage.AmazonS3Backend:
+		return listAmazonPrefixes(b, prefix)
+	case *AmazonS3Backend:
+		return listAmazonPrefixes(b.AmazonS3Backend, prefix)
+	}
+	return nil, ErrPrefixListingUnsupported
+}
+
+func listLocalPrefixes(b *storage.LocalFilesystemBackend, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(pathutil.Join(b.RootDirectory, prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			prefixes = append(prefixes, entry.Name())
+		}
+	}
+	return prefixes, nil
+}
+
+func listAmazonPrefixes(b *storage.AmazonS3Backend, prefix string) ([]string, error) {
+	fullPrefix := pathutil.Join(b.Prefix, prefix)
+	if fullPrefix != "" && fullPrefix != "." {
+		fullPrefix += "/"
+	} else {
+		fullPrefix = ""
+	}
+	var prefixes []string
+	err := b.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.Bucket),
+		Prefix:    aws.String(fullPrefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), fullPrefix), "/")
+			if name != "" {
+				prefixes = append(prefixes, name)
+			}
+		}
+		return true
+	})
+	return prefixes, err
+}
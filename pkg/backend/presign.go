@@ -0,0 +1,139 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	pathutil "path"
+	"strconv"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+)
+
+type (
+	// URLSigner gives short-lived URLs to download objects without going through ChartMuseum
+	URLSigner interface {
+		SignedURL(path string, expiry time.Duration) (string, error)
+	}
+
+	// Unwrapper is implemented by backends which decorate another backend
+	Unwrapper interface {
+		Unwrap() storage.Backend
+	}
+
+	// AmazonURLSigner presigns Amazon S3 (or compatible) GET requests
+	AmazonURLSigner struct {
+		Backend *storage.AmazonS3Backend
+	}
+
+	// GoogleURLSigner signs Google Cloud Storage URLs, the credentials must be able to sign
+	GoogleURLSigner struct {
+		Backend *storage.GoogleCSBackend
+	}
+
+	// LocalURLSigner signs URLs served by ChartMuseum itself, at /:repo/signed/:filename
+	// relative to BaseURL. It is meant for the local filesystem backend, where no other
+	// service can serve the objects.
+	LocalURLSigner struct {
+		Secret  []byte
+		BaseURL string
+		now     func() time.Time
+	}
+)
+
+// NewURLSigner returns a URLSigner for the backend decorated by backend, nil if it cannot sign URLs
+func NewURLSigner(backend storage.Backend) URLSigner {
+	for {
+		unwrapper, ok := backend.(Unwrapper)
+		if !ok {
+			break
+		}
+		backend = unwrapper.Unwrap()
+	}
+	switch b := backend.(type) {
+	case *storage.AmazonS3Backend:
+		return &AmazonURLSigner{Backend: b}
+	case *AmazonS3Backend:
+		return &AmazonURLSigner{Backend: b.AmazonS3Backend}
+	case *storage.GoogleCSBackend:
+		return &GoogleURLSigner{Backend: b}
+	}
+	return nil
+}
+
+// SignedURL presigns a GET request for an object
+func (signer *AmazonURLSigner) SignedURL(path string, expiry time.Duration) (string, error) {
+	req, _ := signer.Backend.Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(signer.Backend.Bucket),
+		Key:    aws.String(pathutil.Join(signer.Backend.Prefix, path)),
+	})
+	return req.Presign(expiry)
+}
+
+// SignedURL signs a GET URL for an object
+func (signer *GoogleURLSigner) SignedURL(path string, expiry time.Duration) (string, error) {
+	return signer.Backend.Client.SignedURL(pathutil.Join(signer.Backend.Prefix, path), &gcs.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expiry),
+		Scheme:  gcs.SigningSchemeV4,
+	})
+}
+
+// NewLocalURLSigner creates a new LocalURLSigner
+func NewLocalURLSigner(secret []byte, baseURL string) *LocalURLSigner {
+	return &LocalURLSigner{
+		Secret:  secret,
+		BaseURL: baseURL,
+		now:     time.Now,
+	}
+}
+
+// SignedURL signs the URL of an object, valid until expiry has elapsed
+func (signer *LocalURLSigner) SignedURL(path string, expiry time.Duration) (string, error) {
+	expires := strconv.FormatInt(signer.now().Add(expiry).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", signer.signature(path, expires))
+	repo, filename := pathutil.Split(path)
+	signedPath := pathutil.Join("/", repo, "signed", filename)
+	return fmt.Sprintf("%s%s?%s", signer.BaseURL, signedPath, query.Encode()), nil
+}
+
+// Verify reports whether the expires and signature query parameters of a signed URL are
+// valid for an object, and have not expired
+func (signer *LocalURLSigner) Verify(path string, expires string, signature string) bool {
+	timestamp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || signer.now().Unix() > timestamp {
+		return false
+	}
+	expected := signer.signature(path, expires)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (signer *LocalURLSigner) signature(path string, expires string) string {
+	mac := hmac.New(sha256.New, signer.Secret)
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
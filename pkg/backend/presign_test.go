@@ -0,0 +1,78 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type URLSignerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *URLSignerTestSuite) TestNewURLSigner() {
+	suite.T().Setenv("AWS_ACCESS_KEY_ID", "key")
+	suite.T().Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	amazon := storage.NewAmazonS3Backend("mybucket", "prefix", "us-east-1", "", "")
+	signer := NewURLSigner(NewResilientBackend(amazon, ResilientBackendOptions{}))
+	suite.IsType(&AmazonURLSigner{}, signer, "decorated backend unwrapped")
+
+	signedURL, err := signer.SignedURL("org/mychart-0.1.0.tgz", time.Minute)
+	suite.Nil(err, "no error presigning S3 URL")
+	parsed, err := url.Parse(signedURL)
+	suite.Nil(err, "valid presigned URL")
+	suite.True(strings.HasSuffix(parsed.Path, "/prefix/org/mychart-0.1.0.tgz"), "presigned object key")
+	suite.Equal("60", parsed.Query().Get("X-Amz-Expires"), "presigned URL expiry")
+	suite.IsType(&AmazonURLSigner{}, NewURLSigner(NewAmazonS3Backend(amazon)), "ETag listing backend")
+
+	suite.Nil(NewURLSigner(storage.NewLocalFilesystemBackend(suite.T().TempDir())), "local backend cannot presign")
+}
+
+func (suite *URLSignerTestSuite) TestLocalURLSigner() {
+	now := time.Now()
+	signer := NewLocalURLSigner([]byte("secret"), "https://charts.example.com")
+	signer.now = func() time.Time { return now }
+
+	signedURL, err := signer.SignedURL("org/mychart-0.1.0.tgz", time.Minute)
+	suite.Nil(err, "no error signing URL")
+	suite.True(strings.HasPrefix(signedURL, "https://charts.example.com/org/signed/mychart-0.1.0.tgz?"), "signed URL path")
+	parsed, err := url.Parse(signedURL)
+	suite.Nil(err, "valid signed URL")
+	expires, signature := parsed.Query().Get("expires"), parsed.Query().Get("signature")
+	suite.True(signer.Verify("org/mychart-0.1.0.tgz", expires, signature), "valid signature")
+	suite.False(signer.Verify("org/mychart-0.2.0.tgz", expires, signature), "signature bound to path")
+	suite.False(signer.Verify("org/mychart-0.1.0.tgz", expires+"0", signature), "signature bound to expiry")
+	suite.False(signer.Verify("org/mychart-0.1.0.tgz", "invalid", signature), "invalid expiry")
+	suite.False(NewLocalURLSigner([]byte("other"), "").Verify("org/mychart-0.1.0.tgz", expires, signature), "signature bound to secret")
+
+	now = now.Add(2 * time.Minute)
+	suite.False(signer.Verify("org/mychart-0.1.0.tgz", expires, signature), "expired signature")
+
+	signedURL, err = signer.SignedURL("mychart-0.1.0.tgz", time.Minute)
+	suite.Nil(err, "no error signing URL")
+	suite.True(strings.HasPrefix(signedURL, "https://charts.example.com/signed/mychart-0.1.0.tgz?"), "signed URL path without repo")
+}
+
+func TestURLSignerTestSuite(t *testing.T) {
+	suite.Run(t, new(URLSignerTestSuite))
+}
@@ -0,0 +1,257 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/chartmuseum/storage"
+)
+
+var (
+	// ErrTimeout is returned when a storage operation does not complete within the timeout
+	ErrTimeout = errors.New("storage operation timed out")
+)
+
+const (
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 5 * time.Second
+)
+
+type (
+	// ResilientBackendOptions are options for constructing a ResilientBackend
+	ResilientBackendOptions struct {
+		// Timeout bounds each attempt of an operation (0 for no timeout)
+		Timeout time.Duration
+		// Retries is the number of times an operation is retried after a transient error
+		Retries int
+		// RetryBackoff is the delay before the first retry, doubled for each retry up to MaxRetryBackoff
+		RetryBackoff    time.Duration
+		MaxRetryBackoff time.Duration
+		// Breaker stops calling the backend while it keeps failing with transient errors (optional)
+		Breaker *CircuitBreaker
+		// Transient reports whether an error is worth retrying, IsTransientError if nil
+		Transient func(err error) bool
+	}
+
+	// ResilientBackend decorates a storage backend with per-operation timeouts, retries of
+	// transient errors with exponential backoff, a circuit breaker and per-operation metrics.
+	// Backends do not support cancellation, so an operation which timed out keeps running
+	// in the background until the backend returns.
+	ResilientBackend struct {
+		Backend storage.Backend
+		ResilientBackendOptions
+	}
+)
+
+// NewResilientBackend wraps a storage backend
+func NewResilientBackend(backend storage.Backend, options ResilientBackendOptions) *ResilientBackend {
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultRetryBackoff
+	}
+	if options.MaxRetryBackoff <= 0 {
+		options.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	if options.Transient == nil {
+		options.Transient = IsTransientError
+	}
+	return &ResilientBackend{
+		Backend:                 backend,
+		ResilientBackendOptions: options,
+	}
+}
+
+// IsTransientError reports whether an error is likely to go away on retry: timeouts,
+// network errors, and server-side or throttling errors of HTTP-based backends
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		return requestErr.StatusCode() >= 500 || requestErr.StatusCode() == 429
+	}
+	return false
+}
+
+// ListObjects lists all objects under prefix
+func (b *ResilientBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	return call(b, "list", func() ([]storage.Object, error) {
+		return b.Backend.ListObjects(prefix)
+	})
+}
+
+// ListObjectsWithChecksums lists all objects under prefix, with their checksums when the
+// decorated backend is a ChecksumLister
+func (b *ResilientBackend) ListObjectsWithChecksums(prefix string) ([]storage.Object, map[string]string, error) {
+	lister, ok := b.Backend.(ChecksumLister)
+	if !ok {
+		objects, err := b.ListObjects(prefix)
+		return objects, nil, err
+	}
+	type listing struct {
+		objects   []storage.Object
+		checksums map[string]string
+	}
+	result, err := call(b, "list", func() (listing, error) {
+		objects, checksums, err := lister.ListObjectsWithChecksums(prefix)
+		return listing{objects, checksums}, err
+	})
+	return result.objects, result.checksums, err
+}
+
+// GetObject retrieves an object
+func (b *ResilientBackend) GetObject(path string) (storage.Object, error) {
+	return call(b, "get", func() (storage.Object, error) {
+		return b.Backend.GetObject(path)
+	})
+}
+
+// PutObject uploads an object
+func (b *ResilientBackend) PutObject(path string, content []byte) error {
+	_, err := call(b, "put", func() (struct{}, error) {
+		return struct{}{}, b.Backend.PutObject(path, content)
+	})
+	return err
+}
+
+// DeleteObject removes an object
+func (b *ResilientBackend) DeleteObject(path string) error {
+	_, err := call(b, "delete", func() (struct{}, error) {
+		return struct{}{}, b.Backend.DeleteObject(path)
+	})
+	return err
+}
+
+// GetObjectStream retrieves an object as a stream, the timeout only applies to opening the stream
+func (b *ResilientBackend) GetObjectStream(path string) (storage.Object, io.ReadSeekCloser, error) {
+	type stream struct {
+		object storage.Object
+		reader io.ReadSeekCloser
+	}
+	result, err := callWithCleanup(b, "get", func() (stream, error) {
+		object, reader, err := GetObjectStream(b.Backend, path)
+		return stream{object, reader}, err
+	}, func(result stream) {
+		result.reader.Close()
+	})
+	return result.object, result.reader, err
+}
+
+// PutObjectStream uploads an object from a stream
+func (b *ResilientBackend) PutObjectStream(path string, content io.ReaderAt, size int64) error {
+	_, err := call(b, "put", func() (struct{}, error) {
+		return struct{}{}, PutObjectStream(b.Backend, path, content, size)
+	})
+	return err
+}
+
+// call runs an operation through the circuit breaker, retrying transient errors
+func call[T any](b *ResilientBackend, operation string, fn func() (T, error)) (T, error) {
+	return callWithCleanup(b, operation, fn, nil)
+}
+
+// callWithCleanup is call for operations whose result holds resources (e.g. an open stream),
+// cleanup releases the result of an attempt which succeeds after it timed out
+func callWithCleanup[T any](b *ResilientBackend, operation string, fn func() (T, error), cleanup func(T)) (T, error) {
+	var result T
+	if b.Breaker != nil {
+		if err := b.Breaker.Allow(); err != nil {
+			storageErrorsCounter.WithLabelValues(operation).Inc()
+			return result, err
+		}
+	}
+
+	start := time.Now()
+	backoff := b.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		result, err = attemptWithTimeout(b.Timeout, fn, cleanup)
+		if err == nil || attempt >= b.Retries || !b.Transient(err) {
+			break
+		}
+		storageRetriesCounter.WithLabelValues(operation).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > b.MaxRetryBackoff {
+			backoff = b.MaxRetryBackoff
+		}
+	}
+	storageDurationHistogram.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		storageErrorsCounter.WithLabelValues(operation).Inc()
+	}
+	if b.Breaker != nil {
+		// errors such as missing objects show that the backend is reachable
+		if b.Transient(err) {
+			b.Breaker.Record(err)
+		} else {
+			b.Breaker.Record(nil)
+		}
+	}
+	return result, err
+}
+
+// attemptWithTimeout runs fn, giving up after timeout (if any). The result of fn returning
+// after the timeout is discarded, released by cleanup (if any).
+func attemptWithTimeout[T any](timeout time.Duration, fn func() (T, error), cleanup func(T)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type outcome struct {
+		result T
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := fn()
+		done <- outcome{result, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		if cleanup != nil {
+			go func() {
+				if o := <-done; o.err == nil {
+					cleanup(o.result)
+				}
+			}()
+		}
+		var result T
+		return result, ErrTimeout
+	}
+}
+
+// Unwrap returns the decorated backend
+func (b *ResilientBackend) Unwrap() storage.Backend {
+	return b.Backend
+}
@@ -0,0 +1,199 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type ResilientBackendTestSuite struct {
+	suite.Suite
+}
+
+// scriptedBackend returns the scripted errors in turn, then succeeds
+type scriptedBackend struct {
+	storage.Backend
+	mutex  sync.Mutex
+	errors []error
+	calls  int
+	delay  time.Duration
+}
+
+func (b *scriptedBackend) next() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls++
+	if len(b.errors) == 0 {
+		return nil
+	}
+	err := b.errors[0]
+	b.errors = b.errors[1:]
+	return err
+}
+
+func (b *scriptedBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	time.Sleep(b.delay)
+	if err := b.next(); err != nil {
+		return nil, err
+	}
+	return []storage.Object{{Path: "mychart-0.1.0.tgz"}}, nil
+}
+
+func (b *scriptedBackend) GetObject(path string) (storage.Object, error) {
+	if err := b.next(); err != nil {
+		return storage.Object{}, err
+	}
+	return storage.Object{Path: path, Content: []byte("content")}, nil
+}
+
+func (b *scriptedBackend) PutObject(path string, content []byte) error {
+	return b.next()
+}
+
+func (b *scriptedBackend) DeleteObject(path string) error {
+	return b.next()
+}
+
+func (b *scriptedBackend) Calls() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.calls
+}
+
+// slowStreamer opens streams after a delay, and counts the streams closed
+type slowStreamer struct {
+	scriptedBackend
+	closed int32
+}
+
+func (b *slowStreamer) GetObjectStream(path string) (storage.Object, io.ReadSeekCloser, error) {
+	time.Sleep(b.delay)
+	return storage.Object{Path: path}, &closeCounter{bytes.NewReader([]byte("content")), &b.closed}, nil
+}
+
+func (b *slowStreamer) PutObjectStream(path string, content io.ReaderAt, size int64) error {
+	return b.next()
+}
+
+type closeCounter struct {
+	*bytes.Reader
+	closed *int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+var errTransient = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+func (suite *ResilientBackendTestSuite) TestRetries() {
+	scripted := &scriptedBackend{errors: []error{errTransient, errTransient}}
+	backend := NewResilientBackend(scripted, ResilientBackendOptions{Retries: 2, RetryBackoff: time.Millisecond})
+
+	objects, err := backend.ListObjects("")
+	suite.Nil(err, "transient errors retried")
+	suite.Len(objects, 1, "objects returned after retries")
+	suite.Equal(3, scripted.Calls(), "called until success")
+
+	scripted = &scriptedBackend{errors: []error{errTransient, errTransient}}
+	backend = NewResilientBackend(scripted, ResilientBackendOptions{Retries: 1, RetryBackoff: time.Millisecond})
+	suite.Equal(errTransient, backend.PutObject("mychart-0.1.0.tgz", []byte{}), "error returned once retries are exhausted")
+	suite.Equal(2, scripted.Calls(), "retried once")
+
+	scripted = &scriptedBackend{errors: []error{os.ErrNotExist}}
+	backend = NewResilientBackend(scripted, ResilientBackendOptions{Retries: 3, RetryBackoff: time.Millisecond})
+	_, err = backend.GetObject("mychart-0.1.0.tgz")
+	suite.Equal(os.ErrNotExist, err, "permanent error returned")
+	suite.Equal(1, scripted.Calls(), "permanent error not retried")
+}
+
+func (suite *ResilientBackendTestSuite) TestTimeout() {
+	scripted := &scriptedBackend{delay: 200 * time.Millisecond}
+	backend := NewResilientBackend(scripted, ResilientBackendOptions{Timeout: 10 * time.Millisecond})
+
+	start := time.Now()
+	_, err := backend.ListObjects("")
+	suite.Equal(ErrTimeout, err, "slow operation times out")
+	suite.Less(time.Since(start), 200*time.Millisecond, "caller not blocked until the backend returns")
+
+	scripted = &scriptedBackend{}
+	backend = NewResilientBackend(scripted, ResilientBackendOptions{Timeout: time.Second})
+	_, err = backend.ListObjects("")
+	suite.Nil(err, "fast operation succeeds")
+
+	streamer := &slowStreamer{scriptedBackend: scriptedBackend{delay: 50 * time.Millisecond}}
+	backend = NewResilientBackend(streamer, ResilientBackendOptions{Timeout: 10 * time.Millisecond})
+	_, reader, err := backend.GetObjectStream("mychart-0.1.0.tgz")
+	suite.Equal(ErrTimeout, err, "slow stream times out")
+	suite.Nil(reader, "no stream returned on timeout")
+	suite.Eventually(func() bool {
+		return atomic.LoadInt32(&streamer.closed) == 1
+	}, time.Second, 10*time.Millisecond, "stream opened after the timeout closed")
+}
+
+func (suite *ResilientBackendTestSuite) TestCircuitBreaker() {
+	scripted := &scriptedBackend{errors: []error{errTransient, errTransient, os.ErrNotExist}}
+	backend := NewResilientBackend(scripted, ResilientBackendOptions{Breaker: NewCircuitBreaker(2, time.Minute)})
+
+	suite.Equal(errTransient, backend.DeleteObject("a.tgz"), "first failure returned")
+	suite.Equal(errTransient, backend.DeleteObject("a.tgz"), "second failure returned")
+	suite.Equal(ErrCircuitOpen, backend.DeleteObject("a.tgz"), "circuit open after threshold")
+	suite.Equal(2, scripted.Calls(), "backend not called while open")
+
+	scripted = &scriptedBackend{errors: []error{errTransient, os.ErrNotExist, errTransient}}
+	backend = NewResilientBackend(scripted, ResilientBackendOptions{Breaker: NewCircuitBreaker(2, time.Minute)})
+	for i := 0; i < 3; i++ {
+		backend.DeleteObject("a.tgz")
+	}
+	suite.False(backend.Breaker.Open(), "permanent errors do not open the circuit")
+}
+
+func (suite *ResilientBackendTestSuite) TestListObjectsWithChecksums() {
+	scripted := &scriptedBackend{}
+	backend := NewResilientBackend(scripted, ResilientBackendOptions{})
+	objects, checksums, err := backend.ListObjectsWithChecksums("")
+	suite.Nil(err, "no error listing without checksum support")
+	suite.Len(objects, 1, "objects listed")
+	suite.Nil(checksums, "no checksums without checksum support")
+}
+
+func (suite *ResilientBackendTestSuite) TestIsTransientError() {
+	suite.False(IsTransientError(nil), "nil")
+	suite.True(IsTransientError(ErrTimeout), "timeout")
+	suite.True(IsTransientError(errTransient), "network error")
+	suite.False(IsTransientError(os.ErrNotExist), "missing object")
+	suite.True(IsTransientError(awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 503, "")), "server error")
+	suite.True(IsTransientError(awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 429, "")), "throttling")
+	suite.False(IsTransientError(awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, "")), "not found")
+}
+
+func TestResilientBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(ResilientBackendTestSuite))
+}
@@ -0,0 +1,293 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathutil "path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/chartmuseum/storage"
+)
+
+// PartialUploadPrefix starts the name of the temporary files written by streamed uploads to the
+// local filesystem, left behind if the server stops mid-upload
+const PartialUploadPrefix = ".upload-"
+
+var (
+	// ErrStatUnsupported is returned by StatObject for backends which cannot read the metadata
+	// of an object without its content
+	ErrStatUnsupported = errors.New("storage backend cannot read object metadata")
+)
+
+type (
+	// ObjectStreamer is implemented by backends able to read and write objects without
+	// holding their whole content in memory
+	ObjectStreamer interface {
+		// GetObjectStream returns the object at path without its content, and a reader of its content
+		GetObjectStream(path string) (storage.Object, io.ReadSeekCloser, error)
+		// PutObjectStream writes size bytes of content at path
+		PutObjectStream(path string, content io.ReaderAt, size int64) error
+	}
+
+	// ObjectStater is implemented by backends able to return an object without its content,
+	// from its metadata only
+	ObjectStater interface {
+		StatObject(path string) (storage.Object, error)
+	}
+
+	// bufferedObject is the content of an object read by a backend which cannot stream
+	bufferedObject struct {
+		*bytes.Reader
+	}
+
+	// amazonObjectReader reads an S3 object, seeking by starting a ranged request
+	amazonObjectReader struct {
+		backend *storage.AmazonS3Backend
+		key     string
+		size    int64
+		offset  int64
+		body    io.ReadCloser
+	}
+)
+
+// GetObjectStream returns an object without its content, and a reader of its content. The local
+// filesystem and Amazon S3 backends are read as a stream, other backends are read in memory.
+func GetObjectStream(backend storage.Backend, path string) (storage.Object, io.ReadSeekCloser, error) {
+	switch b := backend.(type) {
+	case ObjectStreamer:
+		return b.GetObjectStream(path)
+	case *storage.LocalFilesystemBackend:
+		return getLocalObjectStream(b, path)
+	case *storage.AmazonS3Backend:
+		return getAmazonObjectStream(b, path)
+	case *AmazonS3Backend:
+		return getAmazonObjectStream(b.AmazonS3Backend, path)
+	}
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return object, nil, err
+	}
+	reader := bufferedObject{bytes.NewReader(object.Content)}
+	object.Content = nil
+	return object, reader, nil
+}
+
+// StatObject returns the object at path without its content, from its metadata only. The local
+// filesystem and Amazon S3 backends are supported, through decorators.
+func StatObject(backend storage.Backend, path string) (storage.Object, error) {
+	for {
+		if stater, ok := backend.(ObjectStater); ok {
+			return stater.StatObject(path)
+		}
+		unwrapper, ok := backend.(Unwrapper)
+		if !ok {
+			break
+		}
+		backend = unwrapper.Unwrap()
+	}
+	switch b := backend.(type) {
+	case *storage.LocalFilesystemBackend:
+		return statLocalObject(b, path)
+	case *storage.AmazonS3Backend:
+		return statAmazonObject(b, path)
+	case *AmazonS3Backend:
+		return statAmazonObject(b.AmazonS3Backend, path)
+	}
+	return storage.Object{Path: path}, ErrStatUnsupported
+}
+
+// PutObjectStream writes size bytes of content at path. The local filesystem and Amazon S3 backends
+// are written from a stream, other backends from memory.
+func PutObjectStream(backend storage.Backend, path string, content io.ReaderAt, size int64) error {
+	switch b := backend.(type) {
+	case ObjectStreamer:
+		return b.PutObjectStream(path, content, size)
+	case *storage.LocalFilesystemBackend:
+		return putLocalObjectStream(b, path, content, size)
+	case *storage.AmazonS3Backend:
+		return putAmazonObjectStream(b, path, content, size)
+	case *AmazonS3Backend:
+		return putAmazonObjectStream(b.AmazonS3Backend, path, content, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(content, 0, size), buf); err != nil {
+		return err
+	}
+	return backend.PutObject(path, buf)
+}
+
+func getLocalObjectStream(b *storage.LocalFilesystemBackend, path string) (storage.Object, io.ReadSeekCloser, error) {
+	object := storage.Object{Path: path}
+	file, err := os.Open(pathutil.Join(b.RootDirectory, path))
+	if err != nil {
+		return object, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return object, nil, err
+	}
+	object.LastModified = info.ModTime()
+	return object, file, nil
+}
+
+func statLocalObject(b *storage.LocalFilesystemBackend, path string) (storage.Object, error) {
+	object := storage.Object{Path: path}
+	info, err := os.Stat(pathutil.Join(b.RootDirectory, path))
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = info.ModTime()
+	return object, nil
+}
+
+// putLocalObjectStream writes to a temporary file renamed once complete, so that a partial
+// object is never read
+func putLocalObjectStream(b *storage.LocalFilesystemBackend, path string, content io.ReaderAt, size int64) error {
+	fullpath := pathutil.Join(b.RootDirectory, path)
+	folderPath := pathutil.Dir(fullpath)
+	if _, err := os.Stat(folderPath); os.IsNotExist(err) {
+		// same permissions as the local filesystem backend
+		if err := os.MkdirAll(folderPath, 0774); err != nil {
+			return err
+		}
+		if err := os.Chmod(folderPath, 0774); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(folderPath, PartialUploadPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(content, 0, size))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fullpath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func getAmazonObjectStream(b *storage.AmazonS3Backend, path string) (storage.Object, io.ReadSeekCloser, error) {
+	object := storage.Object{Path: path}
+	key := pathutil.Join(b.Prefix, path)
+	head, err := b.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return object, nil, err
+	}
+	object.LastModified = aws.TimeValue(head.LastModified)
+	return object, &amazonObjectReader{
+		backend: b,
+		key:     key,
+		size:    aws.Int64Value(head.ContentLength),
+	}, nil
+}
+
+func statAmazonObject(b *storage.AmazonS3Backend, path string) (storage.Object, error) {
+	object := storage.Object{Path: path}
+	head, err := b.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(pathutil.Join(b.Prefix, path)),
+	})
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = aws.TimeValue(head.LastModified)
+	return object, nil
+}
+
+func putAmazonObjectStream(b *storage.AmazonS3Backend, path string, content io.ReaderAt, size int64) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(pathutil.Join(b.Prefix, path)),
+		Body:   io.NewSectionReader(content, 0, size),
+	}
+	if b.SSE != "" {
+		input.ServerSideEncryption = aws.String(b.SSE)
+	}
+	_, err := b.Uploader.Upload(input)
+	return err
+}
+
+func (r *amazonObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		output, err := r.backend.Client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(r.backend.Bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.body = output.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *amazonObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != r.offset {
+		// the next read starts another request at the new offset
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *amazonObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Close does nothing, the content is in memory
+func (r bufferedObject) Close() error {
+	return nil
+}
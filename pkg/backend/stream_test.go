@@ -0,0 +1,126 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type StreamTestSuite struct {
+	suite.Suite
+	Dir     string
+	Storage *storage.LocalFilesystemBackend
+}
+
+// bufferedBackend hides the type of a local backend, so that it is not streamed
+type bufferedBackend struct {
+	storage.Backend
+}
+
+func (suite *StreamTestSuite) SetupTest() {
+	suite.Dir = suite.T().TempDir()
+	suite.Storage = storage.NewLocalFilesystemBackend(suite.Dir)
+}
+
+func (suite *StreamTestSuite) readStream(backend storage.Backend, path string) string {
+	object, reader, err := GetObjectStream(backend, path)
+	suite.Nil(err, "no error opening stream")
+	defer reader.Close()
+	suite.Equal(path, object.Path, "path of streamed object")
+	suite.False(object.LastModified.IsZero(), "last modified time of streamed object")
+	suite.Nil(object.Content, "content not read in memory")
+	_, err = reader.Seek(2, io.SeekStart)
+	suite.Nil(err, "no error seeking stream")
+	content, err := io.ReadAll(reader)
+	suite.Nil(err, "no error reading stream")
+	return string(content)
+}
+
+func (suite *StreamTestSuite) TestLocalFilesystem() {
+	content := strings.NewReader("abcdef")
+	suite.Nil(PutObjectStream(suite.Storage, "org/mychart-0.1.0.tgz", content, 4), "no error writing stream")
+	object, err := suite.Storage.GetObject("org/mychart-0.1.0.tgz")
+	suite.Nil(err, "streamed object stored")
+	suite.Equal("abcd", string(object.Content), "size bytes of content stored")
+	files, err := os.ReadDir(filepath.Join(suite.Dir, "org"))
+	suite.Nil(err)
+	suite.Len(files, 1, "no temporary file left")
+
+	suite.Equal("cd", suite.readStream(suite.Storage, "org/mychart-0.1.0.tgz"), "content read from offset")
+
+	_, _, err = GetObjectStream(suite.Storage, "missing-0.1.0.tgz")
+	suite.NotNil(err, "error on missing object")
+}
+
+func (suite *StreamTestSuite) TestBufferedFallback() {
+	backend := bufferedBackend{suite.Storage}
+	suite.Nil(PutObjectStream(backend, "mychart-0.1.0.tgz", strings.NewReader("abcdef"), 4), "no error writing from memory")
+	suite.Equal("cd", suite.readStream(backend, "mychart-0.1.0.tgz"), "content read from memory")
+
+	_, _, err := GetObjectStream(backend, "missing-0.1.0.tgz")
+	suite.NotNil(err, "error on missing object")
+}
+
+func (suite *StreamTestSuite) TestDecorators() {
+	counting := &countingBackend{Backend: suite.Storage}
+	cache, err := NewDiskCacheBackend(counting, suite.T().TempDir(), 10)
+	suite.Nil(err, "no error creating disk cache")
+	backend := NewResilientBackend(cache, ResilientBackendOptions{})
+
+	suite.Nil(PutObjectStream(backend, "mychart-0.1.0.tgz", strings.NewReader("abcd"), 4), "no error writing through decorators")
+	suite.Equal("cd", suite.readStream(backend, "mychart-0.1.0.tgz"), "content read on miss")
+	suite.Equal("cd", suite.readStream(backend, "mychart-0.1.0.tgz"), "content read on hit")
+	suite.Equal(int64(4), cache.Size(), "streamed object cached")
+	suite.Equal(1, counting.gets, "storage read once")
+
+	suite.Nil(PutObjectStream(backend, "mychart-0.1.0.tgz", strings.NewReader("efgh"), 4), "no error overwriting")
+	suite.Equal("gh", suite.readStream(backend, "mychart-0.1.0.tgz"), "overwritten object not served from cache")
+}
+
+func (suite *StreamTestSuite) TestStatObject() {
+	suite.Nil(suite.Storage.PutObject("mychart-0.1.0.tgz", []byte("abcd")), "no error writing object")
+	cache, err := NewDiskCacheBackend(suite.Storage, suite.T().TempDir(), 10)
+	suite.Nil(err, "no error creating disk cache")
+	for name, backend := range map[string]storage.Backend{
+		"local":     suite.Storage,
+		"decorated": NewResilientBackend(cache, ResilientBackendOptions{}),
+		"encrypted": &EncryptedBackend{Backend: suite.Storage},
+	} {
+		object, err := StatObject(backend, "mychart-0.1.0.tgz")
+		suite.Nil(err, "no error reading metadata of %s object", name)
+		suite.Equal("mychart-0.1.0.tgz", object.Path, "path of %s object", name)
+		suite.False(object.LastModified.IsZero(), "last modified time of %s object", name)
+		suite.Empty(object.Content, "content of %s object not read", name)
+	}
+	suite.Equal(int64(0), cache.Size(), "content not read through decorators")
+
+	_, err = StatObject(suite.Storage, "missing-0.1.0.tgz")
+	suite.NotNil(err, "error on missing object")
+	_, err = StatObject(bufferedBackend{suite.Storage}, "mychart-0.1.0.tgz")
+	suite.Equal(ErrStatUnsupported, err, "unsupported backend")
+}
+
+func TestStreamTestSuite(t *testing.T) {
+	suite.Run(t, new(StreamTestSuite))
+}
@@ -0,0 +1,125 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+type (
+	// Bus is a generic interface for broadcasting messages to all the subscribers,
+	// used to notify peer replicas of changes
+	Bus interface {
+		Publish(message []byte) error
+		Subscribe(handler func(message []byte)) error
+		Close() error
+	}
+
+	// MemoryBus implements the Bus interface within a single process
+	MemoryBus struct {
+		mutex    sync.RWMutex
+		handlers []func(message []byte)
+	}
+
+	// RedisBus implements the Bus interface using Redis pub/sub
+	RedisBus struct {
+		Client  redis.UniversalClient
+		Channel string
+		mutex   sync.Mutex
+		pubsubs []*redis.PubSub
+	}
+)
+
+// NewMemoryBus creates a new MemoryBus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+// Publish calls all the handlers with the message
+func (bus *MemoryBus) Publish(message []byte) error {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	for _, handler := range bus.handlers {
+		handler(message)
+	}
+	return nil
+}
+
+// Subscribe adds a handler called for each message published
+func (bus *MemoryBus) Subscribe(handler func(message []byte)) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.handlers = append(bus.handlers, handler)
+	return nil
+}
+
+// Close removes all the handlers
+func (bus *MemoryBus) Close() error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.handlers = nil
+	return nil
+}
+
+// NewRedisBus creates a new RedisBus publishing on a channel, sharing the client of a RedisStore
+func NewRedisBus(client redis.UniversalClient, channel string) *RedisBus {
+	return &RedisBus{
+		Client:  client,
+		Channel: channel,
+	}
+}
+
+// Publish publishes the message on the channel
+func (bus *RedisBus) Publish(message []byte) error {
+	return bus.Client.Publish(bus.Channel, message).Err()
+}
+
+// Subscribe subscribes to the channel and calls the handler for each message, in order
+func (bus *RedisBus) Subscribe(handler func(message []byte)) error {
+	pubsub := bus.Client.Subscribe(bus.Channel)
+	// wait for the subscription to be confirmed, so no message published afterwards is missed
+	_, err := pubsub.Receive()
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+	bus.mutex.Lock()
+	bus.pubsubs = append(bus.pubsubs, pubsub)
+	bus.mutex.Unlock()
+	go func() {
+		for msg := range pubsub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+// Close closes all the subscriptions
+func (bus *RedisBus) Close() error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	var err error
+	for _, pubsub := range bus.pubsubs {
+		if closeErr := pubsub.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	bus.pubsubs = nil
+	return err
+}
@@ -0,0 +1,63 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BusTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BusTestSuite) TestMemoryBus() {
+	bus := NewMemoryBus()
+	var received [][]byte
+	for i := 0; i < 2; i++ {
+		err := bus.Subscribe(func(message []byte) {
+			received = append(received, message)
+		})
+		suite.Nil(err, "able to subscribe")
+	}
+
+	err := bus.Publish([]byte("1"))
+	suite.Nil(err, "able to publish")
+	suite.Equal([][]byte{[]byte("1"), []byte("1")}, received, "message received by all subscribers")
+
+	err = bus.Close()
+	suite.Nil(err, "able to close")
+	err = bus.Publish([]byte("2"))
+	suite.Nil(err, "able to publish after close")
+	suite.Len(received, 2, "no message received after close")
+}
+
+func (suite *BusTestSuite) TestRedisBus() {
+	store := NewRedisStoreWithOptions(RedisStoreOptions{
+		Addrs:     []string{"localhost:6379"},
+		KeyPrefix: "chartmuseum:",
+	})
+	bus := NewRedisBus(store.UniversalClient, "chartmuseum:notifications")
+	suite.Equal("chartmuseum:notifications", bus.Channel, "channel set")
+	suite.Nil(bus.Close(), "able to close without subscriptions")
+	store.Client.Close()
+}
+
+func TestBusTestSuite(t *testing.T) {
+	suite.Run(t, new(BusTestSuite))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrNotFound is returned when getting or deleting a missing key
+	ErrNotFound = errors.New("key not found")
+
+	diskStoreBucket = []byte("cache")
+)
+
+type (
+	// DiskStore implements the Store interface, used for storing objects in a bbolt file on local disk
+	DiskStore struct {
+		DB *bolt.DB
+	}
+)
+
+// NewDiskStore opens (or creates) a DiskStore at path
+func NewDiskStore(path string) (*DiskStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(diskStoreBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DiskStore{DB: db}, nil
+}
+
+// diskStoreKey prefixes the key, since bbolt keys cannot be empty (the key of the root repo)
+func diskStoreKey(key string) []byte {
+	return []byte("/" + key)
+}
+
+// Get returns an object at key
+func (store *DiskStore) Get(key string) ([]byte, error) {
+	content := []byte{}
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(diskStoreBucket).Get(diskStoreKey(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		// the value is only valid during the transaction
+		content = append(content, value...)
+		return nil
+	})
+	return content, err
+}
+
+// Set saves a new value for key
+func (store *DiskStore) Set(key string, contents []byte) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskStoreBucket).Put(diskStoreKey(key), contents)
+	})
+}
+
+// Delete removes a key from the store
+func (store *DiskStore) Delete(key string) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(diskStoreBucket)
+		if bucket.Get(diskStoreKey(key)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete(diskStoreKey(key))
+	})
+}
+
+// Close closes the database file
+func (store *DiskStore) Close() error {
+	return store.DB.Close()
+}
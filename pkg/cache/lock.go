@@ -0,0 +1,198 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrLockTimeout is returned when a lock could not be acquired in time
+	ErrLockTimeout = errors.New("timed out waiting for lock")
+
+	// releaseScript deletes the lock key only if it still holds the token of the owner,
+	// so that a lock which expired and was acquired by another replica is left alone
+	releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+	// renewScript extends the expiration of the lock key only if it still holds the token of the owner
+	renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+)
+
+const (
+	defaultLockTimeout       = 30 * time.Second
+	defaultLockTTL           = time.Minute
+	defaultLockRetryInterval = 50 * time.Millisecond
+)
+
+type (
+	// Locker is a generic interface for mutual exclusion on keys, across replicas
+	// when backed by a shared service
+	Locker interface {
+		// Lock waits until the lock of key is acquired, it returns a function releasing it
+		Lock(key string) (unlock func() error, err error)
+	}
+
+	// MemoryLocker implements the Locker interface within a single process
+	MemoryLocker struct {
+		Timeout time.Duration
+		mutex   sync.Mutex
+		locks   map[string]chan struct{}
+	}
+
+	// RedisLocker implements the Locker interface using Redis keys set with NX and an expiration,
+	// renewed while the lock is held
+	RedisLocker struct {
+		Client    redis.UniversalClient
+		KeyPrefix string
+		// TTL bounds how long a lock is held if its owner dies without releasing it,
+		// the lock is renewed every third of it until released
+		TTL           time.Duration
+		Timeout       time.Duration
+		RetryInterval time.Duration
+	}
+)
+
+// NewMemoryLocker creates a new MemoryLocker, waiting at most timeout (0 for the default)
+func NewMemoryLocker(timeout time.Duration) *MemoryLocker {
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	return &MemoryLocker{
+		Timeout: timeout,
+		locks:   map[string]chan struct{}{},
+	}
+}
+
+// Lock acquires the lock of key
+func (locker *MemoryLocker) Lock(key string) (func() error, error) {
+	deadline := time.NewTimer(locker.Timeout)
+	defer deadline.Stop()
+	for {
+		locker.mutex.Lock()
+		held, ok := locker.locks[key]
+		if !ok {
+			released := make(chan struct{})
+			locker.locks[key] = released
+			locker.mutex.Unlock()
+			var once sync.Once
+			return func() error {
+				once.Do(func() {
+					locker.mutex.Lock()
+					delete(locker.locks, key)
+					locker.mutex.Unlock()
+					close(released)
+				})
+				return nil
+			}, nil
+		}
+		locker.mutex.Unlock()
+		select {
+		case <-held:
+		case <-deadline.C:
+			return nil, ErrLockTimeout
+		}
+	}
+}
+
+// NewRedisLocker creates a new RedisLocker, sharing the client of a RedisStore
+func NewRedisLocker(client redis.UniversalClient, keyPrefix string, ttl time.Duration, timeout time.Duration) *RedisLocker {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	return &RedisLocker{
+		Client:        client,
+		KeyPrefix:     keyPrefix,
+		TTL:           ttl,
+		Timeout:       timeout,
+		RetryInterval: defaultLockRetryInterval,
+	}
+}
+
+// Lock acquires the lock of key
+func (locker *RedisLocker) Lock(key string) (func() error, error) {
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+	key = locker.KeyPrefix + "lock:" + key
+	deadline := time.Now().Add(locker.Timeout)
+	for {
+		ok, err := locker.Client.SetNX(key, token, locker.TTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			released := make(chan struct{})
+			go locker.renew(key, token, released)
+			var once sync.Once
+			return func() error {
+				once.Do(func() { close(released) })
+				return releaseScript.Run(locker.Client, []string{key}, token).Err()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(locker.RetryInterval)
+	}
+}
+
+// renew extends the expiration of a lock until it is released, or lost to another owner
+func (locker *RedisLocker) renew(key string, token string, released <-chan struct{}) {
+	ticker := time.NewTicker(locker.TTL / 3)
+	defer ticker.Stop()
+	ttl := locker.TTL.Milliseconds()
+	for {
+		select {
+		case <-released:
+			return
+		case <-ticker.C:
+			renewed, err := renewScript.Run(locker.Client, []string{key}, token, ttl).Int64()
+			if err == nil && renewed == 0 {
+				return
+			}
+		}
+	}
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockTestSuite struct {
+	suite.Suite
+	RedisMock *miniredis.Miniredis
+	Lockers   map[string]Locker
+}
+
+func (suite *LockTestSuite) SetupSuite() {
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	suite.RedisMock = redisMock
+
+	suite.Lockers = map[string]Locker{
+		"Memory": NewMemoryLocker(100 * time.Millisecond),
+		"Redis": NewRedisLocker(NewRedisStore(redisMock.Addr(), "", 0).UniversalClient, "chartmuseum:",
+			time.Minute, 100*time.Millisecond),
+	}
+}
+
+func (suite *LockTestSuite) TearDownSuite() {
+	suite.RedisMock.Close()
+}
+
+func (suite *LockTestSuite) TestAllLockers() {
+	for key, locker := range suite.Lockers {
+		unlock, err := locker.Lock("org1/mychart")
+		suite.Nil(err, fmt.Sprintf("able to acquire a lock using %s locker", key))
+
+		_, err = locker.Lock("org1/mychart")
+		suite.Equal(ErrLockTimeout, err, fmt.Sprintf("timeout acquiring a held lock using %s locker", key))
+
+		otherUnlock, err := locker.Lock("org1/otherchart")
+		suite.Nil(err, fmt.Sprintf("able to acquire another lock using %s locker", key))
+		suite.Nil(otherUnlock(), fmt.Sprintf("able to release another lock using %s locker", key))
+
+		suite.Nil(unlock(), fmt.Sprintf("able to release a lock using %s locker", key))
+		unlock, err = locker.Lock("org1/mychart")
+		suite.Nil(err, fmt.Sprintf("able to acquire a released lock using %s locker", key))
+		suite.Nil(unlock(), fmt.Sprintf("able to release a lock again using %s locker", key))
+	}
+}
+
+func (suite *LockTestSuite) TestMutualExclusion() {
+	for key, locker := range suite.Lockers {
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		holders, maxHolders := 0, 0
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := locker.Lock("mychart")
+				if err != nil {
+					return
+				}
+				mutex.Lock()
+				holders++
+				if holders > maxHolders {
+					maxHolders = holders
+				}
+				mutex.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+				unlock()
+			}()
+		}
+		wg.Wait()
+		suite.Equal(1, maxHolders, fmt.Sprintf("lock held by one goroutine at a time using %s locker", key))
+	}
+}
+
+func (suite *LockTestSuite) TestRedisLockExpiration() {
+	locker := suite.Lockers["Redis"]
+	unlock, err := locker.Lock("expiring")
+	suite.Nil(err, "able to acquire a lock")
+	suite.True(suite.RedisMock.Exists("chartmuseum:lock:expiring"), "lock key prefixed")
+
+	// the lock of a dead owner expires and can be acquired by another one
+	suite.RedisMock.FastForward(2 * time.Minute)
+	otherUnlock, err := locker.Lock("expiring")
+	suite.Nil(err, "able to acquire an expired lock")
+
+	suite.Nil(unlock(), "able to release an expired lock")
+	suite.True(suite.RedisMock.Exists("chartmuseum:lock:expiring"), "lock of the new owner kept")
+	suite.Nil(otherUnlock(), "able to release the lock of the new owner")
+	suite.False(suite.RedisMock.Exists("chartmuseum:lock:expiring"), "lock released")
+}
+
+func (suite *LockTestSuite) TestRedisLockRenewal() {
+	locker := NewRedisLocker(NewRedisStore(suite.RedisMock.Addr(), "", 0).UniversalClient, "chartmuseum:",
+		300*time.Millisecond, 100*time.Millisecond)
+	unlock, err := locker.Lock("renewed")
+	suite.Nil(err, "able to acquire a lock")
+
+	// the lock is renewed while held, past its TTL
+	suite.RedisMock.FastForward(250 * time.Millisecond)
+	suite.Eventually(func() bool {
+		return suite.RedisMock.TTL("chartmuseum:lock:renewed") > 100*time.Millisecond
+	}, time.Second, 10*time.Millisecond, "lock renewed")
+	suite.RedisMock.FastForward(250 * time.Millisecond)
+	suite.True(suite.RedisMock.Exists("chartmuseum:lock:renewed"), "lock held past its TTL")
+
+	// a lock lost to another owner is not renewed
+	suite.RedisMock.Set("chartmuseum:lock:renewed", "other owner")
+	suite.RedisMock.SetTTL("chartmuseum:lock:renewed", 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	suite.Equal(50*time.Millisecond, suite.RedisMock.TTL("chartmuseum:lock:renewed"), "lock of another owner not renewed")
+	suite.Nil(unlock(), "able to release a lost lock")
+	suite.True(suite.RedisMock.Exists("chartmuseum:lock:renewed"), "lock of another owner kept")
+	suite.RedisMock.Del("chartmuseum:lock:renewed")
+}
+
+func TestLockTestSuite(t *testing.T) {
+	suite.Run(t, new(LockTestSuite))
+}
@@ -17,42 +17,139 @@ limitations under the License.
 package cache
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/go-redis/redis"
 )
 
 type (
 	// RedisStore implements the Store interface, used for storing objects in-memory
 	RedisStore struct {
+		// Client is the standalone or Sentinel client, nil with Redis Cluster
 		Client *redis.Client
+		// UniversalClient is the client in every mode
+		UniversalClient redis.UniversalClient
+		KeyPrefix       string
+		TTL             time.Duration
+	}
+
+	// RedisStoreOptions are options for constructing a RedisStore
+	RedisStoreOptions struct {
+		// Addrs are the address of the server, the addresses of the sentinels when MasterName
+		// is set, or the addresses of (some of) the nodes when Cluster is set
+		Addrs []string
+		// MasterName is the name of the master monitored by the sentinels
+		MasterName string
+		// Cluster connects to a Redis Cluster
+		Cluster  bool
+		Password string
+		// DB is not supported by Redis Cluster
+		DB int
+		// KeyPrefix is prepended to every key, so that several instances can share a server
+		KeyPrefix string
+		// TTL is the expiration of the keys, 0 for no expiration
+		TTL       time.Duration
+		TLSConfig *tls.Config
 	}
 )
 
 // NewRedisStore creates a new RedisStore
 func NewRedisStore(addr string, password string, db int) *RedisStore {
-	store := &RedisStore{}
-	redisClientOptions := &redis.Options{
-		Addr:     addr,
+	return NewRedisStoreWithOptions(RedisStoreOptions{
+		Addrs:    []string{addr},
 		Password: password,
 		DB:       db,
+	})
+}
+
+// NewRedisStoreWithOptions creates a new RedisStore with options
+func NewRedisStoreWithOptions(options RedisStoreOptions) *RedisStore {
+	store := &RedisStore{
+		KeyPrefix: options.KeyPrefix,
+		TTL:       options.TTL,
+	}
+	switch {
+	case options.Cluster:
+		store.UniversalClient = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     options.Addrs,
+			Password:  options.Password,
+			TLSConfig: options.TLSConfig,
+		})
+	case options.MasterName != "":
+		store.Client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    options.MasterName,
+			SentinelAddrs: options.Addrs,
+			Password:      options.Password,
+			DB:            options.DB,
+			TLSConfig:     options.TLSConfig,
+		})
+	default:
+		var addr string
+		if len(options.Addrs) > 0 {
+			addr = options.Addrs[0]
+		}
+		store.Client = redis.NewClient(&redis.Options{
+			Addr:      addr,
+			Password:  options.Password,
+			DB:        options.DB,
+			TLSConfig: options.TLSConfig,
+		})
+	}
+	if store.Client != nil {
+		store.UniversalClient = store.Client
 	}
-	store.Client = redis.NewClient(redisClientOptions)
 	return store
 }
 
+// NewRedisTLSConfig creates the TLS configuration used to connect to Redis. The CA certificate
+// is optional (system roots are used otherwise), and so is the client key pair.
+func NewRedisTLSConfig(caCert string, cert string, key string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caCert != "" {
+		content, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", caCert)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("both a client certificate and key are required")
+		}
+		keypair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{keypair}
+	}
+	return tlsConfig, nil
+}
+
 // Get returns an object at key
 func (store *RedisStore) Get(key string) ([]byte, error) {
-	content, err := store.Client.Get(key).Bytes()
+	content, err := store.UniversalClient.Get(store.KeyPrefix + key).Bytes()
 	return content, err
 }
 
 // Set saves a new value for key
 func (store *RedisStore) Set(key string, contents []byte) error {
-	err := store.Client.Set(key, contents, 0).Err()
+	err := store.UniversalClient.Set(store.KeyPrefix+key, contents, store.TTL).Err()
 	return err
 }
 
 // Delete removes a key from the store
 func (store *RedisStore) Delete(key string) error {
-	err := store.Client.Del(key).Err()
+	err := store.UniversalClient.Del(store.KeyPrefix + key).Err()
 	return err
 }
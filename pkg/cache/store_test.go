@@ -18,7 +18,11 @@ package cache
 
 import (
 	"fmt"
+	"os"
+	pathutil "path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/stretchr/testify/suite"
@@ -26,8 +30,9 @@ import (
 
 type StoreTestSuite struct {
 	suite.Suite
-	RedisMock *miniredis.Miniredis
-	Stores    map[string]Store
+	RedisMock     *miniredis.Miniredis
+	TempDirectory string
+	Stores        map[string]Store
 }
 
 func (suite *StoreTestSuite) SetupSuite() {
@@ -37,10 +42,23 @@ func (suite *StoreTestSuite) SetupSuite() {
 	suite.Nil(err, "able to create miniredis instance")
 	suite.RedisMock = redisMock
 	suite.Stores["Redis"] = NewRedisStore(redisMock.Addr(), "", 0)
+	suite.Stores["RedisWithOptions"] = NewRedisStoreWithOptions(RedisStoreOptions{
+		Addrs:     []string{redisMock.Addr()},
+		KeyPrefix: "chartmuseum:",
+		TTL:       time.Hour,
+	})
+
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/chartmuseum-cache/%s", timestamp)
+	diskStore, err := NewDiskStore(pathutil.Join(suite.TempDirectory, "cache.db"))
+	suite.Nil(err, "able to create disk store")
+	suite.Stores["Disk"] = diskStore
 }
 
 func (suite *StoreTestSuite) TearDownSuite() {
 	suite.RedisMock.Close()
+	suite.Stores["Disk"].(*DiskStore).Close()
+	os.RemoveAll(suite.TempDirectory)
 }
 
 func (suite *StoreTestSuite) TestAllStores() {
@@ -67,13 +85,80 @@ func (suite *StoreTestSuite) TestAllStores() {
 		suite.Equal([]byte{}, value, fmt.Sprintf("error getting deleted key using %s store", key))
 
 		// in Redis, "A key is ignored if it does not exist"
-		if key != "Redis" {
+		if !strings.HasPrefix(key, "Redis") {
 			err = store.Delete("x")
 			suite.NotNil(err, fmt.Sprintf("error deleting already-deleted key using %s store", key))
 		}
 	}
 }
 
+func (suite *StoreTestSuite) TestDiskStorePersistence() {
+	path := pathutil.Join(suite.TempDirectory, "persistent.db")
+	store, err := NewDiskStore(path)
+	suite.Nil(err, "able to create disk store")
+	suite.Nil(store.Set("org1/repoa", []byte("1")), "able to set a key")
+	suite.Nil(store.Set("", []byte("2")), "able to set the empty key")
+	suite.Nil(store.Close(), "able to close disk store")
+
+	store, err = NewDiskStore(path)
+	suite.Nil(err, "able to reopen disk store")
+	defer store.Close()
+	value, err := store.Get("org1/repoa")
+	suite.Nil(err, "able to get a key after reopening")
+	suite.Equal([]byte("1"), value, "value persisted")
+	value, err = store.Get("")
+	suite.Nil(err, "able to get the empty key after reopening")
+	suite.Equal([]byte("2"), value, "value of the empty key persisted")
+}
+
+func (suite *StoreTestSuite) TestRedisKeyPrefixAndTTL() {
+	store := suite.Stores["RedisWithOptions"]
+	err := store.Set("org1/repoa", []byte("1"))
+	suite.Nil(err, "able to set a key")
+
+	suite.True(suite.RedisMock.Exists("chartmuseum:org1/repoa"), "key prefixed")
+	suite.False(suite.RedisMock.Exists("org1/repoa"), "key not stored without prefix")
+	suite.Equal(time.Hour, suite.RedisMock.TTL("chartmuseum:org1/repoa"), "key expires")
+
+	suite.RedisMock.FastForward(2 * time.Hour)
+	_, err = store.Get("org1/repoa")
+	suite.NotNil(err, "error getting expired key")
+}
+
+func (suite *StoreTestSuite) TestRedisStoreModes() {
+	store := NewRedisStore("localhost:6379", "", 0)
+	suite.NotNil(store.Client, "standalone client created")
+	suite.Equal(store.Client, store.UniversalClient, "same client in every mode")
+	store.Client.Close()
+
+	store = NewRedisStoreWithOptions(RedisStoreOptions{
+		Addrs:      []string{"localhost:26379"},
+		MasterName: "mymaster",
+	})
+	suite.NotNil(store.Client, "sentinel client created")
+	store.Client.Close()
+
+	store = NewRedisStoreWithOptions(RedisStoreOptions{
+		Addrs:   []string{"localhost:7000", "localhost:7001"},
+		Cluster: true,
+	})
+	suite.Nil(store.Client, "no standalone client with Redis Cluster")
+	suite.NotNil(store.UniversalClient, "cluster client created")
+	store.UniversalClient.Close()
+}
+
+func (suite *StoreTestSuite) TestRedisTLSConfig() {
+	tlsConfig, err := NewRedisTLSConfig("", "", "", true)
+	suite.Nil(err, "no error without certificates")
+	suite.True(tlsConfig.InsecureSkipVerify, "insecure skip verify set")
+
+	_, err = NewRedisTLSConfig("nonexistent.pem", "", "", false)
+	suite.NotNil(err, "error with missing CA certificate")
+
+	_, err = NewRedisTLSConfig("", "client.crt", "", false)
+	suite.NotNil(err, "error with certificate but no key")
+}
+
 func TestStoreTestSuite(t *testing.T) {
 	suite.Run(t, new(StoreTestSuite))
 }
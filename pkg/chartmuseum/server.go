@@ -22,10 +22,14 @@ import (
 
 	"github.com/chartmuseum/storage"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	"helm.sh/chartmuseum/pkg/cache"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
 	mt "helm.sh/chartmuseum/pkg/chartmuseum/server/multitenant"
+	"helm.sh/chartmuseum/pkg/metadb"
+	"helm.sh/chartmuseum/pkg/protection"
+	"helm.sh/chartmuseum/pkg/retention"
 )
 
 type (
@@ -85,6 +89,54 @@ type (
 		// which means that the GetChart will increase its latency , be careful to enable this .
 		AlwaysRegenerateIndex bool
 		JSONIndex             bool
+		// ShardedIndex splits the statefile and the external cache entry per chart name,
+		// so that a single upload does not rewrite the whole index of large repositories
+		ShardedIndex bool
+		// UseSidecars writes a metadata sidecar next to each uploaded package,
+		// so that reindexing does not need to download the packages
+		UseSidecars bool
+		// MetadataStore is an optional embedded database holding the chart versions of each repo,
+		// used to load indexes and page through charts
+		MetadataStore metadb.Store
+		// CacheMaxTenants and CacheTenantIdleTimeout bound the tenants held in memory,
+		// evicting the least recently used ones
+		CacheMaxTenants        int
+		CacheTenantIdleTimeout time.Duration
+		// Bus notifies the peer replicas of index changes, so that they do not wait for CacheInterval
+		Bus cache.Bus
+		// Locker serializes uploads of the same file and per-chart limits across replicas
+		Locker cache.Locker
+		// StaleWhileRevalidate serves the cached index while regenerating it in the background
+		StaleWhileRevalidate bool
+		// URLSigner redirects chart downloads to signed URLs, valid for SignedURLExpiry
+		URLSigner       cm_backend.URLSigner
+		SignedURLExpiry time.Duration
+		// MirrorReconciler repairs drift between mirrored storage backends every ReconcileInterval
+		MirrorReconciler  cm_backend.Reconciler
+		ReconcileInterval time.Duration
+		// ScrubInterval is the interval at which the digests of the indexed chart packages are
+		// verified again, at most ScrubRateLimit per second, quarantining mismatches with ScrubQuarantine
+		ScrubInterval   time.Duration
+		ScrubRateLimit  int
+		ScrubQuarantine bool
+		// RetentionPolicy deletes chart versions on upload and every RetentionInterval,
+		// only logging them with RetentionDryRun
+		RetentionPolicy   *retention.Policy
+		RetentionInterval time.Duration
+		RetentionDryRun   bool
+		// GCInterval is the interval at which the garbage modified at least GCMinAge ago is deleted:
+		// orphaned provenance files and sidecars, partial uploads, and unknown files with GCUnknown
+		GCInterval time.Duration
+		GCMinAge   time.Duration
+		GCUnknown  bool
+		GCDryRun   bool
+		// Trash moves deleted chart versions to the trash of their repo, purged after TrashPurgeAfter
+		Trash           bool
+		TrashPurgeAfter time.Duration
+		// ProtectionPolicy prevents the chart versions matching its rules from being overwritten or deleted
+		ProtectionPolicy *protection.Policy
+		// AllowUnlock enables the route unlocking chart versions locked through the API
+		AllowUnlock bool
 	}
 
 	// Server is a generic interface for web servers
@@ -148,11 +200,37 @@ func NewServer(options ServerOptions) (Server, error) {
 		PerChartLimit:          options.PerChartLimit,
 		ArtifactHubRepoID:      options.ArtifactHubRepoID,
 		WebTemplatePath:        options.WebTemplatePath,
+		CacheMaxTenants:        options.CacheMaxTenants,
+		CacheTenantIdleTimeout: options.CacheTenantIdleTimeout,
+		Bus:                    options.Bus,
+		Locker:                 options.Locker,
+		StaleWhileRevalidate:   options.StaleWhileRevalidate,
+		URLSigner:              options.URLSigner,
+		SignedURLExpiry:        options.SignedURLExpiry,
+		MirrorReconciler:       options.MirrorReconciler,
+		ReconcileInterval:      options.ReconcileInterval,
+		ScrubInterval:          options.ScrubInterval,
+		ScrubRateLimit:         options.ScrubRateLimit,
+		ScrubQuarantine:        options.ScrubQuarantine,
+		RetentionPolicy:        options.RetentionPolicy,
+		RetentionInterval:      options.RetentionInterval,
+		RetentionDryRun:        options.RetentionDryRun,
+		GCInterval:             options.GCInterval,
+		GCMinAge:               options.GCMinAge,
+		GCUnknown:              options.GCUnknown,
+		GCDryRun:               options.GCDryRun,
+		Trash:                  options.Trash,
+		TrashPurgeAfter:        options.TrashPurgeAfter,
+		ProtectionPolicy:       options.ProtectionPolicy,
+		AllowUnlock:            options.AllowUnlock,
 		// Deprecated options
 		// EnforceSemver2 - see https://github.com/helm/chartmuseum/issues/485 for more info
 		EnforceSemver2:        options.EnforceSemver2,
 		AlwaysRegenerateIndex: options.AlwaysRegenerateIndex,
 		JSONIndex:             options.JSONIndex,
+		ShardedIndex:          options.ShardedIndex,
+		UseSidecars:           options.UseSidecars,
+		MetadataStore:         options.MetadataStore,
 	})
 
 	return server, err
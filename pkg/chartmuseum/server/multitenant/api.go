@@ -17,15 +17,20 @@ limitations under the License.
 package multitenant
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	pathutil "path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/chartmuseum/storage"
 	"github.com/gin-gonic/gin"
 
+	"helm.sh/chartmuseum/pkg/cache"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
@@ -41,6 +46,16 @@ func (server *MultiTenantServer) getAllCharts(log cm_logger.LoggingFn, repo stri
 	if offset == 0 && limit == -1 {
 		return indexFile.Entries, nil
 	}
+	if server.MetadataStore != nil {
+		// the metadata store pages through chart names without sorting all of them
+		if found, _ := server.MetadataStore.HasTenant(repo); found {
+			result, storeErr := server.MetadataStore.ListCharts(repo, offset, limit)
+			if storeErr == nil {
+				return result, nil
+			}
+			server.logMetadataStoreError(log, repo, storeErr)
+		}
+	}
 	result := map[string]helm_repo.ChartVersions{}
 	var keys []string
 	for k := range indexFile.Entries {
@@ -85,6 +100,12 @@ func (server *MultiTenantServer) getChartVersion(log cm_logger.LoggingFn, repo s
 }
 
 func (server *MultiTenantServer) deleteChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	if err := server.checkProtection(repo, name, version, http.StatusForbidden); err != nil {
+		return err
+	}
+	if server.Trash {
+		return server.trashChartVersion(log, repo, name, version)
+	}
 	filename := pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(name, version))
 	log(cm_logger.DebugLevel, "Deleting package from storage",
 		"package", filename,
@@ -95,6 +116,7 @@ func (server *MultiTenantServer) deleteChartVersion(log cm_logger.LoggingFn, rep
 	}
 	provFilename := pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(name, version))
 	server.StorageBackend.DeleteObject(provFilename) // ignore error here, may be no prov file
+	server.deleteSidecar(repo, filename)
 	return nil
 }
 
@@ -113,18 +135,26 @@ func (server *MultiTenantServer) getChartFileName(log cm_logger.LoggingFn, repo
 	return split[1], nil
 }
 
-func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, repo string, content []byte, force bool) (string, *HTTPError) {
-	var filename string
-
-	filename, err := cm_repo.ChartPackageFilenameFromContent(content)
+// uploadChartPackageStream stores a chart package read from content (e.g. a temporary file), and
+// returns its filename and chart version
+func (server *MultiTenantServer) uploadChartPackageStream(log cm_logger.LoggingFn, repo string, content *io.SectionReader, force bool) (string, *helm_repo.ChartVersion, *HTTPError) {
+	filename, chartVersion, err := chartPackageFromReader(content)
 	if err != nil {
-		return filename, &HTTPError{http.StatusBadRequest, err.Error()}
+		return filename, nil, &HTTPError{http.StatusBadRequest, err.Error()}
 	}
 
 	if pathutil.Base(filename) != filename {
 		// Name wants to break out of current directory
-		return filename, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
+		return filename, nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
+	}
+
+	// hold the lock from the overwrite check to the put, so concurrent uploads of the same version
+	// (possibly on other replicas) cannot both succeed
+	unlock, err := server.lockObject(log, repo, filename)
+	if err != nil {
+		return filename, nil, lockHTTPError(err)
 	}
+	defer unlock()
 
 	// we should ensure that whether chart is existed even if the `overwrite` option is set
 	// For `overwrite` option , here will increase one `storage.GetObject` than before ; others should be equalvarant with the previous version.
@@ -135,30 +165,43 @@ func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, rep
 		found = true
 		// For those no-overwrite servers, return the Conflict error.
 		if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-			return filename, &HTTPError{http.StatusConflict, "file already exists"}
+			return filename, nil, &HTTPError{http.StatusConflict, "file already exists"}
+		}
+		// even the `overwrite` servers never overwrite protected chart versions
+		if err := server.checkProtection(repo, chartVersion.Name, chartVersion.Version, http.StatusConflict); err != nil {
+			return filename, nil, err
 		}
 		// continue with the `overwrite` servers
 	}
 
 	limitReached, err := server.checkStorageLimit(repo, filename, force)
 	if err != nil {
-		return filename, &HTTPError{http.StatusInternalServerError, err.Error()}
+		return filename, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 	}
 	if limitReached {
-		return filename, &HTTPError{http.StatusInsufficientStorage, "repo has reached storage limit"}
+		return filename, nil, &HTTPError{http.StatusInsufficientStorage, "repo has reached storage limit"}
 	}
 	log(cm_logger.DebugLevel, "Adding package to storage",
 		"package", filename,
 	)
-	if err := server.PutWithLimit(&gin.Context{}, log, repo, filename, content); err != nil {
-		return filename, &HTTPError{http.StatusInternalServerError, err.Error()}
+	if err := server.putWithLimit(&gin.Context{}, log, repo, filename, content, chartVersion); err != nil {
+		return filename, nil, lockHTTPError(err)
 	}
 	if found {
 		// here is a fake conflict error for outside call
 		// In order to not add another return `bool` check (API Compatibility)
-		return filename, &HTTPError{http.StatusConflict, ""}
+		return filename, chartVersion, &HTTPError{http.StatusConflict, ""}
+	}
+	return filename, chartVersion, nil
+}
+
+// chartPackageFromReader returns the filename and chart version of a chart package
+func chartPackageFromReader(content *io.SectionReader) (string, *helm_repo.ChartVersion, error) {
+	chartVersion, err := cm_repo.ChartVersionFromReader(io.NewSectionReader(content, 0, content.Size()), time.Now())
+	if err != nil {
+		return "", nil, err
 	}
-	return filename, nil
+	return cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version), chartVersion, nil
 }
 
 func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, repo string, content []byte, force bool) *HTTPError {
@@ -172,11 +215,19 @@ func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, r
 		return &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
 	}
 
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err = server.StorageBackend.GetObject(pathutil.Join(repo, filename))
-		if err == nil {
+	unlock, err := server.lockObject(log, repo, filename)
+	if err != nil {
+		return lockHTTPError(err)
+	}
+	defer unlock()
+
+	if _, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename)); err == nil {
+		if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
 			return &HTTPError{http.StatusConflict, "file already exists"}
 		}
+		if err := server.checkFileProtection(repo, filename, http.StatusConflict); err != nil {
+			return err
+		}
 	}
 	limitReached, err := server.checkStorageLimit(repo, filename, force)
 	if err != nil {
@@ -219,31 +270,67 @@ func (server *MultiTenantServer) checkStorageLimit(repo string, filename string,
 	return false, nil
 }
 
-func extractFromChart(content []byte) (name string, version string, err error) {
-	cv, err := cm_repo.ChartVersionFromStorageObject(storage.Object{
-		Content: content,
-	})
+// lockObject acquires the lock of an object of a repo, shared by all replicas using the same locker
+func (server *MultiTenantServer) lockObject(log cm_logger.LoggingFn, repo string, filename string) (func(), error) {
+	return server.lock(log, "object/"+pathutil.Join(repo, filename))
+}
+
+func (server *MultiTenantServer) lock(log cm_logger.LoggingFn, key string) (func(), error) {
+	release, err := server.Locker.Lock(key)
 	if err != nil {
-		return "", "", err
+		log(cm_logger.WarnLevel, "Unable to acquire lock",
+			"key", key,
+			"error", err.Error(),
+		)
+		return nil, err
 	}
-	return cv.Metadata.Name, cv.Metadata.Version, nil
+	return func() {
+		if err := release(); err != nil {
+			log(cm_logger.WarnLevel, "Unable to release lock",
+				"key", key,
+				"error", err.Error(),
+			)
+		}
+	}, nil
+}
+
+// lockHTTPError returns a conflict when another upload holds the lock for too long
+func lockHTTPError(err error) *HTTPError {
+	if errors.Is(err, cache.ErrLockTimeout) {
+		return &HTTPError{http.StatusConflict, "another upload of this file is in progress"}
+	}
+	return &HTTPError{http.StatusInternalServerError, err.Error()}
 }
 
 func (server *MultiTenantServer) PutWithLimit(ctx *gin.Context, log cm_logger.LoggingFn, repo string,
 	filename string, content []byte,
+) error {
+	return server.putWithLimit(ctx, log, repo, filename, io.NewSectionReader(bytes.NewReader(content), 0, int64(len(content))), nil)
+}
+
+// putWithLimit stores a file read from content, removing the oldest version of the chart when
+// the per-chart limit is reached (chartVersion is read from content if nil)
+func (server *MultiTenantServer) putWithLimit(ctx *gin.Context, log cm_logger.LoggingFn, repo string,
+	filename string, content *io.SectionReader, chartVersion *helm_repo.ChartVersion,
 ) error {
 	if server.ChartLimits == nil {
 		log(cm_logger.DebugLevel, "PutWithLimit: per-chart-limit not set")
-		return server.StorageBackend.PutObject(pathutil.Join(repo, filename), content)
+		return server.putObject(log, repo, filename, content, chartVersion)
 	}
 	limit := server.ChartLimits.Limit
-	name, _, err := extractFromChart(content)
+	if chartVersion == nil {
+		var err error
+		if _, chartVersion, err = chartPackageFromReader(content); err != nil {
+			return err
+		}
+	}
+	name := chartVersion.Name
+	// lock the backend storage resource to always get the correct one
+	unlock, err := server.lock(log, "limit/"+pathutil.Join(repo, name))
 	if err != nil {
 		return err
 	}
-	// lock the backend storage resource to always get the correct one
-	server.ChartLimits.Lock()
-	defer server.ChartLimits.Unlock()
+	defer unlock()
 	// clean the oldest chart(both index and storage)
 	// storage cache first
 	objs, err := server.StorageBackend.ListObjects(repo)
@@ -261,27 +348,43 @@ func (server *MultiTenantServer) PutWithLimit(ctx *gin.Context, log cm_logger.Lo
 	}
 	if len(newObjs) < limit {
 		log(cm_logger.DebugLevel, "PutWithLimit", "current objects", len(newObjs))
-		return server.StorageBackend.PutObject(pathutil.Join(repo, filename), content)
+		return server.putObject(log, repo, filename, content, chartVersion)
 	}
 	sort.Slice(newObjs, func(i, j int) bool {
 		return newObjs[i].LastModified.Unix() < newObjs[j].LastModified.Unix()
 	})
+	// protected chart versions are never cleaned, the limit is exceeded if they are all protected
+	oldest := -1
+	for i, obj := range newObjs {
+		_, v := cm_repo.GetExactChartNameVersion(strings.TrimSuffix(obj.Path, "."+cm_repo.ChartPackageFileExtension))
+		if server.checkProtection(repo, name, v, http.StatusForbidden) == nil {
+			oldest = i
+			break
+		}
+	}
+	if oldest < 0 {
+		log(cm_logger.DebugLevel, "PutWithLimit", "no unprotected chart to clean", len(newObjs))
+		return server.putObject(log, repo, filename, content, chartVersion)
+	}
 
-	log(cm_logger.DebugLevel, "PutWithLimit", "old chart", newObjs[0].Path)
+	log(cm_logger.DebugLevel, "PutWithLimit", "old chart", newObjs[oldest].Path)
 	// should we support delete N out-of-date charts ?
 	// and should we must ensure the delete operation is ok ?
-	o, err := server.StorageBackend.GetObject(pathutil.Join(repo, newObjs[0].Path))
+	o, err := server.StorageBackend.GetObject(pathutil.Join(repo, newObjs[oldest].Path))
 	if err != nil {
 		return err
 	}
-	if err := server.StorageBackend.DeleteObject(pathutil.Join(repo, newObjs[0].Path)); err != nil {
+	if err := server.StorageBackend.DeleteObject(pathutil.Join(repo, newObjs[oldest].Path)); err != nil {
 		return fmt.Errorf("PutWithLimit: clean the old chart: %w", err)
 	}
+	// ignore error here, may be no prov file
+	server.StorageBackend.DeleteObject(pathutil.Join(repo, newObjs[oldest].Path) + ".prov")
+	server.deleteSidecar(repo, newObjs[oldest].Path)
 	cv, err := cm_repo.ChartVersionFromStorageObject(o)
 	if err != nil {
 		return fmt.Errorf("PutWithLimit: extract chartversion from storage object: %w", err)
 	}
-	if err = server.StorageBackend.PutObject(pathutil.Join(repo, filename), content); err != nil {
+	if err = server.putObject(log, repo, filename, content, chartVersion); err != nil {
 		return fmt.Errorf("PutWithLimit: put new chart: %w", err)
 	}
 	go server.emitEvent(ctx, repo, deleteChart, &helm_repo.ChartVersion{
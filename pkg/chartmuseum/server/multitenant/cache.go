@@ -33,15 +33,19 @@ _.-'  \        ( \___
 */
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"errors"
+	"maps"
 	pathutil "path"
+	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
@@ -58,10 +62,26 @@ type (
 		RepoName  string         `json:"a"`
 		RepoIndex *cm_repo.Index `json:"b"`
 		RepoLock  sync.RWMutex
+		// CacheShards tracks the shards saved in the external cache store when sharding is enabled
+		CacheShards *shardDigests `json:"-"`
+		// Refreshed is set once the index has been compared with storage
+		Refreshed bool `json:"-"`
 	}
 
+	// memoryCacheStore holds cache entries in memory and tracks the tenants in use, least recently used
+	// first. Tenants are evicted past MaxTenants or once idle for IdleTimeout, when either is set.
 	memoryCacheStore struct {
-		cache sync.Map
+		MaxTenants  int
+		IdleTimeout time.Duration
+		mutex       sync.Mutex
+		items       map[string]*list.Element
+		lru         *list.List
+	}
+
+	memoryCacheItem struct {
+		repo     string
+		entry    *cacheEntry
+		lastUsed time.Time
 	}
 
 	event struct {
@@ -83,6 +103,7 @@ const (
 var (
 	EntrySavedMessage             = "Entry saved in cache store"
 	CouldNotSaveEntryErrorMessage = "Could not save entry in cache store"
+	DiscardedEntryMessage         = "Discarding entry of unsupported format from cache store"
 )
 
 func (server *MultiTenantServer) primeCache() error {
@@ -97,11 +118,45 @@ func (server *MultiTenantServer) primeCache() error {
 	return nil
 }
 
+// tenant returns the internals of a tenant, creating them if needed (e.g. after an eviction).
+// It must be called with TenantCacheKeyLock held
+func (server *MultiTenantServer) tenant(repo string) *tenantInternals {
+	tenant, ok := server.Tenants[repo]
+	if !ok {
+		tenant = &tenantInternals{
+			FetchedObjectsLock: &sync.Mutex{},
+			StatefileShards:    newShardDigests(nil),
+		}
+		server.Tenants[repo] = tenant
+	}
+	return tenant
+}
+
+// restoreStatefileShards records the digests of the statefile shards the index of a repo was
+// loaded from, if any. It must be called with TenantCacheKeyLock held
+func (server *MultiTenantServer) restoreStatefileShards(repo string, digests map[string]string) {
+	if digests != nil {
+		server.tenant(repo).StatefileShards.reset(digests)
+	}
+}
+
+// evictTenants releases the internals of the tenants evicted from the in-memory cache.
+// It must be called with TenantCacheKeyLock held
+func (server *MultiTenantServer) evictTenants(log cm_logger.LoggingFn, evicted []string) {
+	for _, repo := range evicted {
+		// requests still holding the internals of an evicted tenant carry on with them
+		delete(server.Tenants, repo)
+		log(cm_logger.DebugLevel, "Tenant evicted from cache",
+			"repo", repo,
+		)
+	}
+}
+
 // getChartList fetches from the server and accumulates concurrent requests to be fulfilled all at once.
 func (server *MultiTenantServer) getChartList(log cm_logger.LoggingFn, repo string) <-chan fetchedObjects {
 	ch := make(chan fetchedObjects, 1)
 	server.TenantCacheKeyLock.Lock()
-	tenant := server.Tenants[repo]
+	tenant := server.tenant(repo)
 	server.TenantCacheKeyLock.Unlock()
 
 	tenant.FetchedObjectsLock.Lock()
@@ -111,13 +166,13 @@ func (server *MultiTenantServer) getChartList(log cm_logger.LoggingFn, repo stri
 		// this unlock is wanted, while fetching the list, allow other channeled requests to be added
 		tenant.FetchedObjectsLock.Unlock()
 
-		objects, err := server.fetchChartsInStorage(log, repo)
+		objects, checksums, err := server.fetchChartsInStorage(log, repo)
 
 		tenant.FetchedObjectsLock.Lock()
 
 		// flush every other consumer that also wanted the index
 		for _, foCh := range tenant.FetchedObjectsChans {
-			foCh <- fetchedObjects{objects, err}
+			foCh <- fetchedObjects{objects, checksums, err}
 		}
 
 		tenant.FetchedObjectsChans = nil
@@ -128,14 +183,16 @@ func (server *MultiTenantServer) getChartList(log cm_logger.LoggingFn, repo stri
 	return ch
 }
 
-func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff) <-chan indexRegeneration {
+func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff, checksums map[string]string) <-chan indexRegeneration {
 	ch := make(chan indexRegeneration, 1)
-	tenant := server.Tenants[entry.RepoName]
+	server.TenantCacheKeyLock.Lock()
+	tenant := server.tenant(entry.RepoName)
+	server.TenantCacheKeyLock.Unlock()
 
 	tenant.RegeneratedIndexesChans = append(tenant.RegeneratedIndexesChans, ch)
 
 	if len(tenant.RegeneratedIndexesChans) == 1 {
-		index, err := server.regenerateRepositoryIndexWorker(log, entry, diff)
+		index, err := server.regenerateRepositoryIndexWorker(log, entry, diff, checksums)
 		for _, riCh := range tenant.RegeneratedIndexesChans {
 			riCh <- indexRegeneration{index, err}
 		}
@@ -145,7 +202,9 @@ func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.Logging
 	return ch
 }
 
-func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff) (*cm_repo.Index, error) {
+// regenerateRepositoryIndexWorker applies a diff to the index of a cache entry. The checksums
+// listed by the backend, if any, replace the ones recorded in the index.
+func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff, checksums map[string]string) (*cm_repo.Index, error) {
 	repo := entry.RepoName
 
 	log(cm_logger.DebugLevel, "Regenerating index.yaml",
@@ -158,6 +217,7 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 		ChartURL:   entry.RepoIndex.ChartURL,
 		IndexLock:  sync.RWMutex{},
 		OutputJSON: server.JSONIndex,
+		Checksums:  maps.Clone(entry.RepoIndex.Checksums),
 	}
 
 	for _, object := range diff.Removed {
@@ -168,22 +228,27 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 	}
 
 	for _, object := range diff.Updated {
-		err := server.updateIndexObject(log, repo, index, object)
+		err := server.updateIndexObject(log, repo, index, object, checksums[object.Path])
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// Parallelize retrieval of added objects to improve speed
-	err := server.addIndexObjectsAsync(log, repo, index, diff.Added)
+	err := server.addIndexObjectsAsync(log, repo, index, diff.Added, checksums)
 	if err != nil {
 		return nil, err
 	}
 
+	if checksums != nil {
+		index.SetChecksums(checksums)
+	}
+
 	err = index.Regenerate()
 	if err != nil {
 		return nil, err
 	}
+	server.syncMetadataStore(log, repo, index, diff)
 
 	log(cm_logger.DebugLevel, "index.yaml regenerated",
 		"repo", repo,
@@ -194,24 +259,41 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 	return index, err
 }
 
-func (server *MultiTenantServer) fetchChartsInStorage(log cm_logger.LoggingFn, repo string) ([]cm_storage.Object, error) {
+// fetchChartsInStorage lists the chart packages of a repo, along with their checksums
+// when the storage backend is able to list them
+func (server *MultiTenantServer) fetchChartsInStorage(log cm_logger.LoggingFn, repo string) ([]cm_storage.Object, map[string]string, error) {
 	log(cm_logger.DebugLevel, "Fetching chart list from storage",
 		"repo", repo,
 	)
-	allObjects, err := server.StorageBackend.ListObjects(repo)
+	var allObjects []cm_storage.Object
+	var checksums map[string]string
+	var err error
+	if lister, ok := server.StorageBackend.(cm_backend.ChecksumLister); ok {
+		allObjects, checksums, err = lister.ListObjectsWithChecksums(repo)
+	} else {
+		allObjects, err = server.StorageBackend.ListObjects(repo)
+	}
 	if err != nil {
-		return []cm_storage.Object{}, err
+		return []cm_storage.Object{}, nil, err
 	}
 
-	// filter out storage objects that dont have extension used for chart packages (.tgz)
+	// filter out storage objects that dont have extension used for chart packages (.tgz),
+	// and the soft-deleted ones in case the backend lists nested objects
 	filteredObjects := []cm_storage.Object{}
+	var filteredChecksums map[string]string
+	if checksums != nil {
+		filteredChecksums = map[string]string{}
+	}
 	for _, object := range allObjects {
-		if object.HasExtension(cm_repo.ChartPackageFileExtension) {
+		if object.HasExtension(cm_repo.ChartPackageFileExtension) && !strings.HasPrefix(object.Path, cm_repo.TrashDirname+"/") {
 			filteredObjects = append(filteredObjects, object)
+			if checksum, ok := checksums[object.Path]; ok {
+				filteredChecksums[object.Path] = checksum
+			}
 		}
 	}
 
-	return filteredObjects, nil
+	return filteredObjects, filteredChecksums, nil
 }
 
 func (server *MultiTenantServer) removeIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, object cm_storage.Object) error {
@@ -228,8 +310,8 @@ func (server *MultiTenantServer) removeIndexObject(log cm_logger.LoggingFn, repo
 	return nil
 }
 
-func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, object cm_storage.Object) error {
-	chartVersion, err := server.getObjectChartVersion(repo, object, true)
+func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, object cm_storage.Object, checksum string) error {
+	chartVersion, err := server.downloadObjectChartVersion(log, repo, object, checksum)
 	if err != nil {
 		return server.checkInvalidChartPackageError(log, repo, object, err, "updated")
 	}
@@ -242,7 +324,7 @@ func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo
 	return nil
 }
 
-func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, objects []cm_storage.Object) error {
+func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, objects []cm_storage.Object, checksums map[string]string) error {
 	numObjects := len(objects)
 	if numObjects == 0 {
 		return nil
@@ -277,7 +359,7 @@ func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, r
 			case <-ctx.Done():
 				return
 			default:
-				chartVersion, err := server.getObjectChartVersion(repo, o, true)
+				chartVersion, err := server.loadObjectChartVersion(log, repo, o, checksums[o.Path])
 				if err != nil {
 					err = server.checkInvalidChartPackageError(log, repo, o, err, "added")
 					if err != nil {
@@ -337,24 +419,36 @@ func (server *MultiTenantServer) checkInvalidChartPackageError(log cm_logger.Log
 }
 
 func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo string) (*cacheEntry, error) {
+	return server.loadCacheEntry(log, repo, true)
+}
+
+// loadCacheEntry returns the cache entry of a repo, recording the repo as in use unless
+// called for background maintenance such as the periodic refresh
+func (server *MultiTenantServer) loadCacheEntry(log cm_logger.LoggingFn, repo string, use bool) (*cacheEntry, error) {
 	var entry *cacheEntry
 	var content []byte
 	var err error
 
 	server.TenantCacheKeyLock.Lock()
-	defer server.TenantCacheKeyLock.Unlock()
+	if use {
+		server.evictTenants(log, server.InternalCacheStore.Touch(repo))
+	}
+	server.tenant(repo)
 
-	if _, ok := server.Tenants[repo]; !ok {
-		server.Tenants[repo] = &tenantInternals{
-			FetchedObjectsLock: &sync.Mutex{},
-		}
+	if server.ExternalCacheStore != nil && server.ShardedIndex {
+		// the unchanged shards are copied under the lock of the cached entry, which is held
+		// while taking TenantCacheKeyLock when the index is regenerated
+		server.TenantCacheKeyLock.Unlock()
+		return server.loadShardedCacheEntry(log, repo)
 	}
+	defer server.TenantCacheKeyLock.Unlock()
 
 	if server.ExternalCacheStore == nil {
 		var ok bool
 		entry, ok = server.InternalCacheStore.Load(repo)
 		if !ok {
-			repoIndex := server.newRepositoryIndex(log, repo)
+			repoIndex, statefileDigests := server.newRepositoryIndex(log, repo)
+			server.restoreStatefileShards(repo, statefileDigests)
 			entry = &cacheEntry{
 				RepoName:  repo,
 				RepoIndex: repoIndex,
@@ -368,14 +462,24 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 		}
 	} else {
 		content, err = server.ExternalCacheStore.Get(repo)
+		if err == nil {
+			entry, err = server.decodeCacheEntry(content)
+			if err != nil {
+				log(cm_logger.WarnLevel, DiscardedEntryMessage,
+					"error", err.Error(),
+					"repo", repo,
+				)
+			}
+		}
 		if err != nil {
-			repoIndex := server.newRepositoryIndex(log, repo)
+			repoIndex, statefileDigests := server.newRepositoryIndex(log, repo)
+			server.restoreStatefileShards(repo, statefileDigests)
 			entry = &cacheEntry{
 				RepoName:  repo,
 				RepoIndex: repoIndex,
 				RepoLock:  sync.RWMutex{},
 			}
-			content, err = json.Marshal(entry)
+			content, err = encodeCacheEntry(entry)
 			if err != nil {
 				return nil, err
 			}
@@ -392,25 +496,25 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 		log(cm_logger.DebugLevel, "Entry found in cache store",
 			"repo", repo,
 		)
-
-		err = json.Unmarshal(content, &entry)
-		if err != nil {
-			return nil, err
-		}
 	}
 
 	return entry, nil
 }
 
-func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *cacheEntry) error {
+// saveCacheEntry saves an entry in the cache store. When sharding is enabled, only the shards of
+// the given chart names are considered (all charts if empty).
+func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *cacheEntry, names ...string) error {
 	repo := entry.RepoName
+	if server.ExternalCacheStore != nil && server.ShardedIndex {
+		return server.saveShardedCacheEntry(log, entry, names...)
+	}
 	if server.ExternalCacheStore == nil {
 		server.InternalCacheStore.Store(repo, entry)
 		log(cm_logger.DebugLevel, EntrySavedMessage,
 			"repo", repo,
 		)
 	} else {
-		content, err := json.Marshal(entry)
+		content, err := encodeCacheEntry(entry)
 		if err != nil {
 			return err
 		}
@@ -429,7 +533,7 @@ func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *
 	return nil
 }
 
-func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, repo string) *cm_repo.Index {
+func (server *MultiTenantServer) repoChartURL(repo string) string {
 	var chartURL string
 	if server.ChartURL != "" {
 		chartURL = server.ChartURL
@@ -437,19 +541,51 @@ func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, rep
 			chartURL = chartURL + "/" + repo
 		}
 	}
+	return chartURL
+}
 
+// newRepositoryIndex loads the index of a repo missing from the cache store, along with the
+// digests of the statefile shards it was loaded from (nil if none), to be recorded with
+// restoreStatefileShards. It does not touch the tenant internals, so that it can be called
+// without TenantCacheKeyLock held
+func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, map[string]string) {
 	serverInfo := &cm_repo.ServerInfo{
 		ContextPath: server.Router.ContextPath,
 	}
 
+	if server.MetadataStore == nil {
+		return server.loadStatefileIndex(log, repo, serverInfo)
+	}
+	if index, ok := server.loadMetadataIndex(log, repo, serverInfo); ok {
+		return index, nil
+	}
+	// the repo is missing from the metadata store, it is rebuilt from the statefile
+	// (if any), and then from storage as the diff gets applied
+	index, digests := server.loadStatefileIndex(log, repo, serverInfo)
+	server.replaceMetadataTenant(log, repo, index)
+	return index, digests
+}
+
+// loadStatefileIndex loads the index of a repo from its statefile, returning the digests of
+// its shards when sharded
+func (server *MultiTenantServer) loadStatefileIndex(log cm_logger.LoggingFn, repo string, serverInfo *cm_repo.ServerInfo) (*cm_repo.Index, map[string]string) {
+	chartURL := server.repoChartURL(repo)
+
 	if !server.UseStatefiles {
-		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex)
+		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex), nil
+	}
+
+	if server.ShardedIndex {
+		if index, digests, ok := server.loadStatefileShards(log, repo); ok {
+			return index, digests
+		}
+		// fall back to index-cache.yaml, which is migrated to shards on the next save
 	}
 
 	objectPath := pathutil.Join(repo, cm_repo.StatefileFilename)
 	object, err := server.StorageBackend.GetObject(objectPath)
 	if err != nil {
-		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex)
+		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex), nil
 	}
 
 	indexFile := &cm_repo.IndexFile{}
@@ -464,7 +600,7 @@ func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, rep
 			"repo", repo,
 			"error", err.Error(),
 		)
-		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex)
+		return cm_repo.NewIndex(chartURL, repo, serverInfo, server.JSONIndex), nil
 	}
 
 	log(cm_logger.DebugLevel, "index-cache.yaml loaded",
@@ -478,7 +614,7 @@ func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, rep
 		ChartURL:   chartURL,
 		IndexLock:  sync.RWMutex{},
 		OutputJSON: server.JSONIndex,
-	}
+	}, nil
 }
 
 func (server *MultiTenantServer) initCacheTimer() {
@@ -536,16 +672,14 @@ func (server *MultiTenantServer) startEventListener() {
 				"operation_type", e.OpType)
 			continue
 		}
+		server.invalidateStorageObjects(repo, e.OpType, e.ChartVersion)
+
+		// encoded before the index prefixes the chart URL
+		message := server.encodeNotification(log, e)
 
 		entry.RepoLock.Lock()
-		switch e.OpType {
-		case updateChart:
-			index.UpdateEntry(e.ChartVersion)
-		case addChart:
-			index.AddEntry(e.ChartVersion)
-		case deleteChart:
-			index.RemoveEntry(e.ChartVersion)
-		default:
+		if !applyEvent(index, e.OpType, e.ChartVersion) {
+			entry.RepoLock.Unlock()
 			log(cm_logger.ErrorLevel, "Invalid operation type", zap.String("repo", repo),
 				"operation_type", e.OpType)
 			continue
@@ -553,35 +687,55 @@ func (server *MultiTenantServer) startEventListener() {
 
 		err = index.Regenerate()
 		if err != nil {
+			entry.RepoLock.Unlock()
 			log(cm_logger.ErrorLevel, "Error regenerating index", zap.Error(err), zap.String("repo", repo))
 			continue
 		}
 		entry.RepoIndex = index
 		entry.RepoLock.Unlock()
-		err = server.saveCacheEntry(log, entry)
+		server.updateMetadataStore(log, repo, e.OpType, e.ChartVersion)
+		err = server.saveCacheEntry(log, entry, e.ChartVersion.Name)
 		if err != nil {
 			log(cm_logger.ErrorLevel, "Error saving cache entry", zap.Error(err), zap.String("repo", repo))
 			continue
 		}
 
-		if server.UseStatefiles {
-			// Dont wait, save index-cache.yaml to storage in the background.
-			// It is not crucial if this does not succeed, we will just log any errors
-			go server.saveStatefile(log, e.RepoName, entry.RepoIndex.Raw)
-		}
+		server.persistStatefile(log, e.RepoName, entry.RepoIndex, e.ChartVersion.Name)
+		server.publishNotification(log, repo, message)
 
 		log(cm_logger.DebugLevel, "Event handled successfully", zap.Any("event", e))
 	}
 }
 
+// applyEvent applies an upload or delete to an index, it reports whether the operation type is valid
+func applyEvent(index *cm_repo.Index, opType operationType, chartVersion *helm_repo.ChartVersion) bool {
+	switch opType {
+	case updateChart:
+		index.UpdateEntry(chartVersion)
+	case addChart:
+		index.AddEntry(chartVersion)
+	case deleteChart:
+		index.RemoveEntry(chartVersion)
+	default:
+		return false
+	}
+	return true
+}
+
 func (server *MultiTenantServer) rebuildIndex() {
 	server.TenantCacheKeyLock.Lock()
 	defer server.TenantCacheKeyLock.Unlock()
+	server.evictTenants(server.Logger.ContextLoggingFn(&gin.Context{}), server.InternalCacheStore.Evict())
 	if len(server.Tenants) == 0 {
 		return
 	}
 	server.Logger.Info("Rebuilding index for all tenants in cache")
 	for repo := range server.Tenants {
+		if !server.InternalCacheStore.Contains(repo) {
+			// recreated by a request which was in flight when the tenant got evicted
+			delete(server.Tenants, repo)
+			continue
+		}
 		go server.rebuildIndexForTenant(repo)
 	}
 }
@@ -589,7 +743,7 @@ func (server *MultiTenantServer) rebuildIndex() {
 func (server *MultiTenantServer) rebuildIndexForTenant(repo string) {
 	log := server.Logger.ContextLoggingFn(&gin.Context{})
 	log(cm_logger.InfoLevel, "Rebuilding index for tenant", zap.String("repo", repo))
-	entry, err := server.initCacheEntry(log, repo)
+	entry, err := server.loadCacheEntry(log, repo, false)
 	if err != nil {
 		errStr := err.Error()
 		log(cm_logger.ErrorLevel, errStr,
@@ -610,14 +764,19 @@ func (server *MultiTenantServer) refreshCacheEntry(log cm_logger.LoggingFn, repo
 		)
 		return
 	}
-	objects := server.getRepoObjectSliceWithLock(entry)
-	diff := cm_storage.GetObjectSliceDiff(objects, fo.objects, server.TimestampTolerance)
+	diff := server.getObjectSliceDiffWithLock(entry, fo)
 
 	// return fast if no changes
 	if !diff.Change {
 		log(cm_logger.DebugLevel, "No change detected between cache and storage",
 			"repo", repo,
 		)
+		entry.RepoLock.Lock()
+		if fo.checksums != nil {
+			entry.RepoIndex.SetChecksums(fo.checksums)
+		}
+		entry.Refreshed = true
+		entry.RepoLock.Unlock()
 		return
 	}
 
@@ -628,7 +787,7 @@ func (server *MultiTenantServer) refreshCacheEntry(log cm_logger.LoggingFn, repo
 	entry.RepoLock.Lock()
 	defer entry.RepoLock.Unlock()
 
-	ir := <-server.regenerateRepositoryIndex(log, entry, diff)
+	ir := <-server.regenerateRepositoryIndex(log, entry, diff, fo.checksums)
 	if ir.err != nil {
 		errStr := ir.err.Error()
 		log(cm_logger.ErrorLevel, errStr,
@@ -637,26 +796,115 @@ func (server *MultiTenantServer) refreshCacheEntry(log cm_logger.LoggingFn, repo
 		return
 	}
 	entry.RepoIndex = ir.index
-	if server.UseStatefiles {
-		// Dont wait, save index-cache.yaml to storage in the background.
-		// It is not crucial if this does not succeed, we will just log any errors
-		go server.saveStatefile(log, repo, ir.index.Raw)
+	entry.Refreshed = true
+	server.persistStatefile(log, repo, ir.index)
+}
+
+func newMemoryCacheStore(maxTenants int, idleTimeout time.Duration) *memoryCacheStore {
+	return &memoryCacheStore{
+		MaxTenants:  maxTenants,
+		IdleTimeout: idleTimeout,
+		items:       map[string]*list.Element{},
+		lru:         list.New(),
 	}
 }
 
-func (m *memoryCacheStore) Load(key interface{}) (*cacheEntry, bool) {
-	var entry *cacheEntry
-	var okinterface bool
-	value, ok := m.cache.Load(key)
-	if ok {
-		entry, okinterface = value.(*cacheEntry)
-		if !okinterface {
-			return nil, okinterface
+// Load returns the entry of a repo, if any
+func (m *memoryCacheStore) Load(repo string) (*cacheEntry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if element, ok := m.items[repo]; ok {
+		if entry := element.Value.(*memoryCacheItem).entry; entry != nil {
+			cacheHitsCounter.Inc()
+			return entry, true
 		}
 	}
-	return entry, ok
+	cacheMissesCounter.Inc()
+	return nil, false
+}
+
+// Store sets the entry of a repo
+func (m *memoryCacheStore) Store(repo string, entry *cacheEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	element, ok := m.items[repo]
+	if !ok {
+		element = m.lru.PushFront(&memoryCacheItem{repo: repo, lastUsed: time.Now()})
+		m.items[repo] = element
+		cacheTenantsGauge.Set(float64(m.lru.Len()))
+	}
+	element.Value.(*memoryCacheItem).entry = entry
 }
 
-func (m *memoryCacheStore) Store(key, value interface{}) {
-	m.cache.Store(key, value)
+// Peek returns the entry of a repo, if any, without recording a lookup
+func (m *memoryCacheStore) Peek(repo string) (*cacheEntry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if element, ok := m.items[repo]; ok {
+		if entry := element.Value.(*memoryCacheItem).entry; entry != nil {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// Remove stops tracking a repo
+func (m *memoryCacheStore) Remove(repo string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if element, ok := m.items[repo]; ok {
+		m.lru.Remove(element)
+		delete(m.items, repo)
+		cacheTenantsGauge.Set(float64(m.lru.Len()))
+	}
+}
+
+// Contains reports whether a repo is tracked, with or without entry
+func (m *memoryCacheStore) Contains(repo string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.items[repo]
+	return ok
+}
+
+// Touch records that a repo is in use, even if its entry is held in an external cache store,
+// and evicts the other tenants past the bounds. The evicted repos are returned, so their
+// tenant internals can be released as well.
+func (m *memoryCacheStore) Touch(repo string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	element, ok := m.items[repo]
+	if ok {
+		element.Value.(*memoryCacheItem).lastUsed = time.Now()
+		m.lru.MoveToFront(element)
+	} else {
+		m.items[repo] = m.lru.PushFront(&memoryCacheItem{repo: repo, lastUsed: time.Now()})
+	}
+	return m.evict(m.lru.Front())
+}
+
+// Evict evicts the tenants past the bounds and returns them
+func (m *memoryCacheStore) Evict() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.evict(nil)
+}
+
+// evict removes least recently used tenants, other than keep, until within bounds
+func (m *memoryCacheStore) evict(keep *list.Element) []string {
+	var evicted []string
+	for element := m.lru.Back(); element != nil && element != keep; element = m.lru.Back() {
+		item := element.Value.(*memoryCacheItem)
+		overflow := m.MaxTenants > 0 && m.lru.Len() > m.MaxTenants
+		idle := m.IdleTimeout > 0 && time.Since(item.lastUsed) > m.IdleTimeout
+		if !overflow && !idle {
+			break
+		}
+		m.lru.Remove(element)
+		delete(m.items, item.repo)
+		evicted = append(evicted, item.repo)
+	}
+	cacheEvictionsCounter.Add(float64(len(evicted)))
+	cacheTenantsGauge.Set(float64(m.lru.Len()))
+	return evicted
 }
@@ -0,0 +1,163 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+// Values saved in the external cache store are the magic bytes, the format version and
+// the gzipped JSON content. Values written before versioning are plain JSON, they are still
+// read and get replaced by the versioned encoding on the next save. Values of any other
+// version are discarded, so that the entry is rebuilt whenever the format changes.
+const (
+	cacheFormatVersion byte = 1
+)
+
+var (
+	cacheFormatMagic = []byte("CMCE")
+
+	errCacheFormat = errors.New("unsupported cache entry format")
+)
+
+type (
+	// storedCacheEntry is the content of a cache entry in the external cache store. The rendered
+	// index is left out, since it is a copy of the index file which can be rendered again.
+	storedCacheEntry struct {
+		RepoName  string             `json:"repo"`
+		IndexFile *cm_repo.IndexFile `json:"index"`
+		ChartURL  string             `json:"chartURL,omitempty"`
+		Checksums map[string]string  `json:"checksums,omitempty"`
+	}
+)
+
+// encodeCacheValue encodes JSON content for the external cache store
+func encodeCacheValue(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(cacheFormatMagic)
+	buf.WriteByte(cacheFormatVersion)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCacheValue returns the JSON content of a value from the external cache store,
+// and whether it was saved in the legacy (plain JSON) format
+func decodeCacheValue(value []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(value, cacheFormatMagic) {
+		if json.Valid(value) {
+			return value, true, nil
+		}
+		return nil, false, errCacheFormat
+	}
+	header := len(cacheFormatMagic)
+	if len(value) <= header || value[header] != cacheFormatVersion {
+		return nil, false, errCacheFormat
+	}
+	r, err := gzip.NewReader(bytes.NewReader(value[header+1:]))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", errCacheFormat, err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", errCacheFormat, err)
+	}
+	return content, false, nil
+}
+
+// marshalCacheValue encodes v as JSON for the external cache store
+func marshalCacheValue(v interface{}) ([]byte, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return encodeCacheValue(content)
+}
+
+// unmarshalCacheValue decodes a value from the external cache store into v
+func unmarshalCacheValue(value []byte, v interface{}) error {
+	content, _, err := decodeCacheValue(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// encodeCacheEntry encodes a cache entry for the external cache store
+func encodeCacheEntry(entry *cacheEntry) ([]byte, error) {
+	return marshalCacheValue(storedCacheEntry{
+		RepoName:  entry.RepoName,
+		IndexFile: entry.RepoIndex.IndexFile,
+		ChartURL:  entry.RepoIndex.ChartURL,
+		Checksums: entry.RepoIndex.Checksums,
+	})
+}
+
+// decodeCacheEntry decodes a cache entry from the external cache store, rendering its index again
+func (server *MultiTenantServer) decodeCacheEntry(value []byte) (*cacheEntry, error) {
+	content, legacy, err := decodeCacheValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		var entry *cacheEntry
+		err = json.Unmarshal(content, &entry)
+		if err == nil && (entry == nil || entry.RepoIndex == nil || entry.RepoIndex.IndexFile == nil) {
+			err = errCacheFormat
+		}
+		return entry, err
+	}
+
+	stored := &storedCacheEntry{}
+	err = json.Unmarshal(content, stored)
+	if err != nil {
+		return nil, err
+	}
+	if stored.IndexFile == nil || stored.IndexFile.IndexFile == nil {
+		return nil, errCacheFormat
+	}
+	index := &cm_repo.Index{
+		IndexFile:  stored.IndexFile,
+		RepoName:   stored.RepoName,
+		ChartURL:   stored.ChartURL,
+		OutputJSON: server.JSONIndex,
+		Checksums:  stored.Checksums,
+	}
+	err = index.Render()
+	if err != nil {
+		return nil, err
+	}
+	return &cacheEntry{
+		RepoName:  stored.RepoName,
+		RepoIndex: index,
+		RepoLock:  sync.RWMutex{},
+	}, nil
+}
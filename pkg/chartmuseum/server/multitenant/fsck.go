@@ -0,0 +1,60 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"net/http"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	"helm.sh/chartmuseum/pkg/maintenance"
+)
+
+// fsck checks the storage of a repo, and with repair rebuilds its index from the fixed storage
+func (server *MultiTenantServer) fsck(log cm_logger.LoggingFn, repo string, repair bool) (*maintenance.FsckReport, *HTTPError) {
+	report, err := maintenance.Fsck(server.StorageBackend, maintenance.FsckOptions{
+		Repo:   repo,
+		Repair: repair,
+		MinAge: server.GCMinAge,
+	})
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	repaired := 0
+	for _, problem := range report.Problems {
+		log(cm_logger.WarnLevel, "Storage inconsistency found",
+			"repo", repo,
+			"kind", problem.Kind,
+			"path", problem.Path,
+			"detail", problem.Detail,
+			"repaired", problem.Repaired,
+		)
+		if problem.Repaired {
+			repaired++
+		}
+	}
+	if repaired == 0 {
+		return report, nil
+	}
+
+	server.TenantCacheKeyLock.Lock()
+	_, cached := server.Tenants[repo]
+	server.TenantCacheKeyLock.Unlock()
+	if cached {
+		server.rebuildIndexForTenant(repo)
+	}
+	return report, nil
+}
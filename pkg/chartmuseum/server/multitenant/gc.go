@@ -0,0 +1,91 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"net/http"
+	"time"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	"helm.sh/chartmuseum/pkg/maintenance"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (server *MultiTenantServer) initGCTimer() {
+	if server.GCInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(server.GCInterval)
+		for range t.C {
+			server.collectGarbage()
+		}
+	}()
+}
+
+// collectGarbage deletes the garbage of every repo in storage
+func (server *MultiTenantServer) collectGarbage() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, repo := range server.storageRepos(log) {
+		if _, err := server.gc(log, repo, server.GCDryRun); err != nil {
+			log(cm_logger.ErrorLevel, "Unable to collect storage garbage",
+				"repo", repo,
+				"error", err.Message,
+			)
+		}
+	}
+}
+
+// gc finds the garbage files of a repo, and deletes them unless dryRun. Garbage does not
+// show in the index, which is left as is.
+func (server *MultiTenantServer) gc(log cm_logger.LoggingFn, repo string, dryRun bool) (*maintenance.GCReport, *HTTPError) {
+	report, err := maintenance.GC(server.StorageBackend, maintenance.GCOptions{
+		Repo:    repo,
+		MinAge:  server.GCMinAge,
+		Unknown: server.GCUnknown,
+		DryRun:  dryRun,
+	})
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	invalidator, _ := server.StorageBackend.(cm_backend.ObjectInvalidator)
+	for _, object := range report.Garbage {
+		log(cm_logger.InfoLevel, "Storage garbage found",
+			"repo", repo,
+			"kind", object.Kind,
+			"path", object.Path,
+			"deleted", object.Deleted,
+		)
+		if object.Error != "" {
+			log(cm_logger.WarnLevel, "Unable to delete storage garbage",
+				"repo", repo,
+				"path", object.Path,
+				"error", object.Error,
+			)
+		}
+		if !object.Deleted {
+			continue
+		}
+		gcDeletedCounter.WithLabelValues(object.Kind).Inc()
+		if invalidator != nil {
+			invalidator.InvalidateObject(object.Path)
+		}
+	}
+	return report, nil
+}
@@ -20,14 +20,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	pathutil "path"
 	"strconv"
 	"time"
 
-	cm_storage "github.com/chartmuseum/storage"
-
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
@@ -79,13 +79,20 @@ type (
 
 type (
 	chartOrProvenanceFile struct {
-		filename string
-		content  []byte
-		field    string // file was extracted from this form field
-	}
-	filenameFromContentFn func([]byte) (string, error)
+		filename     string
+		content      *io.SectionReader
+		chartVersion *helm_repo.ChartVersion // set for chart packages
+		field        string                  // file was extracted from this form field
+		file         multipart.File
+		unlock       func() // releases the lock of the file, held until it is stored
+	}
+	fileFromContentFn func(*io.SectionReader) (*chartOrProvenanceFile, error)
 )
 
+// multipartMaxMemory is the size of the form fields kept in memory when parsing multipart
+// uploads, larger files are written to temporary files
+const multipartMaxMemory = 1 << 20
+
 func (server *MultiTenantServer) getWelcomePageHandler(c *gin.Context) {
 	if server.WebTemplatePath != "" {
 		// Check if template file exists, otherwise return default welcome page
@@ -120,11 +127,14 @@ func (server *MultiTenantServer) getHealthCheckHandler(c *gin.Context) {
 func (server *MultiTenantServer) getIndexFileRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	log := server.Logger.ContextLoggingFn(c)
-	indexFile, err := server.getIndexFile(log, repo)
+	indexFile, warning, err := server.getIndexFileWithWarning(log, repo)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	if warning != "" {
+		c.Header("Warning", warning)
+	}
 	indexFile.IndexLock.RLock()
 	defer indexFile.IndexLock.RUnlock()
 	c.Data(200, indexFileContentType, indexFile.Raw)
@@ -150,12 +160,27 @@ func (server *MultiTenantServer) getStorageObjectRequestHandler(c *gin.Context)
 	repo := c.Param("repo")
 	filename := c.Param("filename")
 	log := server.Logger.ContextLoggingFn(c)
-	storageObject, err := server.getStorageObject(log, repo, filename)
-	if err != nil {
+	if signedURL, ok := server.getSignedStorageObjectURL(log, repo, filename); ok {
+		c.Redirect(http.StatusFound, signedURL)
+		return
+	}
+	if err := server.serveStorageObject(c, log, repo, filename); err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
+	}
+}
+
+func (server *MultiTenantServer) getSignedStorageObjectRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	filename := c.Param("filename")
+	log := server.Logger.ContextLoggingFn(c)
+	signer, ok := server.URLSigner.(*cm_backend.LocalURLSigner)
+	if !ok || !signer.Verify(pathutil.Join(repo, filename), c.Query("expires"), c.Query("signature")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid or expired signature"})
 		return
 	}
-	c.Data(200, storageObject.ContentType, storageObject.Content)
+	if err := server.serveStorageObject(c, log, repo, filename); err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+	}
 }
 func (server *MultiTenantServer) getStorageObjectTemplateRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
@@ -327,6 +352,141 @@ func (server *MultiTenantServer) deleteChartVersionRequestHandler(c *gin.Context
 	c.JSON(200, objectDeletedResponse)
 }
 
+func (server *MultiTenantServer) getChartVersionLockRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	status, err := server.getProtectionStatus(repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, status)
+}
+
+func (server *MultiTenantServer) lockChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	err := server.lockChartVersion(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, gin.H{"locked": true})
+}
+
+func (server *MultiTenantServer) unlockChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	err := server.unlockChartVersion(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, gin.H{"locked": false})
+}
+
+func (server *MultiTenantServer) getTrashRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	entries, err := server.listTrash(repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+func (server *MultiTenantServer) restoreTrashChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	chartVersion, err := server.restoreChartVersion(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	server.emitEvent(c, repo, addChart, chartVersion)
+	c.JSON(200, gin.H{"restored": true})
+}
+
+func (server *MultiTenantServer) deleteTrashChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	err := server.purgeChartVersion(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, objectDeletedResponse)
+}
+
+func (server *MultiTenantServer) deleteTrashRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	purged, err := server.purgeTrash(log, repo, time.Time{})
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, gin.H{"purged": purged})
+}
+
+func (server *MultiTenantServer) getFsckRequestHandler(c *gin.Context) {
+	server.fsckRequestHandler(c, false)
+}
+
+func (server *MultiTenantServer) postFsckRequestHandler(c *gin.Context) {
+	server.fsckRequestHandler(c, true)
+}
+
+func (server *MultiTenantServer) fsckRequestHandler(c *gin.Context, repair bool) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	report, err := server.fsck(log, repo, repair)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, report)
+}
+
+func (server *MultiTenantServer) getGCRequestHandler(c *gin.Context) {
+	server.gcRequestHandler(c, true)
+}
+
+func (server *MultiTenantServer) postGCRequestHandler(c *gin.Context) {
+	server.gcRequestHandler(c, false)
+}
+
+func (server *MultiTenantServer) gcRequestHandler(c *gin.Context, dryRun bool) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	report, err := server.gc(log, repo, dryRun)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, report)
+}
+
+func (server *MultiTenantServer) getRetentionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	deletions, err := server.applyRetention(log, repo, nil, true)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, gin.H{"deletions": deletions})
+}
+
 func (server *MultiTenantServer) postRequestHandler(c *gin.Context) {
 	if c.ContentType() == "multipart/form-data" {
 		server.postPackageAndProvenanceRequestHandler(c) // new route handling form-based chart and/or prov files
@@ -337,7 +497,9 @@ func (server *MultiTenantServer) postRequestHandler(c *gin.Context) {
 
 func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
-	content, getContentErr := c.GetRawData()
+	// the body is spooled to a temporary file rather than memory, the size limit
+	// is enforced while reading it
+	file, size, getContentErr := spoolToTempFile(c.Request.Body)
 	if getContentErr != nil {
 		if len(c.Errors) > 0 {
 			return // this is a "request too large"
@@ -345,10 +507,11 @@ func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", getContentErr)})
 		return
 	}
+	defer removeTempFile(file)
 	log := server.Logger.ContextLoggingFn(c)
 	_, force := c.GetQuery("force")
 	action := addChart
-	filename, err := server.uploadChartPackage(log, repo, content, force)
+	_, chart, err := server.uploadChartPackageStream(log, repo, io.NewSectionReader(file, 0, size), force)
 	if err != nil {
 		// here should check both err.Status and err.Message
 		// The http.StatusConflict status means the chart is existed but overwrite is not sed OR chart is existed and overwrite is set
@@ -365,14 +528,8 @@ func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context) {
 		}
 	}
 
-	chart, chartErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{
-		Path:         pathutil.Join(repo, filename),
-		Content:      content,
-		LastModified: time.Now()})
-	if chartErr != nil {
-		log(cm_logger.ErrorLevel, "cannot get chart from content", zap.Error(chartErr), zap.Binary("content", content))
-	}
 	server.emitEvent(c, repo, action, chart)
+	server.applyRetentionOnUpload(log, repo, chart)
 
 	c.JSON(201, objectSavedResponse)
 }
@@ -402,11 +559,19 @@ func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.C
 	log := server.Logger.ContextLoggingFn(&gin.Context{})
 	repo := c.Param("repo")
 	_, force := c.GetQuery("force")
-	var chartContent []byte
-	var path string
+	var chart *helm_repo.ChartVersion
 	// action used to determine what operation to emit
 	action := addChart
-	cpFiles, status, err := server.getChartAndProvFiles(c.Request, repo, force)
+	cpFiles, status, err := server.getChartAndProvFiles(log, c.Request, repo, force)
+	defer func() {
+		for _, ppf := range cpFiles {
+			ppf.file.Close()
+			ppf.unlock()
+		}
+		if c.Request.MultipartForm != nil {
+			c.Request.MultipartForm.RemoveAll()
+		}
+	}()
 	if err != nil {
 		c.JSON(status, gin.H{"error": fmt.Sprintf("%s", err)})
 		return
@@ -445,7 +610,7 @@ func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.C
 			"filename", ppf.filename,
 			"field", ppf.field,
 		)
-		if err := server.PutWithLimit(&gin.Context{}, log, repo, ppf.filename, ppf.content); err == nil {
+		if err := server.putWithLimit(&gin.Context{}, log, repo, ppf.filename, ppf.content, ppf.chartVersion); err == nil {
 			storedFiles = append(storedFiles, ppf)
 		} else {
 			// Clean up what's already been saved
@@ -455,92 +620,145 @@ func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.C
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s", err)})
 			return
 		}
-		if ppf.field == defaultFormField {
-			// find the content of chart
-			chartContent = ppf.content
-			path = pathutil.Join(repo, ppf.filename)
+		if ppf.chartVersion != nil {
+			// find the chart
+			chart = ppf.chartVersion
 		}
 	}
 
-	chart, chartErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{
-		Path:         path,
-		Content:      chartContent,
-		LastModified: time.Now()})
-	if chartErr != nil {
-		log(cm_logger.ErrorLevel, "cannot get chart from content", zap.Error(err), zap.Binary("content", chartContent))
+	if chart == nil {
+		log(cm_logger.ErrorLevel, "cannot get chart from form fields", zap.String("repo", repo))
 	}
 
 	server.emitEvent(c, repo, action, chart)
+	server.applyRetentionOnUpload(log, repo, chart)
 
 	c.JSON(http.StatusCreated, objectSavedResponse)
 }
 
-func (server *MultiTenantServer) getChartAndProvFiles(req *http.Request, repo string, force bool) (map[string]*chartOrProvenanceFile, int, error) {
+// getChartAndProvFiles returns the files of a multipart form, each locked from the existence
+// check until the caller stores it and releases the lock
+func (server *MultiTenantServer) getChartAndProvFiles(log cm_logger.LoggingFn, req *http.Request, repo string, force bool) (map[string]*chartOrProvenanceFile, int, error) {
 	type fieldFuncPair struct {
 		field string
-		fn    filenameFromContentFn
+		fn    fileFromContentFn
 	}
 
 	ffp := []fieldFuncPair{
-		{defaultFormField, cm_repo.ChartPackageFilenameFromContent},
-		{server.ChartPostFormFieldName, cm_repo.ChartPackageFilenameFromContent},
-		{defaultProvField, cm_repo.ProvenanceFilenameFromContent},
-		{server.ProvPostFormFieldName, cm_repo.ProvenanceFilenameFromContent},
+		{defaultFormField, chartPackageFileFromContent},
+		{server.ChartPostFormFieldName, chartPackageFileFromContent},
+		{defaultProvField, provenanceFileFromContent},
+		{server.ProvPostFormFieldName, provenanceFileFromContent},
 	}
 
+	// files larger than multipartMaxMemory are kept in temporary files until the form is removed
+	req.ParseMultipartForm(multipartMaxMemory)
+
 	validReturnStatusCode := http.StatusOK
 	cpFiles := make(map[string]*chartOrProvenanceFile)
-	for _, ff := range ffp {
-		content, err := extractContentFromRequest(req, ff.field)
-		if err != nil {
-			return nil, http.StatusInternalServerError, err
+	closeFiles := func() {
+		for _, cpFile := range cpFiles {
+			cpFile.file.Close()
+			if cpFile.unlock != nil {
+				cpFile.unlock()
+			}
 		}
-		if content == nil {
+	}
+	for _, ff := range ffp {
+		file, content := extractContentFromRequest(req, ff.field)
+		if file == nil {
 			continue
 		}
-		filename, err := ff.fn(content)
+		cpFile, err := ff.fn(content)
 		if err != nil {
+			file.Close()
+			closeFiles()
 			return nil, http.StatusBadRequest, err
 		}
+		cpFile.field = ff.field
+		cpFile.file = file
+		filename := cpFile.filename
 		if _, ok := cpFiles[filename]; ok {
+			file.Close()
 			continue
 		}
-		// if the file already exists, we don't need to validate it again
-		if validReturnStatusCode == http.StatusConflict {
-			cpFiles[filename] = &chartOrProvenanceFile{filename, content, ff.field}
-			continue
-		}
+		cpFiles[filename] = cpFile // closed on error
 		// check filename
 		if pathutil.Base(filename) != filename {
+			closeFiles()
 			return nil, http.StatusBadRequest, fmt.Errorf("%s is improperly formatted", filename) // Name wants to break out of current directory
 		}
+		// hold the lock from the existence check to the put, as for single package uploads
+		unlock, err := server.lockObject(log, repo, filename)
+		if err != nil {
+			closeFiles()
+			lockErr := lockHTTPError(err)
+			return nil, lockErr.Status, fmt.Errorf("%s", lockErr.Message)
+		}
+		cpFile.unlock = unlock
 		// check existence
 		status, err := server.validateChartOrProv(repo, filename, force)
 		if err != nil {
+			closeFiles()
 			return nil, status, err
 		}
 		// return conflict status code if the file already exists
 		if status == http.StatusConflict {
 			validReturnStatusCode = status
 		}
-		cpFiles[filename] = &chartOrProvenanceFile{filename, content, ff.field}
 	}
 
 	// validState code can be 200 or 409. Returning 409 means that the chart already exists
 	return cpFiles, validReturnStatusCode, nil
 }
 
-func extractContentFromRequest(req *http.Request, field string) ([]byte, error) {
+// extractContentFromRequest opens a file form field, backed by memory or a temporary file
+// depending on its size, and returns a reader of its content
+func extractContentFromRequest(req *http.Request, field string) (multipart.File, *io.SectionReader) {
 	file, header, _ := req.FormFile(field)
 	if file == nil || header == nil {
 		return nil, nil // field is not present
 	}
-	buf := bytes.NewBuffer(nil)
-	_, err := io.Copy(buf, file)
+	return file, io.NewSectionReader(file, 0, header.Size)
+}
+
+func chartPackageFileFromContent(content *io.SectionReader) (*chartOrProvenanceFile, error) {
+	filename, chartVersion, err := chartPackageFromReader(content)
 	if err != nil {
-		return nil, err // IO error
+		return nil, err
 	}
-	return buf.Bytes(), nil
+	return &chartOrProvenanceFile{filename: filename, content: content, chartVersion: chartVersion}, nil
+}
+
+func provenanceFileFromContent(content *io.SectionReader) (*chartOrProvenanceFile, error) {
+	buf, err := io.ReadAll(io.NewSectionReader(content, 0, content.Size()))
+	if err != nil {
+		return nil, err
+	}
+	filename, err := cm_repo.ProvenanceFilenameFromContent(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &chartOrProvenanceFile{filename: filename, content: content}, nil
+}
+
+// spoolToTempFile copies body to a temporary file, returning the file and its size
+func spoolToTempFile(body io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "chartmuseum-upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, body)
+	if err != nil {
+		removeTempFile(file)
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+func removeTempFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
 }
 
 func (server *MultiTenantServer) validateChartOrProv(repo, filename string, force bool) (int, error) {
@@ -554,6 +772,10 @@ func (server *MultiTenantServer) validateChartOrProv(repo, filename string, forc
 	// for example, when overwrite is allowed, it's valid
 	// so that the client can decide what to do and here we just return conflict with no error
 	if _, err := server.StorageBackend.GetObject(f); err == nil {
+		// unless the chart version is protected, which is never overwritten
+		if err := server.checkFileProtection(repo, filename, http.StatusConflict); err != nil {
+			return err.Status, fmt.Errorf("%s", err.Message)
+		}
 		return http.StatusConflict, nil
 	}
 	return http.StatusOK, nil
@@ -31,13 +31,21 @@ const (
 )
 
 func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, *HTTPError) {
+	index, _, err := server.getIndexFileWithWarning(log, repo)
+	return index, err
+}
+
+// getIndexFileWithWarning returns the index of a repo, along with the value of a Warning header
+// when the index is served stale: either while it gets revalidated in the background, or because
+// storage could not be reached (stale-if-error)
+func (server *MultiTenantServer) getIndexFileWithWarning(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, string, *HTTPError) {
 	entry, err := server.initCacheEntry(log, repo)
 	if err != nil {
 		errStr := err.Error()
 		log(cm_logger.ErrorLevel, errStr,
 			"repo", repo,
 		)
-		return nil, &HTTPError{http.StatusInternalServerError, errStr}
+		return nil, "", &HTTPError{http.StatusInternalServerError, errStr}
 	}
 	entry.RepoLock.Lock()
 	defer entry.RepoLock.Unlock()
@@ -46,6 +54,11 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 	// and ignore the chart cache
 	if server.AlwaysRegenerateIndex /* the flag is set */ ||
 		(!server.AlwaysRegenerateIndex && len(entry.RepoIndex.Entries) == 0) /* initial */ {
+		if server.StaleWhileRevalidate && server.canServeStale(entry) {
+			server.revalidateInBackground(repo, entry)
+			return entry.RepoIndex, StaleWarning, nil
+		}
+
 		fo := <-server.getChartList(log, repo)
 
 		if fo.err != nil {
@@ -53,36 +66,40 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 			log(cm_logger.ErrorLevel, errStr,
 				"repo", repo,
 			)
-			return nil, &HTTPError{http.StatusInternalServerError, errStr}
+			if server.canServeStale(entry) {
+				return entry.RepoIndex, RevalidationFailedWarning, nil
+			}
+			return nil, "", &HTTPError{http.StatusInternalServerError, errStr}
 		}
 
-		objects := server.getRepoObjectSlice(entry)
-		diff := cm_storage.GetObjectSliceDiff(objects, fo.objects, server.TimestampTolerance)
+		diff := server.getObjectSliceDiff(entry, fo)
 
 		// return fast if no changes
 		if !diff.Change {
 			log(cm_logger.DebugLevel, "No change detected between cache and storage",
 				"repo", repo,
 			)
+			if fo.checksums != nil {
+				entry.RepoIndex.SetChecksums(fo.checksums)
+			}
 		} else {
-			ir := <-server.regenerateRepositoryIndex(log, entry, diff)
+			ir := <-server.regenerateRepositoryIndex(log, entry, diff, fo.checksums)
 			if ir.err != nil {
 				errStr := ir.err.Error()
 				log(cm_logger.ErrorLevel, errStr,
 					"repo", repo,
 				)
-				return ir.index, &HTTPError{http.StatusInternalServerError, errStr}
+				if server.canServeStale(entry) {
+					return entry.RepoIndex, RevalidationFailedWarning, nil
+				}
+				return ir.index, "", &HTTPError{http.StatusInternalServerError, errStr}
 			}
 			entry.RepoIndex = ir.index
-
-			if server.UseStatefiles {
-				// Dont wait, save index-cache.yaml to storage in the background.
-				// It is not crucial if this does not succeed, we will just log any errors
-				go server.saveStatefile(log, repo, ir.index.Raw)
-			}
+			server.persistStatefile(log, repo, ir.index)
 		}
+		entry.Refreshed = true
 	}
-	return entry.RepoIndex, nil
+	return entry.RepoIndex, "", nil
 }
 
 func (server *MultiTenantServer) saveStatefile(log cm_logger.LoggingFn, repo string, content []byte) {
@@ -105,6 +122,47 @@ func (server *MultiTenantServer) getRepoObjectSliceWithLock(entry *cacheEntry) [
 	return server.getRepoObjectSlice(entry)
 }
 
+func (server *MultiTenantServer) getObjectSliceDiffWithLock(entry *cacheEntry, fo fetchedObjects) cm_storage.ObjectSliceDiff {
+	entry.RepoLock.RLock()
+	defer entry.RepoLock.RUnlock()
+
+	return server.getObjectSliceDiff(entry, fo)
+}
+
+// getObjectSliceDiff compares the packages in the index with the ones fetched from storage.
+// Packages with a checksum both recorded in the index and listed by the backend are compared
+// by checksum, which is immune to clock skew and rewritten timestamps and catches overwrites
+// within the same second. Other packages are compared by timestamp.
+func (server *MultiTenantServer) getObjectSliceDiff(entry *cacheEntry, fo fetchedObjects) cm_storage.ObjectSliceDiff {
+	objects := server.getRepoObjectSlice(entry)
+	diff := cm_storage.GetObjectSliceDiff(objects, fo.objects, server.TimestampTolerance)
+	if len(fo.checksums) == 0 || len(entry.RepoIndex.Checksums) == 0 {
+		return diff
+	}
+
+	prev := make(map[string]cm_storage.Object, len(objects))
+	for _, object := range objects {
+		prev[object.Path] = object
+	}
+	diff.Updated = nil
+	for _, c := range fo.objects {
+		p, found := prev[c.Path]
+		if !found {
+			continue
+		}
+		prevChecksum, currChecksum := entry.RepoIndex.Checksum(c.Path), fo.checksums[c.Path]
+		if prevChecksum != "" && currChecksum != "" {
+			if prevChecksum != currChecksum {
+				diff.Updated = append(diff.Updated, c)
+			}
+		} else if c.LastModified.Sub(p.LastModified) > server.TimestampTolerance {
+			diff.Updated = append(diff.Updated, c)
+		}
+	}
+	diff.Change = len(diff.Removed)+len(diff.Added)+len(diff.Updated) > 0
+	return diff
+}
+
 func (server *MultiTenantServer) getRepoObjectSlice(entry *cacheEntry) []cm_storage.Object {
 	var objects []cm_storage.Object
 	for _, entry := range entry.RepoIndex.Entries {
@@ -0,0 +1,131 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	cm_storage "github.com/chartmuseum/storage"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+// loadMetadataIndex builds the index of a repo from the metadata store, if the repo is in it
+func (server *MultiTenantServer) loadMetadataIndex(log cm_logger.LoggingFn, repo string, serverInfo *cm_repo.ServerInfo) (*cm_repo.Index, bool) {
+	found, err := server.MetadataStore.HasTenant(repo)
+	if err == nil && found {
+		var entries map[string]helm_repo.ChartVersions
+		entries, err = server.MetadataStore.ChartVersions(repo)
+		if err == nil {
+			// chart URLs are stored as found in the index, so entries are not added again
+			index := cm_repo.NewIndex(server.repoChartURL(repo), repo, serverInfo, server.JSONIndex)
+			index.Entries = entries
+			err = index.Regenerate()
+			if err == nil {
+				log(cm_logger.DebugLevel, "Index loaded from metadata store",
+					"repo", repo,
+				)
+				return index, true
+			}
+		}
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Unable to load index from metadata store",
+			"repo", repo,
+			"error", err.Error(),
+		)
+	}
+	return nil, false
+}
+
+// syncMetadataStore applies the diff used to regenerate the index of a repo to the metadata store.
+// Repos missing from the store are added with all their chart versions.
+func (server *MultiTenantServer) syncMetadataStore(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, diff cm_storage.ObjectSliceDiff) {
+	if server.MetadataStore == nil {
+		return
+	}
+	found, err := server.MetadataStore.HasTenant(repo)
+	if err == nil && !found {
+		err = server.MetadataStore.ReplaceTenant(repo, index.Entries)
+	}
+	if err == nil && found {
+		for _, object := range diff.Removed {
+			removed, cvErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{Path: object.Path})
+			if cvErr != nil {
+				continue
+			}
+			if err = server.MetadataStore.DeleteChartVersion(repo, removed.Name, removed.Version); err != nil {
+				break
+			}
+		}
+		changed := append(append([]cm_storage.Object{}, diff.Updated...), diff.Added...)
+		for _, object := range changed {
+			if err != nil {
+				break
+			}
+			filename, cvErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{Path: object.Path})
+			if cvErr != nil {
+				continue
+			}
+			chartVersion, getErr := index.Get(filename.Name, filename.Version)
+			if getErr != nil {
+				// invalid package, not in the index
+				continue
+			}
+			err = server.MetadataStore.PutChartVersion(repo, chartVersion)
+		}
+	}
+	server.logMetadataStoreError(log, repo, err)
+}
+
+// updateMetadataStore applies an upload or delete event to the metadata store
+func (server *MultiTenantServer) updateMetadataStore(log cm_logger.LoggingFn, repo string, opType operationType, chartVersion *helm_repo.ChartVersion) {
+	if server.MetadataStore == nil {
+		return
+	}
+	var err error
+	if opType == deleteChart {
+		err = server.MetadataStore.DeleteChartVersion(repo, chartVersion.Name, chartVersion.Version)
+	} else {
+		err = server.MetadataStore.PutChartVersion(repo, chartVersion)
+	}
+	server.logMetadataStoreError(log, repo, err)
+}
+
+// replaceMetadataTenant stores all the chart versions of a freshly loaded index
+func (server *MultiTenantServer) replaceMetadataTenant(log cm_logger.LoggingFn, repo string, index *cm_repo.Index) {
+	err := server.MetadataStore.ReplaceTenant(repo, index.Entries)
+	server.logMetadataStoreError(log, repo, err)
+}
+
+// invalidateMetadataTenant removes a repo from the metadata store, so that its index gets loaded from storage
+func (server *MultiTenantServer) invalidateMetadataTenant(log cm_logger.LoggingFn, repo string) {
+	if server.MetadataStore == nil {
+		return
+	}
+	err := server.MetadataStore.DeleteTenant(repo)
+	server.logMetadataStoreError(log, repo, err)
+}
+
+func (server *MultiTenantServer) logMetadataStoreError(log cm_logger.LoggingFn, repo string, err error) {
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Metadata store error",
+			"repo", repo,
+			"error", err.Error(),
+		)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Lookups of the in-memory cache which found an entry
+	cacheHitsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "cache_hits_total",
+			Help:      "Number of in-memory cache lookups which found an entry",
+		},
+	)
+	// Lookups of the in-memory cache which did not find an entry
+	cacheMissesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "cache_misses_total",
+			Help:      "Number of in-memory cache lookups which did not find an entry",
+		},
+	)
+	// Tenants evicted from the in-memory cache
+	cacheEvictionsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "cache_evictions_total",
+			Help:      "Number of tenants evicted from the in-memory cache",
+		},
+	)
+	// Tenants tracked by the in-memory cache
+	cacheTenantsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "chartmuseum",
+			Name:      "cache_tenants",
+			Help:      "Current number of tenants held in the in-memory cache",
+		},
+	)
+	// Chart packages downloaded again by the scrubber
+	scrubbedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "scrubbed_objects_total",
+			Help:      "Number of chart packages whose digest was verified again",
+		},
+	)
+	// Chart packages which no longer match the digest they were indexed with
+	scrubMismatchesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "scrub_mismatches_total",
+			Help:      "Number of chart packages found with another digest than the indexed one",
+		},
+		[]string{"repo"},
+	)
+	// Chart packages which could not be verified
+	scrubErrorsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "scrub_errors_total",
+			Help:      "Number of chart packages whose digest could not be verified",
+		},
+	)
+	// Chart versions deleted by the retention rules
+	retentionDeletionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "retention_deletions_total",
+			Help:      "Number of chart versions deleted by the retention rules",
+		},
+		[]string{"repo"},
+	)
+	// Garbage files deleted from storage
+	gcDeletedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "chartmuseum",
+			Name:      "gc_deleted_objects_total",
+			Help:      "Number of garbage files deleted from storage",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheHitsCounter, cacheMissesCounter, cacheEvictionsCounter, cacheTenantsGauge)
+	prometheus.MustRegister(scrubbedCounter, scrubMismatchesCounter, scrubErrorsCounter)
+	prometheus.MustRegister(retentionDeletionsCounter, gcDeletedCounter)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (server *MultiTenantServer) initMirrorReconcileTimer() {
+	if server.MirrorReconciler == nil || server.ReconcileInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(server.ReconcileInterval)
+		for range t.C {
+			server.reconcileMirror()
+		}
+	}()
+}
+
+// reconcileMirror repairs drift between mirrored storage backends, for every repo in storage
+func (server *MultiTenantServer) reconcileMirror() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, repo := range server.storageRepos(log) {
+		for _, prefix := range storagePrefixes(repo) {
+			report, err := server.MirrorReconciler.Reconcile(prefix)
+			if err != nil {
+				log(cm_logger.ErrorLevel, "Unable to reconcile storage mirror",
+					"repo", repo,
+					"prefix", prefix,
+					"error", err.Error(),
+				)
+				continue
+			}
+			for path, err := range report.Failed {
+				log(cm_logger.WarnLevel, "Unable to reconcile storage object",
+					"repo", repo,
+					"path", path,
+					"error", err.Error(),
+				)
+			}
+			if report.Copied > 0 || report.Deleted > 0 {
+				log(cm_logger.InfoLevel, "Reconciled storage mirror",
+					"repo", repo,
+					"prefix", prefix,
+					"copied", report.Copied,
+					"deleted", report.Deleted,
+				)
+			}
+		}
+	}
+}
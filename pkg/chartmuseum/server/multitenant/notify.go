@@ -0,0 +1,153 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+)
+
+type (
+	// notification is an index change published to the peer replicas over the bus
+	notification struct {
+		Origin       string                  `json:"origin"`
+		RepoName     string                  `json:"repo_name"`
+		OpType       operationType           `json:"operation_type"`
+		ChartVersion *helm_repo.ChartVersion `json:"chart_version,omitempty"`
+	}
+)
+
+// startNotificationListener subscribes to the changes made by the peer replicas
+func (server *MultiTenantServer) startNotificationListener() error {
+	if server.Bus == nil {
+		return nil
+	}
+	server.Router.Logger.Debug("Starting notification listener")
+	return server.Bus.Subscribe(server.handleNotification)
+}
+
+// encodeNotification encodes the notification of an event, nil if there is no bus
+func (server *MultiTenantServer) encodeNotification(log cm_logger.LoggingFn, e event) []byte {
+	if server.Bus == nil {
+		return nil
+	}
+	message, err := json.Marshal(notification{
+		Origin:       server.ReplicaID,
+		RepoName:     e.RepoName,
+		OpType:       e.OpType,
+		ChartVersion: e.ChartVersion,
+	})
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error encoding notification",
+			"repo", e.RepoName,
+			"error", err.Error(),
+		)
+		return nil
+	}
+	return message
+}
+
+// publishNotification publishes a notification once the event has been handled locally
+func (server *MultiTenantServer) publishNotification(log cm_logger.LoggingFn, repo string, message []byte) {
+	if server.Bus == nil || message == nil {
+		return
+	}
+	err := server.Bus.Publish(message)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error publishing notification",
+			"repo", repo,
+			"error", err.Error(),
+		)
+	}
+}
+
+// handleNotification applies the change made by a peer to the in-memory index of the repo, if loaded.
+// The cache store and statefile have already been saved by the peer. Changes which cannot be applied
+// invalidate the in-memory entry, so that it gets reloaded on the next request.
+func (server *MultiTenantServer) handleNotification(message []byte) {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	n := &notification{}
+	err := json.Unmarshal(message, n)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Invalid notification received",
+			"error", err.Error(),
+		)
+		return
+	}
+	if n.Origin == server.ReplicaID {
+		return
+	}
+	repo := n.RepoName
+	log(cm_logger.DebugLevel, "Notification received",
+		"repo", repo,
+		"origin", n.Origin,
+		"operation_type", n.OpType,
+	)
+
+	if n.ChartVersion == nil {
+		server.invalidateStorageRepo(repo)
+		server.invalidateTenant(log, repo)
+		return
+	}
+	server.invalidateStorageObjects(repo, n.OpType, n.ChartVersion)
+
+	entry, ok := server.InternalCacheStore.Peek(repo)
+	if !ok {
+		if n.OpType == deleteChart {
+			server.updateMetadataStore(log, repo, n.OpType, n.ChartVersion)
+		} else {
+			// not loaded here, the metadata store is refreshed along with the index
+			server.invalidateMetadataTenant(log, repo)
+		}
+		return
+	}
+
+	entry.RepoLock.Lock()
+	if !applyEvent(entry.RepoIndex, n.OpType, n.ChartVersion) {
+		entry.RepoLock.Unlock()
+		server.invalidateTenant(log, repo)
+		return
+	}
+	err = entry.RepoIndex.Regenerate()
+	entry.RepoLock.Unlock()
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error regenerating index",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		server.invalidateTenant(log, repo)
+		return
+	}
+	server.updateMetadataStore(log, repo, n.OpType, n.ChartVersion)
+}
+
+// invalidateTenant drops the in-memory entry of a repo
+func (server *MultiTenantServer) invalidateTenant(log cm_logger.LoggingFn, repo string) {
+	server.TenantCacheKeyLock.Lock()
+	server.InternalCacheStore.Remove(repo)
+	delete(server.Tenants, repo)
+	server.TenantCacheKeyLock.Unlock()
+	server.invalidateMetadataTenant(log, repo)
+	log(cm_logger.DebugLevel, "Entry invalidated",
+		"repo", repo,
+	)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	pathutil "path"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+type (
+	// chartVersionLock is the content of the lock protecting a chart version through the API
+	chartVersionLock struct {
+		Name    string    `json:"name"`
+		Version string    `json:"version"`
+		Locked  time.Time `json:"locked"`
+	}
+
+	// protectionStatus tells whether a chart version is protected, by a rule of the protection
+	// policy or a lock
+	protectionStatus struct {
+		Protected bool   `json:"protected"`
+		Rule      string `json:"rule,omitempty"`
+		Locked    bool   `json:"locked"`
+	}
+)
+
+// getProtectionStatus returns whether a chart version of a repo is protected and why. Failing
+// to tell whether it is locked is an error, rather than a reason to let it be overwritten or deleted.
+func (server *MultiTenantServer) getProtectionStatus(repo string, name string, version string) (protectionStatus, *HTTPError) {
+	var status protectionStatus
+	if server.ProtectionPolicy != nil {
+		status.Rule, status.Protected = server.ProtectionPolicy.Protects(repo, name, version)
+	}
+	locked, err := server.isLocked(repo, name, version)
+	if err != nil {
+		return status, &HTTPError{http.StatusServiceUnavailable, fmt.Sprintf("unable to read the lock of chart version %s-%s: %s", name, version, err)}
+	}
+	if locked {
+		status.Locked = true
+		status.Protected = true
+	}
+	return status, nil
+}
+
+// isLocked reports whether a chart version of a repo is locked. Backends do not tell a missing
+// object from a failed read, so the lock is only considered missing if it is not listed either.
+func (server *MultiTenantServer) isLocked(repo string, name string, version string) (bool, error) {
+	path := lockPath(repo, name, version)
+	_, getErr := server.StorageBackend.GetObject(path)
+	if getErr == nil {
+		return true, nil
+	}
+	objects, err := server.StorageBackend.ListObjects(pathutil.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object.Path == pathutil.Base(path) {
+			return false, getErr
+		}
+	}
+	return false, nil
+}
+
+// checkProtection returns an error with the given status if a chart version of a repo is
+// protected from being overwritten or deleted
+func (server *MultiTenantServer) checkProtection(repo string, name string, version string, status int) *HTTPError {
+	protection, err := server.getProtectionStatus(repo, name, version)
+	switch {
+	case err != nil:
+		return err
+	case protection.Rule != "":
+		return &HTTPError{status, fmt.Sprintf("chart version %s-%s is protected by rule %q", name, version, protection.Rule)}
+	case protection.Locked:
+		return &HTTPError{status, fmt.Sprintf("chart version %s-%s is locked", name, version)}
+	}
+	return nil
+}
+
+// checkFileProtection checks the protection of the chart version of a chart package or provenance file
+func (server *MultiTenantServer) checkFileProtection(repo string, filename string, status int) *HTTPError {
+	nameVersion := strings.TrimSuffix(filename, "."+cm_repo.ProvenanceFileExtension)
+	nameVersion = strings.TrimSuffix(nameVersion, "."+cm_repo.ChartPackageFileExtension)
+	name, version := cm_repo.GetExactChartNameVersion(nameVersion)
+	return server.checkProtection(repo, name, version, status)
+}
+
+// lockChartVersion protects an existing chart version from being overwritten or deleted,
+// until unlocked
+func (server *MultiTenantServer) lockChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	if _, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename)); err != nil {
+		return &HTTPError{http.StatusNotFound, "chart version not found"}
+	}
+	content, err := json.Marshal(chartVersionLock{Name: name, Version: version, Locked: time.Now()})
+	if err != nil {
+		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	log(cm_logger.DebugLevel, "Locking chart version",
+		"package", pathutil.Join(repo, filename),
+	)
+	if err := server.StorageBackend.PutObject(lockPath(repo, name, version), content); err != nil {
+		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+// unlockChartVersion removes the lock of a chart version. Chart versions protected by a rule
+// of the protection policy remain protected.
+func (server *MultiTenantServer) unlockChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	locked, err := server.isLocked(repo, name, version)
+	if err != nil {
+		return &HTTPError{http.StatusServiceUnavailable, err.Error()}
+	}
+	if !locked {
+		return &HTTPError{http.StatusNotFound, "chart version not locked"}
+	}
+	log(cm_logger.DebugLevel, "Unlocking chart version",
+		"package", pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(name, version)),
+	)
+	if err := server.StorageBackend.DeleteObject(lockPath(repo, name, version)); err != nil {
+		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+func lockPath(repo string, name string, version string) string {
+	return pathutil.Join(repo, cm_repo.ProtectedDirname, name+"-"+version)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	"helm.sh/chartmuseum/pkg/retention"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+func (server *MultiTenantServer) initRetentionTimer() {
+	if server.RetentionPolicy == nil || server.RetentionInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(server.RetentionInterval)
+		for range t.C {
+			server.enforceRetention()
+		}
+	}()
+}
+
+// enforceRetention applies the retention rules to every repo in storage
+func (server *MultiTenantServer) enforceRetention() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, repo := range server.storageRepos(log) {
+		server.applyRetention(log, repo, nil, server.RetentionDryRun)
+	}
+}
+
+// applyRetentionOnUpload applies the retention rules to the versions of an uploaded chart,
+// never deleting the uploaded version itself
+func (server *MultiTenantServer) applyRetentionOnUpload(log cm_logger.LoggingFn, repo string, uploaded *helm_repo.ChartVersion) {
+	if server.RetentionPolicy == nil || uploaded == nil {
+		return
+	}
+	server.applyRetention(log, repo, uploaded, server.RetentionDryRun)
+}
+
+// applyRetention evaluates the retention rules against the index of a repo, or only the versions
+// of the uploaded chart if set, and deletes the chart versions they match unless dryRun
+func (server *MultiTenantServer) applyRetention(log cm_logger.LoggingFn, repo string, uploaded *helm_repo.ChartVersion, dryRun bool) ([]retention.Deletion, *HTTPError) {
+	deletions := []retention.Deletion{}
+	if server.RetentionPolicy == nil {
+		return deletions, nil
+	}
+	index, err := server.getIndexFile(log, repo)
+	if err != nil {
+		return nil, err
+	}
+	var chartVersions []*helm_repo.ChartVersion
+	if uploaded != nil {
+		// the index may not have been updated with the uploaded version yet
+		chartVersions = append(chartVersions, uploaded)
+		for _, chartVersion := range index.Entries[uploaded.Name] {
+			if chartVersion.Version != uploaded.Version {
+				chartVersions = append(chartVersions, chartVersion)
+			}
+		}
+	} else {
+		for _, versions := range index.Entries {
+			chartVersions = append(chartVersions, versions...)
+		}
+	}
+
+	for _, deletion := range server.RetentionPolicy.Evaluate(repo, chartVersions, time.Now()) {
+		if uploaded != nil && deletion.Version == uploaded.Version {
+			continue
+		}
+		protection, err := server.getProtectionStatus(repo, deletion.Name, deletion.Version)
+		if err != nil {
+			log(cm_logger.WarnLevel, "Unable to check the protection of chart version, keeping it",
+				"repo", repo,
+				"name", deletion.Name,
+				"version", deletion.Version,
+				"error", err.Message,
+			)
+			continue
+		}
+		if protection.Protected {
+			continue
+		}
+		deletions = append(deletions, deletion)
+		log(cm_logger.InfoLevel, "Deleting chart version per retention rule",
+			"repo", repo,
+			"name", deletion.Name,
+			"version", deletion.Version,
+			"rule", deletion.Rule,
+			"dry_run", dryRun,
+		)
+		if dryRun {
+			continue
+		}
+		if err := server.deleteChartVersion(log, repo, deletion.Name, deletion.Version); err != nil {
+			log(cm_logger.WarnLevel, "Unable to delete chart version per retention rule",
+				"repo", repo,
+				"name", deletion.Name,
+				"version", deletion.Version,
+				"error", err.Message,
+			)
+			continue
+		}
+		retentionDeletionsCounter.WithLabelValues(repo).Inc()
+		server.emitEvent(&gin.Context{}, repo, deleteChart, &helm_repo.ChartVersion{
+			Metadata: &chart.Metadata{
+				Name:    deletion.Name,
+				Version: deletion.Version,
+			},
+		})
+	}
+	return deletions, nil
+}
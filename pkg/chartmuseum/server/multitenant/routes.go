@@ -19,6 +19,7 @@ package multitenant
 import (
 	cm_auth "github.com/chartmuseum/auth"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
 )
 
@@ -49,8 +50,13 @@ func (s *MultiTenantServer) Routes() []*cm_router.Route {
 		{Method: "GET", Path: "/api/:repo/charts/:name/:version", Handler: s.getChartVersionRequestHandler, Action: cm_auth.PullAction},
 		{Method: "GET", Path: "/api/:repo/charts/:name/:version/templates", Handler: s.getStorageObjectTemplateRequestHandler, Action: cm_auth.PullAction},
 		{Method: "GET", Path: "/api/:repo/charts/:name/:version/values", Handler: s.getStorageObjectValuesRequestHandler, Action: cm_auth.PullAction},
+		{Method: "GET", Path: "/api/:repo/charts/:name/:version/lock", Handler: s.getChartVersionLockRequestHandler, Action: cm_auth.PullAction},
+		{Method: "POST", Path: "/api/:repo/charts/:name/:version/lock", Handler: s.lockChartVersionRequestHandler, Action: cm_auth.PushAction},
 		{Method: "POST", Path: "/api/:repo/charts", Handler: s.postRequestHandler, Action: cm_auth.PushAction},
 		{Method: "POST", Path: "/api/:repo/prov", Handler: s.postProvenanceFileRequestHandler, Action: cm_auth.PushAction},
+		{Method: "GET", Path: "/api/:repo/fsck", Handler: s.getFsckRequestHandler, Action: cm_auth.PushAction},
+		{Method: "GET", Path: "/api/:repo/gc", Handler: s.getGCRequestHandler, Action: cm_auth.PushAction},
+		{Method: "GET", Path: "/api/:repo/retention", Handler: s.getRetentionRequestHandler, Action: cm_auth.PushAction},
 	}
 
 	routes = append(routes, serverInfoRoutes...)
@@ -69,12 +75,40 @@ func (s *MultiTenantServer) Routes() []*cm_router.Route {
 		})
 	}
 
+	// signed URLs are served by ChartMuseum itself for the local filesystem backend, the
+	// signature stands for authorization
+	if _, ok := s.URLSigner.(*cm_backend.LocalURLSigner); ok {
+		routes = append(routes, &cm_router.Route{
+			Method:  "GET",
+			Path:    "/:repo/signed/:filename",
+			Handler: s.getSignedStorageObjectRequestHandler,
+			Action:  "",
+		})
+	}
+
 	if s.APIEnabled {
 		routes = append(routes, chartManipulationRoutes...)
 	}
 
+	// anyone allowed to push could otherwise lift the locks protecting chart versions
+	if s.APIEnabled && s.AllowUnlock {
+		routes = append(routes, &cm_router.Route{Method: "DELETE", Path: "/api/:repo/charts/:name/:version/lock", Handler: s.unlockChartVersionRequestHandler, Action: cm_auth.PushAction})
+	}
+
 	if s.APIEnabled && !s.DisableDelete {
 		routes = append(routes, &cm_router.Route{Method: "DELETE", Path: "/api/:repo/charts/:name/:version", Handler: s.deleteChartVersionRequestHandler, Action: cm_auth.PushAction})
+		// repairs may delete files
+		routes = append(routes, &cm_router.Route{Method: "POST", Path: "/api/:repo/fsck", Handler: s.postFsckRequestHandler, Action: cm_auth.PushAction})
+		routes = append(routes, &cm_router.Route{Method: "POST", Path: "/api/:repo/gc", Handler: s.postGCRequestHandler, Action: cm_auth.PushAction})
+	}
+
+	if s.APIEnabled && !s.DisableDelete && s.Trash {
+		routes = append(routes, []*cm_router.Route{
+			{Method: "GET", Path: "/api/:repo/trash", Handler: s.getTrashRequestHandler, Action: cm_auth.PushAction},
+			{Method: "DELETE", Path: "/api/:repo/trash", Handler: s.deleteTrashRequestHandler, Action: cm_auth.PushAction},
+			{Method: "POST", Path: "/api/:repo/trash/:name/:version/restore", Handler: s.restoreTrashChartVersionRequestHandler, Action: cm_auth.PushAction},
+			{Method: "DELETE", Path: "/api/:repo/trash/:name/:version", Handler: s.deleteTrashChartVersionRequestHandler, Action: cm_auth.PushAction},
+		}...)
 	}
 
 	return routes
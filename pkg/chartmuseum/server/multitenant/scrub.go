@@ -0,0 +1,207 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	pathutil "path"
+	"time"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+func (server *MultiTenantServer) initScrubTimer() {
+	if server.ScrubInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(server.ScrubInterval)
+		for range t.C {
+			server.scrub()
+		}
+	}()
+}
+
+// scrub downloads the chart packages of every repo in storage again, at most ScrubRateLimit per
+// second, to detect the ones which no longer match the digest they were indexed with
+func (server *MultiTenantServer) scrub() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	var throttle <-chan time.Time
+	if server.ScrubRateLimit > 0 {
+		t := time.NewTicker(time.Second / time.Duration(server.ScrubRateLimit))
+		defer t.Stop()
+		throttle = t.C
+	}
+	for _, repo := range server.storageRepos(log) {
+		scrubbed, mismatches := 0, 0
+		for _, chartVersion := range server.indexedChartVersions(log, repo) {
+			if throttle != nil {
+				<-throttle
+			}
+			ok, err := server.scrubChartVersion(log, repo, chartVersion)
+			if err != nil {
+				scrubErrorsCounter.Inc()
+				log(cm_logger.WarnLevel, "Unable to scrub chart package",
+					"repo", repo,
+					"name", chartVersion.Name,
+					"version", chartVersion.Version,
+					"error", err.Error(),
+				)
+				continue
+			}
+			scrubbed++
+			if !ok {
+				mismatches++
+			}
+		}
+		log(cm_logger.DebugLevel, "Repo scrubbed",
+			"repo", repo,
+			"scrubbed", scrubbed,
+			"mismatches", mismatches,
+		)
+	}
+}
+
+// indexedChartVersions returns the chart versions of the index of a repo, loading it in cache
+// if needed
+func (server *MultiTenantServer) indexedChartVersions(log cm_logger.LoggingFn, repo string) []*helm_repo.ChartVersion {
+	if _, err := server.getIndexFile(log, repo); err != nil {
+		return nil
+	}
+	entry, ok := server.InternalCacheStore.Peek(repo)
+	if !ok {
+		return nil
+	}
+	entry.RepoLock.RLock()
+	defer entry.RepoLock.RUnlock()
+	var chartVersions []*helm_repo.ChartVersion
+	for _, versions := range entry.RepoIndex.Entries {
+		for _, chartVersion := range versions {
+			if chartVersion.Digest != "" && len(chartVersion.URLs) > 0 {
+				chartVersions = append(chartVersions, chartVersion)
+			}
+		}
+	}
+	return chartVersions
+}
+
+// scrubChartVersion computes the digest of a chart package from storage, bypassing caches,
+// and reports whether it matches the indexed one. Mismatching packages are quarantined if enabled.
+func (server *MultiTenantServer) scrubChartVersion(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion) (bool, error) {
+	filename := pathutil.Base(chartVersion.URLs[0])
+	digest, err := server.storageDigest(repo, filename)
+	if err != nil {
+		return false, err
+	}
+	scrubbedCounter.Inc()
+	if digest == chartVersion.Digest {
+		return true, nil
+	}
+
+	// the package may have been overwritten since the index was read: check it again
+	// against the current index, with uploads of the package locked out
+	unlock, err := server.lockObject(log, repo, filename)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	indexedDigest, ok := server.indexedDigest(repo, chartVersion.Name, chartVersion.Version)
+	if !ok {
+		// deleted meanwhile
+		return true, nil
+	}
+	digest, err = server.storageDigest(repo, filename)
+	if err != nil {
+		return false, err
+	}
+	if digest == indexedDigest {
+		return true, nil
+	}
+
+	scrubMismatchesCounter.WithLabelValues(repo).Inc()
+	log(cm_logger.ErrorLevel, "Chart package digest mismatch",
+		"repo", repo,
+		"package", filename,
+		"indexed_digest", indexedDigest,
+		"digest", digest,
+		"quarantine", server.ScrubQuarantine,
+	)
+	if server.ScrubQuarantine {
+		server.quarantineChartVersion(log, repo, filename, chartVersion)
+	}
+	return false, nil
+}
+
+// storageDigest computes the digest of a chart package from storage, bypassing caches
+func (server *MultiTenantServer) storageDigest(repo string, filename string) (string, error) {
+	path := pathutil.Join(repo, filename)
+	if invalidator, ok := server.StorageBackend.(cm_backend.ObjectInvalidator); ok {
+		invalidator.InvalidateObject(path)
+	}
+	_, reader, err := cm_backend.GetObjectStream(server.StorageBackend, path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return cm_repo.DigestFromReader(reader)
+}
+
+// indexedDigest returns the digest of a chart version in the current index of a repo in cache
+func (server *MultiTenantServer) indexedDigest(repo string, name string, version string) (string, bool) {
+	entry, ok := server.InternalCacheStore.Peek(repo)
+	if !ok {
+		return "", false
+	}
+	entry.RepoLock.RLock()
+	defer entry.RepoLock.RUnlock()
+	chartVersion, err := entry.RepoIndex.Get(name, version)
+	if err != nil {
+		return "", false
+	}
+	return chartVersion.Digest, true
+}
+
+// quarantineChartVersion moves a chart package and its provenance file out of the repo,
+// under its quarantine directory, and removes the chart version from the index
+func (server *MultiTenantServer) quarantineChartVersion(log cm_logger.LoggingFn, repo string, filename string, chartVersion *helm_repo.ChartVersion) {
+	for _, name := range []string{filename, cm_repo.ProvenanceFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)} {
+		path := pathutil.Join(repo, name)
+		object, err := server.StorageBackend.GetObject(path)
+		if err != nil {
+			continue // may be no prov file
+		}
+		err = server.StorageBackend.PutObject(pathutil.Join(repo, cm_repo.QuarantineDirname, name), object.Content)
+		if err == nil {
+			err = server.StorageBackend.DeleteObject(path)
+		}
+		if err != nil {
+			log(cm_logger.ErrorLevel, "Unable to quarantine storage object",
+				"repo", repo,
+				"path", path,
+				"error", err.Error(),
+			)
+			return
+		}
+	}
+	server.deleteSidecar(repo, filename)
+	server.emitEvent(&gin.Context{}, repo, deleteChart, chartVersion)
+}
@@ -25,11 +25,16 @@ import (
 
 	cm_storage "github.com/chartmuseum/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	"helm.sh/chartmuseum/pkg/cache"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
+	"helm.sh/chartmuseum/pkg/metadb"
+	"helm.sh/chartmuseum/pkg/protection"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
+	"helm.sh/chartmuseum/pkg/retention"
 )
 
 var (
@@ -38,8 +43,9 @@ var (
 )
 
 const (
-	defaultFormField = "chart"
-	defaultProvField = "prov"
+	defaultFormField       = "chart"
+	defaultProvField       = "prov"
+	defaultSignedURLExpiry = 5 * time.Minute
 )
 
 type (
@@ -50,7 +56,7 @@ type (
 		StorageBackend         cm_storage.Backend
 		TimestampTolerance     time.Duration
 		ExternalCacheStore     cache.Store
-		InternalCacheStore     memoryCacheStore
+		InternalCacheStore     *memoryCacheStore
 		MaxStorageObjects      int
 		IndexLimit             int
 		AllowOverwrite         bool
@@ -74,6 +80,31 @@ type (
 		WebTemplatePath       string
 		AlwaysRegenerateIndex bool
 		JSONIndex             bool
+		ShardedIndex          bool
+		UseSidecars           bool
+		MetadataStore         metadb.Store
+		Bus                   cache.Bus
+		ReplicaID             string
+		Locker                cache.Locker
+		StaleWhileRevalidate  bool
+		URLSigner             cm_backend.URLSigner
+		SignedURLExpiry       time.Duration
+		MirrorReconciler      cm_backend.Reconciler
+		ReconcileInterval     time.Duration
+		ScrubInterval         time.Duration
+		ScrubRateLimit        int
+		ScrubQuarantine       bool
+		RetentionPolicy       *retention.Policy
+		RetentionInterval     time.Duration
+		RetentionDryRun       bool
+		GCInterval            time.Duration
+		GCMinAge              time.Duration
+		GCUnknown             bool
+		GCDryRun              bool
+		Trash                 bool
+		TrashPurgeAfter       time.Duration
+		ProtectionPolicy      *protection.Policy
+		AllowUnlock           bool
 	}
 
 	ObjectsPerChartLimit struct {
@@ -108,17 +139,74 @@ type (
 		EnforceSemver2        bool
 		AlwaysRegenerateIndex bool
 		JSONIndex             bool
+		// ShardedIndex stores the statefile and the external cache entry per chart name
+		ShardedIndex bool
+		// UseSidecars writes a metadata sidecar for each uploaded package and reads it when reindexing
+		UseSidecars bool
+		// MetadataStore holds the chart versions of each repo, the index is loaded from it when possible
+		MetadataStore metadb.Store
+		// CacheMaxTenants bounds the number of tenants held in memory (0 for no bound)
+		CacheMaxTenants int
+		// CacheTenantIdleTimeout evicts tenants from memory once idle for that long (0 to keep them)
+		CacheTenantIdleTimeout time.Duration
+		// Bus publishes the index changes to the peer replicas and receives theirs
+		Bus cache.Bus
+		// Locker serializes uploads of the same file and per-chart limit enforcement,
+		// across replicas when shared (in-process if nil)
+		Locker cache.Locker
+		// StaleWhileRevalidate serves the cached index right away when it would be regenerated
+		// (see AlwaysRegenerateIndex), refreshing it in the background
+		StaleWhileRevalidate bool
+		// URLSigner redirects chart downloads to signed URLs, valid for SignedURLExpiry (proxied if nil)
+		URLSigner       cm_backend.URLSigner
+		SignedURLExpiry time.Duration
+		// MirrorReconciler repairs drift between mirrored storage backends every ReconcileInterval
+		MirrorReconciler  cm_backend.Reconciler
+		ReconcileInterval time.Duration
+		// ScrubInterval is the interval at which the digests of the indexed chart packages are
+		// verified again, at most ScrubRateLimit packages per second (0 for no limit). Mismatching
+		// packages are moved to the quarantine directory of their repo with ScrubQuarantine.
+		ScrubInterval   time.Duration
+		ScrubRateLimit  int
+		ScrubQuarantine bool
+		// RetentionPolicy deletes the chart versions matching its rules after each upload, and
+		// from every repo in cache every RetentionInterval (0 to disable). With RetentionDryRun,
+		// the chart versions are only logged.
+		RetentionPolicy   *retention.Policy
+		RetentionInterval time.Duration
+		RetentionDryRun   bool
+		// GCInterval is the interval at which the garbage of the repos in cache is deleted:
+		// orphaned provenance files and sidecars and partial uploads modified at least GCMinAge
+		// ago, and unknown files with GCUnknown. With GCDryRun, the garbage is only logged.
+		GCInterval time.Duration
+		GCMinAge   time.Duration
+		GCUnknown  bool
+		GCDryRun   bool
+		// Trash moves the deleted chart versions to the trash directory of their repo, from which
+		// they can be restored until purged, automatically TrashPurgeAfter (0 to keep them)
+		Trash           bool
+		TrashPurgeAfter time.Duration
+		// ProtectionPolicy prevents the chart versions matching its rules from being overwritten
+		// or deleted, like the chart versions locked through the API
+		ProtectionPolicy *protection.Policy
+		// AllowUnlock enables the route unlocking chart versions: without it, locks can only be
+		// removed from storage
+		AllowUnlock bool
 	}
 
 	tenantInternals struct {
 		FetchedObjectsLock      *sync.Mutex
 		FetchedObjectsChans     []chan fetchedObjects
 		RegeneratedIndexesChans []chan indexRegeneration
+		StatefileShards         *shardDigests
+		// Revalidating is set while the index is refreshed in the background
+		Revalidating int32
 	}
 
 	fetchedObjects struct {
-		objects []cm_storage.Object
-		err     error
+		objects   []cm_storage.Object
+		checksums map[string]string
+		err       error
 	}
 
 	indexRegeneration struct {
@@ -147,7 +235,7 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 		StorageBackend:         options.StorageBackend,
 		TimestampTolerance:     options.TimestampTolerance,
 		ExternalCacheStore:     options.ExternalCacheStore,
-		InternalCacheStore:     memoryCacheStore{},
+		InternalCacheStore:     newMemoryCacheStore(options.CacheMaxTenants, options.CacheTenantIdleTimeout),
 		MaxStorageObjects:      options.MaxStorageObjects,
 		IndexLimit:             options.IndexLimit,
 		ChartURL:               chartURL,
@@ -169,6 +257,37 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 		ArtifactHubRepoID:      options.ArtifactHubRepoID,
 		AlwaysRegenerateIndex:  options.AlwaysRegenerateIndex,
 		JSONIndex:              options.JSONIndex,
+		ShardedIndex:           options.ShardedIndex,
+		UseSidecars:            options.UseSidecars,
+		MetadataStore:          options.MetadataStore,
+		Bus:                    options.Bus,
+		ReplicaID:              uuid.Must(uuid.NewV4()).String(),
+		Locker:                 options.Locker,
+		StaleWhileRevalidate:   options.StaleWhileRevalidate,
+		URLSigner:              options.URLSigner,
+		SignedURLExpiry:        options.SignedURLExpiry,
+		MirrorReconciler:       options.MirrorReconciler,
+		ReconcileInterval:      options.ReconcileInterval,
+		ScrubInterval:          options.ScrubInterval,
+		ScrubRateLimit:         options.ScrubRateLimit,
+		ScrubQuarantine:        options.ScrubQuarantine,
+		RetentionPolicy:        options.RetentionPolicy,
+		RetentionInterval:      options.RetentionInterval,
+		RetentionDryRun:        options.RetentionDryRun,
+		GCInterval:             options.GCInterval,
+		GCMinAge:               options.GCMinAge,
+		GCUnknown:              options.GCUnknown,
+		GCDryRun:               options.GCDryRun,
+		Trash:                  options.Trash,
+		TrashPurgeAfter:        options.TrashPurgeAfter,
+		ProtectionPolicy:       options.ProtectionPolicy,
+		AllowUnlock:            options.AllowUnlock,
+	}
+	if server.Locker == nil {
+		server.Locker = cache.NewMemoryLocker(0)
+	}
+	if server.SignedURLExpiry <= 0 {
+		server.SignedURLExpiry = defaultSignedURLExpiry
 	}
 
 	if server.WebTemplatePath != "" {
@@ -191,6 +310,14 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 	server.EventChan = make(chan event, server.IndexLimit)
 	go server.startEventListener()
 	server.initCacheTimer()
+	server.initMirrorReconcileTimer()
+	server.initScrubTimer()
+	server.initRetentionTimer()
+	server.initGCTimer()
+	server.initTrashPurgeTimer()
+	if err == nil {
+		err = server.startNotificationListener()
+	}
 
 	return server, err
 }
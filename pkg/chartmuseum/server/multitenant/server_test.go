@@ -18,6 +18,8 @@ package multitenant
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -26,15 +28,24 @@ import (
 	"os"
 	pathutil "path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	"helm.sh/chartmuseum/pkg/cache"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
+	"helm.sh/chartmuseum/pkg/metadb"
+	"helm.sh/chartmuseum/pkg/protection"
 	"helm.sh/chartmuseum/pkg/repo"
+	"helm.sh/chartmuseum/pkg/retention"
 
+	"github.com/alicebob/miniredis"
 	"github.com/chartmuseum/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
 	"sigs.k8s.io/yaml"
 )
@@ -132,6 +143,48 @@ func (suite *MultiTenantServerTestSuite) doRequest(stype string, method string,
 	return c.Writer
 }
 
+func (suite *MultiTenantServerTestSuite) serveRequest(server *MultiTenantServer, method string, urlStr string, body io.Reader, contentType string, output ...*bytes.Buffer) gin.ResponseWriter {
+	recorder := httptest.NewRecorder()
+	if len(output) > 0 {
+		recorder.Body = output[0]
+	}
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest(method, urlStr, body)
+	if contentType != "" {
+		c.Request.Header.Set("Content-Type", contentType)
+	}
+	server.Router.HandleContext(c)
+	return c.Writer
+}
+
+// newStandaloneServer creates a depth=0 server on top of its own storage directory
+func (suite *MultiTenantServerTestSuite) newStandaloneServer(name string, options MultiTenantServerOptions) (*MultiTenantServer, string) {
+	dir := pathutil.Join(suite.TempDirectory, "standalone", name)
+	err := os.MkdirAll(dir, os.ModePerm)
+	suite.Nil(err, fmt.Sprintf("no error creating %s", dir))
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	options.Logger = logger
+	options.Router = cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         0,
+		MaxUploadSize: maxUploadSize,
+	})
+	if options.StorageBackend == nil {
+		options.StorageBackend = storage.NewLocalFilesystemBackend(dir)
+	}
+	options.EnableAPI = true
+	options.ChartPostFormFieldName = "chart"
+	options.ProvPostFormFieldName = "prov"
+	server, err := NewMultiTenantServer(options)
+	suite.Nil(err, fmt.Sprintf("no error creating %s server", name))
+	return server, dir
+}
+
 func (suite *MultiTenantServerTestSuite) copyTestFilesTo(dir string) {
 	srcFileTarball, err := os.Open(testTarballPath)
 	suite.Nil(err, "no error opening test tarball")
@@ -411,10 +464,11 @@ func (suite *MultiTenantServerTestSuite) SetupSuite() {
 		MaxUploadSize: maxUploadSize,
 	})
 
+	// own storage, the packages over the limit are deleted along with their provenance file
 	server, err = NewMultiTenantServer(MultiTenantServerOptions{
 		Logger:                 logger,
 		Router:                 router,
-		StorageBackend:         backend,
+		StorageBackend:         storage.NewLocalFilesystemBackend(pathutil.Join(suite.TempDirectory, "per-chart-limit")),
 		TimestampTolerance:     time.Duration(0),
 		EnableAPI:              true,
 		AllowOverwrite:         true,
@@ -582,50 +636,50 @@ func (suite *MultiTenantServerTestSuite) regenerateRepositoryIndex(repo string,
 	entry, err := server.initCacheEntry(log, repo)
 	suite.Nil(err, "no error on init cache entry")
 
-	objects, err := server.fetchChartsInStorage(log, repo)
+	objects, _, err := server.fetchChartsInStorage(log, repo)
 	if !isFound {
 		suite.Equal(len(objects), 0)
 		return
 	}
 	suite.Nil(err, "no error on fetchChartsInStorage")
 	diff := storage.GetObjectSliceDiff(server.getRepoObjectSliceWithLock(entry), objects, server.TimestampTolerance)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff, nil)
 	suite.Nil(err, "no error regenerating repo index")
 
 	newtime := time.Now().Add(1 * time.Hour)
 	err = os.Chtimes(suite.TestTarballFilename, newtime, newtime)
 	suite.Nil(err, "no error changing modtime on temp file")
 
-	objects, err = server.fetchChartsInStorage(log, repo)
+	objects, _, err = server.fetchChartsInStorage(log, repo)
 	suite.Nil(err, "no error on fetchChartsInStorage")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSliceWithLock(entry), objects, server.TimestampTolerance)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff, nil)
 	suite.Nil(err, "no error regenerating repo index with tarball updated")
 
 	brokenTarballFilename := pathutil.Join(suite.TempDirectory, "brokenchart.tgz")
 	destFile, err := os.Create(brokenTarballFilename)
 	suite.Nil(err, "no error creating new broken tarball in temp dir")
 	defer destFile.Close()
-	objects, err = server.fetchChartsInStorage(log, repo)
+	objects, _, err = server.fetchChartsInStorage(log, repo)
 	suite.Nil(err, "no error on fetchChartsInStorage")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSliceWithLock(entry), objects, server.TimestampTolerance)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff, nil)
 	suite.Nil(err, "error not returned with broken tarball added")
 
 	err = os.Chtimes(brokenTarballFilename, newtime, newtime)
 	suite.Nil(err, "no error changing modtime on broken tarball")
-	objects, err = server.fetchChartsInStorage(log, repo)
+	objects, _, err = server.fetchChartsInStorage(log, repo)
 	suite.Nil(err, "no error on fetchChartsInStorage")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSliceWithLock(entry), objects, server.TimestampTolerance)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff, nil)
 	suite.Nil(err, "error not returned with broken tarball updated")
 
 	err = os.Remove(brokenTarballFilename)
 	suite.Nil(err, "no error removing broken tarball")
-	objects, err = server.fetchChartsInStorage(log, repo)
+	objects, _, err = server.fetchChartsInStorage(log, repo)
 	suite.Nil(err, "no error on fetchChartsInStorage")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSliceWithLock(entry), objects, server.TimestampTolerance)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff, nil)
 	suite.Nil(err, "error not returned with broken tarball removed")
 }
 
@@ -635,6 +689,52 @@ func (suite *MultiTenantServerTestSuite) TestRegenerateRepositoryIndex() {
 	suite.regenerateRepositoryIndex("not-set-org", false)
 }
 
+func (suite *MultiTenantServerTestSuite) TestChecksumObjectSliceDiff() {
+	server := suite.Depth0Server
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	modified := time.Now().Round(time.Second)
+	chartVersion, err := repo.ChartVersionFromStorageObject(storage.Object{
+		Path:         "mychart-0.1.0.tgz",
+		Content:      content,
+		LastModified: modified,
+	})
+	suite.Nil(err, "no error reading chart version")
+
+	index := repo.NewIndex("", "", &repo.ServerInfo{}, false)
+	index.AddEntry(chartVersion)
+	index.SetChecksums(map[string]string{"mychart-0.1.0.tgz": "a"})
+	entry := &cacheEntry{RepoIndex: index}
+
+	// overwritten within the same second
+	fo := fetchedObjects{
+		objects:   []storage.Object{{Path: "mychart-0.1.0.tgz", LastModified: modified}},
+		checksums: map[string]string{"mychart-0.1.0.tgz": "b"},
+	}
+	diff := server.getObjectSliceDiff(entry, fo)
+	suite.True(diff.Change, "checksum change detected")
+	suite.Len(diff.Updated, 1, "package with new checksum updated")
+
+	// timestamp rewritten by the backend, same content
+	fo = fetchedObjects{
+		objects:   []storage.Object{{Path: "mychart-0.1.0.tgz", LastModified: modified.Add(time.Hour)}},
+		checksums: map[string]string{"mychart-0.1.0.tgz": "a"},
+	}
+	diff = server.getObjectSliceDiff(entry, fo)
+	suite.False(diff.Change, "rewritten timestamp ignored when checksum matches")
+
+	// no checksum listed, fall back to timestamps
+	fo = fetchedObjects{
+		objects: []storage.Object{{Path: "mychart-0.1.0.tgz", LastModified: modified.Add(time.Hour)}},
+	}
+	diff = server.getObjectSliceDiff(entry, fo)
+	suite.Len(diff.Updated, 1, "newer timestamp detected without checksums")
+
+	// replacing an entry forgets its checksum
+	index.UpdateEntry(chartVersion)
+	suite.Equal("", index.Checksum("mychart-0.1.0.tgz"), "checksum dropped on update")
+}
+
 func (suite *MultiTenantServerTestSuite) TestGenIndex() {
 	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
 		Debug:   true,
@@ -735,6 +835,714 @@ generated: "2018-05-23T15:14:46-05:00"`)
 	suite.Contains(suite.LastPrinted, "apiVersion:", "--gen-index prints yaml")
 }
 
+func (suite *MultiTenantServerTestSuite) TestShardedIndex() {
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	defer redisMock.Close()
+	store := cache.NewRedisStore(redisMock.Addr(), "", 0)
+
+	options := MultiTenantServerOptions{
+		ExternalCacheStore: store,
+		UseStatefiles:      true,
+		ShardedIndex:       true,
+	}
+	server, dir := suite.newStandaloneServer("sharded", options)
+	statefilePath := func(name string) string {
+		return pathutil.Join(dir, repo.StatefileShardDirname, "charts", name+".yaml")
+	}
+
+	for _, f := range []string{testTarballPath, otherTestTarballPath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test tarball")
+		res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), "201 POST /api/charts")
+	}
+
+	suite.Eventually(func() bool {
+		_, err1 := store.Get("index-cache.d/charts/mychart")
+		_, err2 := store.Get("index-cache.d/charts/otherchart")
+		return err1 == nil && err2 == nil
+	}, 5*time.Second, 50*time.Millisecond, "chart shards saved in cache store")
+	suite.Eventually(func() bool {
+		_, err1 := os.Stat(statefilePath("mychart"))
+		_, err2 := os.Stat(pathutil.Join(dir, repo.StatefileShardDirname, "manifest.yaml"))
+		return err1 == nil && err2 == nil
+	}, 5*time.Second, 50*time.Millisecond, "chart shards saved in storage")
+
+	// a new replica only reads the manifest and the shards
+	replica, _ := suite.newStandaloneServer("sharded", options)
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	entry, err := replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading sharded cache entry")
+	suite.Len(entry.RepoIndex.Entries, 2, "all charts loaded from shards")
+	suite.Contains(string(entry.RepoIndex.Raw), "otherchart", "index rendered from shards")
+
+	// deleting the last version of a chart removes its shard
+	res := suite.serveRequest(server, "DELETE", "/api/charts/otherchart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/otherchart/0.1.0")
+	suite.Eventually(func() bool {
+		_, err := store.Get("index-cache.d/charts/otherchart")
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond, "chart shard removed from cache store")
+
+	entry, err = replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error reloading sharded cache entry")
+	suite.Len(entry.RepoIndex.Entries, 1, "removed chart not loaded from shards")
+
+	// a shard which expired before the manifest is rebuilt
+	redisMock.Del("index-cache.d/charts/mychart")
+	replica, _ = suite.newStandaloneServer("sharded", options)
+	entry, err = replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading entry with missing shard")
+	suite.Len(entry.RepoIndex.Entries, 1, "charts loaded despite missing shard")
+	_, err = store.Get("index-cache.d/charts/mychart")
+	suite.Nil(err, "missing shard saved again")
+
+	// statefile shards are used when the cache is empty
+	suite.Eventually(func() bool {
+		_, err := os.Stat(statefilePath("otherchart"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond, "chart shard removed from storage")
+	redisMock.FlushAll()
+	replica, _ = suite.newStandaloneServer("sharded", options)
+	entry, err = replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading entry from statefile shards")
+	suite.Len(entry.RepoIndex.Entries, 1, "charts loaded from statefile shards")
+}
+
+func (suite *MultiTenantServerTestSuite) TestShardedIndexLockOrder() {
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	defer redisMock.Close()
+	store := cache.NewRedisStore(redisMock.Addr(), "", 0)
+	options := MultiTenantServerOptions{
+		ExternalCacheStore: store,
+		UseStatefiles:      true,
+		ShardedIndex:       true,
+	}
+	server, _ := suite.newStandaloneServer("sharded-lock-order", options)
+	upload := func(f string) {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test tarball")
+		res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), "201 POST /api/charts")
+	}
+	upload(testTarballPath)
+	upload(otherTestTarballPath)
+	suite.Eventually(func() bool {
+		_, err1 := store.Get("index-cache.d/charts/mychart")
+		_, err2 := store.Get("index-cache.d/charts/otherchart")
+		return err1 == nil && err2 == nil
+	}, 5*time.Second, 50*time.Millisecond, "chart shards saved in cache store")
+
+	replica, _ := suite.newStandaloneServer("sharded-lock-order", options)
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	entry, err := replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading sharded cache entry")
+
+	// a peer changes one shard, the other one is copied from the entry held in memory
+	manifest, err := store.Get("index-cache.d/manifest")
+	suite.Nil(err)
+	upload(testTarballPathV2)
+	suite.Eventually(func() bool {
+		content, err := store.Get("index-cache.d/manifest")
+		return err == nil && !bytes.Equal(content, manifest)
+	}, 5*time.Second, 50*time.Millisecond, "manifest updated by peer")
+
+	// while the replica regenerates its index, holding the lock of the entry
+	entry.RepoLock.Lock()
+	loaded := make(chan struct{})
+	go func() {
+		replica.initCacheEntry(log, "")
+		close(loaded)
+	}()
+	time.Sleep(100 * time.Millisecond) // waiting for the lock of the entry
+	persisted := make(chan struct{})
+	go func() {
+		replica.persistStatefile(log, "", entry.RepoIndex)
+		close(persisted)
+	}()
+	select {
+	case <-persisted:
+	case <-time.After(5 * time.Second):
+		suite.Fail("deadlock between loading a sharded cache entry and persisting the statefile")
+	}
+	entry.RepoLock.Unlock()
+	<-loaded
+}
+
+func (suite *MultiTenantServerTestSuite) TestShardedIndexEviction() {
+	options := MultiTenantServerOptions{
+		UseStatefiles: true,
+		ShardedIndex:  true,
+	}
+	server, dir := suite.newStandaloneServer("sharded-eviction", options)
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Eventually(func() bool {
+		_, err := os.Stat(pathutil.Join(dir, repo.StatefileShardDirname, "manifest.yaml"))
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond, "chart shards saved in storage")
+
+	// a replica without shards in its cache store loads them from storage, while its tenant
+	// keeps being evicted
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	defer redisMock.Close()
+	options.ExternalCacheStore = cache.NewRedisStore(redisMock.Addr(), "", 0)
+	replica, _ := suite.newStandaloneServer("sharded-eviction", options)
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	done := make(chan struct{})
+	evicted := make(chan struct{})
+	go func() {
+		defer close(evicted)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			replica.TenantCacheKeyLock.Lock()
+			replica.evictTenants(log, []string{""})
+			replica.TenantCacheKeyLock.Unlock()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		redisMock.FlushAll()
+		entry, err := replica.initCacheEntry(log, "")
+		suite.Nil(err, "no error loading sharded cache entry")
+		suite.Len(entry.RepoIndex.Entries, 1, "index loaded from storage")
+	}
+	close(done)
+	<-evicted
+
+	redisMock.FlushAll()
+	_, err = replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading sharded cache entry")
+	replica.TenantCacheKeyLock.Lock()
+	digests := replica.tenant("").StatefileShards.snapshot()
+	replica.TenantCacheKeyLock.Unlock()
+	suite.Contains(digests, "mychart", "statefile shard digests recorded")
+}
+
+func (suite *MultiTenantServerTestSuite) TestNotifications() {
+	bus := cache.NewMemoryBus()
+	options := MultiTenantServerOptions{
+		Bus: bus,
+	}
+	server, _ := suite.newStandaloneServer("notifications", options)
+	replica, _ := suite.newStandaloneServer("notifications", options)
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	replicaEntries := func() int {
+		entry, ok := replica.InternalCacheStore.Peek("")
+		if !ok {
+			return -1
+		}
+		entry.RepoLock.RLock()
+		defer entry.RepoLock.RUnlock()
+		return len(entry.RepoIndex.Entries)
+	}
+
+	entry, err := replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading replica cache entry")
+	suite.Empty(entry.RepoIndex.Entries, "replica index empty")
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Eventually(func() bool {
+		return replicaEntries() == 1
+	}, 5*time.Second, 50*time.Millisecond, "upload applied by replica")
+	index, httpErr := replica.getIndexFile(log, "")
+	suite.Nil(httpErr, "no error getting replica index")
+	chartVersion, err := index.Get("mychart", "0.1.0")
+	suite.Nil(err, "uploaded chart in replica index")
+	suite.Equal([]string{"charts/mychart-0.1.0.tgz"}, chartVersion.URLs, "chart URL not prefixed twice")
+
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	suite.Eventually(func() bool {
+		return replicaEntries() == 0
+	}, 5*time.Second, 50*time.Millisecond, "delete applied by replica")
+
+	// own notifications are ignored, others without chart version invalidate the entry
+	message, err := json.Marshal(notification{Origin: replica.ReplicaID, RepoName: ""})
+	suite.Nil(err, "no error encoding notification")
+	replica.handleNotification(message)
+	suite.True(replica.InternalCacheStore.Contains(""), "own notification ignored")
+	message, err = json.Marshal(notification{Origin: server.ReplicaID, RepoName: ""})
+	suite.Nil(err, "no error encoding notification")
+	replica.handleNotification(message)
+	suite.False(replica.InternalCacheStore.Contains(""), "entry invalidated")
+	replica.handleNotification([]byte("invalid"))
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageObjectCacheInvalidation() {
+	dir := pathutil.Join(suite.TempDirectory, "standalone", "objectcache")
+	bus := cache.NewMemoryBus()
+	servers := []*MultiTenantServer{}
+	caches := []*cm_backend.DiskCacheBackend{}
+	for i := 0; i < 2; i++ {
+		objectCache, err := cm_backend.NewDiskCacheBackend(storage.NewLocalFilesystemBackend(pathutil.Join(dir, "storage")),
+			pathutil.Join(dir, fmt.Sprintf("cache%d", i)), 1<<20)
+		suite.Nil(err, "no error creating disk cache")
+		server, _ := suite.newStandaloneServer(fmt.Sprintf("objectcache%d", i), MultiTenantServerOptions{
+			StorageBackend: objectCache,
+			Bus:            bus,
+		})
+		servers = append(servers, server)
+		caches = append(caches, objectCache)
+	}
+	server, replica := servers[0], servers[1]
+	replicaCache := caches[1]
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+
+	res = suite.serveRequest(replica, "GET", "/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal(int64(len(content)), replicaCache.Size(), "package cached by replica")
+
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	suite.Eventually(func() bool {
+		return replicaCache.Size() == 0
+	}, 5*time.Second, 50*time.Millisecond, "package invalidated by replica")
+	res = suite.serveRequest(replica, "GET", "/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /charts/mychart-0.1.0.tgz")
+}
+
+func (suite *MultiTenantServerTestSuite) TestDistributedLocking() {
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	defer redisMock.Close()
+	client := cache.NewRedisStore(redisMock.Addr(), "", 0).UniversalClient
+	options := MultiTenantServerOptions{
+		Locker: cache.NewRedisLocker(client, "", time.Minute, 5*time.Second),
+	}
+	replicas := []*MultiTenantServer{}
+	for i := 0; i < 2; i++ {
+		replica, _ := suite.newStandaloneServer("locking", options)
+		replicas = append(replicas, replica)
+	}
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	var wg sync.WaitGroup
+	statuses := make([]int, 4)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := suite.serveRequest(replicas[i%2], "POST", "/api/charts", bytes.NewBuffer(content), "")
+			statuses[i] = res.Status()
+		}(i)
+	}
+	wg.Wait()
+	suite.ElementsMatch([]int{201, 409, 409, 409}, statuses, "one concurrent upload of the same version succeeds")
+
+	// the same for multipart uploads of a package and its provenance file
+	res := suite.serveRequest(replicas[0], "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	bodies := make([]io.Reader, 4)
+	contentTypes := make([]string, 4)
+	for i := range bodies {
+		buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+		bodies[i], contentTypes[i] = buf, w.FormDataContentType()
+	}
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := suite.serveRequest(replicas[i%2], "POST", "/api/charts", bodies[i], contentTypes[i])
+			statuses[i] = res.Status()
+		}(i)
+	}
+	wg.Wait()
+	suite.ElementsMatch([]int{201, 409, 409, 409}, statuses, "one concurrent multipart upload of the same version succeeds")
+
+	// uploads fail with a conflict while another replica holds the lock for too long
+	locker := cache.NewRedisLocker(client, "", time.Minute, 100*time.Millisecond)
+	replicas[0].Locker = locker
+	unlock, err := locker.Lock("object/" + pathutil.Base(otherTestTarballPath))
+	suite.Nil(err, "able to acquire lock")
+	otherContent, err := os.ReadFile(otherTestTarballPath)
+	suite.Nil(err, "no error opening other test tarball")
+	res = suite.serveRequest(replicas[0], "POST", "/api/charts", bytes.NewBuffer(otherContent), "")
+	suite.Equal(409, res.Status(), "409 POST /api/charts while locked")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{otherTestTarballPath})
+	res = suite.serveRequest(replicas[0], "POST", "/api/charts", buf, w.FormDataContentType())
+	suite.Equal(409, res.Status(), "409 POST /api/charts (multipart) while locked")
+	suite.Nil(unlock(), "able to release lock")
+	res = suite.serveRequest(replicas[0], "POST", "/api/charts", bytes.NewBuffer(otherContent), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts once unlocked")
+}
+
+func (suite *MultiTenantServerTestSuite) TestDiskCacheStore() {
+	path := pathutil.Join(suite.TempDirectory, "disk-cache", "cache.db")
+	store, err := cache.NewDiskStore(path)
+	suite.Nil(err, "no error opening disk cache store")
+	server, _ := suite.newStandaloneServer("disk-cache", MultiTenantServerOptions{
+		ExternalCacheStore: store,
+	})
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Eventually(func() bool {
+		value, err := store.Get("")
+		if err != nil {
+			return false
+		}
+		entry, err := server.decodeCacheEntry(value)
+		return err == nil && len(entry.RepoIndex.Entries) == 1
+	}, 5*time.Second, 50*time.Millisecond, "entry saved in disk cache store")
+	suite.Nil(store.Close(), "no error closing disk cache store")
+
+	// the warm index survives a restart
+	store, err = cache.NewDiskStore(path)
+	suite.Nil(err, "no error reopening disk cache store")
+	defer store.Close()
+	replica, _ := suite.newStandaloneServer("disk-cache", MultiTenantServerOptions{
+		ExternalCacheStore: store,
+	})
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	entry, err := replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading entry from disk cache store")
+	suite.Len(entry.RepoIndex.Entries, 1, "index loaded from disk cache store")
+}
+
+func (suite *MultiTenantServerTestSuite) TestCacheEntryEncoding() {
+	redisMock, err := miniredis.Run()
+	suite.Nil(err, "able to create miniredis instance")
+	defer redisMock.Close()
+	store := cache.NewRedisStore(redisMock.Addr(), "", 0)
+
+	server, _ := suite.newStandaloneServer("encoding", MultiTenantServerOptions{})
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	entry, err := server.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading cache entry")
+
+	// entries saved as plain JSON are still read
+	legacy, err := json.Marshal(entry)
+	suite.Nil(err, "no error encoding legacy cache entry")
+	suite.Nil(store.Set("", legacy), "no error saving legacy cache entry")
+	replica, _ := suite.newStandaloneServer("encoding", MultiTenantServerOptions{
+		ExternalCacheStore: store,
+	})
+	entry, err = replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading legacy cache entry")
+	suite.Len(entry.RepoIndex.Entries, 1, "legacy cache entry loaded")
+
+	// and replaced by a smaller versioned entry on the next save
+	suite.Nil(replica.saveCacheEntry(log, entry), "no error saving cache entry")
+	value, err := store.Get("")
+	suite.Nil(err, "no error getting cache entry")
+	suite.True(bytes.HasPrefix(value, append(cacheFormatMagic, cacheFormatVersion)), "cache entry versioned")
+	suite.Less(len(value), len(legacy), "versioned cache entry smaller")
+	decoded, err := replica.decodeCacheEntry(value)
+	suite.Nil(err, "no error decoding cache entry")
+	suite.Equal(string(entry.RepoIndex.Raw), string(decoded.RepoIndex.Raw), "index rendered again")
+
+	// entries of another format version are discarded and rebuilt
+	value[len(cacheFormatMagic)] = cacheFormatVersion + 1
+	suite.Nil(store.Set("", value), "no error saving cache entry of another version")
+	index, httpErr := replica.getIndexFile(log, "")
+	suite.Nil(httpErr, "no error getting index with cache entry of another version")
+	suite.Len(index.Entries, 1, "cache entry rebuilt from storage")
+	value, err = store.Get("")
+	suite.Nil(err, "no error getting rebuilt cache entry")
+	suite.Equal(cacheFormatVersion, value[len(cacheFormatMagic)], "rebuilt cache entry saved in current format")
+	decoded, err = replica.decodeCacheEntry(value)
+	suite.Nil(err, "no error decoding rebuilt cache entry")
+	suite.Len(decoded.RepoIndex.Entries, 1, "rebuilt cache entry saved")
+}
+
+// flakyBackend fails to list objects on demand
+type flakyBackend struct {
+	storage.Backend
+	failing int32
+	lists   int32
+}
+
+func (b *flakyBackend) ListObjects(prefix string) ([]storage.Object, error) {
+	atomic.AddInt32(&b.lists, 1)
+	if atomic.LoadInt32(&b.failing) == 1 {
+		return nil, errors.New("storage unavailable")
+	}
+	return b.Backend.ListObjects(prefix)
+}
+
+func (suite *MultiTenantServerTestSuite) TestStaleIfError() {
+	dir := pathutil.Join(suite.TempDirectory, "standalone", "stale-if-error")
+	backend := &flakyBackend{Backend: storage.NewLocalFilesystemBackend(dir)}
+	breaker := cm_backend.NewCircuitBreaker(2, time.Hour)
+	server, _ := suite.newStandaloneServer("stale-if-error", MultiTenantServerOptions{
+		StorageBackend: cm_backend.NewResilientBackend(backend, cm_backend.ResilientBackendOptions{
+			Breaker:   breaker,
+			Transient: func(err error) bool { return err != nil },
+		}),
+		AlwaysRegenerateIndex: true,
+	})
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	res = suite.serveRequest(server, "GET", "/index.yaml", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /index.yaml")
+	suite.Empty(res.Header().Get("Warning"), "no warning while storage is available")
+
+	lists := atomic.LoadInt32(&backend.lists)
+	atomic.StoreInt32(&backend.failing, 1)
+	for i := 0; i < 3; i++ {
+		buf := &bytes.Buffer{}
+		res = suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		suite.Equal(200, res.Status(), "200 GET /index.yaml while storage is failing")
+		suite.Equal(RevalidationFailedWarning, res.Header().Get("Warning"), "stale index served with warning")
+		suite.Contains(buf.String(), "mychart", "last good index served")
+	}
+	// the third request did not call storage
+	suite.True(breaker.Open(), "circuit breaker open")
+	suite.Equal(lists+2, atomic.LoadInt32(&backend.lists), "storage no longer called once circuit breaker open")
+
+	res = suite.serveRequest(server, "GET", "/api/charts", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /api/charts while storage is failing")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStaleWhileRevalidate() {
+	server, dir := suite.newStandaloneServer("stale-while-revalidate", MultiTenantServerOptions{
+		AlwaysRegenerateIndex: true,
+		StaleWhileRevalidate:  true,
+	})
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Eventually(func() bool {
+		buf := &bytes.Buffer{}
+		suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		return strings.Contains(buf.String(), "mychart")
+	}, 5*time.Second, 50*time.Millisecond, "uploaded chart in index")
+
+	// a package added behind the server's back shows up once revalidated in the background
+	otherContent, err := os.ReadFile(otherTestTarballPath)
+	suite.Nil(err, "no error opening other test tarball")
+	err = os.WriteFile(pathutil.Join(dir, pathutil.Base(otherTestTarballPath)), otherContent, 0644)
+	suite.Nil(err, "no error adding package to storage")
+	buf := &bytes.Buffer{}
+	res = suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /index.yaml")
+	suite.Equal(StaleWarning, res.Header().Get("Warning"), "index served while revalidating")
+	suite.Eventually(func() bool {
+		buf := &bytes.Buffer{}
+		suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		return strings.Contains(buf.String(), "otherchart")
+	}, 5*time.Second, 50*time.Millisecond, "index revalidated in background")
+}
+
+func (suite *MultiTenantServerTestSuite) TestSidecars() {
+	server, dir := suite.newStandaloneServer("sidecars", MultiTenantServerOptions{
+		UseSidecars: true,
+	})
+	sidecarPath := func(filename string) string {
+		return pathutil.Join(dir, repo.SidecarDirname, filename+".json")
+	}
+	indexedDescription := func() string {
+		replica, _ := suite.newStandaloneServer("sidecars", MultiTenantServerOptions{
+			UseSidecars: true,
+		})
+		log := replica.Logger.ContextLoggingFn(&gin.Context{})
+		index, err := replica.getIndexFile(log, "")
+		suite.Nil(err, "no error getting index")
+		chartVersion, getErr := index.Get("mychart", "0.1.0")
+		suite.Nil(getErr, "chart in index")
+		return chartVersion.Description
+	}
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+
+	sidecarContent, err := os.ReadFile(sidecarPath("mychart-0.1.0.tgz"))
+	suite.Nil(err, "sidecar written on upload")
+	sidecar, err := repo.SidecarFromContent(sidecarContent)
+	suite.Nil(err, "valid sidecar written on upload")
+	suite.Equal("mychart", sidecar.Metadata.Name, "sidecar name")
+	suite.Equal(len(content), sidecar.Size, "sidecar size")
+	suite.NotEmpty(sidecar.Digest, "sidecar digest")
+	info, err := os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err)
+	suite.True(info.ModTime().Equal(sidecar.Modified), "package modification time recorded from storage")
+
+	// the sidecar is read instead of the package, whatever the clock of the host writing it
+	sidecar.Metadata.Description = "from sidecar"
+	sidecar.Created = time.Now().Add(-24 * time.Hour)
+	sidecarContent, err = sidecar.Content()
+	suite.Nil(err, "no error serializing sidecar")
+	err = os.WriteFile(sidecarPath("mychart-0.1.0.tgz"), sidecarContent, 0644)
+	suite.Nil(err, "no error writing sidecar")
+	suite.Equal("from sidecar", indexedDescription(), "chart indexed from sidecar")
+
+	// a package overwritten outside of ChartMuseum is loaded again, even with an earlier modification time
+	newtime := time.Now().Add(-1 * time.Hour)
+	err = os.Chtimes(pathutil.Join(dir, "mychart-0.1.0.tgz"), newtime, newtime)
+	suite.Nil(err, "no error changing modtime on package")
+	suite.NotEqual("from sidecar", indexedDescription(), "stale sidecar ignored")
+	sidecarContent, err = os.ReadFile(sidecarPath("mychart-0.1.0.tgz"))
+	suite.Nil(err, "sidecar rewritten on reindex")
+	suite.NotContains(string(sidecarContent), "from sidecar", "stale sidecar replaced")
+
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	_, err = os.Stat(sidecarPath("mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "sidecar deleted with package")
+}
+
+func (suite *MultiTenantServerTestSuite) TestMetadataStore() {
+	metadataDir := pathutil.Join(suite.TempDirectory, "metadata")
+	store, err := metadb.NewBoltStore(pathutil.Join(metadataDir, "metadata.db"))
+	suite.Nil(err, "no error opening metadata store")
+	defer store.Close()
+
+	server, _ := suite.newStandaloneServer("metadb", MultiTenantServerOptions{
+		MetadataStore: store,
+	})
+	for _, f := range []string{testTarballPath, otherTestTarballPath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test tarball")
+		res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), "201 POST /api/charts")
+	}
+	suite.Eventually(func() bool {
+		entries, err := store.ChartVersions("")
+		return err == nil && len(entries) == 2
+	}, 5*time.Second, 50*time.Millisecond, "uploaded charts in metadata store")
+
+	// a paged listing is read from the metadata store
+	buffer := bytes.NewBufferString("")
+	res := suite.serveRequest(server, "GET", "/api/charts?offset=1&limit=1", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/charts?offset=1&limit=1")
+	var page map[string]json.RawMessage
+	err = json.Unmarshal(buffer.Bytes(), &page)
+	suite.Nil(err, "no error parsing charts")
+	suite.Len(page, 1, "one chart listed")
+	suite.Contains(page, "otherchart", "charts listed in name order")
+
+	// a new replica loads its index from the metadata store, then applies the storage diff
+	phantom, err := repo.ChartVersionFromStorageObject(storage.Object{Path: "phantom-1.0.0.tgz", LastModified: time.Now()})
+	suite.Nil(err, "no error creating chart version")
+	phantom.URLs = []string{"charts/phantom-1.0.0.tgz"}
+	suite.Nil(store.PutChartVersion("", phantom), "no error putting chart version")
+	replica, _ := suite.newStandaloneServer("metadb", MultiTenantServerOptions{
+		MetadataStore: store,
+	})
+	log := replica.Logger.ContextLoggingFn(&gin.Context{})
+	entry, err := replica.initCacheEntry(log, "")
+	suite.Nil(err, "no error loading cache entry")
+	suite.Len(entry.RepoIndex.Entries, 3, "index loaded from metadata store")
+	replica.refreshCacheEntry(log, "", entry)
+	suite.Len(entry.RepoIndex.Entries, 2, "package missing from storage removed from index")
+	entries, err := store.ChartVersions("")
+	suite.Nil(err, "no error reading metadata store")
+	suite.NotContains(entries, "phantom", "package missing from storage removed from metadata store")
+
+	// a missing metadata store is rebuilt from storage
+	os.RemoveAll(metadataDir)
+	rebuilt, err := metadb.NewBoltStore(pathutil.Join(metadataDir, "rebuilt.db"))
+	suite.Nil(err, "no error opening new metadata store")
+	defer rebuilt.Close()
+	replica, _ = suite.newStandaloneServer("metadb", MultiTenantServerOptions{
+		MetadataStore: rebuilt,
+	})
+	_, httpErr := replica.getIndexFile(log, "")
+	suite.Nil(httpErr, "no error getting index")
+	entries, err = rebuilt.ChartVersions("")
+	suite.Nil(err, "no error reading rebuilt metadata store")
+	suite.Len(entries, 2, "metadata store rebuilt from storage")
+}
+
+func (suite *MultiTenantServerTestSuite) TestMemoryCacheStore() {
+	store := newMemoryCacheStore(2, 0)
+	entry := &cacheEntry{RepoName: "org1"}
+
+	misses := testutil.ToFloat64(cacheMissesCounter)
+	_, ok := store.Load("org1")
+	suite.False(ok, "no entry in new store")
+	suite.Equal(misses+1, testutil.ToFloat64(cacheMissesCounter), "miss counted")
+
+	suite.Empty(store.Touch("org1"), "nothing evicted within bounds")
+	_, ok = store.Load("org1")
+	suite.False(ok, "touched tenant has no entry")
+	store.Store("org1", entry)
+	hits := testutil.ToFloat64(cacheHitsCounter)
+	loaded, ok := store.Load("org1")
+	suite.True(ok, "entry found")
+	suite.Equal(entry, loaded, "stored entry loaded")
+	suite.Equal(hits+1, testutil.ToFloat64(cacheHitsCounter), "hit counted")
+
+	evictions := testutil.ToFloat64(cacheEvictionsCounter)
+	suite.Empty(store.Touch("org2"), "nothing evicted within bounds")
+	suite.Empty(store.Touch("org1"), "nothing evicted within bounds")
+	suite.Equal([]string{"org2"}, store.Touch("org3"), "least recently used tenant evicted")
+	suite.Equal(evictions+1, testutil.ToFloat64(cacheEvictionsCounter), "eviction counted")
+	suite.True(store.Contains("org1"), "recently used tenant kept")
+	suite.False(store.Contains("org2"), "evicted tenant dropped")
+
+	store = newMemoryCacheStore(0, time.Millisecond)
+	store.Touch("org1")
+	time.Sleep(5 * time.Millisecond)
+	suite.Equal([]string{"org1"}, store.Touch("org2"), "idle tenant evicted")
+	time.Sleep(5 * time.Millisecond)
+	suite.Equal([]string{"org2"}, store.Evict(), "idle tenant evicted in the background")
+}
+
+func (suite *MultiTenantServerTestSuite) TestTenantEviction() {
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger: suite.Depth1Server.Logger,
+		Depth:  1,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:          suite.Depth1Server.Logger,
+		Router:          router,
+		StorageBackend:  suite.Depth1Server.StorageBackend,
+		EnableAPI:       true,
+		CacheMaxTenants: 1,
+	})
+	suite.Nil(err, "no error creating server with bounded cache")
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	for _, repo := range []string{"org1", "org2"} {
+		_, httpErr := server.getIndexFile(log, repo)
+		suite.Nil(httpErr, fmt.Sprintf("no error getting index of %s", repo))
+	}
+	server.TenantCacheKeyLock.Lock()
+	_, org1 := server.Tenants["org1"]
+	_, org2 := server.Tenants["org2"]
+	server.TenantCacheKeyLock.Unlock()
+	suite.False(org1, "internals of evicted tenant released")
+	suite.True(org2, "internals of recent tenant kept")
+	_, ok := server.InternalCacheStore.Load("org1")
+	suite.False(ok, "entry of evicted tenant released")
+
+	// an evicted tenant is reloaded on demand
+	index, httpErr := server.getIndexFile(log, "org1")
+	suite.Nil(httpErr, "no error getting index of evicted tenant")
+	suite.NotEmpty(index.Entries, "index of evicted tenant reloaded")
+}
+
 func (suite *MultiTenantServerTestSuite) TestDisabledServer() {
 	// Test that all /api routes disabled if EnableAPI=false
 	res := suite.doRequest("disabled", "GET", "/api/charts", nil, "")
@@ -1359,3 +2167,627 @@ func (suite *MultiTenantServerTestSuite) getBodyWithMultipartFormFiles(fields []
 func TestMultiTenantServerTestSuite(t *testing.T) {
 	suite.Run(t, new(MultiTenantServerTestSuite))
 }
+
+type failingURLSigner struct{}
+
+func (signer failingURLSigner) SignedURL(path string, expiry time.Duration) (string, error) {
+	return "", errors.New("signing not available")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStreaming() {
+	server, dir := suite.newStandaloneServer("streaming", MultiTenantServerOptions{})
+	tmpDir := suite.T().TempDir()
+	suite.T().Setenv("TMPDIR", tmpDir)
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	stored, err := os.ReadFile(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "chart package stored")
+	suite.Equal(content, stored, "chart package stored from temporary file")
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPathV2, testProvfilePath})
+	res = suite.serveRequest(server, "POST", "/api/charts", buf, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/charts (multipart)")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.2.0.tgz"))
+	suite.Nil(err, "chart package stored from form field")
+
+	res = suite.serveRequest(server, "POST", "/api/charts", bytes.NewBufferString("not a chart"), "")
+	suite.Equal(400, res.Status(), "400 POST /api/charts invalid package")
+
+	files, err := os.ReadDir(tmpDir)
+	suite.Nil(err)
+	suite.Empty(files, "temporary files removed")
+
+	// range requests
+	output := bytes.NewBuffer(nil)
+	recorder := httptest.NewRecorder()
+	recorder.Body = output
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("GET", "/charts/mychart-0.1.0.tgz", nil)
+	c.Request.Header.Set("Range", "bytes=10-19")
+	server.Router.HandleContext(c)
+	suite.Equal(206, c.Writer.Status(), "206 GET /charts/mychart-0.1.0.tgz with range")
+	suite.Equal(content[10:20], output.Bytes(), "requested range served")
+	suite.Equal(fmt.Sprintf("bytes 10-19/%d", len(content)), recorder.Header().Get("Content-Range"))
+
+	output = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/charts/mychart-0.1.0.tgz", nil, "", output)
+	suite.Equal(200, res.Status(), "200 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal(content, output.Bytes(), "whole chart package served")
+	suite.Equal("application/x-tar", res.Header().Get("Content-Type"))
+	suite.Equal("bytes", res.Header().Get("Accept-Ranges"))
+
+	res = suite.serveRequest(server, "GET", "/charts/missing-0.1.0.tgz", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /charts/missing-0.1.0.tgz")
+}
+
+func (suite *MultiTenantServerTestSuite) TestEncryptedStorage() {
+	dir := pathutil.Join(suite.TempDirectory, "standalone", "encrypted")
+	keyring, err := cm_backend.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	suite.Nil(err, "no error creating keyring")
+	server, _ := suite.newStandaloneServer("encrypted", MultiTenantServerOptions{
+		StorageBackend: cm_backend.NewEncryptedBackend(storage.NewLocalFilesystemBackend(dir), keyring, false),
+		UseSidecars:    true,
+	})
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+
+	stored, err := os.ReadFile(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "chart package stored")
+	suite.NotEqual(content, stored, "chart package encrypted in storage")
+	sidecar, err := os.ReadFile(pathutil.Join(dir, repo.SidecarDirname, "mychart-0.1.0.tgz.json"))
+	suite.Nil(err, "sidecar stored")
+	suite.NotContains(string(sidecar), "mychart", "sidecar encrypted in storage")
+
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /index.yaml")
+	suite.Contains(buf.String(), "mychart", "chart indexed from encrypted storage")
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/charts/mychart-0.1.0.tgz", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal(content, buf.Bytes(), "chart package decrypted")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageMirror() {
+	primaryDir := pathutil.Join(suite.TempDirectory, "standalone", "mirror")
+	secondaryDir := pathutil.Join(suite.TempDirectory, "standalone", "mirror-secondary")
+	mirrored := cm_backend.NewMirroredBackend(storage.NewLocalFilesystemBackend(primaryDir),
+		storage.NewLocalFilesystemBackend(secondaryDir), cm_backend.MirroredBackendOptions{})
+	server, _ := suite.newStandaloneServer("mirror", MultiTenantServerOptions{
+		StorageBackend:    mirrored,
+		UseSidecars:       true,
+		MirrorReconciler:  mirrored,
+		ReconcileInterval: time.Hour,
+	})
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	mirroredPackage := pathutil.Join(secondaryDir, "mychart-0.1.0.tgz")
+	mirroredSidecar := pathutil.Join(secondaryDir, repo.SidecarDirname, "mychart-0.1.0.tgz.json")
+	_, err = os.Stat(mirroredPackage)
+	suite.Nil(err, "chart package mirrored")
+	_, err = os.Stat(mirroredSidecar)
+	suite.Nil(err, "sidecar mirrored")
+
+	// drift, e.g. while the secondary backend was unavailable
+	suite.Nil(os.Remove(mirroredPackage))
+	suite.Nil(os.Remove(mirroredSidecar))
+	suite.Nil(os.WriteFile(pathutil.Join(secondaryDir, "otherchart-0.1.0.tgz"), content, 0644))
+	suite.Nil(os.MkdirAll(pathutil.Join(primaryDir, repo.TrashDirname), os.ModePerm))
+	suite.Nil(os.WriteFile(pathutil.Join(primaryDir, repo.TrashDirname, "otherchart-0.1.0.tgz"), content, 0644))
+	server.reconcileMirror()
+	_, err = os.Stat(mirroredPackage)
+	suite.Nil(err, "chart package reconciled")
+	_, err = os.Stat(pathutil.Join(secondaryDir, repo.TrashDirname, "otherchart-0.1.0.tgz"))
+	suite.Nil(err, "trashed chart package reconciled")
+	_, err = os.Stat(mirroredSidecar)
+	suite.Nil(err, "sidecar reconciled")
+	_, err = os.Stat(pathutil.Join(secondaryDir, "otherchart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "object missing from primary removed")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageRepos() {
+	server, dir := suite.newStandaloneServer("storage-repos", MultiTenantServerOptions{})
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, path := range []string{
+		"org1/repoa/mychart-0.1.0.tgz",
+		"org1/repoa/" + repo.SidecarDirname + "/mychart-0.1.0.tgz.json",
+		"org1/repob/" + repo.TrashDirname + "/mychart-0.1.0.tgz",
+		"org2/repoc/" + repo.StatefileFilename,
+		"org3/" + repo.StatefileFilename,
+	} {
+		suite.Nil(os.MkdirAll(pathutil.Join(dir, pathutil.Dir(path)), os.ModePerm))
+		suite.Nil(os.WriteFile(pathutil.Join(dir, path), []byte("content"), 0644))
+	}
+
+	suite.Equal([]string{""}, server.storageRepos(log), "root repo only")
+	server.Router.Depth = 2
+	suite.Equal([]string{"org1/repoa", "org1/repob", "org2/repoc"}, server.storageRepos(log), "repos at the depth of the router")
+	server.Router.DepthDynamic = true
+	suite.Equal([]string{"", "org1", "org1/repoa", "org1/repob", "org2", "org2/repoc", "org3"}, server.storageRepos(log),
+		"repos at any depth")
+}
+
+func (suite *MultiTenantServerTestSuite) TestFsck() {
+	server, dir := suite.newStandaloneServer("fsck", MultiTenantServerOptions{GCMinAge: time.Hour})
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	orphan := pathutil.Join(dir, "otherchart-0.1.0.tgz.prov")
+	suite.Nil(os.WriteFile(orphan, []byte("orphan"), 0644))
+
+	// a provenance file may be uploaded right before its chart package
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "POST", "/api/fsck", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 POST /api/fsck")
+	suite.Contains(buf.String(), `"problems":[]`, "recent provenance file ignored")
+	_, err = os.Stat(orphan)
+	suite.Nil(err, "recent provenance file kept")
+	modified := time.Now().Add(-2 * time.Hour)
+	suite.Nil(os.Chtimes(orphan, modified, modified))
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/fsck", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/fsck")
+	suite.Contains(buf.String(), `"kind":"orphaned-provenance","path":"otherchart-0.1.0.tgz.prov"`, "problem reported")
+	suite.Contains(buf.String(), `"repaired":false`, "problem not repaired")
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "POST", "/api/fsck", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 POST /api/fsck")
+	suite.Contains(buf.String(), `"repaired":true`, "problem repaired")
+	_, err = os.Stat(pathutil.Join(dir, "otherchart-0.1.0.tgz.prov"))
+	suite.True(os.IsNotExist(err), "orphaned provenance file deleted")
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/fsck", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/fsck")
+	suite.Contains(buf.String(), `"problems":[]`, "no problem left")
+}
+
+func (suite *MultiTenantServerTestSuite) TestGC() {
+	server, dir := suite.newStandaloneServer("gc", MultiTenantServerOptions{PerChartLimit: 1})
+	for _, f := range []string{testTarballPath, testProvfilePath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test file")
+		path := "/api/charts"
+		if strings.HasSuffix(f, ".prov") {
+			path = "/api/prov"
+		}
+		res := suite.serveRequest(server, "POST", path, bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), "201 POST "+path)
+	}
+	content, err := os.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.prov"))
+	suite.True(os.IsNotExist(err), "provenance file deleted along with package over the per-chart limit")
+
+	for _, filename := range []string{"otherchart-0.1.0.tgz.prov", ".upload-123456", "notes.txt"} {
+		suite.Nil(os.WriteFile(pathutil.Join(dir, filename), []byte("garbage"), 0644))
+	}
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/gc", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/gc")
+	suite.Contains(buf.String(), `"kind":"orphaned-provenance","path":"otherchart-0.1.0.tgz.prov"`, "orphaned provenance file reported")
+	suite.Contains(buf.String(), `"kind":"partial-upload","path":".upload-123456"`, "partial upload reported")
+	suite.Contains(buf.String(), `"kind":"unknown-object","path":"notes.txt"`, "unknown object reported")
+	suite.NotContains(buf.String(), `"deleted":true`, "nothing deleted by dry run")
+
+	deleted := testutil.ToFloat64(gcDeletedCounter.WithLabelValues("partial-upload"))
+	res = suite.serveRequest(server, "POST", "/api/gc", nil, "")
+	suite.Equal(200, res.Status(), "200 POST /api/gc")
+	suite.Equal(deleted+1, testutil.ToFloat64(gcDeletedCounter.WithLabelValues("partial-upload")), "deletion counted")
+	for _, filename := range []string{"otherchart-0.1.0.tgz.prov", ".upload-123456"} {
+		_, err = os.Stat(pathutil.Join(dir, filename))
+		suite.True(os.IsNotExist(err), "%s deleted", filename)
+	}
+	for _, filename := range []string{"notes.txt", "mychart-0.2.0.tgz"} {
+		_, err = os.Stat(pathutil.Join(dir, filename))
+		suite.Nil(err, "%s kept", filename)
+	}
+
+	// the job covers the repos found in storage, without having been served yet
+	server.Router.DepthDynamic = true
+	nested := pathutil.Join(dir, "org1", "repoa", ".upload-123456")
+	suite.Nil(os.MkdirAll(pathutil.Dir(nested), os.ModePerm))
+	suite.Nil(os.WriteFile(nested, []byte("garbage"), 0644))
+	server.collectGarbage()
+	_, err = os.Stat(nested)
+	suite.True(os.IsNotExist(err), "garbage of repo not in cache deleted")
+}
+
+func (suite *MultiTenantServerTestSuite) TestTrash() {
+	server, dir := suite.newStandaloneServer("trash", MultiTenantServerOptions{Trash: true})
+	trashDir := pathutil.Join(dir, repo.TrashDirname)
+	upload := func(f string) int {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test file")
+		path := "/api/charts"
+		if strings.HasSuffix(f, ".prov") {
+			path = "/api/prov"
+		}
+		return suite.serveRequest(server, "POST", path, bytes.NewBuffer(content), "").Status()
+	}
+	indexed := func(filename string) bool {
+		buf := bytes.NewBuffer(nil)
+		suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		return strings.Contains(buf.String(), filename)
+	}
+	for _, f := range []string{testTarballPath, testProvfilePath, testTarballPathV2} {
+		suite.Equal(201, upload(f), "201 POST "+f)
+	}
+
+	res := suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	for _, filename := range []string{"mychart-0.1.0.tgz", "mychart-0.1.0.tgz.prov"} {
+		_, err := os.Stat(pathutil.Join(dir, filename))
+		suite.True(os.IsNotExist(err), "%s removed from repo", filename)
+		_, err = os.Stat(pathutil.Join(trashDir, filename))
+		suite.Nil(err, "%s moved to trash", filename)
+	}
+	suite.Eventually(func() bool {
+		return !indexed("mychart-0.1.0.tgz") && indexed("mychart-0.2.0.tgz")
+	}, 5*time.Second, 50*time.Millisecond, "deleted chart version removed from index")
+	server.rebuildIndexForTenant("")
+	suite.False(indexed("mychart-0.1.0.tgz"), "trash not indexed")
+
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/trash", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/trash")
+	suite.Contains(buf.String(), `"name":"mychart","version":"0.1.0","filename":"mychart-0.1.0.tgz"`, "deleted chart version listed")
+	suite.Contains(buf.String(), `"provenance":true`)
+
+	res = suite.serveRequest(server, "POST", "/api/trash/mychart/0.1.0/restore", nil, "")
+	suite.Equal(200, res.Status(), "200 POST /api/trash/mychart/0.1.0/restore")
+	for _, filename := range []string{"mychart-0.1.0.tgz", "mychart-0.1.0.tgz.prov"} {
+		_, err := os.Stat(pathutil.Join(dir, filename))
+		suite.Nil(err, "%s restored", filename)
+		_, err = os.Stat(pathutil.Join(trashDir, filename))
+		suite.True(os.IsNotExist(err), "%s removed from trash", filename)
+	}
+	suite.Eventually(func() bool {
+		return indexed("mychart-0.1.0.tgz")
+	}, 5*time.Second, 50*time.Millisecond, "restored chart version indexed")
+	res = suite.serveRequest(server, "POST", "/api/trash/mychart/9.9.9/restore", nil, "")
+	suite.Equal(404, res.Status(), "404 POST /api/trash/mychart/9.9.9/restore")
+
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	suite.Equal(201, upload(testTarballPath), "201 POST /api/charts")
+	res = suite.serveRequest(server, "POST", "/api/trash/mychart/0.1.0/restore", nil, "")
+	suite.Equal(409, res.Status(), "409 POST /api/trash/mychart/0.1.0/restore")
+
+	res = suite.serveRequest(server, "DELETE", "/api/trash/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/trash/mychart/0.1.0")
+	res = suite.serveRequest(server, "DELETE", "/api/trash/mychart/0.1.0", nil, "")
+	suite.Equal(404, res.Status(), "404 DELETE /api/trash/mychart/0.1.0")
+	entries, err := os.ReadDir(trashDir)
+	suite.Nil(err)
+	suite.Empty(entries, "chart version purged along with its provenance file")
+
+	// automatic purge
+	server.TrashPurgeAfter = time.Hour
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.2.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.2.0")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0")
+	past := time.Now().Add(-2 * time.Hour)
+	suite.Nil(os.Chtimes(pathutil.Join(trashDir, "mychart-0.2.0.tgz"), past, past))
+	server.purgeExpiredTrash()
+	_, err = os.Stat(pathutil.Join(trashDir, "mychart-0.2.0.tgz"))
+	suite.True(os.IsNotExist(err), "expired chart version purged")
+	_, err = os.Stat(pathutil.Join(trashDir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "recently deleted chart version kept")
+
+	// the job covers the repos found in storage, without having been served yet
+	server.Router.DepthDynamic = true
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	nested := pathutil.Join(dir, "org1", "repoa", repo.TrashDirname, "mychart-0.1.0.tgz")
+	suite.Nil(os.MkdirAll(pathutil.Dir(nested), os.ModePerm))
+	suite.Nil(os.WriteFile(nested, content, 0644))
+	suite.Nil(os.Chtimes(nested, past, past))
+	server.purgeExpiredTrash()
+	_, err = os.Stat(nested)
+	suite.True(os.IsNotExist(err), "expired chart version of repo not in cache purged")
+	server.Router.DepthDynamic = false
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "DELETE", "/api/trash", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 DELETE /api/trash")
+	suite.Equal(`{"purged":1}`, buf.String())
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/trash", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/trash")
+	suite.Equal(`[]`, buf.String(), "trash empty")
+}
+
+func (suite *MultiTenantServerTestSuite) TestProtection() {
+	policy := &protection.Policy{Rules: []protection.Rule{
+		{Name: "released", Chart: "mychart", Versions: ">=0.2.0"},
+	}}
+	suite.Nil(policy.Validate())
+	server, dir := suite.newStandaloneServer("protection", MultiTenantServerOptions{
+		AllowOverwrite:   true,
+		ProtectionPolicy: policy,
+		AllowUnlock:      true,
+	})
+	upload := func(f string, output ...*bytes.Buffer) int {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test file")
+		path := "/api/charts"
+		if strings.HasSuffix(f, ".prov") {
+			path = "/api/prov"
+		}
+		return suite.serveRequest(server, "POST", path, bytes.NewBuffer(content), "", output...).Status()
+	}
+	for _, f := range []string{testTarballPathV0, testTarballPath, testProvfilePath, testTarballPathV2} {
+		suite.Equal(201, upload(f), "201 POST "+f)
+	}
+
+	// protected by rule
+	buf := bytes.NewBuffer(nil)
+	suite.Equal(409, upload(testTarballPathV2, buf), "409 POST /api/charts overwriting protected version")
+	suite.Contains(buf.String(), `chart version mychart-0.2.0 is protected by rule \"released\"`)
+	suite.Equal(201, upload(testTarballPath), "201 POST /api/charts overwriting unprotected version")
+	res := suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.2.0", nil, "")
+	suite.Equal(403, res.Status(), "403 DELETE /api/charts/mychart/0.2.0")
+	_, err := os.Stat(pathutil.Join(dir, "mychart-0.2.0.tgz"))
+	suite.Nil(err, "protected version kept")
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/charts/mychart/0.2.0/lock", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/charts/mychart/0.2.0/lock")
+	suite.Equal(`{"protected":true,"rule":"released","locked":false}`, buf.String())
+
+	// locked through the API
+	res = suite.serveRequest(server, "POST", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(200, res.Status(), "200 POST /api/charts/mychart/0.1.0/lock")
+	_, err = os.Stat(pathutil.Join(dir, repo.ProtectedDirname, "mychart-0.1.0"))
+	suite.Nil(err, "lock stored")
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/charts/mychart/0.1.0/lock", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/charts/mychart/0.1.0/lock")
+	suite.Equal(`{"protected":true,"locked":true}`, buf.String())
+	buf = bytes.NewBuffer(nil)
+	suite.Equal(409, upload(testTarballPath, buf), "409 POST /api/charts overwriting locked version")
+	suite.Contains(buf.String(), "chart version mychart-0.1.0 is locked")
+	suite.Equal(409, upload(testProvfilePath), "409 POST /api/prov overwriting provenance of locked version")
+	body, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "POST", "/api/charts", body, w.FormDataContentType(), buf)
+	suite.Equal(409, res.Status(), "409 POST /api/charts (form) overwriting locked version")
+	suite.Contains(buf.String(), "is locked")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(403, res.Status(), "403 DELETE /api/charts/mychart/0.1.0")
+	res = suite.serveRequest(server, "POST", "/api/charts/mychart/9.9.9/lock", nil, "")
+	suite.Equal(404, res.Status(), "404 POST /api/charts/mychart/9.9.9/lock")
+
+	// never deleted by retention rules
+	server.RetentionPolicy = &retention.Policy{Rules: []retention.Rule{{Chart: "mychart", KeepNewerThan: retention.Duration(time.Nanosecond)}}}
+	deletions, httpErr := server.applyRetention(server.Logger.ContextLoggingFn(&gin.Context{}), "", nil, true)
+	suite.Nil(httpErr)
+	suite.Len(deletions, 1, "only the unprotected version deleted")
+	suite.Equal("0.0.1", deletions[0].Version)
+	server.RetentionPolicy = nil
+
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0/lock")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(404, res.Status(), "404 DELETE /api/charts/mychart/0.1.0/lock")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/charts/mychart/0.1.0 once unlocked")
+}
+
+func (suite *MultiTenantServerTestSuite) TestProtectionStorageError() {
+	dir := pathutil.Join(suite.TempDirectory, "standalone", "protection-storage-error")
+	backend := &flakyBackend{Backend: storage.NewLocalFilesystemBackend(dir)}
+	server, _ := suite.newStandaloneServer("protection-storage-error", MultiTenantServerOptions{StorageBackend: backend})
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	res = suite.serveRequest(server, "POST", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(200, res.Status(), "200 POST /api/charts/mychart/0.1.0/lock")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(404, res.Status(), "404 DELETE /api/charts/mychart/0.1.0/lock without --protection-allow-unlock")
+
+	// a chart version is not considered unlocked when storage cannot tell
+	suite.Nil(os.Remove(pathutil.Join(dir, repo.ProtectedDirname, "mychart-0.1.0")))
+	atomic.StoreInt32(&backend.failing, 1)
+	res = suite.serveRequest(server, "GET", "/api/charts/mychart/0.1.0/lock", nil, "")
+	suite.Equal(503, res.Status(), "503 GET /api/charts/mychart/0.1.0/lock while storage is failing")
+	res = suite.serveRequest(server, "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+	suite.Equal(503, res.Status(), "503 DELETE /api/charts/mychart/0.1.0 while storage is failing")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "chart version kept")
+
+	atomic.StoreInt32(&backend.failing, 0)
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/charts/mychart/0.1.0/lock", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/charts/mychart/0.1.0/lock")
+	suite.Equal(`{"protected":false,"locked":false}`, buf.String(), "missing lock means unlocked")
+}
+
+func (suite *MultiTenantServerTestSuite) TestRetention() {
+	policy := &retention.Policy{Rules: []retention.Rule{
+		{Chart: "mychart", KeepNewerThan: retention.Duration(7 * 24 * time.Hour)},
+	}}
+	server, dir := suite.newStandaloneServer("retention", MultiTenantServerOptions{RetentionPolicy: policy})
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for _, f := range []string{testTarballPathV0, testTarballPath, otherTestTarballPath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test tarball")
+		path := pathutil.Join(dir, pathutil.Base(f))
+		suite.Nil(os.WriteFile(path, content, 0644))
+		suite.Nil(os.Chtimes(path, old, old))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	res := suite.serveRequest(server, "GET", "/api/retention", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/retention")
+	suite.Contains(buf.String(), `"name":"mychart","version":"0.1.0"`, "old chart version reported")
+	suite.Contains(buf.String(), `"name":"mychart","version":"0.0.1"`, "old chart version reported")
+	suite.NotContains(buf.String(), "otherchart", "chart without rule not reported")
+	_, err := os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "nothing deleted by dry run")
+
+	deleted := testutil.ToFloat64(retentionDeletionsCounter.WithLabelValues(""))
+	content, err := os.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball")
+	res = suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	for _, filename := range []string{"mychart-0.0.1.tgz", "mychart-0.1.0.tgz"} {
+		_, err = os.Stat(pathutil.Join(dir, filename))
+		suite.True(os.IsNotExist(err), "%s deleted on upload", filename)
+	}
+	for _, filename := range []string{"mychart-0.2.0.tgz", "otherchart-0.1.0.tgz"} {
+		_, err = os.Stat(pathutil.Join(dir, filename))
+		suite.Nil(err, "%s kept", filename)
+	}
+	suite.Equal(deleted+2, testutil.ToFloat64(retentionDeletionsCounter.WithLabelValues("")), "deletions counted")
+	suite.Eventually(func() bool {
+		buf := bytes.NewBuffer(nil)
+		suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		return !strings.Contains(buf.String(), "mychart-0.0.1.tgz") && !strings.Contains(buf.String(), "mychart-0.1.0.tgz") &&
+			strings.Contains(buf.String(), "mychart-0.2.0.tgz")
+	}, 5*time.Second, 50*time.Millisecond, "deleted chart versions removed from index")
+
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/api/retention", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /api/retention")
+	suite.Equal(`{"deletions":[]}`, buf.String(), "nothing left to delete")
+}
+
+func (suite *MultiTenantServerTestSuite) TestEnforceRetention() {
+	policy := &retention.Policy{Rules: []retention.Rule{
+		{Chart: "mychart", KeepNewerThan: retention.Duration(7 * 24 * time.Hour)},
+	}}
+	server, dir := suite.newStandaloneServer("enforce-retention", MultiTenantServerOptions{RetentionPolicy: policy})
+	server.Router.Depth = 1
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	suite.Nil(os.MkdirAll(pathutil.Join(dir, "org1"), os.ModePerm))
+	for _, f := range []string{testTarballPath, otherTestTarballPath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test tarball")
+		path := pathutil.Join(dir, "org1", pathutil.Base(f))
+		suite.Nil(os.WriteFile(path, content, 0644))
+		suite.Nil(os.Chtimes(path, old, old))
+	}
+
+	// the repo is found in storage, without having been served yet
+	server.enforceRetention()
+	_, err := os.Stat(pathutil.Join(dir, "org1", "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "old chart version of repo not in cache deleted")
+	_, err = os.Stat(pathutil.Join(dir, "org1", "otherchart-0.1.0.tgz"))
+	suite.Nil(err, "chart without rule kept")
+}
+
+func (suite *MultiTenantServerTestSuite) TestScrub() {
+	server, dir := suite.newStandaloneServer("scrub", MultiTenantServerOptions{ScrubQuarantine: true})
+	for _, f := range []string{testTarballPath, testProvfilePath, otherTestTarballPath} {
+		content, err := os.ReadFile(f)
+		suite.Nil(err, "no error opening test file")
+		suite.Nil(os.WriteFile(pathutil.Join(dir, pathutil.Base(f)), content, 0644))
+	}
+
+	// the repo is found in storage, without having been served yet
+	scrubbed := testutil.ToFloat64(scrubbedCounter)
+	server.scrub()
+	suite.Equal(scrubbed+2, testutil.ToFloat64(scrubbedCounter), "chart packages of repo not in cache scrubbed")
+	suite.Equal(float64(0), testutil.ToFloat64(scrubMismatchesCounter.WithLabelValues("")), "no mismatch")
+
+	// bit rot
+	tampered, err := os.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball")
+	suite.Nil(os.WriteFile(pathutil.Join(dir, "mychart-0.1.0.tgz"), tampered, 0644))
+	server.scrub()
+	suite.Equal(float64(1), testutil.ToFloat64(scrubMismatchesCounter.WithLabelValues("")), "mismatch counted")
+	for _, filename := range []string{"mychart-0.1.0.tgz", "mychart-0.1.0.tgz.prov"} {
+		_, err = os.Stat(pathutil.Join(dir, repo.QuarantineDirname, filename))
+		suite.Nil(err, "%s quarantined", filename)
+		_, err = os.Stat(pathutil.Join(dir, filename))
+		suite.True(os.IsNotExist(err), "%s removed from repo", filename)
+	}
+	suite.Eventually(func() bool {
+		buf := bytes.NewBuffer(nil)
+		suite.serveRequest(server, "GET", "/index.yaml", nil, "", buf)
+		return !strings.Contains(buf.String(), "mychart-0.1.0.tgz") && strings.Contains(buf.String(), "otherchart")
+	}, 5*time.Second, 50*time.Millisecond, "quarantined chart version removed from index")
+}
+
+func (suite *MultiTenantServerTestSuite) TestScrubOverwrite() {
+	server, dir := suite.newStandaloneServer("scrub-overwrite", MultiTenantServerOptions{
+		ScrubQuarantine: true,
+		AllowOverwrite:  true,
+	})
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	res = suite.serveRequest(server, "GET", "/index.yaml", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /index.yaml")
+	chartVersions := server.indexedChartVersions(server.Logger.ContextLoggingFn(&gin.Context{}), "")
+	suite.Len(chartVersions, 1, "chart version indexed")
+
+	// the scrubber read the index before the package was overwritten, and the index updated
+	snapshot := *chartVersions[0]
+	snapshot.Digest = "digest before overwrite"
+
+	mismatches := testutil.ToFloat64(scrubMismatchesCounter.WithLabelValues(""))
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	ok, err := server.scrubChartVersion(log, "", &snapshot)
+	suite.Nil(err, "no error scrubbing chart version")
+	suite.True(ok, "overwritten package matches the current index")
+	suite.Equal(mismatches, testutil.ToFloat64(scrubMismatchesCounter.WithLabelValues("")), "no mismatch counted")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "overwritten package not quarantined")
+}
+
+func (suite *MultiTenantServerTestSuite) TestDownloadRedirects() {
+	signer := cm_backend.NewLocalURLSigner([]byte("secret"), "")
+	server, _ := suite.newStandaloneServer("redirects", MultiTenantServerOptions{
+		URLSigner:       signer,
+		SignedURLExpiry: time.Minute,
+	})
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.serveRequest(server, "POST", "/api/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/charts")
+
+	res = suite.serveRequest(server, "GET", "/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(302, res.Status(), "302 GET /charts/mychart-0.1.0.tgz")
+	location := res.Header().Get("Location")
+	suite.True(strings.HasPrefix(location, "/signed/mychart-0.1.0.tgz?"), "redirected to signed URL")
+
+	buf := bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", location, nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET signed URL")
+	suite.Equal(content, buf.Bytes(), "chart package served from signed URL")
+
+	res = suite.serveRequest(server, "GET", strings.Replace(location, "mychart-0.1.0.tgz", "mychart-0.2.0.tgz", 1), nil, "")
+	suite.Equal(403, res.Status(), "403 GET tampered signed URL")
+	res = suite.serveRequest(server, "GET", "/signed/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(403, res.Status(), "403 GET unsigned URL")
+
+	res = suite.serveRequest(server, "GET", "/charts/index.yaml", nil, "")
+	suite.NotEqual(302, res.Status(), "only chart packages and provenance files redirected")
+
+	// downloads are proxied when the URL cannot be signed
+	server.URLSigner = failingURLSigner{}
+	buf = bytes.NewBuffer(nil)
+	res = suite.serveRequest(server, "GET", "/charts/mychart-0.1.0.tgz", nil, "", buf)
+	suite.Equal(200, res.Status(), "200 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal(content, buf.Bytes(), "chart package proxied")
+}
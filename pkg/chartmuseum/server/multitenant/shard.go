@@ -0,0 +1,500 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	pathutil "path"
+	"sort"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+// With sharding enabled, the statefile and the external cache entry of a repo are
+// split into one shard per chart name plus a small manifest listing the digest of
+// every shard. Writers only rewrite the shards whose digest changed, and readers
+// only fetch the shards whose digest differs from the copy they already hold.
+
+const (
+	shardManifestName = "manifest"
+	shardChartsDir    = "charts"
+)
+
+type (
+	// indexManifest describes a sharded index
+	indexManifest struct {
+		APIVersion string              `json:"apiVersion"`
+		Generated  time.Time           `json:"generated"`
+		ServerInfo *cm_repo.ServerInfo `json:"serverInfo,omitempty"`
+		Shards     map[string]string   `json:"shards"`
+	}
+
+	// shardDigests keeps track of the shards last persisted to a destination
+	shardDigests struct {
+		sync.Mutex
+		digests map[string]string
+	}
+
+	// indexShard is a single encoded chart shard
+	indexShard struct {
+		name    string
+		content []byte
+		digest  string
+	}
+)
+
+func newShardDigests(digests map[string]string) *shardDigests {
+	if digests == nil {
+		digests = map[string]string{}
+	}
+	return &shardDigests{digests: digests}
+}
+
+// snapshot returns a copy of the known digests
+func (sd *shardDigests) snapshot() map[string]string {
+	sd.Lock()
+	defer sd.Unlock()
+	digests := make(map[string]string, len(sd.digests))
+	for name, digest := range sd.digests {
+		digests[name] = digest
+	}
+	return digests
+}
+
+// diff encodes the shards of the given chart names (all charts in the index if empty)
+// and returns the ones which changed, along with the chart names which no longer exist
+func (sd *shardDigests) diff(index *cm_repo.Index, names []string) ([]indexShard, []string, error) {
+	sd.Lock()
+	defer sd.Unlock()
+
+	if len(names) == 0 {
+		for name := range index.Entries {
+			names = append(names, name)
+		}
+		for name := range sd.digests {
+			if _, ok := index.Entries[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var changed []indexShard
+	var removed []string
+	for _, name := range names {
+		chartVersions, ok := index.Entries[name]
+		if !ok {
+			if _, known := sd.digests[name]; known {
+				removed = append(removed, name)
+			}
+			continue
+		}
+		content, err := json.Marshal(chartVersions)
+		if err != nil {
+			return nil, nil, err
+		}
+		digest := shardDigest(content)
+		if sd.digests[name] == digest {
+			continue
+		}
+		changed = append(changed, indexShard{name: name, content: content, digest: digest})
+	}
+	return changed, removed, nil
+}
+
+// reset replaces the known digests, e.g. with the ones of a statefile loaded from storage
+func (sd *shardDigests) reset(digests map[string]string) {
+	sd.Lock()
+	defer sd.Unlock()
+	if digests == nil {
+		digests = map[string]string{}
+	}
+	sd.digests = digests
+}
+
+// commit records shards as persisted
+func (sd *shardDigests) commit(changed []indexShard, removed []string) {
+	sd.Lock()
+	defer sd.Unlock()
+	for _, shard := range changed {
+		sd.digests[shard.name] = shard.digest
+	}
+	for _, name := range removed {
+		delete(sd.digests, name)
+	}
+}
+
+func shardDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func newIndexManifest(index *cm_repo.Index, digests map[string]string) *indexManifest {
+	return &indexManifest{
+		APIVersion: index.APIVersion,
+		Generated:  index.Generated,
+		ServerInfo: index.ServerInfo,
+		Shards:     digests,
+	}
+}
+
+// shardManifestPath returns the storage path or cache key of a repo manifest
+func shardManifestPath(repo string) string {
+	return pathutil.Join(repo, cm_repo.StatefileShardDirname, shardManifestName)
+}
+
+// shardPath returns the storage path or cache key of a chart shard
+func shardPath(repo string, name string) string {
+	return pathutil.Join(repo, cm_repo.StatefileShardDirname, shardChartsDir, name)
+}
+
+// indexFromShards assembles a repository index from a manifest and its decoded shards
+func (server *MultiTenantServer) indexFromShards(repo string, manifest *indexManifest, entries map[string]helm_repo.ChartVersions) (*cm_repo.Index, error) {
+	serverInfo := manifest.ServerInfo
+	if serverInfo == nil {
+		serverInfo = &cm_repo.ServerInfo{ContextPath: server.Router.ContextPath}
+	}
+	index := cm_repo.NewIndex(server.repoChartURL(repo), repo, serverInfo, server.JSONIndex)
+	index.Entries = entries
+	index.Generated = manifest.Generated
+	if manifest.APIVersion != "" {
+		index.APIVersion = manifest.APIVersion
+	}
+	index.SortEntries()
+	err := index.Render()
+	return index, err
+}
+
+// loadStatefileShards reads a sharded statefile from storage
+func (server *MultiTenantServer) loadStatefileShards(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, map[string]string, bool) {
+	object, err := server.StorageBackend.GetObject(shardManifestPath(repo) + ".yaml")
+	if err != nil {
+		return nil, nil, false
+	}
+	manifest := &indexManifest{}
+	if err = unmarshalStatefile(object.Content, manifest); err != nil {
+		log(cm_logger.WarnLevel, "index-cache.d manifest found but could not be parsed",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return nil, nil, false
+	}
+
+	entries := map[string]helm_repo.ChartVersions{}
+	for name := range manifest.Shards {
+		object, err = server.StorageBackend.GetObject(shardPath(repo, name) + ".yaml")
+		if err == nil {
+			var chartVersions helm_repo.ChartVersions
+			if err = unmarshalStatefile(object.Content, &chartVersions); err == nil {
+				entries[name] = chartVersions
+				continue
+			}
+		}
+		log(cm_logger.WarnLevel, "index-cache.d shard could not be loaded",
+			"repo", repo,
+			"chart", name,
+			"error", err.Error(),
+		)
+		return nil, nil, false
+	}
+
+	index, err := server.indexFromShards(repo, manifest, entries)
+	if err != nil {
+		return nil, nil, false
+	}
+	log(cm_logger.DebugLevel, "index-cache.d loaded",
+		"repo", repo,
+		"shards", len(entries),
+	)
+	return index, manifest.Shards, true
+}
+
+// persistStatefile saves the statefile of a repo in the background.
+// When sharding is enabled, only the shards of the given chart names are considered
+// (all charts if empty), and only the ones which changed are written to storage.
+func (server *MultiTenantServer) persistStatefile(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, names ...string) {
+	if !server.UseStatefiles {
+		return
+	}
+	if !server.ShardedIndex {
+		// Dont wait, save index-cache.yaml to storage in the background.
+		// It is not crucial if this does not succeed, we will just log any errors
+		go server.saveStatefile(log, repo, index.Raw)
+		return
+	}
+
+	server.TenantCacheKeyLock.Lock()
+	tenant, ok := server.Tenants[repo]
+	server.TenantCacheKeyLock.Unlock()
+	if !ok {
+		return
+	}
+
+	// shards are encoded right away since the index may change once we return
+	changed, removed, err := tenant.StatefileShards.diff(index, names)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error encoding index-cache.d shards",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+	manifest := newIndexManifest(index, nil)
+	go server.saveStatefileShards(log, repo, tenant.StatefileShards, manifest, changed, removed)
+}
+
+// saveStatefileShards writes the changed shards of a repo to storage, then its manifest listing
+// the shards persisted so far: a shard which could not be saved is written again next time
+func (server *MultiTenantServer) saveStatefileShards(log cm_logger.LoggingFn, repo string, digests *shardDigests, manifest *indexManifest, changed []indexShard, removed []string) {
+	for _, shard := range changed {
+		content, err := server.encodeStatefile(shard.content)
+		if err == nil {
+			err = server.StorageBackend.PutObject(shardPath(repo, shard.name)+".yaml", content)
+		}
+		if err != nil {
+			log(cm_logger.WarnLevel, "Error saving index-cache.d shard",
+				"repo", repo,
+				"chart", shard.name,
+				"error", err.Error(),
+			)
+			continue
+		}
+		digests.commit([]indexShard{shard}, nil)
+	}
+	for _, name := range removed {
+		server.StorageBackend.DeleteObject(shardPath(repo, name) + ".yaml") // ignore error here, shard may never have been saved
+	}
+	digests.commit(nil, removed)
+	manifest.Shards = digests.snapshot()
+
+	content, err := json.Marshal(manifest)
+	if err == nil {
+		content, err = server.encodeStatefile(content)
+	}
+	if err == nil {
+		err = server.StorageBackend.PutObject(shardManifestPath(repo)+".yaml", content)
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error saving index-cache.d manifest",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+	log(cm_logger.DebugLevel, "index-cache.d saved in storage",
+		"repo", repo,
+		"changed", len(changed),
+		"removed", len(removed),
+	)
+}
+
+// encodeStatefile converts JSON content to the statefile output format
+func (server *MultiTenantServer) encodeStatefile(content []byte) ([]byte, error) {
+	if server.JSONIndex {
+		return content, nil
+	}
+	return yaml.JSONToYAML(content)
+}
+
+func unmarshalStatefile(content []byte, v interface{}) error {
+	if json.Valid(content) {
+		return json.Unmarshal(content, v)
+	}
+	return yaml.Unmarshal(content, v)
+}
+
+// newShardedCacheEntry builds the cache entry of a repo and saves all its shards to the external cache store
+func (server *MultiTenantServer) newShardedCacheEntry(log cm_logger.LoggingFn, repo string) (*cacheEntry, error) {
+	repoIndex, statefileDigests := server.newRepositoryIndex(log, repo)
+	server.TenantCacheKeyLock.Lock()
+	server.restoreStatefileShards(repo, statefileDigests)
+	server.TenantCacheKeyLock.Unlock()
+	entry := &cacheEntry{
+		RepoName:    repo,
+		RepoIndex:   repoIndex,
+		RepoLock:    sync.RWMutex{},
+		CacheShards: newShardDigests(nil),
+	}
+	server.InternalCacheStore.Store(repo, entry)
+	err := server.saveShardedCacheEntry(log, entry)
+	return entry, err
+}
+
+// loadShardedCacheEntry loads a cache entry from the external cache store, only fetching
+// the shards which differ from the copy of the entry held in memory.
+// It must be called without TenantCacheKeyLock held.
+func (server *MultiTenantServer) loadShardedCacheEntry(log cm_logger.LoggingFn, repo string) (*cacheEntry, error) {
+	content, err := server.ExternalCacheStore.Get(shardManifestPath(repo))
+	if err != nil {
+		return server.newShardedCacheEntry(log, repo)
+	}
+
+	manifest := &indexManifest{}
+	err = unmarshalCacheValue(content, manifest)
+	if err != nil {
+		log(cm_logger.WarnLevel, DiscardedEntryMessage,
+			"error", err.Error(),
+			"repo", repo,
+		)
+		return server.newShardedCacheEntry(log, repo)
+	}
+
+	var known map[string]string
+	cached, ok := server.InternalCacheStore.Load(repo)
+	if ok && cached.CacheShards != nil {
+		known = cached.CacheShards.snapshot()
+		if digestsEqual(known, manifest.Shards) {
+			log(cm_logger.DebugLevel, "Entry found in cache store",
+				"repo", repo,
+			)
+			return cached, nil
+		}
+	}
+
+	fetched := 0
+	entries := map[string]helm_repo.ChartVersions{}
+	checksums := map[string]string{}
+	for name, digest := range manifest.Shards {
+		if ok && known[name] == digest {
+			cached.RepoLock.RLock()
+			entries[name] = append(helm_repo.ChartVersions(nil), cached.RepoIndex.Entries[name]...)
+			// keep the backend checksums of unchanged packages
+			for _, chartVersion := range entries[name] {
+				if len(chartVersion.URLs) == 0 {
+					continue
+				}
+				filename := pathutil.Base(chartVersion.URLs[0])
+				if checksum := cached.RepoIndex.Checksum(filename); checksum != "" {
+					checksums[filename] = checksum
+				}
+			}
+			cached.RepoLock.RUnlock()
+			continue
+		}
+		shard, err := server.ExternalCacheStore.Get(shardPath(repo, name))
+		if err != nil {
+			// unchanged shards are not rewritten, so they may expire before the manifest
+			log(cm_logger.WarnLevel, "Shard missing from cache store, rebuilding entry",
+				"repo", repo,
+				"chart", name,
+			)
+			return server.newShardedCacheEntry(log, repo)
+		}
+		var chartVersions helm_repo.ChartVersions
+		err = unmarshalCacheValue(shard, &chartVersions)
+		if err != nil {
+			log(cm_logger.WarnLevel, DiscardedEntryMessage,
+				"error", err.Error(),
+				"repo", repo,
+				"chart", name,
+			)
+			return server.newShardedCacheEntry(log, repo)
+		}
+		entries[name] = chartVersions
+		fetched++
+	}
+
+	index, err := server.indexFromShards(repo, manifest, entries)
+	if err != nil {
+		return nil, err
+	}
+	index.SetChecksums(checksums)
+	log(cm_logger.DebugLevel, "Entry loaded from cache store shards",
+		"repo", repo,
+		"fetched", fetched,
+		"total", len(entries),
+	)
+	entry := &cacheEntry{
+		RepoName:    repo,
+		RepoIndex:   index,
+		RepoLock:    sync.RWMutex{},
+		CacheShards: newShardDigests(manifest.Shards),
+	}
+	server.InternalCacheStore.Store(repo, entry)
+	return entry, nil
+}
+
+// saveShardedCacheEntry writes the changed shards of an entry and its manifest to the external cache store
+func (server *MultiTenantServer) saveShardedCacheEntry(log cm_logger.LoggingFn, entry *cacheEntry, names ...string) error {
+	repo := entry.RepoName
+	if entry.CacheShards == nil {
+		entry.CacheShards = newShardDigests(nil)
+	}
+	changed, removed, err := entry.CacheShards.diff(entry.RepoIndex, names)
+	if err != nil {
+		return err
+	}
+	for _, shard := range changed {
+		var content []byte
+		content, err = encodeCacheValue(shard.content)
+		if err == nil {
+			err = server.ExternalCacheStore.Set(shardPath(repo, shard.name), content)
+		}
+		if err != nil {
+			log(cm_logger.ErrorLevel, CouldNotSaveEntryErrorMessage,
+				"error", err.Error(),
+				"repo", repo,
+				"chart", shard.name,
+			)
+			return nil
+		}
+	}
+	for _, name := range removed {
+		server.ExternalCacheStore.Delete(shardPath(repo, name)) // ignore error here, a stale shard is never read
+	}
+	entry.CacheShards.commit(changed, removed)
+
+	content, err := marshalCacheValue(newIndexManifest(entry.RepoIndex, entry.CacheShards.snapshot()))
+	if err != nil {
+		return err
+	}
+	err = server.ExternalCacheStore.Set(shardManifestPath(repo), content)
+	if err != nil {
+		log(cm_logger.ErrorLevel, CouldNotSaveEntryErrorMessage,
+			"error", err.Error(),
+			"repo", repo,
+		)
+		return nil
+	}
+	log(cm_logger.DebugLevel, EntrySavedMessage,
+		"repo", repo,
+		"changed", len(changed),
+		"removed", len(removed),
+	)
+	return nil
+}
+
+func digestsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, digest := range a {
+		if b[name] != digest {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	pathutil "path"
+	"strings"
+	"time"
+
+	cm_storage "github.com/chartmuseum/storage"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+// putObject stores size bytes of content as a file of the repo, along with its metadata sidecar when
+// it is a chart package (chartVersion is read from content if nil)
+func (server *MultiTenantServer) putObject(log cm_logger.LoggingFn, repo string, filename string, content *io.SectionReader, chartVersion *helm_repo.ChartVersion) error {
+	err := cm_backend.PutObjectStream(server.StorageBackend, pathutil.Join(repo, filename), content, content.Size())
+	if err != nil {
+		return err
+	}
+	if !server.UseSidecars || !isChartPackage(filename) {
+		return nil
+	}
+	if chartVersion == nil {
+		chartVersion, err = cm_repo.ChartVersionFromReader(io.NewSectionReader(content, 0, content.Size()), time.Now())
+		if err != nil {
+			log(cm_logger.WarnLevel, "Unable to save sidecar",
+				"repo", repo,
+				"package", filename,
+				"error", err.Error(),
+			)
+			return nil
+		}
+	}
+	sidecar := cm_repo.SidecarFromChartVersion(chartVersion, int(content.Size()))
+	sidecar.Created = time.Now()
+	// the modification time of the package is read back from the backend, its clock may differ.
+	// Backends which cannot tell it without downloading the package get the local time instead:
+	// when out of tolerance, the sidecar is refreshed with the listed checksum on the next reindex
+	stored, err := cm_backend.StatObject(server.StorageBackend, pathutil.Join(repo, filename))
+	switch {
+	case err == nil:
+		sidecar.Modified = stored.LastModified
+	case errors.Is(err, cm_backend.ErrStatUnsupported):
+		sidecar.Modified = time.Now()
+	default:
+		log(cm_logger.WarnLevel, "Unable to save sidecar",
+			"repo", repo,
+			"package", filename,
+			"error", err.Error(),
+		)
+		return nil
+	}
+	server.writeSidecar(log, repo, filename, sidecar)
+	return nil
+}
+
+// loadObjectChartVersion returns the chart version of a package listed with checksum by the backend
+// ("" if unknown), from its sidecar when there is an up-to-date one
+func (server *MultiTenantServer) loadObjectChartVersion(log cm_logger.LoggingFn, repo string, object cm_storage.Object, checksum string) (*helm_repo.ChartVersion, error) {
+	if !server.UseSidecars {
+		return server.getObjectChartVersion(repo, object, true)
+	}
+
+	sidecarObject, err := server.StorageBackend.GetObject(cm_repo.SidecarPath(repo, object.Path))
+	if err == nil {
+		sidecar, err := cm_repo.SidecarFromContent(sidecarObject.Content)
+		switch {
+		case err != nil:
+			log(cm_logger.WarnLevel, "Invalid sidecar in storage, loading package instead",
+				"repo", repo,
+				"package", object.Path,
+			)
+		case !sidecar.Describes(object, checksum, server.TimestampTolerance):
+			// the package was written after its sidecar, e.g. outside of ChartMuseum
+			log(cm_logger.DebugLevel, "Stale sidecar in storage, loading package instead",
+				"repo", repo,
+				"package", object.Path,
+			)
+		default:
+			return sidecar.ChartVersion(object), nil
+		}
+	}
+
+	return server.downloadObjectChartVersion(log, repo, object, checksum)
+}
+
+// downloadObjectChartVersion returns the chart version of a package read from its content,
+// and refreshes its sidecar for the next reindex
+func (server *MultiTenantServer) downloadObjectChartVersion(log cm_logger.LoggingFn, repo string, object cm_storage.Object, checksum string) (*helm_repo.ChartVersion, error) {
+	if !server.UseSidecars {
+		return server.getObjectChartVersion(repo, object, true)
+	}
+
+	loaded, err := server.StorageBackend.GetObject(pathutil.Join(repo, object.Path))
+	if err != nil {
+		return nil, err
+	}
+	if len(loaded.Content) == 0 {
+		return nil, cm_repo.ErrorInvalidChartPackage
+	}
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(loaded)
+	if err != nil {
+		return nil, err
+	}
+	// compared with the next listings
+	loaded.Path = object.Path
+	loaded.LastModified = object.LastModified
+	server.saveSidecar(log, repo, loaded, checksum)
+	return chartVersion, nil
+}
+
+// saveSidecar writes the metadata sidecar of a chart package listed with checksum by the backend
+// ("" if unknown), errors are only logged
+func (server *MultiTenantServer) saveSidecar(log cm_logger.LoggingFn, repo string, object cm_storage.Object, checksum string) {
+	if !server.UseSidecars {
+		return
+	}
+	sidecar, err := cm_repo.SidecarFromStorageObject(object)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Unable to save sidecar",
+			"repo", repo,
+			"package", object.Path,
+			"error", err.Error(),
+		)
+		return
+	}
+	sidecar.Checksum = checksum
+	server.writeSidecar(log, repo, object.Path, sidecar)
+}
+
+// writeSidecar stores the metadata sidecar of a chart package, errors are only logged
+func (server *MultiTenantServer) writeSidecar(log cm_logger.LoggingFn, repo string, filename string, sidecar *cm_repo.Sidecar) {
+	content, err := sidecar.Content()
+	if err == nil {
+		err = server.StorageBackend.PutObject(cm_repo.SidecarPath(repo, filename), content)
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Unable to save sidecar",
+			"repo", repo,
+			"package", filename,
+			"error", err.Error(),
+		)
+	}
+}
+
+// deleteSidecar removes the metadata sidecar of a chart package, if any
+func (server *MultiTenantServer) deleteSidecar(repo string, filename string) {
+	if !server.UseSidecars {
+		return
+	}
+	server.StorageBackend.DeleteObject(cm_repo.SidecarPath(repo, filename)) // ignore error here, may be no sidecar
+}
+
+func isChartPackage(filename string) bool {
+	return strings.HasSuffix(filename, fmt.Sprintf(".%s", cm_repo.ChartPackageFileExtension))
+}
@@ -0,0 +1,57 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+)
+
+var (
+	// StaleWarning is the Warning header of an index served while it gets revalidated
+	StaleWarning = `110 chartmuseum "Response is Stale"`
+	// RevalidationFailedWarning is the Warning header of an index served because storage failed
+	RevalidationFailedWarning = `111 chartmuseum "Revalidation Failed"`
+)
+
+// canServeStale reports whether the index of an entry is good enough to be served without
+// comparing it with storage first: it has been loaded with charts (from the cache store, a
+// statefile or the metadata store) or compared with storage before
+func (server *MultiTenantServer) canServeStale(entry *cacheEntry) bool {
+	return entry.Refreshed || len(entry.RepoIndex.Entries) > 0
+}
+
+// revalidateInBackground refreshes the index of a repo from storage, unless already in progress
+func (server *MultiTenantServer) revalidateInBackground(repo string, entry *cacheEntry) {
+	server.TenantCacheKeyLock.Lock()
+	tenant := server.tenant(repo)
+	server.TenantCacheKeyLock.Unlock()
+	if !atomic.CompareAndSwapInt32(&tenant.Revalidating, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&tenant.Revalidating, 0)
+		log := server.Logger.ContextLoggingFn(&gin.Context{})
+		log(cm_logger.DebugLevel, "Revalidating index in background",
+			"repo", repo,
+		)
+		server.refreshCacheEntry(log, repo, entry)
+	}()
+}
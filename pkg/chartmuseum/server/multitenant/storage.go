@@ -19,12 +19,17 @@ package multitenant
 import (
 	"net/http"
 	pathutil "path"
+	"sort"
 	"strings"
 
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	"helm.sh/chartmuseum/pkg/maintenance"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
 	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
 )
 
 var (
@@ -40,14 +45,9 @@ type (
 )
 
 func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo string, filename string) (*StorageObject, *HTTPError) {
-	isChartPackage := strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension)
-	isProvenanceFile := strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension)
-	if !isChartPackage && !isProvenanceFile {
-		log(cm_logger.WarnLevel, "unsupported file extension",
-			"repo", repo,
-			"filename", filename,
-		)
-		return nil, &HTTPError{http.StatusInternalServerError, "unsupported file extension"}
+	contentType, httpErr := storageObjectContentType(log, repo, filename)
+	if httpErr != nil {
+		return nil, httpErr
 	}
 
 	objectPath := pathutil.Join(repo, filename)
@@ -63,13 +63,6 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 		return nil, &HTTPError{http.StatusNotFound, "object not found"}
 	}
 
-	var contentType string
-	if isProvenanceFile {
-		contentType = provenanceFileContentType
-	} else {
-		contentType = chartPackageContentType
-	}
-
 	storageObject := &StorageObject{
 		Object:      &object,
 		ContentType: contentType,
@@ -77,3 +70,139 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 
 	return storageObject, nil
 }
+
+// serveStorageObject streams a chart package or provenance file from storage to the client,
+// without reading it whole in memory. Range requests are supported.
+func (server *MultiTenantServer) serveStorageObject(c *gin.Context, log cm_logger.LoggingFn, repo string, filename string) *HTTPError {
+	contentType, httpErr := storageObjectContentType(log, repo, filename)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	object, reader, err := cm_backend.GetObjectStream(server.StorageBackend, pathutil.Join(repo, filename))
+	if err != nil {
+		log(cm_logger.WarnLevel, err.Error(),
+			"repo", repo,
+			"filename", filename,
+		)
+		return &HTTPError{http.StatusNotFound, "object not found"}
+	}
+	defer reader.Close()
+
+	c.Header("Content-Type", contentType)
+	http.ServeContent(c.Writer, c.Request, filename, object.LastModified, reader)
+	return nil
+}
+
+// storageObjectContentType returns the content type of a chart package or provenance file
+func storageObjectContentType(log cm_logger.LoggingFn, repo string, filename string) (string, *HTTPError) {
+	switch {
+	case strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension):
+		return chartPackageContentType, nil
+	case strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension):
+		return provenanceFileContentType, nil
+	}
+	log(cm_logger.WarnLevel, "unsupported file extension",
+		"repo", repo,
+		"filename", filename,
+	)
+	return "", &HTTPError{http.StatusInternalServerError, "unsupported file extension"}
+}
+
+// getSignedStorageObjectURL returns a signed URL to download a chart package or provenance
+// file from, if the storage backend supports it
+func (server *MultiTenantServer) getSignedStorageObjectURL(log cm_logger.LoggingFn, repo string, filename string) (string, bool) {
+	if server.URLSigner == nil {
+		return "", false
+	}
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) && !strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension) {
+		return "", false
+	}
+	signedURL, err := server.URLSigner.SignedURL(pathutil.Join(repo, filename), server.SignedURLExpiry)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Unable to sign storage object URL, proxying download",
+			"repo", repo,
+			"filename", filename,
+			"error", err.Error(),
+		)
+		return "", false
+	}
+	log(cm_logger.InfoLevel, "Redirecting download to signed URL",
+		"repo", repo,
+		"filename", filename,
+	)
+	return signedURL, true
+}
+
+// storagePrefixes returns the storage prefixes holding the objects of a repo
+func storagePrefixes(repo string) []string {
+	return []string{
+		repo,
+		pathutil.Join(repo, cm_repo.SidecarDirname),
+		pathutil.Join(repo, cm_repo.ProtectedDirname),
+		pathutil.Join(repo, cm_repo.TrashDirname),
+		pathutil.Join(repo, cm_repo.QuarantineDirname),
+		pathutil.Join(repo, cm_repo.StatefileShardDirname),
+		pathutil.Join(repo, cm_repo.StatefileShardDirname, shardChartsDir),
+	}
+}
+
+// storageRepos returns the repos found in storage at the depth of the router (at any depth when
+// dynamic), for background jobs to go through every repo, including the ones not in cache.
+// Backends which cannot list prefixes fall back to the repos in cache.
+func (server *MultiTenantServer) storageRepos(log cm_logger.LoggingFn) []string {
+	depth, dynamic := server.Router.Depth, server.Router.DepthDynamic
+	var repos []string
+	err := maintenance.WalkRepos(server.StorageBackend, "", depth > 0 || dynamic, func(repo string) error {
+		if dynamic || repoDepth(repo) == depth {
+			repos = append(repos, repo)
+		}
+		return nil
+	})
+	if err == nil {
+		return repos
+	}
+	log(cm_logger.WarnLevel, "Unable to list repos in storage, using the repos in cache",
+		"error", err.Error(),
+	)
+	server.TenantCacheKeyLock.Lock()
+	defer server.TenantCacheKeyLock.Unlock()
+	repos = make([]string, 0, len(server.Tenants))
+	for repo := range server.Tenants {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// repoDepth returns the number of path segments of a repo, 0 for the root
+func repoDepth(repo string) int {
+	if repo == "" {
+		return 0
+	}
+	return strings.Count(repo, "/") + 1
+}
+
+// invalidateStorageObjects drops the package and provenance file of an updated or deleted
+// chart version from the storage backend cache, if any
+func (server *MultiTenantServer) invalidateStorageObjects(repo string, opType operationType, chartVersion *helm_repo.ChartVersion) {
+	invalidator, ok := server.StorageBackend.(cm_backend.ObjectInvalidator)
+	if !ok || opType == addChart {
+		return
+	}
+	invalidator.InvalidateObject(pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)))
+	invalidator.InvalidateObject(pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)))
+}
+
+// invalidateStorageRepo drops all objects of a repo from the storage backend cache, if any
+func (server *MultiTenantServer) invalidateStorageRepo(repo string) {
+	invalidator, ok := server.StorageBackend.(cm_backend.ObjectInvalidator)
+	if !ok {
+		return
+	}
+	if repo == "" {
+		invalidator.InvalidatePrefix("")
+		return
+	}
+	invalidator.InvalidatePrefix(repo + "/")
+}
@@ -0,0 +1,223 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+// maxTrashPurgeInterval bounds the interval at which the trash is checked for chart versions to purge
+const maxTrashPurgeInterval = time.Hour
+
+type (
+	// trashEntry is a soft-deleted chart version
+	trashEntry struct {
+		Name       string    `json:"name"`
+		Version    string    `json:"version"`
+		Filename   string    `json:"filename"`
+		Deleted    time.Time `json:"deleted"`
+		Provenance bool      `json:"provenance"`
+	}
+)
+
+func (server *MultiTenantServer) initTrashPurgeTimer() {
+	if !server.Trash || server.TrashPurgeAfter <= 0 {
+		return
+	}
+	interval := min(server.TrashPurgeAfter, maxTrashPurgeInterval)
+	go func() {
+		t := time.NewTicker(interval)
+		for range t.C {
+			server.purgeExpiredTrash()
+		}
+	}()
+}
+
+// purgeExpiredTrash purges the chart versions deleted more than TrashPurgeAfter ago from the
+// trash of every repo in storage
+func (server *MultiTenantServer) purgeExpiredTrash() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	deletedBefore := time.Now().Add(-server.TrashPurgeAfter)
+	for _, repo := range server.storageRepos(log) {
+		if _, err := server.purgeTrash(log, repo, deletedBefore); err != nil {
+			log(cm_logger.ErrorLevel, "Unable to purge trash",
+				"repo", repo,
+				"error", err.Message,
+			)
+		}
+	}
+}
+
+// trashChartVersion moves a chart package and its provenance file to the trash of the repo
+func (server *MultiTenantServer) trashChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	log(cm_logger.DebugLevel, "Moving package to trash",
+		"package", pathutil.Join(repo, filename),
+	)
+	if err := server.moveObject(pathutil.Join(repo, filename), trashPath(repo, filename)); err != nil {
+		return &HTTPError{http.StatusNotFound, err.Error()}
+	}
+	provFilename := cm_repo.ProvenanceFilenameFromNameVersion(name, version)
+	server.moveObject(pathutil.Join(repo, provFilename), trashPath(repo, provFilename)) // ignore error here, may be no prov file
+	server.deleteSidecar(repo, filename)
+	return nil
+}
+
+// listTrash returns the chart versions in the trash of a repo, most recently deleted first
+func (server *MultiTenantServer) listTrash(repo string) ([]trashEntry, *HTTPError) {
+	objects, err := server.StorageBackend.ListObjects(pathutil.Join(repo, cm_repo.TrashDirname))
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	provenance := map[string]bool{}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Path, cm_repo.ProvenanceFileExtension) {
+			provenance[strings.TrimSuffix(object.Path, ".prov")] = true
+		}
+	}
+	entries := []trashEntry{}
+	for _, object := range objects {
+		if !isChartPackage(object.Path) {
+			continue
+		}
+		name, version := cm_repo.GetExactChartNameVersion(strings.TrimSuffix(object.Path, "."+cm_repo.ChartPackageFileExtension))
+		entries = append(entries, trashEntry{
+			Name:       name,
+			Version:    version,
+			Filename:   object.Path,
+			Deleted:    object.LastModified,
+			Provenance: provenance[object.Path],
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// restoreChartVersion moves a chart package and its provenance file back from the trash of
+// the repo, unless the chart version was uploaded again meanwhile
+func (server *MultiTenantServer) restoreChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) (*helm_repo.ChartVersion, *HTTPError) {
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	unlock, err := server.lockObject(log, repo, filename)
+	if err != nil {
+		return nil, lockHTTPError(err)
+	}
+	defer unlock()
+
+	if _, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename)); err == nil {
+		return nil, &HTTPError{http.StatusConflict, "chart version already exists"}
+	}
+	object, err := server.StorageBackend.GetObject(trashPath(repo, filename))
+	if err != nil {
+		return nil, &HTTPError{http.StatusNotFound, "chart version not found in trash"}
+	}
+	object.Path = filename
+	object.LastModified = time.Now()
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(object)
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	log(cm_logger.DebugLevel, "Restoring package from trash",
+		"package", pathutil.Join(repo, filename),
+	)
+	content := io.NewSectionReader(bytes.NewReader(object.Content), 0, int64(len(object.Content)))
+	if err := server.putObject(log, repo, filename, content, chartVersion); err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	provFilename := cm_repo.ProvenanceFilenameFromNameVersion(name, version)
+	if _, err := server.StorageBackend.GetObject(trashPath(repo, provFilename)); err == nil {
+		if err := server.moveObject(trashPath(repo, provFilename), pathutil.Join(repo, provFilename)); err != nil {
+			return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+		}
+	}
+	server.StorageBackend.DeleteObject(trashPath(repo, filename)) // restored already, purged eventually
+	return chartVersion, nil
+}
+
+// purgeChartVersion deletes a chart package and its provenance file from the trash of the repo
+func (server *MultiTenantServer) purgeChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	log(cm_logger.DebugLevel, "Purging package from trash",
+		"package", pathutil.Join(repo, filename),
+	)
+	if err := server.StorageBackend.DeleteObject(trashPath(repo, filename)); err != nil {
+		return &HTTPError{http.StatusNotFound, err.Error()}
+	}
+	provFilename := cm_repo.ProvenanceFilenameFromNameVersion(name, version)
+	server.StorageBackend.DeleteObject(trashPath(repo, provFilename)) // ignore error here, may be no prov file
+	return nil
+}
+
+// purgeTrash deletes the files moved to the trash of a repo before deletedBefore (zero for all),
+// and returns their number
+func (server *MultiTenantServer) purgeTrash(log cm_logger.LoggingFn, repo string, deletedBefore time.Time) (int, *HTTPError) {
+	objects, err := server.StorageBackend.ListObjects(pathutil.Join(repo, cm_repo.TrashDirname))
+	if err != nil {
+		return 0, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	purged := 0
+	for _, object := range objects {
+		if !deletedBefore.IsZero() && object.LastModified.After(deletedBefore) {
+			continue
+		}
+		if err := server.StorageBackend.DeleteObject(trashPath(repo, object.Path)); err != nil {
+			log(cm_logger.WarnLevel, "Unable to purge file from trash",
+				"repo", repo,
+				"path", object.Path,
+				"error", err.Error(),
+			)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		log(cm_logger.InfoLevel, "Trash purged",
+			"repo", repo,
+			"purged", purged,
+		)
+	}
+	return purged, nil
+}
+
+// moveObject copies a storage object to another path, then deletes it
+func (server *MultiTenantServer) moveObject(from string, to string) error {
+	object, err := server.StorageBackend.GetObject(from)
+	if err != nil {
+		return err
+	}
+	if err := server.StorageBackend.PutObject(to, object.Content); err != nil {
+		return err
+	}
+	return server.StorageBackend.DeleteObject(from)
+}
+
+func trashPath(repo string, filename string) string {
+	return pathutil.Join(repo, cm_repo.TrashDirname, filename)
+}
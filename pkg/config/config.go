@@ -98,25 +98,39 @@ func (conf *Config) ShowDeprecationWarnings(c *cli.Context, logger *cm_logger.Lo
 	}
 }
 
+// NewConfigFromFile creates a new Config instance from a config file only, e.g. to configure
+// another storage backend than the one of the CLI flags
+func NewConfigFromFile(confFilePath string) (*Config, error) {
+	conf := NewConfig()
+	if err := conf.readConfigFile(confFilePath); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 func (conf *Config) readConfigFileFromCLIContext(c *cli.Context) error {
 	if confFilePath := c.String("config"); confFilePath != "" {
-		if _, err := os.Stat(confFilePath); os.IsNotExist(err) {
-			return fmt.Errorf("config file not found: %s", confFilePath)
-		}
+		return conf.readConfigFile(confFilePath)
+	}
 
-		ext := filepath.Ext(confFilePath)
-		if ext != ".yaml" && ext != ".yml" && ext != "" {
-			return errors.New("config file must have .yaml/.yml extension (or no extension)")
-		}
+	return nil
+}
 
-		base := strings.TrimSuffix(filepath.Base(confFilePath), ext)
-		dir := filepath.Dir(confFilePath)
-		conf.SetConfigName(base)
-		conf.AddConfigPath(dir)
-		return conf.ReadInConfig()
+func (conf *Config) readConfigFile(confFilePath string) error {
+	if _, err := os.Stat(confFilePath); os.IsNotExist(err) {
+		return fmt.Errorf("config file not found: %s", confFilePath)
 	}
 
-	return nil
+	ext := filepath.Ext(confFilePath)
+	if ext != ".yaml" && ext != ".yml" && ext != "" {
+		return errors.New("config file must have .yaml/.yml extension (or no extension)")
+	}
+
+	base := strings.TrimSuffix(filepath.Base(confFilePath), ext)
+	dir := filepath.Dir(confFilePath)
+	conf.SetConfigName(base)
+	conf.AddConfigPath(dir)
+	return conf.ReadInConfig()
 }
 
 func (conf *Config) setDefaults() {
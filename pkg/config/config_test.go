@@ -139,6 +139,16 @@ func (suite *ConfigTestSuite) TestUpdateFromCLIContext() {
 	suite.Equal(map[string]string{"foo": "bar"}, conf.GetStringMapString("artifact-hub-repo-id"))
 }
 
+func (suite *ConfigTestSuite) TestNewConfigFromFile() {
+	conf, err := NewConfigFromFile(suite.TempConfigFile)
+	suite.Nil(err)
+	suite.Equal("myuser", conf.GetString("basicauth.user"))
+	suite.Equal(8080, conf.GetInt("port"), "defaults set")
+
+	_, err = NewConfigFromFile("thisisafakefile.yaml")
+	suite.NotNil(err, "nonexistant config file")
+}
+
 func getNewContext() *cli.Context {
 	var c *cli.Context
 	app := cli.NewApp()
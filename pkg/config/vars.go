@@ -260,16 +260,25 @@ var configVars = map[string]configVar{
 		Default: "",
 		CLIFlag: cli.StringFlag{
 			Name:   "cache",
-			Usage:  "cache store, can be one of: redis",
+			Usage:  "cache store, can be one of: redis, disk",
 			EnvVar: "CACHE",
 		},
 	},
+	"cache.disk.path": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-disk-path",
+			Usage:  "path of the database file (bbolt) holding the disk cache store",
+			EnvVar: "CACHE_DISK_PATH",
+		},
+	},
 	"cache.redis.addr": {
 		Type:    stringType,
 		Default: "",
 		CLIFlag: cli.StringFlag{
 			Name:   "cache-redis-addr",
-			Usage:  "address of Redis service (host:port)",
+			Usage:  "address of Redis service (host:port), comma-separated for sentinel or cluster mode",
 			EnvVar: "CACHE_REDIS_ADDR",
 		},
 	},
@@ -292,6 +301,136 @@ var configVars = map[string]configVar{
 			Value:  0,
 		},
 	},
+	"cache.redis.mode": {
+		Type:    stringType,
+		Default: "standalone",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-mode",
+			Usage:  "Redis deployment: standalone, sentinel or cluster (comma-separated addresses in --cache-redis-addr)",
+			EnvVar: "CACHE_REDIS_MODE",
+			Value:  "standalone",
+		},
+	},
+	"cache.redis.mastername": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-master-name",
+			Usage:  "name of the master monitored by the Redis sentinels",
+			EnvVar: "CACHE_REDIS_MASTER_NAME",
+		},
+	},
+	"cache.redis.keyprefix": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-key-prefix",
+			Usage:  "prefix of the Redis keys, to share a Redis service between instances",
+			EnvVar: "CACHE_REDIS_KEY_PREFIX",
+		},
+	},
+	"cache.redis.ttl": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "cache-redis-ttl",
+			Usage:  "expiration of the Redis keys (0 for no expiration)",
+			EnvVar: "CACHE_REDIS_TTL",
+		},
+	},
+	"cache.redis.tls.enabled": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "cache-redis-tls",
+			Usage:  "connect to Redis over TLS",
+			EnvVar: "CACHE_REDIS_TLS",
+		},
+	},
+	"cache.redis.tls.cacert": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-tls-cacert",
+			Usage:  "path to CA certificate used to verify the Redis server",
+			EnvVar: "CACHE_REDIS_TLS_CACERT",
+		},
+	},
+	"cache.redis.tls.cert": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-tls-cert",
+			Usage:  "path to client certificate used to connect to Redis",
+			EnvVar: "CACHE_REDIS_TLS_CERT",
+		},
+	},
+	"cache.redis.tls.key": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-redis-tls-key",
+			Usage:  "path to client key used to connect to Redis",
+			EnvVar: "CACHE_REDIS_TLS_KEY",
+		},
+	},
+	"cache.redis.tls.insecureskipverify": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "cache-redis-tls-insecure-skip-verify",
+			Usage:  "skip verification of the Redis server certificate",
+			EnvVar: "CACHE_REDIS_TLS_INSECURE_SKIP_VERIFY",
+		},
+	},
+	"cache.bus.backend": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-bus",
+			Usage:  "bus notifying peer replicas of index changes (redis, using the --cache-redis-* options)",
+			EnvVar: "CACHE_BUS",
+		},
+	},
+	"cache.bus.channel": {
+		Type:    stringType,
+		Default: "chartmuseum:notifications",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-bus-channel",
+			Usage:  "Redis pub/sub channel used by the bus (prefixed with --cache-redis-key-prefix)",
+			EnvVar: "CACHE_BUS_CHANNEL",
+			Value:  "chartmuseum:notifications",
+		},
+	},
+	"cache.lock.backend": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "cache-lock",
+			Usage:  "locks shared with peer replicas for uploads and per-chart limits (redis, using the --cache-redis-* options)",
+			EnvVar: "CACHE_LOCK",
+		},
+	},
+	"cache.lock.timeout": {
+		Type:    durationType,
+		Default: 30 * time.Second,
+		CLIFlag: cli.DurationFlag{
+			Name:   "cache-lock-timeout",
+			Usage:  "how long an upload waits for a lock before failing with a conflict",
+			EnvVar: "CACHE_LOCK_TIMEOUT",
+			Value:  30 * time.Second,
+		},
+	},
+	"cache.lock.ttl": {
+		Type:    durationType,
+		Default: time.Minute,
+		CLIFlag: cli.DurationFlag{
+			Name:   "cache-lock-ttl",
+			Usage:  "expiration of Redis locks in case their owner dies without releasing them, renewed while they are held",
+			EnvVar: "CACHE_LOCK_TTL",
+			Value:  time.Minute,
+		},
+	},
 	"storage.backend": {
 		Type:    stringType,
 		Default: "",
@@ -310,6 +449,304 @@ var configVars = map[string]configVar{
 			EnvVar: "STORAGE_TIMESTAMP_TOLERANCE",
 		},
 	},
+	"redirect-downloads": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "redirect-downloads",
+			Usage:  "redirect chart downloads to short-lived signed storage URLs when the storage backend supports it",
+			EnvVar: "REDIRECT_DOWNLOADS",
+		},
+	},
+	"redirect-downloads-expiry": {
+		Type:    durationType,
+		Default: 5 * time.Minute,
+		CLIFlag: cli.DurationFlag{
+			Name:   "redirect-downloads-expiry",
+			Usage:  "how long signed download URLs are valid",
+			EnvVar: "REDIRECT_DOWNLOADS_EXPIRY",
+			Value:  5 * time.Minute,
+		},
+	},
+	"redirect-downloads-secret": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "redirect-downloads-secret",
+			Usage:  "secret signing download URLs served by ChartMuseum, required to redirect downloads with local storage (must be the same on all replicas)",
+			EnvVar: "REDIRECT_DOWNLOADS_SECRET",
+		},
+	},
+	"storage.breaker.threshold": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-breaker-threshold",
+			Usage:  "consecutive transient storage failures after which storage is no longer called for a while, serving the last good index (0 to disable)",
+			EnvVar: "STORAGE_BREAKER_THRESHOLD",
+			Value:  0,
+		},
+	},
+	"storage.breaker.cooldown": {
+		Type:    durationType,
+		Default: 30 * time.Second,
+		CLIFlag: cli.DurationFlag{
+			Name:   "storage-breaker-cooldown",
+			Usage:  "how long storage is no longer called once the storage breaker threshold is reached",
+			EnvVar: "STORAGE_BREAKER_COOLDOWN",
+			Value:  30 * time.Second,
+		},
+	},
+	"storage.timeout": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "storage-timeout",
+			Usage:  "timeout of each storage operation attempt (0 for no timeout)",
+			EnvVar: "STORAGE_TIMEOUT",
+		},
+	},
+	"storage.retries": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-retries",
+			Usage:  "number of times a storage operation is retried after a transient error",
+			EnvVar: "STORAGE_RETRIES",
+			Value:  0,
+		},
+	},
+	"storage.retry.backoff": {
+		Type:    durationType,
+		Default: 100 * time.Millisecond,
+		CLIFlag: cli.DurationFlag{
+			Name:   "storage-retry-backoff",
+			Usage:  "delay before the first storage retry, doubled for each further retry",
+			EnvVar: "STORAGE_RETRY_BACKOFF",
+			Value:  100 * time.Millisecond,
+		},
+	},
+	"storage.retry.maxbackoff": {
+		Type:    durationType,
+		Default: 5 * time.Second,
+		CLIFlag: cli.DurationFlag{
+			Name:   "storage-retry-max-backoff",
+			Usage:  "maximum delay between storage retries",
+			EnvVar: "STORAGE_RETRY_MAX_BACKOFF",
+			Value:  5 * time.Second,
+		},
+	},
+	"storage.cache.dir": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-cache-dir",
+			Usage:  "directory of a local disk cache of chart packages and provenance files read from storage (emptied on startup)",
+			EnvVar: "STORAGE_CACHE_DIR",
+		},
+	},
+	"storage.cache.maxsize": {
+		Type:    intType,
+		Default: 1073741824,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-cache-max-size",
+			Usage:  "maximum size in bytes of the local disk cache of storage objects",
+			EnvVar: "STORAGE_CACHE_MAX_SIZE",
+			Value:  1073741824,
+		},
+	},
+	"storage.encryption.keyfile": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-encryption-keyfile",
+			Usage:  "YAML file of AES keys used to encrypt storage objects before they are stored (encryption disabled if not set)",
+			EnvVar: "STORAGE_ENCRYPTION_KEYFILE",
+		},
+	},
+	"storage.encryption.allowplaintext": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "storage-encryption-allow-plaintext",
+			Usage:  "read storage objects which were stored before encryption was enabled",
+			EnvVar: "STORAGE_ENCRYPTION_ALLOW_PLAINTEXT",
+		},
+	},
+	"storage.mirror.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-mirror-config",
+			Usage:  "config file of a secondary storage backend which every write is mirrored to (same format as --config)",
+			EnvVar: "STORAGE_MIRROR_CONFIG",
+		},
+	},
+	"storage.mirror.async": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "storage-mirror-async",
+			Usage:  "mirror writes to the secondary storage backend in the background",
+			EnvVar: "STORAGE_MIRROR_ASYNC",
+		},
+	},
+	"storage.mirror.queuesize": {
+		Type:    intType,
+		Default: 1000,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-mirror-queue-size",
+			Usage:  "number of writes waiting to be mirrored in the background",
+			EnvVar: "STORAGE_MIRROR_QUEUE_SIZE",
+			Value:  1000,
+		},
+	},
+	"storage.mirror.failover": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "storage-mirror-failover",
+			Usage:  "read from the secondary storage backend when the primary one is unavailable",
+			EnvVar: "STORAGE_MIRROR_FAILOVER",
+		},
+	},
+	"storage.mirror.reconcileinterval": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "storage-mirror-reconcile-interval",
+			Usage:  "interval at which drift between the storage backends is repaired (0 to disable)",
+			EnvVar: "STORAGE_MIRROR_RECONCILE_INTERVAL",
+		},
+	},
+	"scrub.interval": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "scrub-interval",
+			Usage:  "interval at which the digests of the indexed chart packages are verified again (0 to disable)",
+			EnvVar: "SCRUB_INTERVAL",
+		},
+	},
+	"scrub.ratelimit": {
+		Type:    intType,
+		Default: 10,
+		CLIFlag: cli.IntFlag{
+			Name:   "scrub-rate-limit",
+			Usage:  "number of chart packages verified per second (0 for no limit)",
+			EnvVar: "SCRUB_RATE_LIMIT",
+			Value:  10,
+		},
+	},
+	"scrub.quarantine": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "scrub-quarantine",
+			Usage:  "move the chart packages which fail verification to the .quarantine directory of their repo",
+			EnvVar: "SCRUB_QUARANTINE",
+		},
+	},
+	"retention.policyfile": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "retention-policy-file",
+			Usage:  "YAML file of retention rules deleting chart versions on upload and every retention interval",
+			EnvVar: "RETENTION_POLICY_FILE",
+		},
+	},
+	"retention.interval": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "retention-interval",
+			Usage:  "interval at which the retention rules are applied to every repo (0 to only apply them on upload)",
+			EnvVar: "RETENTION_INTERVAL",
+		},
+	},
+	"retention.dryrun": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "retention-dry-run",
+			Usage:  "log the chart versions the retention rules would delete, instead of deleting them",
+			EnvVar: "RETENTION_DRY_RUN",
+		},
+	},
+	"gc.interval": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "gc-interval",
+			Usage:  "interval at which orphaned provenance files and sidecars and partial uploads are deleted (0 to disable)",
+			EnvVar: "GC_INTERVAL",
+		},
+	},
+	"gc.minage": {
+		Type:    durationType,
+		Default: time.Hour,
+		CLIFlag: cli.DurationFlag{
+			Name:   "gc-min-age",
+			Usage:  "minimum time since a file was modified before it can be deleted as garbage",
+			EnvVar: "GC_MIN_AGE",
+			Value:  time.Hour,
+		},
+	},
+	"gc.unknown": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "gc-unknown",
+			Usage:  "also delete the files which are neither chart packages, provenance files nor index caches",
+			EnvVar: "GC_UNKNOWN",
+		},
+	},
+	"gc.dryrun": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "gc-dry-run",
+			Usage:  "log the garbage files instead of deleting them",
+			EnvVar: "GC_DRY_RUN",
+		},
+	},
+	"trash.enabled": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "trash",
+			Usage:  "move deleted chart versions to the .trash directory of their repo, from which they can be restored",
+			EnvVar: "TRASH",
+		},
+	},
+	"trash.purgeafter": {
+		Type:    durationType,
+		Default: 0,
+		CLIFlag: cli.DurationFlag{
+			Name:   "trash-purge-after",
+			Usage:  "time after which deleted chart versions are purged from the trash (0 to keep them)",
+			EnvVar: "TRASH_PURGE_AFTER",
+		},
+	},
+	"protection.policyfile": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "protection-policy-file",
+			Usage:  "YAML file of protection rules preventing chart versions from being overwritten or deleted",
+			EnvVar: "PROTECTION_POLICY_FILE",
+		},
+	},
+	"protection.allowunlock": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "protection-allow-unlock",
+			Usage:  "allow chart versions locked through the API to be unlocked through the API",
+			EnvVar: "PROTECTION_ALLOW_UNLOCK",
+		},
+	},
 	"storage.local.rootdir": {
 		Type:    stringType,
 		Default: "",
@@ -771,6 +1208,24 @@ var configVars = map[string]configVar{
 			EnvVar: "CACHE_INTERVAL",
 		},
 	},
+	"cache-max-tenants": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "cache-max-tenants",
+			Usage:  "maximum number of tenants held in the in-memory cache, least recently used ones are evicted (0 for no limit)",
+			EnvVar: "CACHE_MAX_TENANTS",
+		},
+	},
+	"cache-tenant-idle-timeout": {
+		Type:    durationType,
+		Default: time.Duration(0),
+		CLIFlag: cli.DurationFlag{
+			Name:   "cache-tenant-idle-timeout",
+			Usage:  "evict tenants from the in-memory cache once idle for that long (0 to keep them)",
+			EnvVar: "CACHE_TENANT_IDLE_TIMEOUT",
+		},
+	},
 	"listen.host": {
 		Type:    stringType,
 		Default: "0.0.0.0",
@@ -816,6 +1271,42 @@ var configVars = map[string]configVar{
 			EnvVar: "ALWAYS_REGENERATE_CHART_INDEX",
 		},
 	},
+	"stale-while-revalidate": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "stale-while-revalidate",
+			Usage:  "serve the cached chart index right away instead of regenerating it first, and regenerate it in the background",
+			EnvVar: "STALE_WHILE_REVALIDATE",
+		},
+	},
+	"sharded-index": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "sharded-index",
+			Usage:  "store index-cache.yaml and the external cache entry sharded per chart name",
+			EnvVar: "SHARDED_INDEX",
+		},
+	},
+	"sidecars": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "sidecars",
+			Usage:  "write a metadata sidecar next to each uploaded chart package and read it instead of the package when reindexing",
+			EnvVar: "SIDECARS",
+		},
+	},
+	"metadata-db-path": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "metadata-db-path",
+			Usage:  "path of an embedded metadata database (bbolt) holding chart versions, rebuilt from storage when missing",
+			EnvVar: "METADATA_DB_PATH",
+		},
+	},
 }
 
 type KeyValueFlag struct {
@@ -0,0 +1,296 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	pathutil "path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"sigs.k8s.io/yaml"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+const (
+	// BackupManifestFilename is the name of the manifest in a backup archive, after the objects
+	BackupManifestFilename = "manifest.yaml"
+	// BackupManifestAPIVersion is the version of the manifest format
+	BackupManifestAPIVersion = "v1"
+
+	// backupObjectsDirname is the directory holding the storage objects in a backup archive
+	backupObjectsDirname = "objects"
+)
+
+var (
+	// ErrInvalidBackup is returned when a backup archive does not match its manifest
+	ErrInvalidBackup = errors.New("invalid backup archive")
+)
+
+type (
+	// BackupOptions are options for Backup
+	BackupOptions struct {
+		// Repos are the repos (storage prefixes) to back up, defaults to the storage root
+		Repos []string
+		// Recursive backs up the repos nested under Repos too, which requires a backend able
+		// to list prefixes
+		Recursive bool
+	}
+
+	// BackupManifest lists the objects of a backup archive
+	BackupManifest struct {
+		APIVersion string                `json:"apiVersion"`
+		Created    time.Time             `json:"created"`
+		Repos      []string              `json:"repos"`
+		Objects    []BackupManifestEntry `json:"objects"`
+	}
+
+	// BackupManifestEntry is a storage object of a backup archive
+	BackupManifestEntry struct {
+		Repo   string `json:"repo"`
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		Digest string `json:"digest"`
+	}
+
+	// RestoreOptions are options for Restore
+	RestoreOptions struct {
+		// Repos are the repos to restore, defaults to every repo of the archive
+		Repos []string
+		// Overwrite replaces objects which already exist with another content, which are
+		// reported as conflicts otherwise
+		Overwrite bool
+		// DryRun only validates the archive and reports the objects which would be restored
+		DryRun bool
+	}
+
+	// RestoreReport summarizes a restore
+	RestoreReport struct {
+		Manifest  *BackupManifest
+		Restored  []string
+		Skipped   int
+		Conflicts []string
+		Failed    map[string]error
+	}
+)
+
+// Backup writes the chart packages and provenance files of repos to a tar archive, followed
+// by a manifest with their SHA-256 digests
+func Backup(backend storage.Backend, w io.Writer, options BackupOptions) (*BackupManifest, error) {
+	repos := options.Repos
+	if len(repos) == 0 {
+		repos = []string{""}
+	}
+	manifest := &BackupManifest{
+		APIVersion: BackupManifestAPIVersion,
+		Created:    time.Now().UTC(),
+	}
+	archive := tar.NewWriter(w)
+	for _, repo := range repos {
+		err := WalkRepos(backend, repo, options.Recursive, func(repo string) error {
+			manifest.Repos = append(manifest.Repos, repo)
+			paths, _, err := repoObjects(backend, repo)
+			if err != nil {
+				return err
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				object, err := backend.GetObject(path)
+				if err != nil {
+					return err
+				}
+				if err := writeTarEntry(archive, pathutil.Join(backupObjectsDirname, path), object.Content, object.LastModified); err != nil {
+					return err
+				}
+				digest := sha256.Sum256(object.Content)
+				manifest.Objects = append(manifest.Objects, BackupManifestEntry{
+					Repo:   repo,
+					Path:   path,
+					Size:   int64(len(object.Content)),
+					Digest: hex.EncodeToString(digest[:]),
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	content, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(archive, BackupManifestFilename, content, manifest.Created); err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+func writeTarEntry(archive *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(content)
+	return err
+}
+
+// Restore validates a backup archive against its manifest, then writes its objects to a
+// storage backend. Nothing is written if the archive is invalid.
+func Restore(backend storage.Backend, r io.ReadSeeker, options RestoreOptions) (*RestoreReport, error) {
+	manifest, err := validateBackup(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &RestoreReport{
+		Manifest: manifest,
+		Failed:   map[string]error{},
+	}
+	restored := map[string]bool{}
+	for _, entry := range manifest.Objects {
+		restored[entry.Path] = len(options.Repos) == 0 || slices.Contains(options.Repos, entry.Repo)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		path := strings.TrimPrefix(header.Name, backupObjectsDirname+"/")
+		if !restored[path] {
+			continue
+		}
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		if existing, err := backend.GetObject(path); err == nil {
+			if bytes.Equal(existing.Content, content) {
+				report.Skipped++
+				continue
+			}
+			if !options.Overwrite {
+				report.Conflicts = append(report.Conflicts, path)
+				continue
+			}
+		}
+		if !options.DryRun {
+			if err := backend.PutObject(path, content); err != nil {
+				report.Failed[path] = err
+				continue
+			}
+		}
+		report.Restored = append(report.Restored, path)
+	}
+	return report, nil
+}
+
+// validateBackup reads a backup archive, checking that its objects are the chart packages
+// and provenance files listed by its manifest, with the same digests
+func validateBackup(r io.Reader) (*BackupManifest, error) {
+	digests := map[string]string{}
+	var manifest *BackupManifest
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+		}
+		if header.Name == BackupManifestFilename {
+			manifest, err = readBackupManifest(archive)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		path, ok := strings.CutPrefix(header.Name, backupObjectsDirname+"/")
+		if !ok || header.Typeflag != tar.TypeReg || !validBackupPath(path) {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, header.Name)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, archive); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+		}
+		digests[path] = hex.EncodeToString(hash.Sum(nil))
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: %s not found", ErrInvalidBackup, BackupManifestFilename)
+	}
+	for _, entry := range manifest.Objects {
+		digest, ok := digests[entry.Path]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s missing", ErrInvalidBackup, entry.Path)
+		}
+		if digest != entry.Digest {
+			return nil, fmt.Errorf("%w: digest mismatch for %s", ErrInvalidBackup, entry.Path)
+		}
+		delete(digests, entry.Path)
+	}
+	for path := range digests {
+		return nil, fmt.Errorf("%w: %s not in manifest", ErrInvalidBackup, path)
+	}
+	return manifest, nil
+}
+
+func readBackupManifest(r io.Reader) (*BackupManifest, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+	manifest := &BackupManifest{}
+	if err := yaml.UnmarshalStrict(content, manifest); err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %s", ErrInvalidBackup, err)
+	}
+	if manifest.APIVersion != BackupManifestAPIVersion {
+		return nil, fmt.Errorf("%w: unsupported manifest version %q", ErrInvalidBackup, manifest.APIVersion)
+	}
+	return manifest, nil
+}
+
+// validBackupPath reports whether path is a chart package or provenance file which stays
+// within the storage
+func validBackupPath(path string) bool {
+	if path == "" || pathutil.IsAbs(path) || pathutil.Clean(path) != path || path == ".." || strings.HasPrefix(path, "../") {
+		return false
+	}
+	return strings.HasSuffix(path, cm_repo.ChartPackageFileExtension) || strings.HasSuffix(path, cm_repo.ProvenanceFileExtension)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type BackupTestSuite struct {
+	suite.Suite
+	Backend storage.Backend
+}
+
+func (suite *BackupTestSuite) SetupTest() {
+	suite.Backend = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+	for path, content := range map[string]string{
+		"mychart-0.1.0.tgz":                 "root chart",
+		"index-cache.yaml":                  "statefile",
+		"org1/repoa/mychart-0.1.0.tgz":      "nested chart",
+		"org1/repoa/mychart-0.1.0.tgz.prov": "nested provenance",
+	} {
+		suite.Nil(suite.Backend.PutObject(path, []byte(content)))
+	}
+}
+
+func (suite *BackupTestSuite) content(backend storage.Backend, path string) string {
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return ""
+	}
+	return string(object.Content)
+}
+
+func (suite *BackupTestSuite) backup() []byte {
+	var archive bytes.Buffer
+	manifest, err := Backup(suite.Backend, &archive, BackupOptions{Recursive: true})
+	suite.Nil(err, "no error backing up")
+	suite.Equal([]string{"", "org1", "org1/repoa"}, manifest.Repos)
+	suite.Len(manifest.Objects, 3, "packages and provenance files backed up")
+	return archive.Bytes()
+}
+
+func (suite *BackupTestSuite) TestBackupRestore() {
+	archive := suite.backup()
+
+	destination := storage.NewLocalFilesystemBackend(suite.T().TempDir())
+	report, err := Restore(destination, bytes.NewReader(archive), RestoreOptions{DryRun: true})
+	suite.Nil(err, "no error on dry run")
+	suite.Len(report.Restored, 3, "files to restore reported")
+	suite.Equal("", suite.content(destination, "mychart-0.1.0.tgz"), "nothing restored on dry run")
+
+	suite.Nil(destination.PutObject("mychart-0.1.0.tgz", []byte("root chart")))
+	suite.Nil(destination.PutObject("org1/repoa/mychart-0.1.0.tgz", []byte("other chart")))
+	report, err = Restore(destination, bytes.NewReader(archive), RestoreOptions{})
+	suite.Nil(err, "no error restoring")
+	suite.Equal([]string{"org1/repoa/mychart-0.1.0.tgz.prov"}, report.Restored)
+	suite.Equal(1, report.Skipped, "identical file skipped")
+	suite.Equal([]string{"org1/repoa/mychart-0.1.0.tgz"}, report.Conflicts, "different file not overwritten")
+	suite.Equal("other chart", suite.content(destination, "org1/repoa/mychart-0.1.0.tgz"))
+	suite.Equal("", suite.content(destination, "index-cache.yaml"), "statefile not restored")
+
+	report, err = Restore(destination, bytes.NewReader(archive), RestoreOptions{Overwrite: true})
+	suite.Nil(err, "no error restoring with overwrite")
+	suite.Equal([]string{"org1/repoa/mychart-0.1.0.tgz"}, report.Restored, "different file overwritten")
+	suite.Equal("nested chart", suite.content(destination, "org1/repoa/mychart-0.1.0.tgz"))
+
+	destination = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+	report, err = Restore(destination, bytes.NewReader(archive), RestoreOptions{Repos: []string{"org1/repoa"}})
+	suite.Nil(err, "no error restoring a repo")
+	suite.Len(report.Restored, 2, "files of the repo restored")
+	suite.Equal("", suite.content(destination, "mychart-0.1.0.tgz"), "other repos not restored")
+}
+
+func (suite *BackupTestSuite) TestRestoreInvalid() {
+	archive := suite.backup()
+	destination := storage.NewLocalFilesystemBackend(suite.T().TempDir())
+
+	corrupted := bytes.Replace(archive, []byte("nested chart"), []byte("altered data"), 1)
+	_, err := Restore(destination, bytes.NewReader(corrupted), RestoreOptions{})
+	suite.ErrorIs(err, ErrInvalidBackup, "digest mismatch")
+	suite.Equal("", suite.content(destination, "mychart-0.1.0.tgz"), "nothing restored from invalid archive")
+
+	_, err = Restore(destination, bytes.NewReader(archive[:1024]), RestoreOptions{})
+	suite.ErrorIs(err, ErrInvalidBackup, "truncated archive")
+
+	for name, entries := range map[string][]string{
+		"no manifest":     {"objects/mychart-0.1.0.tgz"},
+		"path traversal":  {"objects/../mychart-0.1.0.tgz", BackupManifestFilename},
+		"unexpected file": {"objects/README.md", BackupManifestFilename},
+		"not in manifest": {"objects/mychart-0.1.0.tgz", BackupManifestFilename},
+	} {
+		var buffer bytes.Buffer
+		writer := tar.NewWriter(&buffer)
+		for _, entry := range entries {
+			content := []byte("content")
+			if entry == BackupManifestFilename {
+				content = []byte("apiVersion: v1\n")
+			}
+			suite.Nil(writeTarEntry(writer, entry, content, time.Now()))
+		}
+		suite.Nil(writer.Close())
+		_, err = Restore(destination, bytes.NewReader(buffer.Bytes()), RestoreOptions{})
+		suite.ErrorIs(err, ErrInvalidBackup, name)
+	}
+}
+
+func TestBackupTestSuite(t *testing.T) {
+	suite.Run(t, new(BackupTestSuite))
+}
@@ -0,0 +1,382 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"sigs.k8s.io/yaml"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// FsckInvalidPackage is a chart package which cannot be loaded
+	FsckInvalidPackage = "invalid-package"
+	// FsckFilenameMismatch is a chart package not named after its chart name and version
+	FsckFilenameMismatch = "filename-mismatch"
+	// FsckOrphanedProvenance is a provenance file without chart package
+	FsckOrphanedProvenance = "orphaned-provenance"
+	// FsckMissingObject is a statefile entry without chart package
+	FsckMissingObject = "missing-object"
+	// FsckDigestMismatch is a statefile entry with another digest than its chart package
+	FsckDigestMismatch = "digest-mismatch"
+)
+
+type (
+	// FsckOptions are options for Fsck
+	FsckOptions struct {
+		// Repo is the repo (storage prefix) to check, "" for the root
+		Repo string
+		// Repair fixes the problems which can be fixed without losing data
+		Repair bool
+		// MinAge ignores the provenance files modified less than MinAge ago, e.g. uploaded
+		// right before their chart package
+		MinAge time.Duration
+	}
+
+	// FsckProblem is an inconsistency found in the storage of a repo
+	FsckProblem struct {
+		Kind     string `json:"kind"`
+		Path     string `json:"path"`
+		Detail   string `json:"detail,omitempty"`
+		Repaired bool   `json:"repaired"`
+		// Error is the error repairing the problem, if any
+		Error string `json:"error,omitempty"`
+	}
+
+	// FsckReport lists the problems found in the storage of a repo
+	FsckReport struct {
+		Repo     string        `json:"repo"`
+		Scanned  int           `json:"scanned"`
+		Problems []FsckProblem `json:"problems"`
+	}
+
+	// statefileManifest is the manifest of a sharded statefile (index-cache.d), listing the
+	// digest of the shard of every chart
+	statefileManifest struct {
+		Shards map[string]string `json:"shards"`
+	}
+)
+
+const statefileManifestName = "manifest.yaml"
+
+// Fsck checks the consistency of the chart packages, provenance files and statefile
+// (index-cache.yaml, or its shards in index-cache.d) of a repo. With repair, packages are
+// renamed after their chart name and version unless the name is taken, orphaned provenance
+// files modified at least MinAge ago are deleted, and the statefile entries are fixed.
+// Invalid packages are only reported.
+func Fsck(backend storage.Backend, options FsckOptions) (*FsckReport, error) {
+	objects, err := backend.ListObjects(options.Repo)
+	if err != nil {
+		return nil, err
+	}
+	report := &FsckReport{
+		Repo:     options.Repo,
+		Problems: []FsckProblem{},
+	}
+	// digests of the packages by filename, under their chart name and version
+	digests := map[string]string{}
+	filenames := map[string]bool{}
+	var provenanceFiles []storage.Object
+	for _, object := range objects {
+		switch {
+		case strings.HasSuffix(object.Path, cm_repo.ChartPackageFileExtension):
+			filenames[object.Path] = true
+		case strings.HasSuffix(object.Path, cm_repo.ProvenanceFileExtension):
+			provenanceFiles = append(provenanceFiles, object)
+		}
+	}
+
+	packages := make([]string, 0, len(filenames))
+	for filename := range filenames {
+		packages = append(packages, filename)
+	}
+	sort.Strings(packages)
+	report.Scanned = len(packages) + len(provenanceFiles)
+	for _, filename := range packages {
+		path := pathutil.Join(options.Repo, filename)
+		object, err := backend.GetObject(path)
+		if err != nil {
+			return nil, err
+		}
+		chartVersion, err := cm_repo.ChartVersionFromStorageObject(object)
+		if err != nil {
+			report.Problems = append(report.Problems, FsckProblem{Kind: FsckInvalidPackage, Path: path, Detail: err.Error()})
+			continue
+		}
+		digests[filename] = chartVersion.Digest
+		expected := cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+		if expected == filename {
+			continue
+		}
+		problem := FsckProblem{Kind: FsckFilenameMismatch, Path: path, Detail: fmt.Sprintf("chart is %s", expected)}
+		if options.Repair && !filenames[expected] {
+			problem.Repaired, err = renamePackage(backend, options.Repo, filename, expected, object.Content)
+			if problem.Repaired {
+				// the provenance file moved along, if any
+				delete(digests, filename)
+				digests[expected] = chartVersion.Digest
+			}
+			problem.setError(err)
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	minModified := time.Now().Add(-options.MinAge)
+	for _, object := range provenanceFiles {
+		if filenames[strings.TrimSuffix(object.Path, ".prov")] || object.LastModified.After(minModified) {
+			continue
+		}
+		path := pathutil.Join(options.Repo, object.Path)
+		problem := FsckProblem{Kind: FsckOrphanedProvenance, Path: path}
+		if options.Repair {
+			err := backend.DeleteObject(path)
+			problem.Repaired = err == nil
+			problem.setError(err)
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	problems, err := fsckStatefile(backend, options, digests)
+	if err != nil {
+		return nil, err
+	}
+	report.Problems = append(report.Problems, problems...)
+	problems, err = fsckStatefileShards(backend, options, digests)
+	if err != nil {
+		return nil, err
+	}
+	report.Problems = append(report.Problems, problems...)
+	return report, nil
+}
+
+// renamePackage moves a chart package, and its provenance file if any, to the filename
+// of its chart name and version
+func renamePackage(backend storage.Backend, repo string, filename string, expected string, content []byte) (bool, error) {
+	if err := backend.PutObject(pathutil.Join(repo, expected), content); err != nil {
+		return false, err
+	}
+	provenancePath := pathutil.Join(repo, filename) + ".prov"
+	if provenance, err := backend.GetObject(provenancePath); err == nil {
+		if err := backend.PutObject(pathutil.Join(repo, expected)+".prov", provenance.Content); err != nil {
+			return false, err
+		}
+		if err := backend.DeleteObject(provenancePath); err != nil {
+			return false, err
+		}
+	}
+	return true, backend.DeleteObject(pathutil.Join(repo, filename))
+}
+
+// fsckStatefile checks the entries of the statefile of a repo against the digests of its
+// packages by filename
+func fsckStatefile(backend storage.Backend, options FsckOptions, digests map[string]string) ([]FsckProblem, error) {
+	path := pathutil.Join(options.Repo, cm_repo.StatefileFilename)
+	object, err := backend.GetObject(path)
+	if err != nil {
+		// no statefile
+		return nil, nil
+	}
+	isJSON := json.Valid(object.Content)
+	indexFile := &cm_repo.IndexFile{}
+	if isJSON {
+		err = json.Unmarshal(object.Content, indexFile)
+	} else {
+		err = yaml.Unmarshal(object.Content, indexFile)
+	}
+	if err != nil || indexFile.IndexFile == nil {
+		// the statefile is rebuilt from storage by the server
+		return nil, nil
+	}
+
+	var problems []FsckProblem
+	names := make([]string, 0, len(indexFile.Entries))
+	for name := range indexFile.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kept, entryProblems := fsckChartVersions(path, indexFile.Entries[name], digests)
+		problems = append(problems, entryProblems...)
+		if len(kept) == 0 {
+			delete(indexFile.Entries, name)
+		} else {
+			indexFile.Entries[name] = kept
+		}
+	}
+	if !options.Repair || len(problems) == 0 {
+		return problems, nil
+	}
+
+	var content []byte
+	if isJSON {
+		content, err = json.Marshal(indexFile)
+	} else {
+		content, err = yaml.Marshal(indexFile)
+	}
+	if err == nil {
+		err = backend.PutObject(path, content)
+	}
+	for i := range problems {
+		problems[i].Repaired = err == nil
+		problems[i].setError(err)
+	}
+	return problems, nil
+}
+
+// fsckStatefileShards checks the shards of the sharded statefile of a repo, if any, against
+// the digests of its packages by filename. Repaired shards are rewritten along with their
+// digest in the manifest.
+func fsckStatefileShards(backend storage.Backend, options FsckOptions, digests map[string]string) ([]FsckProblem, error) {
+	shardDir := pathutil.Join(options.Repo, cm_repo.StatefileShardDirname)
+	manifestPath := pathutil.Join(shardDir, statefileManifestName)
+	object, err := backend.GetObject(manifestPath)
+	if err != nil {
+		// not sharded
+		return nil, nil
+	}
+	isJSON := json.Valid(object.Content)
+	manifest := &statefileManifest{}
+	if err := yaml.Unmarshal(object.Content, manifest); err != nil {
+		// the statefile is rebuilt from storage by the server
+		return nil, nil
+	}
+
+	var problems []FsckProblem
+	names := make([]string, 0, len(manifest.Shards))
+	for name := range manifest.Shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := pathutil.Join(shardDir, statefileShardChartsDirname, name+".yaml")
+		shard, err := backend.GetObject(path)
+		if err != nil {
+			continue
+		}
+		var chartVersions helm_repo.ChartVersions
+		if err := yaml.Unmarshal(shard.Content, &chartVersions); err != nil {
+			continue
+		}
+		kept, shardProblems := fsckChartVersions(path, chartVersions, digests)
+		if options.Repair && len(shardProblems) > 0 {
+			err := repairStatefileShard(backend, manifest, name, path, kept, json.Valid(shard.Content))
+			for i := range shardProblems {
+				shardProblems[i].Repaired = err == nil
+				shardProblems[i].setError(err)
+			}
+		}
+		problems = append(problems, shardProblems...)
+	}
+	if !options.Repair || len(problems) == 0 {
+		return problems, nil
+	}
+
+	// the manifest lists the digests of the repaired shards
+	content, err := json.Marshal(manifest.raw(object.Content))
+	if err == nil && !isJSON {
+		content, err = yaml.JSONToYAML(content)
+	}
+	if err == nil {
+		err = backend.PutObject(manifestPath, content)
+	}
+	if err != nil {
+		for i := range problems {
+			problems[i].Repaired = false
+			problems[i].setError(err)
+		}
+	}
+	return problems, nil
+}
+
+// repairStatefileShard rewrites the shard of a chart with the entries kept, or deletes it if
+// none is left, and records its digest in the manifest
+func repairStatefileShard(backend storage.Backend, manifest *statefileManifest, name string, path string, kept helm_repo.ChartVersions, isJSON bool) error {
+	if len(kept) == 0 {
+		delete(manifest.Shards, name)
+		return backend.DeleteObject(path)
+	}
+	content, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	if !isJSON {
+		if content, err = yaml.JSONToYAML(content); err != nil {
+			return err
+		}
+	}
+	if err := backend.PutObject(path, content); err != nil {
+		return err
+	}
+	manifest.Shards[name] = digest
+	return nil
+}
+
+// raw returns the fields of the manifest content, with the shards of the manifest
+func (manifest *statefileManifest) raw(content []byte) map[string]interface{} {
+	fields := map[string]interface{}{}
+	yaml.Unmarshal(content, &fields)
+	fields["shards"] = manifest.Shards
+	return fields
+}
+
+// fsckChartVersions checks the chart versions of a statefile entry against the digests of
+// the packages by filename, and returns the ones with a package, with the right digest
+func fsckChartVersions(path string, chartVersions helm_repo.ChartVersions, digests map[string]string) (helm_repo.ChartVersions, []FsckProblem) {
+	var kept helm_repo.ChartVersions
+	var problems []FsckProblem
+	for _, chartVersion := range chartVersions {
+		filename := cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+		if len(chartVersion.URLs) > 0 {
+			filename = pathutil.Base(chartVersion.URLs[0])
+		}
+		digest, ok := digests[filename]
+		switch {
+		case !ok:
+			problems = append(problems, FsckProblem{Kind: FsckMissingObject, Path: path, Detail: filename})
+			continue
+		case digest != chartVersion.Digest:
+			problems = append(problems, FsckProblem{
+				Kind:   FsckDigestMismatch,
+				Path:   path,
+				Detail: fmt.Sprintf("%s is %s, not %s", filename, digest, chartVersion.Digest),
+			})
+			chartVersion.Digest = digest
+		}
+		kept = append(kept, chartVersion)
+	}
+	return kept, problems
+}
+
+func (problem *FsckProblem) setError(err error) {
+	if err != nil {
+		problem.Error = err.Error()
+	}
+}
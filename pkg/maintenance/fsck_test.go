@@ -0,0 +1,212 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	pathutil "path"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+	"sigs.k8s.io/yaml"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type FsckTestSuite struct {
+	suite.Suite
+	Directory string
+	Backend   storage.Backend
+}
+
+func (suite *FsckTestSuite) SetupTest() {
+	suite.Directory = suite.T().TempDir()
+	suite.Backend = storage.NewLocalFilesystemBackend(suite.Directory)
+	for path, source := range map[string]string{
+		"org1/mychart-0.1.0.tgz":      "../../testdata/charts/mychart/mychart-0.1.0.tgz",
+		"org1/mychart-0.1.0.tgz.prov": "../../testdata/charts/mychart/mychart-0.1.0.tgz.prov",
+		"org1/renamed.tgz":            "../../testdata/charts/mychart/mychart-0.2.0.tgz",
+		"org1/renamed.tgz.prov":       "../../testdata/charts/mychart/mychart-0.2.0.tgz.prov",
+		"org1/otherchart-0.1.0.tgz":   "../../testdata/charts/mychart/mychart-0.0.1.tgz",
+		"org1/orphan-0.1.0.tgz.prov":  "../../testdata/charts/otherchart/otherchart-0.1.0.tgz.prov",
+	} {
+		content, err := os.ReadFile(source)
+		suite.Nil(err, "no error reading test file")
+		suite.Nil(suite.Backend.PutObject(path, content))
+	}
+	suite.Nil(suite.Backend.PutObject("org1/broken-0.1.0.tgz", []byte("not a chart")))
+
+	object, err := suite.Backend.GetObject("org1/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(object)
+	suite.Nil(err)
+	chartVersion.Digest = "0000"
+	indexFile := &cm_repo.IndexFile{IndexFile: helm_repo.NewIndexFile()}
+	indexFile.Entries["mychart"] = helm_repo.ChartVersions{chartVersion}
+	missing := *chartVersion
+	missing.URLs = []string{"charts/deleted-0.1.0.tgz"}
+	indexFile.Entries["deleted"] = helm_repo.ChartVersions{&missing}
+	content, err := yaml.Marshal(indexFile)
+	suite.Nil(err)
+	suite.Nil(suite.Backend.PutObject("org1/"+cm_repo.StatefileFilename, content))
+}
+
+func (suite *FsckTestSuite) problems(report *FsckReport) map[string]FsckProblem {
+	problems := map[string]FsckProblem{}
+	for _, problem := range report.Problems {
+		problems[problem.Kind+" "+problem.Path+" "+problem.Detail] = problem
+	}
+	return problems
+}
+
+func (suite *FsckTestSuite) exists(path string) bool {
+	_, err := suite.Backend.GetObject(path)
+	return err == nil
+}
+
+func (suite *FsckTestSuite) TestFsck() {
+	report, err := Fsck(suite.Backend, FsckOptions{Repo: "org1"})
+	suite.Nil(err, "no error checking repo")
+	suite.Equal(7, report.Scanned)
+	problems := suite.problems(report)
+	suite.Len(problems, 6, "problems found")
+	suite.Contains(problems, FsckInvalidPackage+" org1/broken-0.1.0.tgz invalid chart package")
+	suite.Contains(problems, FsckFilenameMismatch+" org1/renamed.tgz chart is mychart-0.2.0.tgz")
+	suite.Contains(problems, FsckFilenameMismatch+" org1/otherchart-0.1.0.tgz chart is mychart-0.0.1.tgz")
+	suite.Contains(problems, FsckOrphanedProvenance+" org1/orphan-0.1.0.tgz.prov ")
+	suite.Contains(problems, FsckMissingObject+" org1/index-cache.yaml deleted-0.1.0.tgz")
+	for key, problem := range problems {
+		suite.False(problem.Repaired, "nothing repaired: %s", key)
+		if problem.Kind == FsckDigestMismatch {
+			suite.Contains(problem.Detail, "mychart-0.1.0.tgz is ")
+		}
+	}
+
+	report, err = Fsck(suite.Backend, FsckOptions{Repo: "org1", Repair: true})
+	suite.Nil(err, "no error repairing repo")
+	for _, problem := range report.Problems {
+		suite.Empty(problem.Error, "no error repairing %s", problem.Path)
+		suite.Equal(problem.Kind != FsckInvalidPackage, problem.Repaired, "%s %s repaired", problem.Kind, problem.Path)
+	}
+	suite.True(suite.exists("org1/mychart-0.2.0.tgz"), "package renamed")
+	suite.True(suite.exists("org1/mychart-0.2.0.tgz.prov"), "provenance file renamed")
+	suite.False(suite.exists("org1/renamed.tgz"))
+	suite.False(suite.exists("org1/renamed.tgz.prov"))
+	suite.True(suite.exists("org1/broken-0.1.0.tgz"), "invalid package kept")
+	suite.False(suite.exists("org1/orphan-0.1.0.tgz.prov"), "orphaned provenance file deleted")
+
+	report, err = Fsck(suite.Backend, FsckOptions{Repo: "org1"})
+	suite.Nil(err)
+	suite.Len(report.Problems, 1, "only the invalid package left")
+	suite.Equal(FsckInvalidPackage, report.Problems[0].Kind)
+}
+
+func (suite *FsckTestSuite) TestFsckNameTaken() {
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Nil(suite.Backend.PutObject("copy.tgz", content))
+	suite.Nil(suite.Backend.PutObject("mychart-0.1.0.tgz", content))
+	report, err := Fsck(suite.Backend, FsckOptions{Repair: true})
+	suite.Nil(err)
+	suite.Len(report.Problems, 1)
+	suite.False(report.Problems[0].Repaired, "package not renamed over another one")
+	suite.True(suite.exists("copy.tgz"))
+}
+
+func (suite *FsckTestSuite) TestFsckMinAge() {
+	report, err := Fsck(suite.Backend, FsckOptions{Repo: "org1", Repair: true, MinAge: time.Hour})
+	suite.Nil(err)
+	suite.NotContains(suite.problems(report), FsckOrphanedProvenance+" org1/orphan-0.1.0.tgz.prov ", "recent provenance file ignored")
+	suite.True(suite.exists("org1/orphan-0.1.0.tgz.prov"), "recent provenance file kept")
+
+	modified := time.Now().Add(-2 * time.Hour)
+	suite.Nil(os.Chtimes(pathutil.Join(suite.Directory, "org1", "orphan-0.1.0.tgz.prov"), modified, modified))
+	report, err = Fsck(suite.Backend, FsckOptions{Repo: "org1", Repair: true, MinAge: time.Hour})
+	suite.Nil(err)
+	suite.Contains(suite.problems(report), FsckOrphanedProvenance+" org1/orphan-0.1.0.tgz.prov ")
+	suite.False(suite.exists("org1/orphan-0.1.0.tgz.prov"), "old provenance file deleted")
+}
+
+func (suite *FsckTestSuite) TestFsckShards() {
+	object, err := suite.Backend.GetObject("org1/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(object)
+	suite.Nil(err)
+	digest := chartVersion.Digest
+	chartVersion.Digest = "0000"
+	missing := *chartVersion
+	missing.Name = "deleted"
+	missing.URLs = []string{"charts/deleted-0.1.0.tgz"}
+	shards := map[string]helm_repo.ChartVersions{
+		"mychart": {chartVersion},
+		"deleted": {&missing},
+	}
+	manifest := map[string]interface{}{"apiVersion": "v1", "shards": map[string]string{}}
+	for name, chartVersions := range shards {
+		content, err := yaml.Marshal(chartVersions)
+		suite.Nil(err)
+		suite.Nil(suite.Backend.PutObject("org1/index-cache.d/charts/"+name+".yaml", content))
+		manifest["shards"].(map[string]string)[name] = "digest"
+	}
+	content, err := yaml.Marshal(manifest)
+	suite.Nil(err)
+	suite.Nil(suite.Backend.PutObject("org1/index-cache.d/manifest.yaml", content))
+
+	report, err := Fsck(suite.Backend, FsckOptions{Repo: "org1"})
+	suite.Nil(err)
+	problems := suite.problems(report)
+	suite.Contains(problems, FsckMissingObject+" org1/index-cache.d/charts/deleted.yaml deleted-0.1.0.tgz", "shard entry without package")
+	suite.Contains(problems, FsckDigestMismatch+" org1/index-cache.d/charts/mychart.yaml mychart-0.1.0.tgz is "+digest+", not 0000", "shard entry with another digest")
+
+	report, err = Fsck(suite.Backend, FsckOptions{Repo: "org1", Repair: true})
+	suite.Nil(err)
+	for _, problem := range report.Problems {
+		suite.Empty(problem.Error, "no error repairing %s", problem.Path)
+	}
+	suite.False(suite.exists("org1/index-cache.d/charts/deleted.yaml"), "empty shard deleted")
+	object, err = suite.Backend.GetObject("org1/index-cache.d/charts/mychart.yaml")
+	suite.Nil(err)
+	var chartVersions helm_repo.ChartVersions
+	suite.Nil(yaml.Unmarshal(object.Content, &chartVersions))
+	suite.Equal(digest, chartVersions[0].Digest, "shard digest fixed")
+	object, err = suite.Backend.GetObject("org1/index-cache.d/manifest.yaml")
+	suite.Nil(err)
+	repaired := map[string]interface{}{}
+	suite.Nil(yaml.Unmarshal(object.Content, &repaired))
+	suite.Equal("v1", repaired["apiVersion"], "manifest fields kept")
+	encoded, err := json.Marshal(chartVersions)
+	suite.Nil(err)
+	sum := sha256.Sum256(encoded)
+	suite.Equal(map[string]interface{}{"mychart": hex.EncodeToString(sum[:])}, repaired["shards"], "manifest lists the digests of the repaired shards")
+
+	report, err = Fsck(suite.Backend, FsckOptions{Repo: "org1"})
+	suite.Nil(err)
+	for _, problem := range report.Problems {
+		suite.NotContains(problem.Path, cm_repo.StatefileShardDirname, "shards repaired")
+	}
+}
+
+func TestFsckTestSuite(t *testing.T) {
+	suite.Run(t, new(FsckTestSuite))
+}
@@ -0,0 +1,152 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chartmuseum/storage"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+const (
+	// GCOrphanedProvenance is a provenance file without chart package
+	GCOrphanedProvenance = "orphaned-provenance"
+	// GCOrphanedSidecar is a metadata sidecar without chart package
+	GCOrphanedSidecar = "orphaned-sidecar"
+	// GCPartialUpload is the temporary file of an interrupted upload
+	GCPartialUpload = "partial-upload"
+	// GCUnknownObject is an object which is neither a chart package, a provenance file nor a statefile
+	GCUnknownObject = "unknown-object"
+)
+
+type (
+	// GCOptions are options for GC
+	GCOptions struct {
+		// Repo is the repo (storage prefix) to collect, "" for the root
+		Repo string
+		// MinAge keeps the objects modified less than MinAge ago, e.g. a provenance file
+		// uploaded right before its chart package
+		MinAge time.Duration
+		// Unknown also collects the unknown objects, which are only reported otherwise
+		Unknown bool
+		// DryRun reports the garbage without deleting it
+		DryRun bool
+	}
+
+	// GCObject is a garbage object found in the storage of a repo
+	GCObject struct {
+		Kind         string    `json:"kind"`
+		Path         string    `json:"path"`
+		LastModified time.Time `json:"lastModified"`
+		Deleted      bool      `json:"deleted"`
+		// Error is the error deleting the object, if any
+		Error string `json:"error,omitempty"`
+	}
+
+	// GCReport lists the garbage found in the storage of a repo
+	GCReport struct {
+		Repo    string     `json:"repo"`
+		Scanned int        `json:"scanned"`
+		Garbage []GCObject `json:"garbage"`
+	}
+)
+
+// GC finds the garbage left in the storage of a repo: provenance files and metadata sidecars
+// without chart package, partial uploads, and unknown objects, modified at least MinAge ago.
+// The garbage is deleted unless DryRun is set, unknown objects only with Unknown.
+func GC(backend storage.Backend, options GCOptions) (*GCReport, error) {
+	objects, err := backend.ListObjects(options.Repo)
+	if err != nil {
+		return nil, err
+	}
+	sidecars, err := backend.ListObjects(pathutil.Join(options.Repo, cm_repo.SidecarDirname))
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{
+		Repo:    options.Repo,
+		Scanned: len(objects) + len(sidecars),
+		Garbage: []GCObject{},
+	}
+
+	minModified := time.Now().Add(-options.MinAge)
+	collect := func(kind string, path string, lastModified time.Time) {
+		if lastModified.After(minModified) {
+			return
+		}
+		report.Garbage = append(report.Garbage, GCObject{Kind: kind, Path: path, LastModified: lastModified})
+	}
+	packages := map[string]bool{}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Path, cm_repo.ChartPackageFileExtension) {
+			packages[object.Path] = true
+		}
+	}
+	for _, object := range objects {
+		var kind string
+		switch {
+		case packages[object.Path], object.Path == cm_repo.StatefileFilename:
+			continue
+		case strings.HasPrefix(object.Path, cm_backend.PartialUploadPrefix):
+			kind = GCPartialUpload
+		case strings.HasSuffix(object.Path, cm_repo.ProvenanceFileExtension):
+			if packages[strings.TrimSuffix(object.Path, ".prov")] {
+				continue
+			}
+			kind = GCOrphanedProvenance
+		default:
+			kind = GCUnknownObject
+		}
+		collect(kind, pathutil.Join(options.Repo, object.Path), object.LastModified)
+	}
+	for _, object := range sidecars {
+		kind := GCOrphanedSidecar
+		switch {
+		case strings.HasPrefix(object.Path, cm_backend.PartialUploadPrefix):
+			kind = GCPartialUpload
+		case !strings.HasSuffix(object.Path, "."+cm_repo.SidecarFileExtension):
+			kind = GCUnknownObject
+		case packages[strings.TrimSuffix(object.Path, "."+cm_repo.SidecarFileExtension)]:
+			continue
+		}
+		collect(kind, pathutil.Join(options.Repo, cm_repo.SidecarDirname, object.Path), object.LastModified)
+	}
+	sort.Slice(report.Garbage, func(i, j int) bool {
+		return report.Garbage[i].Path < report.Garbage[j].Path
+	})
+
+	if options.DryRun {
+		return report, nil
+	}
+	for i, object := range report.Garbage {
+		if object.Kind == GCUnknownObject && !options.Unknown {
+			continue
+		}
+		err := backend.DeleteObject(object.Path)
+		report.Garbage[i].Deleted = err == nil
+		if err != nil {
+			report.Garbage[i].Error = err.Error()
+		}
+	}
+	return report, nil
+}
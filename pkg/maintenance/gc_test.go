@@ -0,0 +1,112 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+type GCTestSuite struct {
+	suite.Suite
+	Dir     string
+	Backend storage.Backend
+}
+
+func (suite *GCTestSuite) SetupTest() {
+	suite.Dir = suite.T().TempDir()
+	suite.Backend = storage.NewLocalFilesystemBackend(suite.Dir)
+	past := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{
+		"org1/mychart-0.1.0.tgz",
+		"org1/mychart-0.1.0.tgz.prov",
+		"org1/orphan-0.1.0.tgz.prov",
+		"org1/.upload-123456",
+		"org1/notes.txt",
+		"org1/" + cm_repo.StatefileFilename,
+		"org1/.meta/mychart-0.1.0.tgz.json",
+		"org1/.meta/deleted-0.1.0.tgz.json",
+	} {
+		suite.Nil(suite.Backend.PutObject(path, []byte("content")))
+		suite.Nil(os.Chtimes(filepath.Join(suite.Dir, path), past, past))
+	}
+	// uploaded right before its chart package
+	suite.Nil(suite.Backend.PutObject("org1/recent-0.1.0.tgz.prov", []byte("content")))
+}
+
+func (suite *GCTestSuite) garbage(report *GCReport) map[string]string {
+	garbage := map[string]string{}
+	for _, object := range report.Garbage {
+		garbage[object.Path] = object.Kind
+	}
+	return garbage
+}
+
+func (suite *GCTestSuite) exists(path string) bool {
+	_, err := suite.Backend.GetObject(path)
+	return err == nil
+}
+
+func (suite *GCTestSuite) TestDryRun() {
+	report, err := GC(suite.Backend, GCOptions{Repo: "org1", MinAge: time.Hour, DryRun: true})
+	suite.Nil(err, "no error collecting garbage")
+	suite.Equal(9, report.Scanned)
+	suite.Equal(map[string]string{
+		"org1/orphan-0.1.0.tgz.prov":        GCOrphanedProvenance,
+		"org1/.upload-123456":               GCPartialUpload,
+		"org1/notes.txt":                    GCUnknownObject,
+		"org1/.meta/deleted-0.1.0.tgz.json": GCOrphanedSidecar,
+	}, suite.garbage(report), "garbage found")
+	for _, object := range report.Garbage {
+		suite.False(object.Deleted, "%s not deleted", object.Path)
+		suite.True(suite.exists(object.Path), "%s kept", object.Path)
+	}
+}
+
+func (suite *GCTestSuite) TestCollect() {
+	report, err := GC(suite.Backend, GCOptions{Repo: "org1", MinAge: time.Hour})
+	suite.Nil(err, "no error collecting garbage")
+	suite.Len(report.Garbage, 4)
+	for _, object := range report.Garbage {
+		suite.Empty(object.Error)
+		suite.Equal(object.Kind != GCUnknownObject, object.Deleted, "%s deleted unless unknown", object.Path)
+		suite.Equal(!object.Deleted, suite.exists(object.Path))
+	}
+	for _, path := range []string{"org1/mychart-0.1.0.tgz", "org1/mychart-0.1.0.tgz.prov", "org1/.meta/mychart-0.1.0.tgz.json", "org1/recent-0.1.0.tgz.prov"} {
+		suite.True(suite.exists(path), "%s kept", path)
+	}
+
+	report, err = GC(suite.Backend, GCOptions{Repo: "org1", MinAge: time.Hour, Unknown: true})
+	suite.Nil(err)
+	suite.Equal(map[string]string{"org1/notes.txt": GCUnknownObject}, suite.garbage(report))
+	suite.False(suite.exists("org1/notes.txt"), "unknown object deleted")
+
+	report, err = GC(suite.Backend, GCOptions{Repo: "org1"})
+	suite.Nil(err)
+	suite.Equal(map[string]string{"org1/recent-0.1.0.tgz.prov": GCOrphanedProvenance}, suite.garbage(report), "recent garbage collected without min age")
+}
+
+func TestGCTestSuite(t *testing.T) {
+	suite.Run(t, new(GCTestSuite))
+}
@@ -0,0 +1,219 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	pathutil "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chartmuseum/storage"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+// statefileShardChartsDirname is the directory holding the statefile shards of the charts
+const statefileShardChartsDirname = "charts"
+
+var (
+	// ErrDigestMismatch is reported when an object read back from the destination storage
+	// differs from the source one
+	ErrDigestMismatch = errors.New("digest mismatch after copy")
+)
+
+type (
+	// MigrateOptions are options for Migrate
+	MigrateOptions struct {
+		// Repos are the repos (storage prefixes) to migrate, defaults to the storage root
+		Repos []string
+		// Recursive migrates the repos nested under Repos too, which requires a source
+		// backend able to list prefixes
+		Recursive bool
+		// Concurrency is the number of objects copied in parallel, defaults to 1
+		Concurrency int
+		// DryRun only reports the objects which would be copied
+		DryRun bool
+	}
+
+	// MigrateReport summarizes a migration. Objects already in the destination storage with
+	// the same digest are skipped, so that an interrupted migration can be resumed.
+	MigrateReport struct {
+		Repos   []string
+		Scanned int
+		Copied  []string
+		Skipped int
+		Failed  map[string]error
+	}
+)
+
+// Migrate copies the chart packages, provenance files and statefiles of repos from a source
+// storage backend to a destination one, verifying the digest of every copied object. Statefiles
+// are copied after the packages they list.
+func Migrate(source storage.Backend, destination storage.Backend, options MigrateOptions) (*MigrateReport, error) {
+	repos := options.Repos
+	if len(repos) == 0 {
+		repos = []string{""}
+	}
+	report := &MigrateReport{Failed: map[string]error{}}
+	var packages, statefiles []string
+	for _, repo := range repos {
+		err := WalkRepos(source, repo, options.Recursive, func(repo string) error {
+			report.Repos = append(report.Repos, repo)
+			p, s, err := repoObjects(source, repo)
+			packages = append(packages, p...)
+			statefiles = append(statefiles, s...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Scanned = len(packages) + len(statefiles)
+
+	for _, paths := range [][]string{packages, statefiles} {
+		migrateObjects(source, destination, paths, options, report)
+	}
+	sort.Strings(report.Copied)
+	return report, nil
+}
+
+// WalkRepos calls fn for repo, and the repos nested under it when recursive, which requires a
+// backend able to list prefixes. The directories kept next to chart packages are not repos.
+func WalkRepos(backend storage.Backend, repo string, recursive bool, fn func(repo string) error) error {
+	if err := fn(repo); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	prefixes, err := cm_backend.ListPrefixes(backend, repo)
+	if err != nil {
+		return fmt.Errorf("unable to list repos under %q: %w", repo, err)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		switch prefix {
+		case cm_repo.SidecarDirname, cm_repo.StatefileShardDirname, cm_repo.QuarantineDirname, cm_repo.TrashDirname, cm_repo.ProtectedDirname:
+			continue
+		}
+		if err := WalkRepos(backend, pathutil.Join(repo, prefix), true, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repoObjects returns the paths of the chart packages, provenance files and chart version locks
+// of a repo, and the paths of its statefiles. Sidecars are left out, they are regenerated.
+func repoObjects(backend storage.Backend, repo string) ([]string, []string, error) {
+	objects, err := backend.ListObjects(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	var packages, statefiles []string
+	for _, object := range objects {
+		switch {
+		case strings.HasSuffix(object.Path, cm_repo.ChartPackageFileExtension), strings.HasSuffix(object.Path, cm_repo.ProvenanceFileExtension):
+			packages = append(packages, pathutil.Join(repo, object.Path))
+		case object.Path == cm_repo.StatefileFilename:
+			statefiles = append(statefiles, pathutil.Join(repo, object.Path))
+		}
+	}
+	protectedDir := pathutil.Join(repo, cm_repo.ProtectedDirname)
+	locks, err := backend.ListObjects(protectedDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, object := range locks {
+		packages = append(packages, pathutil.Join(protectedDir, object.Path))
+	}
+	// the statefile shards and their manifest
+	shardDir := pathutil.Join(repo, cm_repo.StatefileShardDirname)
+	for _, prefix := range []string{pathutil.Join(shardDir, statefileShardChartsDirname), shardDir} {
+		objects, err := backend.ListObjects(prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, object := range objects {
+			statefiles = append(statefiles, pathutil.Join(prefix, object.Path))
+		}
+	}
+	return packages, statefiles, nil
+}
+
+func migrateObjects(source storage.Backend, destination storage.Backend, paths []string, options MigrateOptions, report *MigrateReport) {
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, concurrency)
+	for _, path := range paths {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(path string) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			copied, err := migrateObject(source, destination, path, options.DryRun)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.Failed[path] = err
+			case copied:
+				report.Copied = append(report.Copied, path)
+			default:
+				report.Skipped++
+			}
+		}(path)
+	}
+	wg.Wait()
+}
+
+func migrateObject(source storage.Backend, destination storage.Backend, path string, dryRun bool) (bool, error) {
+	object, err := source.GetObject(path)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256(object.Content)
+	if existing, err := destination.GetObject(path); err == nil && sha256.Sum256(existing.Content) == digest {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	if err := destination.PutObject(path, object.Content); err != nil {
+		return false, err
+	}
+	copied, err := destination.GetObject(path)
+	if err != nil {
+		return false, err
+	}
+	if sha256.Sum256(copied.Content) != digest {
+		return false, ErrDigestMismatch
+	}
+	return true, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+	Source      storage.Backend
+	Destination storage.Backend
+}
+
+// corruptingBackend stores other content than the one written
+type corruptingBackend struct {
+	storage.Backend
+}
+
+func (b corruptingBackend) PutObject(path string, content []byte) error {
+	return b.Backend.PutObject(path, append(content, '!'))
+}
+
+// flatBackend cannot list prefixes
+type flatBackend struct {
+	storage.Backend
+}
+
+func (suite *MigrateTestSuite) SetupTest() {
+	suite.Source = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+	suite.Destination = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+	for path, content := range map[string]string{
+		"mychart-0.1.0.tgz":                          "root chart",
+		"index-cache.yaml":                           "root statefile",
+		"README.md":                                  "not migrated",
+		".meta/mychart-0.1.0.tgz.json":               "regenerated sidecar",
+		"org1/repoa/mychart-0.1.0.tgz":               "nested chart",
+		"org1/repoa/mychart-0.1.0.tgz.prov":          "nested provenance",
+		"org1/repoa/.protected/mychart-0.1.0":        "lock",
+		"org1/repoa/index-cache.d/manifest.yaml":     "shard manifest",
+		"org1/repoa/index-cache.d/charts/mychart.gz": "shard",
+	} {
+		suite.Nil(suite.Source.PutObject(path, []byte(content)))
+	}
+}
+
+func (suite *MigrateTestSuite) content(backend storage.Backend, path string) string {
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return ""
+	}
+	return string(object.Content)
+}
+
+func (suite *MigrateTestSuite) TestMigrate() {
+	report, err := Migrate(suite.Source, suite.Destination, MigrateOptions{Recursive: true, DryRun: true})
+	suite.Nil(err, "no error on dry run")
+	suite.Equal([]string{"", "org1", "org1/repoa"}, report.Repos, "nested repos found")
+	suite.Equal(7, report.Scanned)
+	suite.Equal([]string{
+		"index-cache.yaml",
+		"mychart-0.1.0.tgz",
+		"org1/repoa/.protected/mychart-0.1.0",
+		"org1/repoa/index-cache.d/charts/mychart.gz",
+		"org1/repoa/index-cache.d/manifest.yaml",
+		"org1/repoa/mychart-0.1.0.tgz",
+		"org1/repoa/mychart-0.1.0.tgz.prov",
+	}, report.Copied, "objects to copy reported")
+	suite.Equal("", suite.content(suite.Destination, "mychart-0.1.0.tgz"), "nothing copied on dry run")
+
+	suite.Nil(suite.Destination.PutObject("mychart-0.1.0.tgz", []byte("root chart")))
+	suite.Nil(suite.Destination.PutObject("index-cache.yaml", []byte("stale statefile")))
+	report, err = Migrate(suite.Source, suite.Destination, MigrateOptions{Recursive: true, Concurrency: 3})
+	suite.Nil(err, "no error migrating")
+	suite.Len(report.Copied, 6, "missing and different objects copied")
+	suite.Equal(1, report.Skipped, "identical object skipped")
+	suite.Empty(report.Failed)
+	suite.Equal("root statefile", suite.content(suite.Destination, "index-cache.yaml"))
+	suite.Equal("nested provenance", suite.content(suite.Destination, "org1/repoa/mychart-0.1.0.tgz.prov"))
+	suite.Equal("shard", suite.content(suite.Destination, "org1/repoa/index-cache.d/charts/mychart.gz"))
+	suite.Equal("lock", suite.content(suite.Destination, "org1/repoa/.protected/mychart-0.1.0"), "chart version locks migrated")
+	suite.Equal("", suite.content(suite.Destination, "README.md"), "other files not migrated")
+	suite.Equal("", suite.content(suite.Destination, ".meta/mychart-0.1.0.tgz.json"), "sidecars not migrated")
+
+	report, err = Migrate(suite.Source, suite.Destination, MigrateOptions{Recursive: true})
+	suite.Nil(err, "no error resuming migration")
+	suite.Empty(report.Copied, "nothing left to copy")
+	suite.Equal(7, report.Skipped)
+}
+
+func (suite *MigrateTestSuite) TestMigrateRepos() {
+	report, err := Migrate(flatBackend{suite.Source}, suite.Destination, MigrateOptions{Repos: []string{"org1/repoa"}})
+	suite.Nil(err, "no error migrating a repo")
+	suite.Equal([]string{"org1/repoa"}, report.Repos)
+	suite.Len(report.Copied, 5, "objects of the repo copied")
+	suite.Equal("", suite.content(suite.Destination, "mychart-0.1.0.tgz"), "other repos not migrated")
+
+	_, err = Migrate(flatBackend{suite.Source}, suite.Destination, MigrateOptions{Recursive: true})
+	suite.NotNil(err, "nested repos cannot be listed")
+}
+
+func (suite *MigrateTestSuite) TestMigrateDigestMismatch() {
+	report, err := Migrate(suite.Source, corruptingBackend{suite.Destination}, MigrateOptions{})
+	suite.Nil(err)
+	suite.Len(report.Failed, 2, "copies failing verification reported")
+	suite.ErrorIs(report.Failed["mychart-0.1.0.tgz"], ErrDigestMismatch)
+}
+
+func TestMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
@@ -0,0 +1,121 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	pathutil "path"
+	"sync"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+type (
+	// ReencryptOptions are options for Reencrypt
+	ReencryptOptions struct {
+		// Repos are the repos (storage prefixes) holding the objects, defaults to the storage root
+		Repos []string
+		// Recursive reencrypts the repos nested under Repos too, which requires a backend able
+		// to list prefixes
+		Recursive bool
+		// Concurrency is the number of objects processed in parallel, defaults to 1
+		Concurrency int
+	}
+
+	// ReencryptReport summarizes a re-encryption
+	ReencryptReport struct {
+		Repos       []string
+		Scanned     int
+		Reencrypted int
+		Skipped     int
+		Failed      map[string]error
+	}
+)
+
+// reencryptedDirnames are the directories of a repo holding objects next to its chart packages
+var reencryptedDirnames = []string{
+	cm_repo.SidecarDirname,
+	cm_repo.ProtectedDirname,
+	cm_repo.TrashDirname,
+	cm_repo.QuarantineDirname,
+	cm_repo.StatefileShardDirname,
+	pathutil.Join(cm_repo.StatefileShardDirname, statefileShardChartsDirname),
+}
+
+// Reencrypt encrypts every object of repos again with the primary key, unless it already is, so
+// that older keys can be removed from the keyring once no object needs them
+func Reencrypt(backend *cm_backend.EncryptedBackend, options ReencryptOptions) (*ReencryptReport, error) {
+	repos := options.Repos
+	if len(repos) == 0 {
+		repos = []string{""}
+	}
+	report := &ReencryptReport{Failed: map[string]error{}}
+	var paths []string
+	for _, repo := range repos {
+		err := WalkRepos(backend, repo, options.Recursive, func(repo string) error {
+			report.Repos = append(report.Repos, repo)
+			for _, dir := range append([]string{""}, reencryptedDirnames...) {
+				prefix := pathutil.Join(repo, dir)
+				objects, err := backend.ListObjects(prefix)
+				if err != nil {
+					return err
+				}
+				for _, object := range objects {
+					paths = append(paths, pathutil.Join(prefix, object.Path))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Scanned = len(paths)
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, concurrency)
+	for _, path := range paths {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(path string) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			reencrypted, err := backend.Reencrypt(path)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.Failed[path] = err
+			case reencrypted:
+				report.Reencrypted++
+			default:
+				report.Skipped++
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	return report, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+
+	cm_backend "helm.sh/chartmuseum/pkg/backend"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+type ReencryptTestSuite struct {
+	suite.Suite
+	Storage *storage.LocalFilesystemBackend
+}
+
+func (suite *ReencryptTestSuite) SetupTest() {
+	suite.Storage = storage.NewLocalFilesystemBackend(suite.T().TempDir())
+}
+
+func (suite *ReencryptTestSuite) newKeyring(primary string) *cm_backend.Keyring {
+	keyring, err := cm_backend.NewKeyring(primary, map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	suite.Nil(err, "no error creating keyring")
+	return keyring
+}
+
+func (suite *ReencryptTestSuite) TestReencrypt() {
+	old := cm_backend.NewEncryptedBackend(suite.Storage, suite.newKeyring("k1"), false)
+	paths := []string{
+		"org1/mychart-0.1.0.tgz",
+		"org1/" + cm_repo.StatefileFilename,
+		cm_repo.SidecarPath("org1", "mychart-0.1.0.tgz"),
+		"org1/" + cm_repo.StatefileShardDirname + "/charts/mychart.yaml",
+	}
+	for _, path := range paths {
+		suite.Nil(old.PutObject(path, []byte("content")), "no error putting object")
+	}
+	suite.Nil(suite.Storage.PutObject("org1/plaintext-0.1.0.tgz", []byte("content")))
+	suite.Nil(old.PutObject("org2/mychart-0.1.0.tgz", []byte("content")))
+
+	backend := cm_backend.NewEncryptedBackend(suite.Storage, suite.newKeyring("k2"), true)
+	suite.Nil(backend.PutObject("org1/other-0.1.0.tgz", []byte("content")))
+	report, err := Reencrypt(backend, ReencryptOptions{Repos: []string{"org1"}, Concurrency: 2})
+	suite.Nil(err, "no error reencrypting")
+	suite.Equal([]string{"org1"}, report.Repos, "given repo only")
+	suite.Equal(6, report.Scanned, "objects of the repo scanned")
+	suite.Equal(5, report.Reencrypted, "objects encrypted with another key, or not encrypted, reencrypted")
+	suite.Equal(1, report.Skipped, "object encrypted with the primary key skipped")
+	suite.Empty(report.Failed, "no failure")
+
+	for _, path := range append(paths, "org1/plaintext-0.1.0.tgz") {
+		stored, err := suite.Storage.GetObject(path)
+		suite.Nil(err)
+		keyID, err := backend.Keyring.KeyID(stored.Content)
+		suite.Nil(err, "object encrypted")
+		suite.Equal("k2", keyID, "object encrypted with the primary key")
+	}
+	stored, err := suite.Storage.GetObject("org2/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	keyID, err := backend.Keyring.KeyID(stored.Content)
+	suite.Nil(err)
+	suite.Equal("k1", keyID, "objects of other repos left alone")
+
+	// objects which cannot be decrypted are reported
+	suite.Nil(suite.Storage.PutObject("org1/plaintext-0.1.0.tgz", []byte("content")))
+	backend.AllowPlaintext = false
+	report, err = Reencrypt(backend, ReencryptOptions{Repos: []string{"org1"}})
+	suite.Nil(err)
+	suite.Contains(report.Failed, "org1/plaintext-0.1.0.tgz", "plaintext object reported")
+	suite.Equal(5, report.Skipped, "objects already reencrypted skipped")
+}
+
+func (suite *ReencryptTestSuite) TestReencryptRecursive() {
+	old := cm_backend.NewEncryptedBackend(suite.Storage, suite.newKeyring("k1"), false)
+	paths := []string{
+		"mychart-0.1.0.tgz",
+		"org1/mychart-0.1.0.tgz",
+		"org1/repoa/mychart-0.1.0.tgz",
+		cm_repo.SidecarPath("org1/repoa", "mychart-0.1.0.tgz"),
+		"org1/repoa/" + cm_repo.StatefileShardDirname + "/charts/mychart.yaml",
+		"org2/mychart-0.1.0.tgz",
+	}
+	for _, path := range paths {
+		suite.Nil(old.PutObject(path, []byte("content")), "no error putting object")
+	}
+
+	backend := cm_backend.NewEncryptedBackend(suite.Storage, suite.newKeyring("k2"), false)
+	report, err := Reencrypt(backend, ReencryptOptions{Recursive: true})
+	suite.Nil(err, "no error reencrypting")
+	suite.Equal([]string{"", "org1", "org1/repoa", "org2"}, report.Repos, "nested repos walked, not their subdirectories")
+	suite.Equal(len(paths), report.Scanned, "objects of every repo scanned")
+	suite.Equal(len(paths), report.Reencrypted, "objects of every repo reencrypted")
+	suite.Empty(report.Failed, "no failure")
+	for _, path := range paths {
+		stored, err := suite.Storage.GetObject(path)
+		suite.Nil(err)
+		keyID, err := backend.Keyring.KeyID(stored.Content)
+		suite.Nil(err, "object encrypted")
+		suite.Equal("k2", keyID, "object of nested repo encrypted with the primary key")
+	}
+}
+
+func TestReencryptTestSuite(t *testing.T) {
+	suite.Run(t, new(ReencryptTestSuite))
+}
@@ -0,0 +1,125 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	pathutil "path"
+	"sync"
+
+	"github.com/chartmuseum/storage"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+type (
+	// BackfillSidecarsOptions are options for BackfillSidecars
+	BackfillSidecarsOptions struct {
+		// Repo is the repo (storage prefix) holding the packages, "" for the root
+		Repo string
+		// Overwrite rewrites sidecars which already exist
+		Overwrite bool
+		// Concurrency is the number of packages processed in parallel, defaults to 1
+		Concurrency int
+	}
+
+	// BackfillSidecarsReport summarizes a sidecar backfill
+	BackfillSidecarsReport struct {
+		Repo    string
+		Scanned int
+		Written int
+		Skipped int
+		Failed  map[string]error
+	}
+)
+
+// BackfillSidecars writes the metadata sidecar of every chart package of a repo
+func BackfillSidecars(backend storage.Backend, options BackfillSidecarsOptions) (*BackfillSidecarsReport, error) {
+	objects, err := backend.ListObjects(options.Repo)
+	if err != nil {
+		return nil, err
+	}
+	var packages []storage.Object
+	for _, object := range objects {
+		if object.HasExtension(cm_repo.ChartPackageFileExtension) {
+			packages = append(packages, object)
+		}
+	}
+
+	report := &BackfillSidecarsReport{
+		Repo:    options.Repo,
+		Scanned: len(packages),
+		Failed:  map[string]error{},
+	}
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, concurrency)
+	for _, object := range packages {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(o storage.Object) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			written, err := backfillSidecar(backend, options.Repo, o.Path, options.Overwrite)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.Failed[o.Path] = err
+			case written:
+				report.Written++
+			default:
+				report.Skipped++
+			}
+		}(object)
+	}
+	wg.Wait()
+
+	return report, nil
+}
+
+func backfillSidecar(backend storage.Backend, repo string, filename string, overwrite bool) (bool, error) {
+	sidecarPath := cm_repo.SidecarPath(repo, filename)
+	if !overwrite {
+		if existing, err := backend.GetObject(sidecarPath); err == nil {
+			if _, err := cm_repo.SidecarFromContent(existing.Content); err == nil {
+				return false, nil
+			}
+		}
+	}
+
+	object, err := backend.GetObject(pathutil.Join(repo, filename))
+	if err != nil {
+		return false, err
+	}
+	sidecar, err := cm_repo.SidecarFromStorageObject(object)
+	if err != nil {
+		return false, err
+	}
+	content, err := sidecar.Content()
+	if err != nil {
+		return false, err
+	}
+	return true, backend.PutObject(sidecarPath, content)
+}
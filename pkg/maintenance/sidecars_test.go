@@ -0,0 +1,95 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package maintenance
+
+import (
+	"fmt"
+	"os"
+	pathutil "path"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+)
+
+var testTarballPath = "../../testdata/charts/mychart/mychart-0.1.0.tgz"
+
+type SidecarsTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Backend       storage.Backend
+}
+
+func (suite *SidecarsTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/chartmuseum-maintenance/%s", timestamp)
+	suite.Backend = storage.NewLocalFilesystemBackend(suite.TempDirectory)
+
+	content, err := os.ReadFile(testTarballPath)
+	suite.Nil(err, "no error reading test tarball")
+	for _, path := range []string{"mychart-0.1.0.tgz", "org1/mychart-0.1.0.tgz"} {
+		err = suite.Backend.PutObject(path, content)
+		suite.Nil(err, "no error putting test tarball")
+	}
+	err = suite.Backend.PutObject("brokenchart-0.1.0.tgz", []byte("not a chart"))
+	suite.Nil(err, "no error putting broken tarball")
+	err = suite.Backend.PutObject("README.md", []byte("not a package"))
+	suite.Nil(err, "no error putting other file")
+}
+
+func (suite *SidecarsTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *SidecarsTestSuite) TestBackfillSidecars() {
+	report, err := BackfillSidecars(suite.Backend, BackfillSidecarsOptions{Concurrency: 2})
+	suite.Nil(err, "no error backfilling sidecars")
+	suite.Equal(2, report.Scanned, "only packages scanned")
+	suite.Equal(1, report.Written, "sidecar written")
+	suite.Contains(report.Failed, "brokenchart-0.1.0.tgz", "broken package reported")
+
+	object, err := suite.Backend.GetObject(cm_repo.SidecarPath("", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "sidecar in storage")
+	sidecar, err := cm_repo.SidecarFromContent(object.Content)
+	suite.Nil(err, "valid sidecar")
+	suite.Equal("0.1.0", sidecar.Metadata.Version, "sidecar version")
+
+	_, err = os.Stat(pathutil.Join(suite.TempDirectory, "org1", cm_repo.SidecarDirname))
+	suite.True(os.IsNotExist(err), "other repos untouched")
+
+	report, err = BackfillSidecars(suite.Backend, BackfillSidecarsOptions{})
+	suite.Nil(err, "no error backfilling sidecars again")
+	suite.Equal(0, report.Written, "existing sidecars kept")
+	suite.Equal(1, report.Skipped, "existing sidecars skipped")
+
+	report, err = BackfillSidecars(suite.Backend, BackfillSidecarsOptions{Overwrite: true})
+	suite.Nil(err, "no error overwriting sidecars")
+	suite.Equal(1, report.Written, "existing sidecars overwritten")
+
+	report, err = BackfillSidecars(suite.Backend, BackfillSidecarsOptions{Repo: "org1"})
+	suite.Nil(err, "no error backfilling sidecars of org1")
+	suite.Equal(1, report.Written, "sidecar of org1 written")
+	_, err = suite.Backend.GetObject(cm_repo.SidecarPath("org1", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "sidecar of org1 in storage")
+}
+
+func TestSidecarsTestSuite(t *testing.T) {
+	suite.Run(t, new(SidecarsTestSuite))
+}
@@ -0,0 +1,230 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+var (
+	// tenantsBucket holds a bucket per tenant, which holds a bucket per chart name,
+	// which maps chart versions to their JSON encoding
+	tenantsBucket = []byte("tenants")
+)
+
+type (
+	// BoltStore is a Store on top of a bbolt database file
+	BoltStore struct {
+		DB *bolt.DB
+	}
+)
+
+// NewBoltStore opens (or creates) a bbolt database file
+func NewBoltStore(path string) (*BoltStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tenantsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{DB: db}, nil
+}
+
+// tenantKey prefixes the repo name, since bucket keys cannot be empty
+func tenantKey(repo string) []byte {
+	return []byte("/" + repo)
+}
+
+func tenantBucket(tx *bolt.Tx, repo string) *bolt.Bucket {
+	return tx.Bucket(tenantsBucket).Bucket(tenantKey(repo))
+}
+
+// HasTenant reports whether the chart versions of a tenant are in the store
+func (store *BoltStore) HasTenant(repo string) (bool, error) {
+	var found bool
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		found = tenantBucket(tx, repo) != nil
+		return nil
+	})
+	return found, err
+}
+
+// Tenants lists the tenants in the store
+func (store *BoltStore) Tenants() ([]string, error) {
+	tenants := []string{}
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tenantsBucket).ForEachBucket(func(k []byte) error {
+			tenants = append(tenants, strings.TrimPrefix(string(k), "/"))
+			return nil
+		})
+	})
+	return tenants, err
+}
+
+// ReplaceTenant replaces all the chart versions of a tenant, adding the tenant if needed
+func (store *BoltStore) ReplaceTenant(repo string, entries map[string]helm_repo.ChartVersions) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(tenantsBucket)
+		if tenants.Bucket(tenantKey(repo)) != nil {
+			err := tenants.DeleteBucket(tenantKey(repo))
+			if err != nil {
+				return err
+			}
+		}
+		tenant, err := tenants.CreateBucket(tenantKey(repo))
+		if err != nil {
+			return err
+		}
+		for _, chartVersions := range entries {
+			for _, chartVersion := range chartVersions {
+				err = putChartVersion(tenant, chartVersion)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteTenant removes a tenant and all its chart versions, it does nothing if the tenant is not in the store
+func (store *BoltStore) DeleteTenant(repo string) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(tenantsBucket)
+		if tenants.Bucket(tenantKey(repo)) == nil {
+			return nil
+		}
+		return tenants.DeleteBucket(tenantKey(repo))
+	})
+}
+
+// PutChartVersion adds or replaces a chart version, it does nothing if the tenant is not in the store
+func (store *BoltStore) PutChartVersion(repo string, chartVersion *helm_repo.ChartVersion) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		tenant := tenantBucket(tx, repo)
+		if tenant == nil {
+			return nil
+		}
+		return putChartVersion(tenant, chartVersion)
+	})
+}
+
+func putChartVersion(tenant *bolt.Bucket, chartVersion *helm_repo.ChartVersion) error {
+	content, err := json.Marshal(chartVersion)
+	if err != nil {
+		return err
+	}
+	chart, err := tenant.CreateBucketIfNotExists([]byte(chartVersion.Name))
+	if err != nil {
+		return err
+	}
+	return chart.Put([]byte(chartVersion.Version), content)
+}
+
+// DeleteChartVersion removes a chart version, it does nothing if the tenant is not in the store
+func (store *BoltStore) DeleteChartVersion(repo string, name string, version string) error {
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		tenant := tenantBucket(tx, repo)
+		if tenant == nil {
+			return nil
+		}
+		chart := tenant.Bucket([]byte(name))
+		if chart == nil {
+			return nil
+		}
+		err := chart.Delete([]byte(version))
+		if err != nil {
+			return err
+		}
+		if k, _ := chart.Cursor().First(); k == nil {
+			return tenant.DeleteBucket([]byte(name))
+		}
+		return nil
+	})
+}
+
+// ChartVersions returns all the chart versions of a tenant, by chart name
+func (store *BoltStore) ChartVersions(repo string) (map[string]helm_repo.ChartVersions, error) {
+	return store.ListCharts(repo, 0, -1)
+}
+
+// ListCharts returns the chart versions of limit charts in name order starting at offset (-1 for no limit)
+func (store *BoltStore) ListCharts(repo string, offset int, limit int) (map[string]helm_repo.ChartVersions, error) {
+	entries := map[string]helm_repo.ChartVersions{}
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		tenant := tenantBucket(tx, repo)
+		if tenant == nil {
+			return nil
+		}
+		c := tenant.Cursor()
+		i := 0
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if limit >= 0 && i >= offset+limit {
+				break
+			}
+			if i >= offset {
+				chartVersions, err := readChartVersions(tenant.Bucket(k))
+				if err != nil {
+					return err
+				}
+				entries[string(k)] = chartVersions
+			}
+			i++
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func readChartVersions(chart *bolt.Bucket) (helm_repo.ChartVersions, error) {
+	chartVersions := helm_repo.ChartVersions{}
+	err := chart.ForEach(func(_, v []byte) error {
+		chartVersion := &helm_repo.ChartVersion{}
+		err := json.Unmarshal(v, chartVersion)
+		if err != nil {
+			return err
+		}
+		chartVersions = append(chartVersions, chartVersion)
+		return nil
+	})
+	// same order as in index.yaml, latest version first
+	sort.Sort(sort.Reverse(chartVersions))
+	return chartVersions, err
+}
+
+// Close closes the database file
+func (store *BoltStore) Close() error {
+	return store.DB.Close()
+}
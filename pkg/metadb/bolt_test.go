@@ -0,0 +1,129 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadb
+
+import (
+	"fmt"
+	"os"
+	pathutil "path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	helm_chart "helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type BoltStoreTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Store         *BoltStore
+}
+
+func chartVersion(name string, version string) *helm_repo.ChartVersion {
+	return &helm_repo.ChartVersion{
+		Metadata: &helm_chart.Metadata{
+			Name:        name,
+			Version:     version,
+			Annotations: map[string]string{"category": "test"},
+		},
+		URLs:   []string{fmt.Sprintf("charts/%s-%s.tgz", name, version)},
+		Digest: "sha256:" + name + version,
+	}
+}
+
+func (suite *BoltStoreTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/chartmuseum-metadb/%s", timestamp)
+	store, err := NewBoltStore(pathutil.Join(suite.TempDirectory, "metadata.db"))
+	suite.Nil(err, "no error opening bolt store")
+	suite.Store = store
+}
+
+func (suite *BoltStoreTestSuite) TearDownTest() {
+	suite.Store.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *BoltStoreTestSuite) TestTenants() {
+	found, err := suite.Store.HasTenant("")
+	suite.Nil(err, "no error looking up tenant")
+	suite.False(found, "no tenant in new store")
+
+	err = suite.Store.PutChartVersion("", chartVersion("mychart", "0.1.0"))
+	suite.Nil(err, "no error putting chart version of missing tenant")
+	found, _ = suite.Store.HasTenant("")
+	suite.False(found, "tenant not added by put")
+
+	for _, repo := range []string{"", "org1/repoa"} {
+		err = suite.Store.ReplaceTenant(repo, map[string]helm_repo.ChartVersions{})
+		suite.Nil(err, "no error adding tenant")
+	}
+	tenants, err := suite.Store.Tenants()
+	suite.Nil(err, "no error listing tenants")
+	suite.ElementsMatch([]string{"", "org1/repoa"}, tenants, "tenants listed")
+
+	suite.Nil(suite.Store.DeleteTenant("org1/repoa"), "no error deleting tenant")
+	suite.Nil(suite.Store.DeleteTenant("org1/repoa"), "no error deleting missing tenant")
+	found, _ = suite.Store.HasTenant("org1/repoa")
+	suite.False(found, "tenant deleted")
+}
+
+func (suite *BoltStoreTestSuite) TestChartVersions() {
+	err := suite.Store.ReplaceTenant("org1", map[string]helm_repo.ChartVersions{
+		"mychart": {chartVersion("mychart", "0.1.0")},
+	})
+	suite.Nil(err, "no error adding tenant")
+
+	suite.Nil(suite.Store.PutChartVersion("org1", chartVersion("mychart", "0.2.0")))
+	suite.Nil(suite.Store.PutChartVersion("org1", chartVersion("otherchart", "1.0.0")))
+	suite.Nil(suite.Store.PutChartVersion("org1", chartVersion("achart", "1.0.0")))
+
+	entries, err := suite.Store.ChartVersions("org1")
+	suite.Nil(err, "no error getting chart versions")
+	suite.Len(entries, 3, "all charts returned")
+	suite.Len(entries["mychart"], 2, "all versions returned")
+	suite.Equal("0.2.0", entries["mychart"][0].Version, "latest version first")
+	suite.Equal("test", entries["mychart"][0].Annotations["category"], "annotations stored")
+
+	entries, err = suite.Store.ListCharts("org1", 1, 1)
+	suite.Nil(err, "no error listing charts")
+	suite.Len(entries, 1, "one chart listed")
+	suite.Contains(entries, "mychart", "charts listed in name order")
+
+	suite.Nil(suite.Store.DeleteChartVersion("org1", "otherchart", "1.0.0"))
+	suite.Nil(suite.Store.DeleteChartVersion("org1", "mychart", "0.1.0"))
+	suite.Nil(suite.Store.DeleteChartVersion("org1", "nochart", "0.1.0"))
+	entries, err = suite.Store.ChartVersions("org1")
+	suite.Nil(err, "no error getting chart versions")
+	suite.NotContains(entries, "otherchart", "chart without versions removed")
+	suite.Len(entries["mychart"], 1, "version removed")
+
+	err = suite.Store.ReplaceTenant("org1", map[string]helm_repo.ChartVersions{
+		"otherchart": {chartVersion("otherchart", "2.0.0")},
+	})
+	suite.Nil(err, "no error replacing tenant")
+	entries, err = suite.Store.ChartVersions("org1")
+	suite.Nil(err, "no error getting chart versions")
+	suite.Len(entries, 1, "tenant replaced")
+	suite.Equal("2.0.0", entries["otherchart"][0].Version, "replaced version")
+}
+
+func TestBoltStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(BoltStoreTestSuite))
+}
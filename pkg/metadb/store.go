@@ -0,0 +1,45 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadb
+
+import (
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type (
+	// Store is a metadata database holding the chart versions of each tenant
+	Store interface {
+		// HasTenant reports whether the chart versions of a tenant are in the store
+		HasTenant(repo string) (bool, error)
+		// Tenants lists the tenants in the store
+		Tenants() ([]string, error)
+		// ReplaceTenant replaces all the chart versions of a tenant, adding the tenant if needed
+		ReplaceTenant(repo string, entries map[string]helm_repo.ChartVersions) error
+		// DeleteTenant removes a tenant and all its chart versions, it does nothing if the tenant is not in the store
+		DeleteTenant(repo string) error
+		// PutChartVersion adds or replaces a chart version, it does nothing if the tenant is not in the store
+		PutChartVersion(repo string, chartVersion *helm_repo.ChartVersion) error
+		// DeleteChartVersion removes a chart version, it does nothing if the tenant is not in the store
+		DeleteChartVersion(repo string, name string, version string) error
+		// ChartVersions returns all the chart versions of a tenant, by chart name
+		ChartVersions(repo string) (map[string]helm_repo.ChartVersions, error)
+		// ListCharts returns the chart versions of limit charts in name order starting at offset (-1 for no limit)
+		ListCharts(repo string, offset int, limit int) (map[string]helm_repo.ChartVersions, error)
+		// Close releases the store
+		Close() error
+	}
+)
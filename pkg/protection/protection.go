@@ -0,0 +1,142 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package protection decides which chart versions must never be overwritten or deleted
+package protection
+
+import (
+	"fmt"
+	"os"
+	pathutil "path"
+	"strconv"
+
+	"github.com/Masterminds/semver/v3"
+	"sigs.k8s.io/yaml"
+)
+
+type (
+	// Policy is a list of protection rules. A chart version is protected when any rule matches it.
+	Policy struct {
+		Rules []Rule `json:"rules"`
+	}
+
+	// Rule protects the versions of the matching charts within a semantic version range
+	Rule struct {
+		// Name identifies the rule in errors (optional)
+		Name string `json:"name,omitempty"`
+		// Repo is a glob matching the repo, e.g. org1/*, every repo if empty
+		Repo string `json:"repo,omitempty"`
+		// Chart is a glob matching the chart name, every chart if empty
+		Chart string `json:"chart,omitempty"`
+		// Versions is a semantic version range, e.g. ">=1.0.0", every version if empty.
+		// Versions which are not valid semantic versions only match an empty range.
+		Versions string `json:"versions,omitempty"`
+
+		constraints *semver.Constraints
+	}
+)
+
+// LoadPolicy reads a protection policy from a YAML file such as:
+//
+//	rules:
+//	  - name: production
+//	    repo: prod/*
+//	    chart: "*"
+//	    versions: ">=1.0.0"
+func LoadPolicy(filename string) (*Policy, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(content, policy); err != nil {
+		return nil, fmt.Errorf("invalid protection policy %s: %w", filename, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid protection policy %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// Validate checks the globs and version ranges of the rules
+func (policy *Policy) Validate() error {
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		for _, glob := range []string{rule.Repo, rule.Chart} {
+			if _, err := pathutil.Match(glob, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid glob %q", rule.name(i), glob)
+			}
+		}
+		if rule.Versions == "" {
+			continue
+		}
+		constraints, err := semver.NewConstraint(rule.Versions)
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid version range %q: %w", rule.name(i), rule.Versions, err)
+		}
+		rule.constraints = constraints
+	}
+	return nil
+}
+
+// Protects returns the name of the first rule protecting a chart version of a repo, and
+// whether there is one
+func (policy *Policy) Protects(repo string, name string, version string) (string, bool) {
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.matches(repo, name, version) {
+			return rule.name(i), true
+		}
+	}
+	return "", false
+}
+
+func (rule *Rule) matches(repo string, name string, version string) bool {
+	if !globMatch(rule.Repo, repo) || !globMatch(rule.Chart, name) {
+		return false
+	}
+	if rule.Versions == "" {
+		return true
+	}
+	constraints := rule.constraints
+	if constraints == nil {
+		// rules built without Validate
+		var err error
+		if constraints, err = semver.NewConstraint(rule.Versions); err != nil {
+			return false
+		}
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	return constraints.Check(v)
+}
+
+func (rule *Rule) name(i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return "#" + strconv.Itoa(i+1)
+}
+
+func globMatch(glob string, value string) bool {
+	if glob == "" {
+		return true
+	}
+	matched, _ := pathutil.Match(glob, value)
+	return matched
+}
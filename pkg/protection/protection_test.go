@@ -0,0 +1,85 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProtectionTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProtectionTestSuite) TestProtects() {
+	policy := &Policy{Rules: []Rule{
+		{Name: "production", Repo: "prod/*", Versions: ">=1.0.0"},
+		{Chart: "infra-*"},
+	}}
+	suite.Nil(policy.Validate())
+
+	rule, ok := policy.Protects("prod/repo1", "mychart", "1.2.0")
+	suite.True(ok, "version in range protected")
+	suite.Equal("production", rule)
+	_, ok = policy.Protects("prod/repo1", "mychart", "0.9.0")
+	suite.False(ok, "version out of range not protected")
+	_, ok = policy.Protects("prod/repo1", "mychart", "1.3.0-rc.1")
+	suite.False(ok, "prerelease out of range not protected")
+	_, ok = policy.Protects("prod/repo1", "mychart", "latest")
+	suite.False(ok, "invalid semantic version not protected by range")
+	_, ok = policy.Protects("dev/repo1", "mychart", "1.2.0")
+	suite.False(ok, "no rule matching repo")
+
+	rule, ok = policy.Protects("dev/repo1", "infra-db", "latest")
+	suite.True(ok, "every version protected without range")
+	suite.Equal("#2", rule)
+
+	unvalidated := &Policy{Rules: []Rule{{Versions: "~1.2"}}}
+	_, ok = unvalidated.Protects("", "mychart", "1.2.5")
+	suite.True(ok, "range parsed without validation")
+}
+
+func (suite *ProtectionTestSuite) TestLoadPolicy() {
+	dir := suite.T().TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "protection.yaml")
+		suite.Nil(os.WriteFile(filename, []byte(content), 0600))
+		return filename
+	}
+
+	policy, err := LoadPolicy(write("rules:\n  - repo: prod/*\n    chart: mychart\n    versions: '>=1.0.0 <2.0.0'\n"))
+	suite.Nil(err, "no error loading policy")
+	suite.Len(policy.Rules, 1)
+	_, ok := policy.Protects("prod/repo1", "mychart", "1.5.0")
+	suite.True(ok)
+
+	_, err = LoadPolicy(write("rules:\n  - versions: 'not a range'\n"))
+	suite.NotNil(err, "invalid version range")
+	_, err = LoadPolicy(write("rules:\n  - chart: '['\n"))
+	suite.NotNil(err, "invalid glob")
+	_, err = LoadPolicy(write("rules:\n  - version: '>=1.0.0'\n"))
+	suite.NotNil(err, "unknown field")
+	_, err = LoadPolicy(filepath.Join(dir, "missing.yaml"))
+	suite.NotNil(err, "missing policy file")
+}
+
+func TestProtectionTestSuite(t *testing.T) {
+	suite.Run(t, new(ProtectionTestSuite))
+}
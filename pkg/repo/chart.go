@@ -20,14 +20,17 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	pathutil "path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chartmuseum/storage"
 
 	helm_chart "helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
 	helm_repo "helm.sh/helm/v3/pkg/repo"
 )
 
@@ -90,6 +93,30 @@ func ChartVersionFromStorageObject(object storage.Object) (*helm_repo.ChartVersi
 	return chartVersion, nil
 }
 
+// ChartVersionFromReader returns the chart version of a chart package read from content (e.g. a
+// temporary file) instead of being held in memory, its URL is named after the chart name and version
+func ChartVersionFromReader(content io.ReadSeeker, lastModified time.Time) (*helm_repo.ChartVersion, error) {
+	chart, err := loader.LoadArchive(content)
+	if err != nil {
+		return nil, ErrorInvalidChartPackage
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	digest, err := provenance.Digest(content)
+	if err != nil {
+		return nil, err
+	}
+	filename := ChartPackageFilenameFromNameVersion(chart.Metadata.Name, chart.Metadata.Version)
+	chartVersion := &helm_repo.ChartVersion{
+		URLs:     []string{fmt.Sprintf("charts/%s", filename)},
+		Metadata: chart.Metadata,
+		Digest:   digest,
+		Created:  lastModified,
+	}
+	return chartVersion, nil
+}
+
 // StorageObjectFromChartVersion returns a storage object from a chart version (empty content)
 func StorageObjectFromChartVersion(chartVersion *helm_repo.ChartVersion) storage.Object {
 	meta := storage.Metadata{}
@@ -17,6 +17,7 @@ limitations under the License.
 package repo
 
 import (
+	"bytes"
 	"os"
 	"testing"
 	"time"
@@ -172,6 +173,22 @@ func (suite *ChartTestSuite) TestChartVersionFromStorageObject() {
 	suite.Equal("1.0.4-rc1-SNAPSHOT", chartVersion.Version, "chart version as expected")
 }
 
+func (suite *ChartTestSuite) TestChartVersionFromReader() {
+	now := time.Now()
+	chartVersion, err := ChartVersionFromReader(bytes.NewReader(suite.TarballContent), now)
+	suite.Nil(err, "no error creating ChartVersion from reader")
+	expected, err := ChartVersionFromStorageObject(storage.Object{
+		Path:         "org/mychart-0.1.0.tgz",
+		Content:      suite.TarballContent,
+		LastModified: now,
+	})
+	suite.Nil(err, "no error creating ChartVersion from storage.Object")
+	suite.Equal(expected, chartVersion, "same chart version as from storage object")
+
+	_, err = ChartVersionFromReader(bytes.NewReader([]byte("invalid")), now)
+	suite.Equal(ErrorInvalidChartPackage, err, "error with invalid package")
+}
+
 func (suite *ChartTestSuite) TestStorageObjectFromChartVersion() {
 	now := time.Now()
 	chartVersion := &helm_repo.ChartVersion{
@@ -18,6 +18,7 @@ package repo
 
 import (
 	"encoding/json"
+	pathutil "path"
 	"sync"
 	"time"
 
@@ -30,6 +31,14 @@ var (
 	// IndexFileContentType is the http content-type header for index.yaml
 	IndexFileContentType = "application/x-yaml"
 	StatefileFilename    = "index-cache.yaml"
+	// StatefileShardDirname is the directory holding the per-chart statefile shards
+	StatefileShardDirname = "index-cache.d"
+	// QuarantineDirname is the directory holding the chart packages which failed integrity checks
+	QuarantineDirname = ".quarantine"
+	// TrashDirname is the directory holding the soft-deleted chart packages until they are purged
+	TrashDirname = ".trash"
+	// ProtectedDirname is the directory holding the locks of the chart versions protected through the API
+	ProtectedDirname = ".protected"
 )
 
 type (
@@ -53,6 +62,8 @@ type (
 		ChartURL   string `json:"d"`
 		IndexLock  sync.RWMutex
 		OutputJSON bool
+		// Checksums holds the backend checksum of every package in the index, by filename
+		Checksums map[string]string `json:"e,omitempty"`
 	}
 )
 
@@ -62,7 +73,7 @@ func NewIndex(chartURL string, repo string, serverInfo *ServerInfo, outputJSON b
 		IndexFile:  &helm_repo.IndexFile{},
 		ServerInfo: serverInfo,
 	}
-	index := Index{indexFile, repo, []byte{}, chartURL, sync.RWMutex{}, outputJSON}
+	index := Index{indexFile, repo, []byte{}, chartURL, sync.RWMutex{}, outputJSON, nil}
 	index.Entries = map[string]helm_repo.ChartVersions{}
 	index.APIVersion = helm_repo.APIVersionV1
 	index.Regenerate()
@@ -70,10 +81,14 @@ func NewIndex(chartURL string, repo string, serverInfo *ServerInfo, outputJSON b
 }
 
 // Regenerate sorts entries in index file and sets current time for generated key
-func (index *Index) Regenerate() (err error) {
+func (index *Index) Regenerate() error {
 	index.SortEntries()
 	index.Generated = time.Now().Round(time.Second)
+	return index.Render()
+}
 
+// Render marshals the index file into Raw, keeping the current generated key
+func (index *Index) Render() (err error) {
 	var raw []byte
 	if index.OutputJSON {
 		raw, err = json.Marshal(index.IndexFile)
@@ -95,6 +110,7 @@ func (index *Index) RemoveEntry(chartVersion *helm_repo.ChartVersion) {
 	if entries, ok := index.Entries[chartVersion.Name]; ok {
 		for i, cv := range entries {
 			if cv.Version == chartVersion.Version {
+				index.forgetChecksum(cv)
 				index.Entries[chartVersion.Name] = append(entries[:i],
 					entries[i+1:]...)
 				if len(index.Entries[chartVersion.Name]) == 0 {
@@ -112,6 +128,7 @@ func (index *Index) AddEntry(chartVersion *helm_repo.ChartVersion) {
 		index.Entries[chartVersion.Name] = helm_repo.ChartVersions{}
 	}
 	//
+	index.forgetChecksum(chartVersion)
 	entries := index.Entries[chartVersion.Name]
 	l := len(entries)
 	for i := 1; i <= 5 && l-i >= 0; i++ {
@@ -140,6 +157,7 @@ func (index *Index) HasEntry(chartVersion *helm_repo.ChartVersion) bool {
 
 // UpdateEntry updates a chart version in index
 func (index *Index) UpdateEntry(chartVersion *helm_repo.ChartVersion) {
+	index.forgetChecksum(chartVersion)
 	if entries, ok := index.Entries[chartVersion.Name]; ok {
 		for i, cv := range entries {
 			if cv.Version == chartVersion.Version {
@@ -151,6 +169,23 @@ func (index *Index) UpdateEntry(chartVersion *helm_repo.ChartVersion) {
 	}
 }
 
+// Checksum returns the backend checksum recorded for a package, if any
+func (index *Index) Checksum(filename string) string {
+	return index.Checksums[filename]
+}
+
+// SetChecksums replaces the backend checksums recorded for the packages in index
+func (index *Index) SetChecksums(checksums map[string]string) {
+	index.Checksums = checksums
+}
+
+// forgetChecksum drops the checksum recorded for a package which is being replaced
+func (index *Index) forgetChecksum(chartVersion *helm_repo.ChartVersion) {
+	if len(chartVersion.URLs) > 0 {
+		delete(index.Checksums, pathutil.Base(chartVersion.URLs[0]))
+	}
+}
+
 func (index *Index) setChartURL(chartVersion *helm_repo.ChartVersion) {
 	if index.ChartURL != "" {
 		chartVersion.URLs[0] = index.ChartURL + "/" + chartVersion.URLs[0]
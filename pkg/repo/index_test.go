@@ -70,6 +70,15 @@ func (suite *IndexTestSuite) TestRegenerate() {
 	suite.Nil(err)
 }
 
+func (suite *IndexTestSuite) TestRender() {
+	index := NewIndex("", "", &ServerInfo{}, false)
+	generated := time.Date(2018, 5, 23, 15, 14, 46, 0, time.UTC)
+	index.Generated = generated
+	suite.NoError(index.Render())
+	suite.Equal(generated, index.Generated, "render keeps generated key")
+	suite.Contains(string(index.Raw), "2018-05-23T15:14:46Z")
+}
+
 func (suite *IndexTestSuite) TestUpdate() {
 	now := time.Now()
 	for _, name := range []string{"a", "b", "c"} {
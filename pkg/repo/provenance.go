@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"regexp"
@@ -60,6 +61,11 @@ func ProvenanceFilenameFromContent(content []byte) (string, error) {
 	return filename, nil
 }
 
+// DigestFromReader returns the digest of a chart package read from content, as found in the index
+func DigestFromReader(content io.Reader) (string, error) {
+	return provenance.Digest(content)
+}
+
 func provenanceDigestFromContent(content []byte) (string, error) {
 	digest, err := provenance.Digest(bytes.NewBuffer(content))
 	return digest, err
@@ -0,0 +1,132 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	pathutil "path"
+	"time"
+
+	"github.com/chartmuseum/storage"
+
+	helm_chart "helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+var (
+	// SidecarDirname is the directory, next to chart packages, holding their metadata sidecars
+	SidecarDirname = ".meta"
+
+	// SidecarFileExtension is the file extension appended to a package filename for its sidecar
+	SidecarFileExtension = "json"
+
+	// ErrorInvalidSidecar is raised when a sidecar is invalid
+	ErrorInvalidSidecar = errors.New("invalid chart metadata sidecar")
+)
+
+type (
+	// Sidecar holds the metadata of a chart package, so it can be indexed without being downloaded.
+	// It describes the package as long as the modification time, and checksum if any, recorded
+	// from the storage backend have not changed.
+	Sidecar struct {
+		Metadata *helm_chart.Metadata `json:"metadata"`
+		Digest   string               `json:"digest"`
+		Size     int                  `json:"size"`
+		Created  time.Time            `json:"created"`
+		Modified time.Time            `json:"modified"`
+		Checksum string               `json:"checksum,omitempty"`
+	}
+)
+
+// SidecarPath returns the path of the sidecar of a chart package
+func SidecarPath(repo string, filename string) string {
+	return pathutil.Join(repo, SidecarDirname, fmt.Sprintf("%s.%s", pathutil.Base(filename), SidecarFileExtension))
+}
+
+// SidecarFromStorageObject builds the sidecar of a chart package stored as object
+func SidecarFromStorageObject(object storage.Object) (*Sidecar, error) {
+	chartVersion, err := ChartVersionFromStorageObject(object)
+	if err != nil {
+		return nil, err
+	}
+	sidecar := &Sidecar{
+		Metadata: chartVersion.Metadata,
+		Digest:   chartVersion.Digest,
+		Size:     len(object.Content),
+		Created:  chartVersion.Created,
+		Modified: object.LastModified,
+	}
+	return sidecar, nil
+}
+
+// SidecarFromChartVersion builds the sidecar of a chart package of size bytes
+func SidecarFromChartVersion(chartVersion *helm_repo.ChartVersion, size int) *Sidecar {
+	return &Sidecar{
+		Metadata: chartVersion.Metadata,
+		Digest:   chartVersion.Digest,
+		Size:     size,
+		Created:  chartVersion.Created,
+	}
+}
+
+// SidecarFromContent parses the content of a sidecar
+func SidecarFromContent(content []byte) (*Sidecar, error) {
+	sidecar := &Sidecar{}
+	err := json.Unmarshal(content, sidecar)
+	if err != nil || sidecar.Metadata == nil || sidecar.Metadata.Name == "" || sidecar.Metadata.Version == "" || sidecar.Digest == "" {
+		return nil, ErrorInvalidSidecar
+	}
+	return sidecar, nil
+}
+
+// Describes reports whether the sidecar describes the package stored as object, listed with
+// checksum by the backend ("" if unknown). Values recorded from the backend are compared, never
+// clocks of different hosts, within tolerance for the modification time.
+func (sidecar *Sidecar) Describes(object storage.Object, checksum string, tolerance time.Duration) bool {
+	if checksum != "" && sidecar.Checksum != "" {
+		return checksum == sidecar.Checksum
+	}
+	if sidecar.Modified.IsZero() {
+		return false
+	}
+	delta := object.LastModified.Sub(sidecar.Modified)
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta <= tolerance
+}
+
+// Content returns the serialized sidecar
+func (sidecar *Sidecar) Content() ([]byte, error) {
+	return json.Marshal(sidecar)
+}
+
+// ChartVersion returns the chart version of the package described by sidecar
+func (sidecar *Sidecar) ChartVersion(object storage.Object) *helm_repo.ChartVersion {
+	created := object.LastModified
+	if created.IsZero() {
+		created = sidecar.Created
+	}
+	return &helm_repo.ChartVersion{
+		URLs:     []string{fmt.Sprintf("charts/%s", pathutil.Base(object.Path))},
+		Metadata: sidecar.Metadata,
+		Digest:   sidecar.Digest,
+		Created:  created,
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repo
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type SidecarTestSuite struct {
+	suite.Suite
+	TarballContent []byte
+}
+
+func (suite *SidecarTestSuite) SetupSuite() {
+	content, err := os.ReadFile("../../testdata/charts/mychart/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error reading test tarball")
+	suite.TarballContent = content
+}
+
+func (suite *SidecarTestSuite) TestSidecarPath() {
+	suite.Equal(".meta/mychart-0.1.0.tgz.json", SidecarPath("", "mychart-0.1.0.tgz"))
+	suite.Equal("org1/repoa/.meta/mychart-0.1.0.tgz.json", SidecarPath("org1/repoa", "org1/repoa/mychart-0.1.0.tgz"))
+}
+
+func (suite *SidecarTestSuite) TestSidecar() {
+	created := time.Now().Round(time.Second)
+	object := storage.Object{
+		Path:         "mychart-0.1.0.tgz",
+		Content:      suite.TarballContent,
+		LastModified: created,
+	}
+	sidecar, err := SidecarFromStorageObject(object)
+	suite.Nil(err, "no error creating sidecar")
+	suite.Equal(len(suite.TarballContent), sidecar.Size, "sidecar size")
+
+	content, err := sidecar.Content()
+	suite.Nil(err, "no error serializing sidecar")
+	sidecar, err = SidecarFromContent(content)
+	suite.Nil(err, "no error parsing sidecar")
+	suite.True(created.Equal(sidecar.Created), "sidecar created")
+
+	expected, err := ChartVersionFromStorageObject(object)
+	suite.Nil(err, "no error reading chart version from package")
+	listed := storage.Object{Path: "mychart-0.1.0.tgz", LastModified: created.Add(time.Minute)}
+	chartVersion := sidecar.ChartVersion(listed)
+	suite.Equal(expected.Metadata, chartVersion.Metadata, "metadata read from sidecar")
+	suite.Equal(expected.Digest, chartVersion.Digest, "digest read from sidecar")
+	suite.Equal(expected.URLs, chartVersion.URLs, "urls built from package filename")
+	suite.Equal(listed.LastModified, chartVersion.Created, "created taken from package")
+
+	_, err = SidecarFromContent([]byte("{}"))
+	suite.Equal(ErrorInvalidSidecar, err, "error parsing empty sidecar")
+	_, err = SidecarFromContent([]byte("not json"))
+	suite.Equal(ErrorInvalidSidecar, err, "error parsing bad sidecar")
+}
+
+func (suite *SidecarTestSuite) TestDescribes() {
+	modified := time.Now().Round(time.Second)
+	sidecar, err := SidecarFromStorageObject(storage.Object{
+		Path:         "mychart-0.1.0.tgz",
+		Content:      suite.TarballContent,
+		LastModified: modified,
+	})
+	suite.Nil(err, "no error creating sidecar")
+	suite.True(modified.Equal(sidecar.Modified), "modification time recorded")
+
+	listed := storage.Object{Path: "mychart-0.1.0.tgz", LastModified: modified}
+	suite.True(sidecar.Describes(listed, "", 0), "same modification time")
+	listed.LastModified = modified.Add(-time.Second)
+	suite.False(sidecar.Describes(listed, "", 0), "package overwritten with an earlier modification time")
+	suite.True(sidecar.Describes(listed, "", time.Second), "within tolerance")
+
+	sidecar.Checksum = "etag1"
+	suite.True(sidecar.Describes(listed, "etag1", 0), "same checksum, whatever the modification time")
+	suite.False(sidecar.Describes(storage.Object{LastModified: modified}, "etag2", 0), "checksum changed")
+	suite.True(sidecar.Describes(storage.Object{LastModified: modified}, "", 0), "modification time compared without listed checksum")
+
+	suite.False((&Sidecar{}).Describes(listed, "", time.Hour), "nothing recorded from the backend")
+}
+
+func TestSidecarTestSuite(t *testing.T) {
+	suite.Run(t, new(SidecarTestSuite))
+}
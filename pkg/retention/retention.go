@@ -0,0 +1,246 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retention decides which chart versions to delete from declarative retention rules
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	pathutil "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"sigs.k8s.io/yaml"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type (
+	// Policy is an ordered list of retention rules. The chart versions of a chart are
+	// handled by the first rule matching the repo and chart name, if any.
+	Policy struct {
+		Rules []Rule `json:"rules"`
+	}
+
+	// Rule deletes the versions of the matching charts which none of its keep conditions hold for.
+	// Versions which are not valid semantic versions are always kept.
+	Rule struct {
+		// Name identifies the rule in reports (optional)
+		Name string `json:"name,omitempty"`
+		// Repo is a glob matching the repo, e.g. org1/*, every repo if empty
+		Repo string `json:"repo,omitempty"`
+		// Chart is a glob matching the chart name, every chart if empty
+		Chart string `json:"chart,omitempty"`
+		// KeepLastPatches keeps the N highest releases of every major.minor version
+		KeepLastPatches int `json:"keepLastPatches,omitempty"`
+		// KeepNewerThan keeps the versions created less than this long ago
+		KeepNewerThan Duration `json:"keepNewerThan,omitempty"`
+		// KeepReleases keeps the versions which are not prereleases
+		KeepReleases bool `json:"keepReleases,omitempty"`
+		// DeletePrereleasesOlderThan keeps the prereleases created less than this long ago.
+		// It keeps the releases too, unless KeepLastPatches limits them.
+		DeletePrereleasesOlderThan Duration `json:"deletePrereleasesOlderThan,omitempty"`
+	}
+
+	// Deletion is a chart version to delete, along with the rule deleting it
+	Deletion struct {
+		Name    string    `json:"name"`
+		Version string    `json:"version"`
+		Created time.Time `json:"created"`
+		Rule    string    `json:"rule"`
+	}
+
+	// Duration is a time.Duration read from a string such as 36h or 30d
+	Duration time.Duration
+)
+
+// LoadPolicy reads a retention policy from a YAML file such as:
+//
+//	rules:
+//	  - repo: org1/*
+//	    chart: "*"
+//	    keepLastPatches: 3
+//	    deletePrereleasesOlderThan: 7d
+//
+// which keeps the 3 highest releases of every major.minor version, and the prereleases
+// created less than 7 days ago.
+func LoadPolicy(filename string) (*Policy, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(content, policy); err != nil {
+		return nil, fmt.Errorf("invalid retention policy %s: %w", filename, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention policy %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// Validate checks the globs of the rules, and that every rule has a keep condition
+func (policy *Policy) Validate() error {
+	for i, rule := range policy.Rules {
+		for _, glob := range []string{rule.Repo, rule.Chart} {
+			if _, err := pathutil.Match(glob, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid glob %q", rule.name(i), glob)
+			}
+		}
+		if rule.KeepLastPatches < 0 || rule.KeepNewerThan < 0 || rule.DeletePrereleasesOlderThan < 0 {
+			return fmt.Errorf("rule %s: negative condition", rule.name(i))
+		}
+		if rule.KeepLastPatches == 0 && rule.KeepNewerThan == 0 && !rule.KeepReleases && rule.DeletePrereleasesOlderThan == 0 {
+			return fmt.Errorf("rule %s: no keep condition, every version would be deleted", rule.name(i))
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the chart versions of a repo to delete at now, by chart name and version
+func (policy *Policy) Evaluate(repo string, chartVersions []*helm_repo.ChartVersion, now time.Time) []Deletion {
+	byName := map[string][]*helm_repo.ChartVersion{}
+	for _, chartVersion := range chartVersions {
+		byName[chartVersion.Name] = append(byName[chartVersion.Name], chartVersion)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var deletions []Deletion
+	for _, name := range names {
+		i, rule := policy.match(repo, name)
+		if rule == nil {
+			continue
+		}
+		deletions = append(deletions, rule.evaluate(rule.name(i), byName[name], now)...)
+	}
+	return deletions
+}
+
+// match returns the first rule matching a chart of a repo, and its index
+func (policy *Policy) match(repo string, name string) (int, *Rule) {
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if globMatch(rule.Repo, repo) && globMatch(rule.Chart, name) {
+			return i, rule
+		}
+	}
+	return -1, nil
+}
+
+func (rule *Rule) evaluate(ruleName string, chartVersions []*helm_repo.ChartVersion, now time.Time) []Deletion {
+	type version struct {
+		chartVersion *helm_repo.ChartVersion
+		semver       *semver.Version
+	}
+	var versions []version
+	for _, chartVersion := range chartVersions {
+		v, err := semver.NewVersion(chartVersion.Version)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version{chartVersion, v})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].semver.GreaterThan(versions[j].semver)
+	})
+
+	var deletions []Deletion
+	patches := map[string]int{}
+	for _, v := range versions {
+		prerelease := v.semver.Prerelease() != ""
+		age := now.Sub(v.chartVersion.Created)
+		keep := false
+		if !prerelease && rule.KeepLastPatches > 0 {
+			minor := fmt.Sprintf("%d.%d", v.semver.Major(), v.semver.Minor())
+			patches[minor]++
+			keep = patches[minor] <= rule.KeepLastPatches
+		}
+		if rule.KeepNewerThan > 0 && age < time.Duration(rule.KeepNewerThan) {
+			keep = true
+		}
+		if rule.KeepReleases && !prerelease {
+			keep = true
+		}
+		if rule.DeletePrereleasesOlderThan > 0 {
+			if prerelease && age < time.Duration(rule.DeletePrereleasesOlderThan) {
+				keep = true
+			}
+			if !prerelease && rule.KeepLastPatches == 0 {
+				keep = true
+			}
+		}
+		if !keep {
+			deletions = append(deletions, Deletion{
+				Name:    v.chartVersion.Name,
+				Version: v.chartVersion.Version,
+				Created: v.chartVersion.Created,
+				Rule:    ruleName,
+			})
+		}
+	}
+	return deletions
+}
+
+func (rule *Rule) name(i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return "#" + strconv.Itoa(i+1)
+}
+
+func globMatch(glob string, value string) bool {
+	if glob == "" {
+		return true
+	}
+	matched, _ := pathutil.Match(glob, value)
+	return matched
+}
+
+// MarshalJSON writes a duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration from a string, in Go format or as a number of days (e.g. 30d)
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
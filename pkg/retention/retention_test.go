@@ -0,0 +1,146 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+var now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+type RetentionTestSuite struct {
+	suite.Suite
+}
+
+func chartVersion(name string, version string, age time.Duration) *helm_repo.ChartVersion {
+	return &helm_repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: name, Version: version},
+		Created:  now.Add(-age),
+	}
+}
+
+func versions(deletions []Deletion) []string {
+	var result []string
+	for _, deletion := range deletions {
+		result = append(result, deletion.Name+"-"+deletion.Version)
+	}
+	return result
+}
+
+func (suite *RetentionTestSuite) TestKeepLastPatches() {
+	policy := &Policy{Rules: []Rule{{KeepLastPatches: 2}}}
+	deletions := policy.Evaluate("", []*helm_repo.ChartVersion{
+		chartVersion("mychart", "1.0.0", 0),
+		chartVersion("mychart", "1.0.1", 0),
+		chartVersion("mychart", "1.0.2", 0),
+		chartVersion("mychart", "1.1.0", 0),
+		chartVersion("mychart", "1.1.1-rc.1", 0),
+		chartVersion("mychart", "latest", 0),
+		chartVersion("other", "0.1.0", 0),
+	}, now)
+	suite.Equal([]string{"mychart-1.1.1-rc.1", "mychart-1.0.0"}, versions(deletions), "older patches and prereleases deleted")
+	suite.Equal("#1", deletions[0].Rule)
+}
+
+func (suite *RetentionTestSuite) TestConditions() {
+	day := 24 * time.Hour
+	chartVersions := []*helm_repo.ChartVersion{
+		chartVersion("mychart", "0.1.0", 100*day),
+		chartVersion("mychart", "0.2.0-beta", 10*day),
+		chartVersion("mychart", "0.2.0-rc", 2*day),
+		chartVersion("mychart", "0.2.0", day),
+	}
+
+	policy := &Policy{Rules: []Rule{{KeepNewerThan: Duration(30 * day)}}}
+	suite.Equal([]string{"mychart-0.1.0"}, versions(policy.Evaluate("", chartVersions, now)), "old versions deleted")
+
+	policy = &Policy{Rules: []Rule{{KeepReleases: true}}}
+	suite.Equal([]string{"mychart-0.2.0-rc", "mychart-0.2.0-beta"}, versions(policy.Evaluate("", chartVersions, now)), "prereleases deleted")
+
+	policy = &Policy{Rules: []Rule{{DeletePrereleasesOlderThan: Duration(7 * day)}}}
+	suite.Equal([]string{"mychart-0.2.0-beta"}, versions(policy.Evaluate("", chartVersions, now)), "old prereleases deleted")
+
+	policy = &Policy{Rules: []Rule{{KeepReleases: true, KeepNewerThan: Duration(7 * day)}}}
+	suite.Equal([]string{"mychart-0.2.0-beta"}, versions(policy.Evaluate("", chartVersions, now)), "versions kept by any condition")
+}
+
+func (suite *RetentionTestSuite) TestKeepLastPatchesAndDeletePrereleases() {
+	day := 24 * time.Hour
+	policy := &Policy{Rules: []Rule{{KeepLastPatches: 2, DeletePrereleasesOlderThan: Duration(7 * day)}}}
+	deletions := policy.Evaluate("", []*helm_repo.ChartVersion{
+		chartVersion("mychart", "1.0.0", 100*day),
+		chartVersion("mychart", "1.0.1", 50*day),
+		chartVersion("mychart", "1.0.2", 20*day),
+		chartVersion("mychart", "1.1.0-rc.1", 10*day),
+		chartVersion("mychart", "1.1.0-rc.2", 2*day),
+	}, now)
+	suite.Equal([]string{"mychart-1.1.0-rc.1", "mychart-1.0.0"}, versions(deletions), "older patches and old prereleases deleted")
+}
+
+func (suite *RetentionTestSuite) TestMatch() {
+	policy := &Policy{Rules: []Rule{
+		{Name: "keep-infra", Repo: "org1/*", Chart: "infra-*", KeepReleases: true},
+		{Name: "org1", Repo: "org1/*", KeepLastPatches: 1},
+	}}
+	chartVersions := []*helm_repo.ChartVersion{
+		chartVersion("infra-db", "1.0.0", 0),
+		chartVersion("infra-db", "1.0.1", 0),
+		chartVersion("app", "1.0.0", 0),
+		chartVersion("app", "1.0.1", 0),
+	}
+	deletions := policy.Evaluate("org1/repo1", chartVersions, now)
+	suite.Equal([]string{"app-1.0.0"}, versions(deletions), "first matching rule applied")
+	suite.Equal("org1", deletions[0].Rule)
+	suite.Empty(policy.Evaluate("org2/repo1", chartVersions, now), "no rule matching repo")
+}
+
+func (suite *RetentionTestSuite) TestLoadPolicy() {
+	dir := suite.T().TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "retention.yaml")
+		suite.Nil(os.WriteFile(filename, []byte(content), 0600))
+		return filename
+	}
+
+	policy, err := LoadPolicy(write("rules:\n  - repo: org1/*\n    keepLastPatches: 3\n    keepNewerThan: 30d\n    deletePrereleasesOlderThan: 36h\n"))
+	suite.Nil(err, "no error loading policy")
+	suite.Len(policy.Rules, 1)
+	suite.Equal(Duration(30*24*time.Hour), policy.Rules[0].KeepNewerThan, "duration in days")
+	suite.Equal(Duration(36*time.Hour), policy.Rules[0].DeletePrereleasesOlderThan)
+
+	_, err = LoadPolicy(write("rules:\n  - repo: org1/*\n"))
+	suite.NotNil(err, "rule without keep condition")
+	_, err = LoadPolicy(write("rules:\n  - repo: '['\n    keepReleases: true\n"))
+	suite.NotNil(err, "invalid glob")
+	_, err = LoadPolicy(write("rules:\n  - keepNewerThan: 30 days\n"))
+	suite.NotNil(err, "invalid duration")
+	_, err = LoadPolicy(write("rules:\n  - keepLatest: 3\n"))
+	suite.NotNil(err, "unknown field")
+	_, err = LoadPolicy(filepath.Join(dir, "missing.yaml"))
+	suite.NotNil(err, "missing policy file")
+}
+
+func TestRetentionTestSuite(t *testing.T) {
+	suite.Run(t, new(RetentionTestSuite))
+}